@@ -0,0 +1,359 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// opsgenieKeyEnv holds the API key of the Opsgenie integration.
+const opsgenieKeyEnv = "OPSGENIE_API_KEY"
+
+const (
+	alertTimeout          = 10 * time.Second
+	defaultAlertFailures  = 3
+	pagerDutyEventsURL    = "https://events.pagerduty.com/v2/enqueue"
+	defaultOpsgenieAPIURL = "https://api.opsgenie.com"
+)
+
+// AlertConfig pages when the images of a group keep failing or go stale in
+// daemon mode. The alert is resolved once the group recovers.
+type AlertConfig struct {
+	// Name identifies the group in alerts and deduplicates them.
+	Name string `json:"name"`
+	// Images are patterns of image names, or name:tag, as understood by
+	// path.Match. Without any the group covers every image.
+	Images []string `json:"images,omitempty"`
+	// Failures is the number of consecutive failed runs that fires the
+	// alert, 3 by default.
+	Failures int `json:"failures,omitempty"`
+	// SLA fires the alert when an image of the group wasn't copied for
+	// longer.
+	SLA Duration `json:"sla,omitempty"`
+
+	PagerDuty *PagerDutyConfig `json:"pagerduty,omitempty"`
+	Opsgenie  *OpsgenieConfig  `json:"opsgenie,omitempty"`
+}
+
+// PagerDutyConfig sends alerts to a service through the Events API v2.
+type PagerDutyConfig struct {
+	RoutingKey string `json:"routing_key"`
+	// Severity is critical (default), error, warning or info.
+	Severity string `json:"severity,omitempty"`
+}
+
+// OpsgenieConfig creates alerts with the API key in OPSGENIE_API_KEY.
+type OpsgenieConfig struct {
+	// APIURL is https://api.eu.opsgenie.com for EU accounts.
+	APIURL   string `json:"api_url,omitempty"`
+	Team     string `json:"team,omitempty"`
+	Priority string `json:"priority,omitempty"`
+}
+
+func (ac AlertConfig) validate() error {
+	if ac.Name == "" {
+		return fmt.Errorf("alerts need a name")
+	}
+	if ac.PagerDuty == nil && ac.Opsgenie == nil {
+		return fmt.Errorf("alert '%v' needs pagerduty or opsgenie", ac.Name)
+	}
+	if ac.Failures < 0 {
+		return fmt.Errorf("alert '%v' has negative failures", ac.Name)
+	}
+
+	if err := validPatterns(ac.Images); err != nil {
+		return fmt.Errorf("alert '%v': %w", ac.Name, err)
+	}
+
+	if pd := ac.PagerDuty; pd != nil {
+		if pd.RoutingKey == "" {
+			return fmt.Errorf("alert '%v' needs pagerduty.routing_key", ac.Name)
+		}
+		switch pd.Severity {
+		case "", "critical", "error", "warning", "info":
+		default:
+			return fmt.Errorf("unknown pagerduty.severity '%v' of alert '%v'", pd.Severity, ac.Name)
+		}
+	}
+
+	if og := ac.Opsgenie; og != nil && og.Priority != "" {
+		switch og.Priority {
+		case "P1", "P2", "P3", "P4", "P5":
+		default:
+			return fmt.Errorf("unknown opsgenie.priority '%v' of alert '%v'", og.Priority, ac.Name)
+		}
+	}
+
+	return nil
+}
+
+func (ac AlertConfig) covers(name, tag string) bool {
+	return ImageData{Name: name, Tag: tag}.selectedBy(ac.Images)
+}
+
+func (ac AlertConfig) failures() int {
+	if ac.Failures == 0 {
+		return defaultAlertFailures
+	}
+	return ac.Failures
+}
+
+// alertState is what the daemon knows about the group of an alert.
+type alertState struct {
+	failures int
+	firing   bool
+}
+
+// alertChange is an alert to trigger, with its summary, or to resolve.
+type alertChange struct {
+	config  AlertConfig
+	trigger bool
+	summary string
+}
+
+// evaluateAlerts updates the state of every alert group after a run, or
+// only checks the SLAs when report is nil, and returns the alerts to
+// trigger or resolve. It's called with d.mu held.
+func (d *daemon) evaluateAlerts(report *runReport, runErr error) []alertChange {
+	changes := []alertChange{}
+	for _, ac := range d.config.Alerts {
+		st := d.alerts[ac.Name]
+
+		if report != nil {
+			failed, seen := false, false
+			for _, res := range report.Images {
+				if !ac.covers(res.name, res.tag) {
+					continue
+				}
+				seen = true
+				if res.Status == resultFailed {
+					failed = true
+				}
+			}
+			// A run that fails before copying anything fails every group.
+			if runErr != nil && !seen {
+				failed = true
+			}
+
+			if failed {
+				st.failures++
+			} else if seen {
+				st.failures = 0
+			}
+		}
+
+		reasons := []string{}
+		if st.failures >= ac.failures() {
+			reason := fmt.Sprintf("%v consecutive failed runs", st.failures)
+			if d.lastErr != nil {
+				reason += ", last: " + redact(d.lastErr.Error())
+			}
+			reasons = append(reasons, reason)
+		}
+		if stale := d.staleImages(ac); len(stale) > 0 {
+			reasons = append(reasons, fmt.Sprintf("not copied for %v: %v", time.Duration(ac.SLA), strings.Join(stale, ", ")))
+		}
+
+		switch {
+		case len(reasons) > 0 && !st.firing:
+			st.firing = true
+			changes = append(changes, alertChange{config: ac, trigger: true,
+				summary: fmt.Sprintf("dimco mirror of %v: %v", ac.Name, strings.Join(reasons, "; "))})
+		case len(reasons) == 0 && st.firing:
+			st.firing = false
+			changes = append(changes, alertChange{config: ac})
+		}
+
+		d.alerts[ac.Name] = st
+	}
+
+	return changes
+}
+
+// staleImages lists the images of the group not copied within its SLA. Images
+// that were never copied count from the start of the daemon.
+func (d *daemon) staleImages(ac AlertConfig) []string {
+	if ac.SLA == 0 {
+		return nil
+	}
+
+	stale := []string{}
+	for dest, st := range d.images {
+		if !ac.covers(st.result.name, st.result.tag) {
+			continue
+		}
+
+		since := st.lastCopied
+		if since.IsZero() {
+			since = d.started
+		}
+		if time.Since(since) > time.Duration(ac.SLA) {
+			stale = append(stale, dest)
+		}
+	}
+	sort.Strings(stale)
+
+	return stale
+}
+
+// watchAlerts checks the SLAs of the alert groups every minute, so a run
+// that hangs still pages.
+func (d *daemon) watchAlerts(ctx context.Context) {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		d.mu.Lock()
+		changes := d.evaluateAlerts(nil, nil)
+		d.mu.Unlock()
+
+		d.sendAlerts(ctx, changes)
+	}
+}
+
+// sendAlerts delivers alert changes. A change that isn't delivered is
+// logged and undone, so the next evaluation retries it.
+func (d *daemon) sendAlerts(ctx context.Context, changes []alertChange) {
+	for _, ch := range changes {
+		ctx, cancel := context.WithTimeout(ctx, alertTimeout)
+
+		delivered := true
+		if pd := ch.config.PagerDuty; pd != nil {
+			if err := pd.send(ctx, ch); err != nil {
+				log.Print(fmt.Errorf("can't send PagerDuty alert of %v: %w", ch.config.Name, err))
+				delivered = false
+			}
+		}
+		if og := ch.config.Opsgenie; og != nil {
+			if err := og.send(ctx, ch); err != nil {
+				log.Print(fmt.Errorf("can't send Opsgenie alert of %v: %w", ch.config.Name, err))
+				delivered = false
+			}
+		}
+
+		cancel()
+
+		if !delivered {
+			d.mu.Lock()
+			st := d.alerts[ch.config.Name]
+			st.firing = !ch.trigger
+			d.alerts[ch.config.Name] = st
+			d.mu.Unlock()
+			continue
+		}
+
+		if ch.trigger {
+			log.Printf("alert %v fired: %v", ch.config.Name, ch.summary)
+		} else {
+			log.Printf("alert %v resolved", ch.config.Name)
+		}
+	}
+}
+
+// alertKey deduplicates the alerts of a group in PagerDuty and Opsgenie.
+func alertKey(name string) string {
+	return "dimco-" + name
+}
+
+func (pd PagerDutyConfig) send(ctx context.Context, ch alertChange) error {
+	event := map[string]interface{}{
+		"routing_key":  pd.RoutingKey,
+		"dedup_key":    alertKey(ch.config.Name),
+		"event_action": "resolve",
+	}
+	if ch.trigger {
+		severity := pd.Severity
+		if severity == "" {
+			severity = "critical"
+		}
+		host, _ := os.Hostname()
+		event["event_action"] = "trigger"
+		event["payload"] = map[string]string{
+			"summary":   truncate(ch.summary, 1024),
+			"source":    host,
+			"severity":  severity,
+			"component": ch.config.Name,
+		}
+	}
+
+	return postAlert(ctx, pagerDutyEventsURL, "", event)
+}
+
+func (og OpsgenieConfig) send(ctx context.Context, ch alertChange) error {
+	key := os.Getenv(opsgenieKeyEnv)
+	if key == "" {
+		return fmt.Errorf("%v is not set", opsgenieKeyEnv)
+	}
+
+	base := strings.TrimRight(og.APIURL, "/")
+	if base == "" {
+		base = defaultOpsgenieAPIURL
+	}
+	alias := alertKey(ch.config.Name)
+
+	if !ch.trigger {
+		u := fmt.Sprintf("%v/v2/alerts/%v/close?identifierType=alias", base, url.PathEscape(alias))
+		return postAlert(ctx, u, key, map[string]string{"source": "dimco"})
+	}
+
+	alert := map[string]interface{}{
+		"message":     truncate(ch.summary, 130),
+		"alias":       alias,
+		"description": ch.summary,
+		"source":      "dimco",
+		"tags":        []string{"dimco", ch.config.Name},
+	}
+	if og.Priority != "" {
+		alert["priority"] = og.Priority
+	}
+	if og.Team != "" {
+		alert["responders"] = []map[string]string{{"type": "team", "name": og.Team}}
+	}
+
+	return postAlert(ctx, base+"/v2/alerts", key, alert)
+}
+
+// postAlert posts body as JSON, with the Opsgenie key if given.
+func postAlert(ctx context.Context, u, genieKey string, body interface{}) error {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u, bytes.NewReader(data))
+	if err != nil {
+		return fmt.Errorf("can't create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if genieKey != "" {
+		req.Header.Set("Authorization", "GenieKey "+genieKey)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("can't send request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		data, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("POST %v: unexpected status %v: %v", req.URL.Host, resp.StatusCode, strings.TrimSpace(string(data)))
+	}
+
+	return nil
+}
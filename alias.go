@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	godigest "github.com/opencontainers/go-digest"
+)
+
+// validateAliases checks the also_tag entries of the images: they are valid
+// tags and no two entries, or an entry and an alias, push to the same tag.
+func (c Config) validateAliases() error {
+	owners := map[string]string{}
+	for _, img := range c.Images {
+		owners[img.destinationKey()] = img.destinationKey()
+	}
+
+	for i, img := range c.Images {
+		for _, alias := range img.AlsoTag {
+			if _, err := godigest.Parse(alias); err == nil || alias == img.Tag {
+				return fmt.Errorf("images[%v] (%v): invalid also_tag '%v'", i, img.Name, alias)
+			}
+			if _, err := imageReference(c.ToRepo, img.ToPrefix, img.destinationName(), alias); err != nil {
+				return fmt.Errorf("images[%v] (%v): invalid also_tag: %w", i, img.Name, err)
+			}
+
+			aliased := img
+			aliased.Tag = alias
+			key := aliased.destinationKey()
+			if prev, ok := owners[key]; ok {
+				return fmt.Errorf("images[%v] (%v): also_tag '%v' is pushed by %v too", i, img.Name, alias, prev)
+			}
+			owners[key] = img.destinationKey()
+		}
+	}
+
+	return nil
+}
+
+// tagAliases points the aliases of img in repo to the manifest of tag. The
+// manifest is copied inside the registry, nothing is pushed again. With
+// journal set, the prior aliases are restored on rollback.
+func (s *syncer) tagAliases(ctx context.Context, img ImageData, repo, tag string) error {
+	if len(img.AlsoTag) == 0 {
+		return nil
+	}
+
+	data, mediaType, digest, err := s.dst.GetManifest(ctx, repo, tag)
+	if err != nil {
+		return fmt.Errorf("can't get manifest of '%v:%v': %w", repo, tag, err)
+	}
+	if digest == "" {
+		digest = godigest.FromBytes(data).String()
+	}
+
+	for _, alias := range img.AlsoTag {
+		current, err := s.dst.ManifestDigest(ctx, repo, alias)
+		if err == nil && current == digest {
+			debugf("%v:%v already points to %v", repo, alias, digest)
+			continue
+		}
+		if err != nil && !isNotFound(err) {
+			return fmt.Errorf("can't check tag '%v:%v': %w", repo, alias, err)
+		}
+
+		var entry pushEntry
+		if s.opts.Atomic {
+			if entry, err = snapshotTag(ctx, s.dst, repo, alias); err != nil {
+				return err
+			}
+		}
+
+		if err := s.dst.PutManifest(ctx, repo, alias, mediaType, data); err != nil {
+			return fmt.Errorf("can't tag '%v:%v': %w", repo, alias, err)
+		}
+		recordAudit(auditAlias, qualifiedReference(s.dst.host, repo, alias), digest)
+
+		if s.opts.Atomic {
+			if err := s.journal.add(ctx, s.dst, entry); err != nil {
+				return fmt.Errorf("can't record tag '%v:%v': %w", repo, alias, err)
+			}
+		}
+
+		infof("tagged %v:%v as %v (%v)", repo, tag, alias, digest)
+	}
+
+	return nil
+}
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	godigest "github.com/opencontainers/go-digest"
+)
+
+// The arch_tags modes of an image.
+const (
+	// archTagsAlso tags the platforms of the index next to it.
+	archTagsAlso = "also"
+	// archTagsOnly tags the platforms and deletes the index.
+	archTagsOnly = "only"
+)
+
+// validateArchTags checks the arch_tags entries of the images.
+func (c Config) validateArchTags() error {
+	for i, img := range c.Images {
+		switch img.ArchTags {
+		case "":
+			continue
+		case archTagsAlso, archTagsOnly:
+		default:
+			return fmt.Errorf("images[%v] (%v): unknown arch_tags '%v', use %v or %v", i, img.Name, img.ArchTags, archTagsAlso, archTagsOnly)
+		}
+
+		// Deleting the index would take the aliases with it.
+		if img.ArchTags == archTagsOnly && len(img.AlsoTag) > 0 {
+			return fmt.Errorf("images[%v] (%v): arch_tags %v can't be combined with also_tag", i, img.Name, archTagsOnly)
+		}
+		if _, err := imageReference(c.ToRepo, img.ToPrefix, img.destinationName(), archTag(img.Tag, &platform{OS: "linux", Architecture: "amd64"})); err != nil {
+			return fmt.Errorf("images[%v] (%v): invalid arch_tags: %w", i, img.Name, err)
+		}
+	}
+
+	return nil
+}
+
+// archTag is the tag of the platform p of tag: 1.2-amd64, 1.2-armv7 for
+// linux/arm/v7, 1.2-windows-amd64 for other systems. arm64/v8 is the only
+// arm64 there is and keeps the plain name.
+func archTag(tag string, p *platform) string {
+	arch := p.Architecture
+	if p.Variant != "" && !(arch == "arm64" && p.Variant == "v8") {
+		arch += p.Variant
+	}
+	if p.OS != "linux" {
+		arch = p.OS + "-" + arch
+	}
+	return tag + "-" + arch
+}
+
+// tagArchitectures points a tag per platform of the index at tag in repo to
+// the manifest of the platform, for tooling that can't read indexes. With
+// arch_tags only the index is deleted afterwards. Images of a single
+// platform keep their tag. With journal set, the prior tags are restored on
+// rollback.
+func (s *syncer) tagArchitectures(ctx context.Context, img ImageData, repo, tag string) error {
+	if img.ArchTags == "" {
+		return nil
+	}
+
+	data, _, digest, err := s.dst.GetManifest(ctx, repo, tag)
+	if err != nil {
+		return fmt.Errorf("can't get manifest of '%v:%v': %w", repo, tag, err)
+	}
+	if digest == "" {
+		digest = godigest.FromBytes(data).String()
+	}
+	m := manifest{}
+	if err := json.Unmarshal(data, &m); err != nil {
+		return fmt.Errorf("can't decode manifest of '%v:%v': %w", repo, tag, err)
+	}
+	if len(m.Manifests) == 0 {
+		infof("%v:%v has a single platform, it gets no architecture tags", repo, tag)
+		return nil
+	}
+
+	for _, at := range architectureTags(tag, m) {
+		d, t := at.desc, at.tag
+
+		current, err := s.dst.ManifestDigest(ctx, repo, t)
+		if err == nil && current == d.Digest {
+			debugf("%v:%v already points to %v", repo, t, d.Digest)
+			continue
+		}
+		if err != nil && !isNotFound(err) {
+			return fmt.Errorf("can't check tag '%v:%v': %w", repo, t, err)
+		}
+
+		pm, mediaType, _, err := s.dst.GetManifest(ctx, repo, d.Digest)
+		if err != nil {
+			return fmt.Errorf("can't get manifest '%v' of '%v:%v': %w", d.Digest, repo, tag, err)
+		}
+		if mediaType == "" {
+			mediaType = d.MediaType
+		}
+
+		var entry pushEntry
+		if s.opts.Atomic {
+			if entry, err = snapshotTag(ctx, s.dst, repo, t); err != nil {
+				return err
+			}
+		}
+
+		if err := s.dst.PutManifest(ctx, repo, t, mediaType, pm); err != nil {
+			return fmt.Errorf("can't tag '%v:%v': %w", repo, t, err)
+		}
+		recordAudit(auditAlias, qualifiedReference(s.dst.host, repo, t), d.Digest)
+
+		if s.opts.Atomic {
+			if err := s.journal.add(ctx, s.dst, entry); err != nil {
+				return fmt.Errorf("can't record tag '%v:%v': %w", repo, t, err)
+			}
+		}
+
+		infof("tagged %v of %v:%v as %v (%v)", d.Platform.OS+"/"+d.Platform.Architecture, repo, tag, t, d.Digest)
+	}
+
+	if img.ArchTags == archTagsOnly {
+		return s.deleteIndex(ctx, repo, tag, digest)
+	}
+
+	return nil
+}
+
+// deleteIndex deletes the index digest of tag in repo for arch_tags only.
+// Deleting a manifest removes every tag pointing to it, so an index other
+// tags point to is kept. With journal set, it's put back on rollback.
+func (s *syncer) deleteIndex(ctx context.Context, repo, tag, digest string) error {
+	tags, err := s.dst.ListTags(ctx, repo)
+	if err != nil {
+		return fmt.Errorf("can't list tags of '%v': %w", repo, err)
+	}
+	for _, t := range tags {
+		if t == tag || isReferrersTag(t) {
+			continue
+		}
+		d, err := s.dst.ManifestDigest(ctx, repo, t)
+		if err != nil {
+			return fmt.Errorf("can't resolve '%v:%v': %w", repo, t, err)
+		}
+		if d == digest {
+			return fmt.Errorf("can't delete index '%v:%v', %v:%v points to it too", repo, tag, repo, t)
+		}
+	}
+
+	var entry pushEntry
+	if s.opts.Atomic {
+		if entry, err = snapshotTag(ctx, s.dst, repo, tag); err != nil {
+			return err
+		}
+	}
+
+	if err := s.dst.DeleteManifest(ctx, repo, digest); err != nil {
+		return fmt.Errorf("can't delete index '%v:%v': %w", repo, tag, err)
+	}
+	recordAudit(auditDelete, qualifiedReference(s.dst.host, repo, tag), digest)
+
+	if s.opts.Atomic {
+		s.journal.record(entry)
+	}
+
+	infof("deleted index %v:%v (%v), only the architecture tags are kept", repo, tag, digest)
+
+	return nil
+}
+
+// archTagged is an architecture tag and the platform manifest it points to.
+type archTagged struct {
+	tag  string
+	desc descriptor
+}
+
+// architectureTags lists the architecture tags of the index m of tag.
+// Attestation manifests have no platform of their own and get none, of two
+// manifests for the same platform the first is tagged.
+func architectureTags(tag string, m manifest) []archTagged {
+	tags := []archTagged{}
+	seen := map[string]string{}
+	for _, d := range m.Manifests {
+		if d.Platform == nil || d.Platform.OS == "unknown" {
+			continue
+		}
+		t := archTag(tag, d.Platform)
+		if prev, ok := seen[t]; ok {
+			debugf("%v has more than one manifest for %v, tagging %v", tag, t, prev)
+			continue
+		}
+		seen[t] = d.Digest
+		tags = append(tags, archTagged{tag: t, desc: d})
+	}
+
+	return tags
+}
+
+// verifyArchTags is verifyImage for images with arch_tags only. Once their
+// index is deleted, the architecture tags of the source index must point to
+// its platforms at the destination.
+func verifyArchTags(ctx context.Context, src, dst *registryClient, fromRepo, toRepo, fromRef, tag string, layers bool) (string, string, bool, string) {
+	if _, err := dst.ManifestDigest(ctx, toRepo, tag); !isNotFound(err) {
+		return verifyImage(ctx, src, dst, fromRepo, toRepo, fromRef, tag, layers)
+	}
+
+	m, srcDigest, err := src.FetchManifest(ctx, fromRepo, fromRef)
+	if err != nil {
+		return "", "", false, fmt.Sprintf("can't fetch source manifest: %v", err)
+	}
+
+	tags := architectureTags(tag, m)
+	if len(tags) == 0 {
+		return srcDigest, "", false, "destination tag is missing"
+	}
+	for _, at := range tags {
+		d, err := dst.ManifestDigest(ctx, toRepo, at.tag)
+		if err != nil {
+			return srcDigest, "", false, fmt.Sprintf("can't resolve architecture tag %v: %v", at.tag, err)
+		}
+		if d != at.desc.Digest {
+			return srcDigest, "", false, fmt.Sprintf("architecture tag %v points to %v, not %v", at.tag, d, at.desc.Digest)
+		}
+	}
+
+	return srcDigest, "", true, "architecture tags match"
+}
+
+// checkArchTags returns why img with arch_tags only isn't copied again, or
+// "" to copy it. Its index is deleted after tagging, so the architecture
+// tags tell whether it's up to date.
+func (s *syncer) checkArchTags(ctx context.Context, img ImageData) (string, error) {
+	if img.ArchTags != archTagsOnly || s.opts.Stage {
+		return "", nil
+	}
+
+	c := s.config
+	fromRepo := repositoryPath(c.FromRepo, img.FromPrefix, img.Name)
+	toRepo := repositoryPath(c.ToRepo, img.ToPrefix, img.destinationName())
+	if _, err := s.dst.ManifestDigest(ctx, toRepo, img.Tag); !isNotFound(err) {
+		return "", nil
+	}
+
+	// Anything short of a match copies the image again.
+	_, _, ok, reason := verifyArchTags(ctx, newRegistryClient(c.FromRepo), s.dst, fromRepo, toRepo, img.sourceRef(), img.Tag, false)
+	if !ok {
+		debugf("copying %v: %v", toRepo+":"+img.Tag, reason)
+		return "", nil
+	}
+	return "its architecture tags are up to date", nil
+}
+
+// ownedArchTags adds the architecture tags of the images of c to tags, by
+// destination repository, so prune and -delete keep them. They are read
+// from the source index; an image whose source is gone owns none.
+func ownedArchTags(ctx context.Context, c Config, src *registryClient, tags map[string]map[string]bool) error {
+	for _, img := range c.Images {
+		if img.ArchTags == "" {
+			continue
+		}
+
+		fromRepo := repositoryPath(c.FromRepo, img.FromPrefix, img.Name)
+		m, _, err := src.FetchManifest(ctx, fromRepo, img.sourceRef())
+		if isNotFound(err) {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("can't fetch source manifest of '%v': %w", fromRepo, err)
+		}
+
+		repo := repositoryPath(c.ToRepo, img.ToPrefix, img.destinationName())
+		if tags[repo] == nil {
+			tags[repo] = map[string]bool{}
+		}
+		for _, at := range architectureTags(img.Tag, m) {
+			tags[repo][at.tag] = true
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+)
+
+// artifactoryTokenEnv holds an access token for the Artifactory REST API.
+// Without it the to_repo credentials are used.
+const artifactoryTokenEnv = "ARTIFACTORY_ACCESS_TOKEN"
+
+// ArtifactoryConfig describes an Artifactory instance behind to_repo, whose
+// pushed images get properties and optionally an Xray scan.
+type ArtifactoryConfig struct {
+	// URL is the base of the REST API, e.g. https://company.jfrog.io/artifactory.
+	URL string `json:"url"`
+	// Repository is the Docker repository key. By default it is the first
+	// path segment of the image, as with the repository path method.
+	Repository string `json:"repository,omitempty"`
+	// Properties are set on every pushed tag, after expanding environment
+	// variables like ${CI_PIPELINE_ID}.
+	Properties map[string]string `json:"properties,omitempty"`
+
+	// XrayScan requests an Xray scan of every pushed tag, XrayURL defaults
+	// to the /xray sibling of URL.
+	XrayScan bool   `json:"xray_scan,omitempty"`
+	XrayURL  string `json:"xray_url,omitempty"`
+}
+
+func (a ArtifactoryConfig) validate() error {
+	if a.URL == "" {
+		return fmt.Errorf("artifactory.url is required")
+	}
+
+	return nil
+}
+
+// storagePath splits the repository path of an image into the Artifactory
+// repository key and the path of the image inside it.
+func (a ArtifactoryConfig) storagePath(repo string) (string, string) {
+	if a.Repository != "" {
+		return a.Repository, strings.TrimPrefix(repo, a.Repository+"/")
+	}
+
+	if i := strings.IndexByte(repo, '/'); i >= 0 {
+		return repo[:i], repo[i+1:]
+	}
+	return repo, ""
+}
+
+// annotateArtifactory sets the configured properties and the source of the
+// image on the pushed tag and requests an Xray scan.
+func (s *syncer) annotateArtifactory(ctx context.Context, img ImageData, toRepo, toTag string) error {
+	c := s.config
+	a := *c.Artifactory
+
+	fromImg, _ := s.references(img)
+	fromDigest := img.Digest
+	if fromDigest == "" {
+		d, err := newRegistryClient(c.FromRepo).ManifestDigest(ctx, repositoryPath(c.FromRepo, img.FromPrefix, img.Name), img.Tag)
+		if err != nil {
+			return fmt.Errorf("can't resolve source digest: %w", err)
+		}
+		fromDigest = d
+	}
+
+	props := map[string]string{
+		"dimco.source":        fromImg,
+		"dimco.source.digest": fromDigest,
+	}
+	for k, v := range a.Properties {
+		props[k] = os.ExpandEnv(v)
+	}
+
+	repoKey, path := a.storagePath(toRepo)
+	u := fmt.Sprintf("%v/api/storage/%v/%v?properties=%v&recursive=1",
+		strings.TrimRight(a.URL, "/"), strings.Trim(repoKey+"/"+path, "/"), url.PathEscape(toTag), url.QueryEscape(matrixParams(props)))
+	if err := a.send(ctx, c.ToRepo, http.MethodPut, u, nil); err != nil {
+		return fmt.Errorf("can't set properties: %w", err)
+	}
+
+	if !a.XrayScan {
+		return nil
+	}
+
+	xray := a.XrayURL
+	if xray == "" {
+		xray = strings.TrimSuffix(strings.TrimRight(a.URL, "/"), "/artifactory") + "/xray"
+	}
+	body := map[string]string{"componentID": fmt.Sprintf("docker://%v:%v", path, toTag)}
+	if err := a.send(ctx, c.ToRepo, http.MethodPost, strings.TrimRight(xray, "/")+"/api/v1/scanArtifact", body); err != nil {
+		return fmt.Errorf("can't request xray scan: %w", err)
+	}
+
+	return nil
+}
+
+// matrixParams encodes properties as k=v;k=v, escaping the separators
+// Artifactory reserves.
+func matrixParams(props map[string]string) string {
+	escape := strings.NewReplacer(`\`, `\\`, ",", `\,`, "|", `\|`, "=", `\=`, ";", `\;`)
+
+	keys := make([]string, 0, len(props))
+	for k := range props {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	parts := make([]string, 0, len(keys))
+	for _, k := range keys {
+		parts = append(parts, escape.Replace(k)+"="+escape.Replace(props[k]))
+	}
+	return strings.Join(parts, ";")
+}
+
+func (a ArtifactoryConfig) send(ctx context.Context, ac AuthConfig, method, u string, in interface{}) error {
+	var body io.Reader
+	if in != nil {
+		data, err := json.Marshal(in)
+		if err != nil {
+			return fmt.Errorf("can't encode request: %w", err)
+		}
+		body = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, u, body)
+	if err != nil {
+		return fmt.Errorf("can't create request: %w", err)
+	}
+	ac.setHeaders(req)
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if token := os.Getenv(artifactoryTokenEnv); token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	} else if ac.Username != "" {
+		req.SetBasicAuth(ac.Username, ac.Password)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("can't send request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		data, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("%v %v: unexpected status %v: %v", method, req.URL.Path, resp.StatusCode, strings.TrimSpace(string(data)))
+	}
+
+	return nil
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+func bindAttestFlags(fs *flag.FlagSet, opts *syncOptions) {
+	fs.StringVar(&opts.AttestOutput, "attest-output", "", "write the pushed references and their digests to this file")
+	fs.StringVar(&opts.AttestKey, "attest-key", "", "sign -attest-output with cosign using this key (file, kms:// or k8s:// reference)")
+}
+
+// attestation is the file of -attest-output: every destination reference
+// pushed by a run with its digest, for release records.
+type attestation struct {
+	Created time.Time          `json:"created"`
+	Images  []attestationImage `json:"images"`
+}
+
+type attestationImage struct {
+	Reference string `json:"reference"`
+	Digest    string `json:"digest"`
+	Source    string `json:"source"`
+}
+
+// writeAttestation writes the copied images of report to path, and its
+// SHA-256 next to it as path.sha256 in sha256sum format. With a key, cosign
+// signs the file into path.sig.
+func writeAttestation(ctx context.Context, report *runReport, path, key string) error {
+	report.mu.Lock()
+	a := attestation{Created: report.Started.UTC(), Images: []attestationImage{}}
+	for _, res := range report.Images {
+		if res.Status == resultCopied && res.Digest != "" {
+			a.Images = append(a.Images, attestationImage{Reference: res.Destination, Digest: res.Digest, Source: res.Source})
+		}
+	}
+	report.mu.Unlock()
+
+	data, err := json.MarshalIndent(a, "", "  ")
+	if err != nil {
+		return fmt.Errorf("can't encode attestation: %w", err)
+	}
+	data = append(data, '\n')
+
+	if err := ioutil.WriteFile(path, data, 0o644); err != nil {
+		return fmt.Errorf("can't write attestation: %w", err)
+	}
+
+	sum := sha256.Sum256(data)
+	line := fmt.Sprintf("%v  %v\n", hex.EncodeToString(sum[:]), filepath.Base(path))
+	if err := ioutil.WriteFile(path+".sha256", []byte(line), 0o644); err != nil {
+		return fmt.Errorf("can't write attestation checksum: %w", err)
+	}
+
+	if key == "" {
+		return nil
+	}
+
+	// COSIGN_PASSWORD and the KMS credentials come from the environment.
+	out, err := exec.CommandContext(ctx, "cosign", "sign-blob", "--yes", "--key", key, "--output-signature", path+".sig", path).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("can't sign attestation: %w: %v", err, strings.TrimSpace(string(out)))
+	}
+
+	infof("signed %v into %v.sig", path, path)
+
+	return nil
+}
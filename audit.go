@@ -0,0 +1,206 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/user"
+	"sync"
+	"time"
+
+	godigest "github.com/opencontainers/go-digest"
+)
+
+// AuditConfig appends a record of every registry mutation to a file, syslog
+// or both, attributed to the actor and reason of the run.
+type AuditConfig struct {
+	// File is appended JSON lines, one per entry.
+	File string `json:"file,omitempty"`
+	// Syslog sends the entries to the local syslog daemon with the auth
+	// facility.
+	Syslog bool `json:"syslog,omitempty"`
+}
+
+func (ac AuditConfig) validate() error {
+	if ac.File == "" && !ac.Syslog {
+		return fmt.Errorf("audit needs file or syslog")
+	}
+
+	return nil
+}
+
+// Audited actions.
+const (
+	auditStart   = "start"
+	auditPush    = "push"
+	auditPromote = "promote"
+	auditDelete  = "delete"
+	auditRestore = "restore"
+	auditExpire  = "expire"
+	auditProps   = "set_properties"
+	auditAlias   = "alias"
+)
+
+// auditEntry is one line of the audit log.
+type auditEntry struct {
+	Time       time.Time `json:"time"`
+	Actor      string    `json:"actor"`
+	Reason     string    `json:"reason,omitempty"`
+	Host       string    `json:"host"`
+	Command    string    `json:"command"`
+	ConfigHash string    `json:"config_hash"`
+	Action     string    `json:"action"`
+	Image      string    `json:"image,omitempty"`
+	Digest     string    `json:"digest,omitempty"`
+}
+
+// auditActor, auditReason and auditCommand are set by bindAuditFlags.
+var auditActor, auditReason, auditCommand string
+
+// bindAuditFlags registers -actor and -reason, which every command accepts.
+func bindAuditFlags(fs *flag.FlagSet, command string) {
+	auditCommand = command
+	fs.StringVar(&auditActor, "actor", os.Getenv("DIMCO_ACTOR"), "who runs dimco, for the audit log (default $DIMCO_ACTOR, the CI user or the OS user)")
+	fs.StringVar(&auditReason, "reason", os.Getenv("DIMCO_REASON"), "why dimco runs, for the audit log (default $DIMCO_REASON)")
+}
+
+// runActor is the -actor of the run, the user that triggered the CI job or
+// the OS user.
+func runActor() string {
+	for _, a := range []string{auditActor, os.Getenv("GITHUB_ACTOR"), os.Getenv("GITLAB_USER_LOGIN")} {
+		if a != "" {
+			return a
+		}
+	}
+
+	if u, err := user.Current(); err == nil {
+		return u.Username
+	}
+	return "unknown"
+}
+
+// auditLog writes the entries of the config a command runs with.
+type auditLog struct {
+	config     AuditConfig
+	configHash string
+
+	mu     sync.Mutex
+	syslog io.Writer
+}
+
+var (
+	auditMu sync.Mutex
+	// auditTrail is the audit log of the running config, nil without one.
+	auditTrail *auditLog
+)
+
+// startAudit opens the audit log of c and records the start of the command.
+// It fails when the entry can't be written, so runs without their audit
+// trail don't mutate anything. A config that is already audited isn't
+// recorded again.
+func (c Config) startAudit() error {
+	auditMu.Lock()
+	defer auditMu.Unlock()
+
+	if c.Audit == nil {
+		auditTrail = nil
+		return nil
+	}
+	if auditTrail != nil && auditTrail.config == *c.Audit && auditTrail.configHash == c.hash {
+		return nil
+	}
+
+	a := &auditLog{config: *c.Audit, configHash: c.hash}
+	if err := a.write(auditStart, "", ""); err != nil {
+		return fmt.Errorf("can't write audit log: %w", err)
+	}
+	auditTrail = a
+
+	return nil
+}
+
+// auditing reports whether mutations are recorded.
+func auditing() bool {
+	auditMu.Lock()
+	defer auditMu.Unlock()
+	return auditTrail != nil
+}
+
+// recordAudit records a mutation of image in the audit log, if there is one.
+// Entries that can't be written are logged, the mutation happened anyway.
+func recordAudit(action, image, digest string) {
+	auditMu.Lock()
+	a := auditTrail
+	auditMu.Unlock()
+
+	if a == nil {
+		return
+	}
+
+	if err := a.write(action, image, digest); err != nil {
+		log.Print(fmt.Errorf("can't write audit log entry for %v %v: %w", action, image, err))
+	}
+}
+
+func (a *auditLog) write(action, image, digest string) error {
+	host, _ := os.Hostname()
+	line, err := json.Marshal(auditEntry{
+		Time:       time.Now().UTC(),
+		Actor:      runActor(),
+		Reason:     auditReason,
+		Host:       host,
+		Command:    auditCommand,
+		ConfigHash: a.configHash,
+		Action:     action,
+		Image:      image,
+		Digest:     digest,
+	})
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.config.File != "" {
+		f, err := os.OpenFile(a.config.File, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+		if err != nil {
+			return err
+		}
+		if _, err := f.Write(line); err != nil {
+			f.Close()
+			return err
+		}
+		if err := f.Close(); err != nil {
+			return err
+		}
+	}
+
+	if a.config.Syslog {
+		if a.syslog == nil {
+			w, err := openSyslog()
+			if err != nil {
+				return fmt.Errorf("can't connect to syslog: %w", err)
+			}
+			a.syslog = w
+		}
+		if _, err := a.syslog.Write(line); err != nil {
+			a.syslog = nil
+			return err
+		}
+	}
+
+	return nil
+}
+
+// qualifiedReference names repo:ref, or repo@ref for digests, at host.
+func qualifiedReference(host, repo, ref string) string {
+	if _, err := godigest.Parse(ref); err == nil {
+		return host + "/" + repo + "@" + ref
+	}
+	return host + "/" + repo + ":" + ref
+}
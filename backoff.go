@@ -0,0 +1,77 @@
+package main
+
+import (
+	"time"
+)
+
+// backoffState counts the consecutive failed copies of a destination image.
+type backoffState struct {
+	failures int
+	last     time.Time
+}
+
+// quarantined reports whether the image failed often enough to be backed
+// off.
+func (b backoffState) quarantined(after int) bool {
+	return after > 0 && b.failures >= after
+}
+
+// retryAt is when a quarantined image is copied again: the interval of its
+// schedule doubled with every failure since it was quarantined, up to max.
+// It is zero for images that aren't quarantined.
+func (b backoffState) retryAt(after int, interval, max time.Duration) time.Time {
+	if !b.quarantined(after) {
+		return time.Time{}
+	}
+
+	delay := interval
+	for i := after; i <= b.failures && delay < max; i++ {
+		delay *= 2
+	}
+	if delay > max {
+		delay = max
+	}
+	return b.last.Add(delay)
+}
+
+// recordBackoff updates the failure counts with the results of a finished
+// run. Canceled and rolled back copies don't count. The caller holds d.mu.
+func (d *daemon) recordBackoff(report *runReport) {
+	for _, res := range report.Images {
+		b := d.backoff[res.Destination]
+		switch res.Status {
+		case resultCopied, resultSkipped:
+			if b.quarantined(d.quarantineAfter) {
+				infof("%v recovered after %v failed copies", res.Destination, b.failures)
+			}
+			delete(d.backoff, res.Destination)
+		case resultFailed:
+			if res.ErrorClass == classCanceled {
+				continue
+			}
+			b.failures++
+			// The start of the run lines the backoff up with the ticks of
+			// the schedule.
+			b.last = d.runStarted
+			d.backoff[res.Destination] = b
+			if b.failures == d.quarantineAfter {
+				infof("%v failed %v times in a row, quarantined", res.Destination, b.failures)
+			}
+		}
+	}
+}
+
+// backedOff reports whether img is quarantined and not due for another try
+// at now. The caller holds d.mu.
+func (d *daemon) backedOff(c Config, img ImageData, now time.Time) bool {
+	return now.Before(d.retryAt(c, img))
+}
+
+// retryAt is when img is tried again, zero unless it is quarantined. The
+// caller holds d.mu.
+func (d *daemon) retryAt(c Config, img ImageData) time.Time {
+	s := &syncer{config: c, opts: d.opts}
+	_, toImg := s.references(img)
+	iv := c.schedules(d.interval)[c.schedule(img)]
+	return d.backoff[toImg].retryAt(d.quarantineAfter, iv, d.maxBackoff)
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// checkpointMaxAge is how long checkpoints are kept. Registries purge
+// upload sessions that weren't completed, distribution after a week.
+const checkpointMaxAge = 7 * 24 * time.Hour
+
+// checkpointStore keeps the progress of chunked blob uploads in a directory,
+// so a run killed in the middle of a large layer continues it where the
+// registry left off instead of uploading it again.
+type checkpointStore struct {
+	dir string
+}
+
+// uploadCheckpoint is the session of a chunked upload and the bytes of the
+// blob the registry committed.
+type uploadCheckpoint struct {
+	Registry   string    `json:"registry"`
+	Repository string    `json:"repository"`
+	Digest     string    `json:"digest"`
+	Location   string    `json:"location"`
+	Offset     int64     `json:"offset"`
+	Updated    time.Time `json:"updated"`
+}
+
+type checkpointKey struct{}
+
+func withCheckpoints(ctx context.Context, s *checkpointStore) context.Context {
+	return context.WithValue(ctx, checkpointKey{}, s)
+}
+
+// checkpointsFrom returns the store of the run, nil without -checkpoint-dir.
+func checkpointsFrom(ctx context.Context) *checkpointStore {
+	s, _ := ctx.Value(checkpointKey{}).(*checkpointStore)
+	return s
+}
+
+// openCheckpoints creates dir and removes the checkpoints too old to resume.
+func openCheckpoints(dir string) (*checkpointStore, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("can't create checkpoint dir: %w", err)
+	}
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("can't read checkpoint dir: %w", err)
+	}
+	for _, fi := range files {
+		if strings.HasPrefix(fi.Name(), "upload-") && time.Since(fi.ModTime()) > checkpointMaxAge {
+			os.Remove(filepath.Join(dir, fi.Name()))
+		}
+	}
+
+	return &checkpointStore{dir: dir}, nil
+}
+
+func (s *checkpointStore) path(host, repo, digest string) string {
+	sum := sha256.Sum256([]byte(host + "/" + repo + "@" + digest))
+	return filepath.Join(s.dir, "upload-"+hex.EncodeToString(sum[:16])+".json")
+}
+
+func (s *checkpointStore) load(host, repo, digest string) (uploadCheckpoint, bool) {
+	if s == nil {
+		return uploadCheckpoint{}, false
+	}
+
+	data, err := ioutil.ReadFile(s.path(host, repo, digest))
+	if err != nil {
+		return uploadCheckpoint{}, false
+	}
+	cp := uploadCheckpoint{}
+	if err := json.Unmarshal(data, &cp); err != nil || cp.Digest != digest || cp.Location == "" {
+		return uploadCheckpoint{}, false
+	}
+	return cp, true
+}
+
+// save records cp. The file is replaced at once, a run killed while saving
+// leaves the previous checkpoint.
+func (s *checkpointStore) save(cp uploadCheckpoint) {
+	if s == nil {
+		return
+	}
+
+	cp.Updated = time.Now().UTC()
+	data, _ := json.Marshal(cp)
+
+	path := s.path(cp.Registry, cp.Repository, cp.Digest)
+	tmp := path + ".tmp"
+	err := ioutil.WriteFile(tmp, data, 0o600)
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		log.Print(fmt.Errorf("can't save checkpoint of %v: %w", cp.Digest, err))
+	}
+}
+
+func (s *checkpointStore) remove(host, repo, digest string) {
+	if s == nil {
+		return
+	}
+	if err := os.Remove(s.path(host, repo, digest)); err != nil && !os.IsNotExist(err) {
+		log.Print(fmt.Errorf("can't remove checkpoint of %v: %w", digest, err))
+	}
+}
+
+// resumeUpload returns the upload session of digest in repo a previous run
+// checkpointed and how much of the blob the registry has, nil when there is
+// none to resume.
+func (r *registryClient) resumeUpload(ctx context.Context, repo, digest string, size int64) (*url.URL, int64) {
+	cps := checkpointsFrom(ctx)
+	cp, ok := cps.load(r.host, repo, digest)
+	if !ok {
+		return nil, 0
+	}
+
+	location, err := url.Parse(cp.Location)
+	if err != nil {
+		cps.remove(r.host, repo, digest)
+		return nil, 0
+	}
+
+	committed, next, err := r.uploadStatus(ctx, location)
+	if err == nil && committed > size {
+		err = fmt.Errorf("the registry has %v bytes of %v", committed, size)
+	}
+	if err != nil {
+		// The session expired or the registry was restarted.
+		debugf("can't resume the upload of %v, starting over: %v", digest, err)
+		cps.remove(r.host, repo, digest)
+		return nil, 0
+	}
+
+	infof("resuming upload of %v at %v of %v from checkpoint", digest, formatBytes(committed), formatBytes(size))
+	return next, committed
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ciDetected reports whether dimco runs in a CI system publishCI supports.
+func ciDetected() bool {
+	return os.Getenv("GITHUB_ACTIONS") == "true" || os.Getenv("GITLAB_CI") == "true"
+}
+
+// publishCI surfaces the results of a sync run in the CI system dimco runs
+// in, detected from its environment: annotations and a job summary on
+// GitHub Actions, a JUnit report on GitLab CI.
+func publishCI(r *runReport) error {
+	switch {
+	case os.Getenv("GITHUB_ACTIONS") == "true":
+		return publishGitHub(r)
+	case os.Getenv("GITLAB_CI") == "true":
+		return publishGitLab(r)
+	}
+
+	return nil
+}
+
+func publishGitHub(r *runReport) error {
+	for _, res := range r.Images {
+		if res.Status == resultCopied || res.Status == resultSkipped {
+			continue
+		}
+		fmt.Printf("::error title=%v::%v\n", escapeGitHubProperty("dimco: "+res.Destination), escapeGitHubData(res.Status+": "+res.Error))
+	}
+
+	path := os.Getenv("GITHUB_STEP_SUMMARY")
+	if path == "" {
+		return nil
+	}
+
+	b := &strings.Builder{}
+	fmt.Fprintf(b, "### dimco sync: %v of %v images failed\n\n", r.failures(), len(r.Images))
+	fmt.Fprintf(b, "| Source | Destination | Status | Digest | Duration | Error |\n|---|---|---|---|---|---|\n")
+	cell := strings.NewReplacer("|", "\\|", "\r", "", "\n", " ")
+	for _, res := range r.Images {
+		status := res.Status
+		if res.Status != resultCopied && res.Status != resultSkipped {
+			status = "❌ " + status
+		}
+		digest := ""
+		if res.Digest != "" {
+			digest = "`" + res.Digest + "`"
+		}
+		fmt.Fprintf(b, "| `%v` | `%v` | %v | %v | %.1fs | %v |\n",
+			res.Source, res.Destination, status, digest, res.Duration, cell.Replace(res.Error))
+	}
+	b.WriteString("\n")
+
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("can't open job summary: %w", err)
+	}
+	defer f.Close()
+
+	if _, err := f.WriteString(b.String()); err != nil {
+		return fmt.Errorf("can't write job summary: %w", err)
+	}
+
+	return nil
+}
+
+// escapeGitHubData escapes the message of a workflow command.
+func escapeGitHubData(s string) string {
+	return strings.NewReplacer("%", "%25", "\r", "%0D", "\n", "%0A").Replace(s)
+}
+
+// escapeGitHubProperty escapes a parameter of a workflow command.
+func escapeGitHubProperty(s string) string {
+	return strings.NewReplacer("%", "%25", "\r", "%0D", "\n", "%0A", ":", "%3A", ",", "%2C").Replace(s)
+}
+
+// publishGitLab writes a JUnit report to DIMCO_JUNIT_REPORT, by default
+// dimco-junit.xml in the project directory, for artifacts:reports:junit.
+func publishGitLab(r *runReport) error {
+	path := os.Getenv("DIMCO_JUNIT_REPORT")
+	if path == "" {
+		path = filepath.Join(os.Getenv("CI_PROJECT_DIR"), "dimco-junit.xml")
+	}
+
+	f, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("can't create junit report: %w", err)
+	}
+
+	err = r.writeJUnit(f)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return fmt.Errorf("can't write junit report: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+)
+
+// Local images removed from the engine after a copy.
+const (
+	cleanupBoth   = "both"
+	cleanupSource = "source"
+	cleanupTarget = "target"
+	cleanupNone   = "none"
+)
+
+func validCleanup(cleanup string) error {
+	switch cleanup {
+	case "", cleanupBoth, cleanupSource, cleanupTarget, cleanupNone:
+		return nil
+	default:
+		return fmt.Errorf("unknown cleanup '%v', use none, source, target or both", cleanup)
+	}
+}
+
+// localCleanup is what copyImage removes from the engine once it is done.
+type localCleanup struct {
+	source, target bool
+}
+
+// planCleanup decides before the pull which local images of a copy are
+// removed afterwards. With cleanup_pulled_only, images that existed before
+// are kept.
+func (s *syncer) planCleanup(ctx context.Context, img ImageData, fromImg, toImg string) localCleanup {
+	c := s.config
+	cleanup := c.cleanup(img)
+	lc := localCleanup{
+		source: cleanup == "" || cleanup == cleanupBoth || cleanup == cleanupSource,
+		target: cleanup == "" || cleanup == cleanupBoth || cleanup == cleanupTarget,
+	}
+
+	if c.CleanupPulledOnly {
+		if lc.source && s.hasLocal(ctx, fromImg) {
+			debugf("keeping %v, it existed before the pull", fromImg)
+			lc.source = false
+		}
+		if lc.target && s.hasLocal(ctx, toImg) {
+			debugf("keeping %v, it existed before the pull", toImg)
+			lc.target = false
+		}
+	}
+
+	return lc
+}
+
+func (s *syncer) hasLocal(ctx context.Context, image string) bool {
+	_, err := s.engine.ImageID(ctx, image)
+	return err == nil
+}
+
+// removeLocal removes image from the engine unless a running container
+// uses it. While other copies of the run use some of its layers, the removal
+// waits for them.
+func (s *syncer) removeLocal(ctx context.Context, image string) {
+	inUse, err := s.engine.InUse(ctx, image)
+	if err != nil {
+		log.Print(fmt.Errorf("can't check containers of '%v', keeping it: %w", image, err))
+		return
+	}
+	if inUse {
+		infof("keeping %v, running containers use it", image)
+		return
+	}
+
+	if s.holds != nil {
+		layers, err := s.engine.Layers(ctx, image)
+		if err != nil {
+			log.Print(fmt.Errorf("can't list layers of '%v', keeping it: %w", image, err))
+			return
+		}
+		if s.holds.deferRemoval(image, layers) {
+			infof("keeping %v while other copies use its layers", image)
+			return
+		}
+	}
+
+	if err := s.engine.Remove(ctx, image); err != nil {
+		log.Print(fmt.Errorf("can't delete image '%v': %w", image, err))
+	}
+}
+
+// layerHolds counts the copies of a run using each local layer. Removing an
+// image whose layers a sibling copy is still pushing breaks that push, so
+// such removals are deferred until the last copy using the layers is done.
+type layerHolds struct {
+	mu     sync.Mutex
+	layers map[string]int
+	// deferred are the layers of the images waiting for removal.
+	deferred map[string][]string
+}
+
+// holdLayers marks the layers of the local image as used by the calling copy.
+// The returned function releases them and removes the images that waited for
+// them; it may be called more than once.
+func (s *syncer) holdLayers(ctx context.Context, image string) (release func()) {
+	if s.holds == nil {
+		return func() {}
+	}
+
+	layers, err := s.engine.Layers(ctx, image)
+	if err != nil {
+		debugf("can't list layers of %v: %v", image, err)
+		return func() {}
+	}
+	s.holds.hold(layers)
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			for _, image := range s.holds.release(layers) {
+				debugf("removing %v, the copies sharing its layers are done", image)
+				s.removeLocal(ctx, image)
+			}
+		})
+	}
+}
+
+func (h *layerHolds) hold(layers []string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.layers == nil {
+		h.layers = map[string]int{}
+	}
+	for _, l := range layers {
+		h.layers[l]++
+	}
+}
+
+// release drops a hold of layers and returns the deferred images none of
+// whose layers are held anymore.
+func (h *layerHolds) release(layers []string) []string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for _, l := range layers {
+		if h.layers[l]--; h.layers[l] <= 0 {
+			delete(h.layers, l)
+		}
+	}
+
+	ready := []string{}
+	for image, ls := range h.deferred {
+		if !h.held(ls) {
+			ready = append(ready, image)
+			delete(h.deferred, image)
+		}
+	}
+	return ready
+}
+
+// deferRemoval reports whether copies hold some of layers, and if so
+// records image to be removed once they are done.
+func (h *layerHolds) deferRemoval(image string, layers []string) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if !h.held(layers) {
+		return false
+	}
+	if h.deferred == nil {
+		h.deferred = map[string][]string{}
+	}
+	h.deferred[image] = layers
+	return true
+}
+
+// held reports whether a copy holds one of layers. h.mu must be held.
+func (h *layerHolds) held(layers []string) bool {
+	for _, l := range layers {
+		if h.layers[l] > 0 {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+)
+
+func newCompletionCommand() *command {
+	fs := flag.NewFlagSet("completion", flag.ExitOnError)
+
+	return &command{
+		name:  "completion",
+		usage: "print the shell completion script: completion bash|zsh|fish",
+		args:  []string{"bash", "zsh", "fish"},
+		flags: fs,
+		run: func(ctx context.Context) error {
+			if fs.NArg() != 1 {
+				return fmt.Errorf("usage: dimco completion bash|zsh|fish")
+			}
+
+			cmds := documentedCommands()
+			switch fs.Arg(0) {
+			case "bash":
+				return writeBashCompletion(os.Stdout, cmds)
+			case "zsh":
+				return writeZshCompletion(os.Stdout, cmds)
+			case "fish":
+				return writeFishCompletion(os.Stdout, cmds)
+			default:
+				return fmt.Errorf("unknown shell '%v', use bash, zsh or fish", fs.Arg(0))
+			}
+		},
+	}
+}
+
+// documentedCommands returns fresh commands with the common flags bound,
+// for completion scripts and the man page.
+func documentedCommands() []*command {
+	cmds := commands()
+	for _, c := range cmds {
+		bindCommonFlags(c.flags, c.name)
+	}
+	return cmds
+}
+
+// commandFlag is a flag as completion scripts see it.
+type commandFlag struct {
+	name  string
+	value string
+	usage string
+}
+
+func commandFlags(fs *flag.FlagSet) []commandFlag {
+	flags := []commandFlag{}
+	fs.VisitAll(func(f *flag.Flag) {
+		value, usage := flag.UnquoteUsage(f)
+		if b, ok := f.Value.(interface{ IsBoolFlag() bool }); ok && b.IsBoolFlag() {
+			value = ""
+		}
+		flags = append(flags, commandFlag{name: f.Name, value: value, usage: usage})
+	})
+	sort.Slice(flags, func(i, j int) bool { return flags[i].name < flags[j].name })
+	return flags
+}
+
+func writeBashCompletion(w io.Writer, cmds []*command) error {
+	b := &strings.Builder{}
+	names := []string{}
+	for _, c := range cmds {
+		names = append(names, c.name)
+	}
+
+	fmt.Fprintf(b, `# bash completion for dimco, load with: source <(dimco completion bash)
+_dimco() {
+	local cur="${COMP_WORDS[COMP_CWORD]}" prev="${COMP_WORDS[COMP_CWORD-1]}" cmd=sync
+	if [[ $COMP_CWORD -eq 1 && $cur != -* ]]; then
+		COMPREPLY=($(compgen -W "%v" -- "$cur"))
+		return
+	fi
+	if [[ ${COMP_WORDS[1]} != -* ]]; then
+		cmd="${COMP_WORDS[1]}"
+	fi
+
+	case "$cmd" in
+`, strings.Join(names, " "))
+
+	for _, c := range cmds {
+		words, valued := []string{}, []string{}
+		for _, f := range commandFlags(c.flags) {
+			words = append(words, "-"+f.name)
+			if f.value != "" {
+				valued = append(valued, "-"+f.name)
+			}
+		}
+
+		fmt.Fprintf(b, "\t%v)\n", c.name)
+		if len(valued) > 0 {
+			fmt.Fprintf(b, "\t\tcase \"$prev\" in\n\t\t%v)\n\t\t\tCOMPREPLY=($(compgen -f -- \"$cur\"))\n\t\t\treturn\n\t\t\t;;\n\t\tesac\n", strings.Join(valued, "|"))
+		}
+		if len(c.args) > 0 {
+			fmt.Fprintf(b, "\t\tif [[ $cur != -* ]]; then\n\t\t\tCOMPREPLY=($(compgen -W \"%v\" -- \"$cur\"))\n\t\t\treturn\n\t\tfi\n", strings.Join(c.args, " "))
+		}
+		fmt.Fprintf(b, "\t\tCOMPREPLY=($(compgen -W \"%v\" -- \"$cur\"))\n\t\t;;\n", strings.Join(words, " "))
+	}
+
+	b.WriteString("\tesac\n}\ncomplete -o default -F _dimco dimco\n")
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+func writeZshCompletion(w io.Writer, cmds []*command) error {
+	b := &strings.Builder{}
+	b.WriteString("#compdef dimco\n\n_dimco() {\n\tlocal -a commands\n\tcommands=(\n")
+	for _, c := range cmds {
+		fmt.Fprintf(b, "\t\t%v\n", zshQuote(c.name+":"+strings.ReplaceAll(c.usage, ":", `\:`)))
+	}
+	b.WriteString(`	)
+
+	if (( CURRENT == 2 )) && [[ $words[2] != -* ]]; then
+		_describe -t commands command commands
+		return
+	fi
+
+	local cmd=sync
+	if [[ $words[2] != -* ]]; then
+		cmd=$words[2]
+		shift words
+		(( CURRENT-- ))
+	fi
+
+	case $cmd in
+`)
+
+	spec := strings.NewReplacer("[", `\[`, "]", `\]`, ":", `\:`)
+	for _, c := range cmds {
+		fmt.Fprintf(b, "\t%v)\n\t\t_arguments", c.name)
+		for _, f := range commandFlags(c.flags) {
+			arg := fmt.Sprintf("-%v[%v]", f.name, spec.Replace(f.usage))
+			if f.value != "" {
+				arg += ":" + f.value + ":_files"
+			}
+			fmt.Fprintf(b, " \\\n\t\t\t%v", zshQuote(arg))
+		}
+		if len(c.args) > 0 {
+			fmt.Fprintf(b, " \\\n\t\t\t%v", zshQuote("1:argument:("+strings.Join(c.args, " ")+")"))
+		}
+		b.WriteString("\n\t\t;;\n")
+	}
+
+	b.WriteString("\tesac\n}\n\n_dimco \"$@\"\n")
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+func writeFishCompletion(w io.Writer, cmds []*command) error {
+	b := &strings.Builder{}
+	b.WriteString("# fish completion for dimco, load with: dimco completion fish | source\ncomplete -c dimco -f\n")
+
+	for _, c := range cmds {
+		fmt.Fprintf(b, "complete -c dimco -n __fish_use_subcommand -a %v -d %v\n", c.name, fishQuote(c.usage))
+	}
+
+	for _, c := range cmds {
+		// sync is the default command, its flags are offered without one.
+		condition := fishQuote("__fish_seen_subcommand_from " + c.name)
+		if c.name == "sync" {
+			condition = fishQuote("__fish_use_subcommand; or __fish_seen_subcommand_from sync")
+		}
+
+		for _, f := range commandFlags(c.flags) {
+			fmt.Fprintf(b, "complete -c dimco -n %v -o %v", condition, f.name)
+			if f.value != "" {
+				b.WriteString(" -r -F")
+			}
+			fmt.Fprintf(b, " -d %v\n", fishQuote(f.usage))
+		}
+		if len(c.args) > 0 {
+			fmt.Fprintf(b, "complete -c dimco -n %v -a %v\n", condition, fishQuote(strings.Join(c.args, " ")))
+		}
+	}
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+func zshQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+func fishQuote(s string) string {
+	return "'" + strings.NewReplacer(`\`, `\\`, "'", `\'`).Replace(s) + "'"
+}
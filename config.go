@@ -0,0 +1,636 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	godigest "github.com/opencontainers/go-digest"
+)
+
+// configTimeout bounds fetching a config, including all its includes.
+const configTimeout = time.Minute
+
+// loadConfig reads the config from a local file or one of the remote
+// sources understood by openSource.
+func loadConfig(path string) (Config, error) {
+	return loadScopedConfig(path, nil)
+}
+
+// loadScopedConfig is loadConfig with scope applied to the validated config
+// before its secrets and credentials are resolved, e.g. the settings of a
+// tenant.
+func loadScopedConfig(path string, scope func(c *Config) error) (Config, error) {
+	src, err := openSource(path)
+	if err != nil {
+		return Config{}, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), configTimeout)
+	defer cancel()
+
+	data, _, err := src.Read(ctx)
+	if err != nil {
+		return Config{}, fmt.Errorf("can't read config file: %w", err)
+	}
+
+	c := Config{}
+	if err := json.Unmarshal(data, &c); err != nil {
+		return Config{}, fmt.Errorf("can't unmarshal config")
+	}
+
+	c.Images = c.withDestinations(c.Images)
+
+	if err := c.mergeIncludes(ctx, src); err != nil {
+		return Config{}, err
+	}
+
+	c.normalizeImages()
+
+	if err := c.validate(); err != nil {
+		return Config{}, fmt.Errorf("invalid config: %w", err)
+	}
+
+	if scope != nil {
+		if err := scope(&c); err != nil {
+			return Config{}, err
+		}
+	}
+
+	merged, err := json.Marshal(c)
+	if err != nil {
+		return Config{}, fmt.Errorf("can't marshal config: %w", err)
+	}
+	c.hash = godigest.FromBytes(merged).String()
+
+	if err := c.resolveSecrets(ctx); err != nil {
+		return Config{}, err
+	}
+
+	if err := c.resolveCredentials(ctx); err != nil {
+		return Config{}, err
+	}
+
+	return c, nil
+}
+
+func (c Config) validate() error {
+	if c.FromRepo.BaseAddress == "" {
+		return fmt.Errorf("from_repo.base_address is required")
+	}
+
+	if c.ToRepo.BaseAddress == "" {
+		return fmt.Errorf("to_repo.base_address is required")
+	}
+
+	if c.WarmCache != nil && c.WarmCache.BaseAddress == "" {
+		return fmt.Errorf("warm_cache.base_address is required")
+	}
+
+	if c.VerifyAgainst != nil {
+		if err := c.VerifyAgainst.validate(); err != nil {
+			return err
+		}
+	}
+
+	for _, ac := range c.registries() {
+		if err := validHeaders(ac.Headers); err != nil {
+			return fmt.Errorf("%v: %w", ac.BaseAddress, err)
+		}
+	}
+
+	if c.ToRepo.ChunkSize != "" {
+		if _, err := parseBytes(c.ToRepo.ChunkSize); err != nil {
+			return fmt.Errorf("to_repo.chunk_size: %w", err)
+		}
+	}
+
+	switch c.Backend {
+	case "", backendDocker, backendContainerd, backendRegistry:
+	default:
+		return fmt.Errorf("unknown backend '%v'", c.Backend)
+	}
+
+	if err := validCleanup(c.Cleanup); err != nil {
+		return err
+	}
+
+	if c.Encryption != nil {
+		if err := c.Encryption.validate(); err != nil {
+			return err
+		}
+	}
+
+	if c.Lock != nil {
+		if err := c.Lock.validate(); err != nil {
+			return err
+		}
+	}
+
+	if c.Quota != nil {
+		if err := c.Quota.validate(); err != nil {
+			return err
+		}
+	}
+
+	if c.Events != nil {
+		if err := c.Events.validate(); err != nil {
+			return err
+		}
+	}
+
+	for _, hc := range c.Hooks {
+		if err := hc.validate(c.Backend); err != nil {
+			return err
+		}
+	}
+
+	names := map[string]bool{}
+	for _, ac := range c.Alerts {
+		if err := ac.validate(); err != nil {
+			return err
+		}
+		if names[ac.Name] {
+			return fmt.Errorf("duplicate alert '%v'", ac.Name)
+		}
+		names[ac.Name] = true
+	}
+
+	if c.Audit != nil {
+		if err := c.Audit.validate(); err != nil {
+			return err
+		}
+	}
+
+	if c.Logging != nil {
+		if err := c.Logging.validate(); err != nil {
+			return err
+		}
+	}
+
+	if c.Retry != nil {
+		if err := c.Retry.validate(); err != nil {
+			return err
+		}
+	}
+
+	if c.Filter != nil {
+		if err := c.Filter.validate(); err != nil {
+			return err
+		}
+	}
+
+	if c.Policy != nil {
+		if err := c.Policy.validate(); err != nil {
+			return err
+		}
+	}
+
+	if c.DiskGuard != nil {
+		if err := c.DiskGuard.validate(); err != nil {
+			return err
+		}
+	}
+
+	if err := c.validateRewrites(); err != nil {
+		return err
+	}
+
+	if err := c.validateGroups(); err != nil {
+		return err
+	}
+
+	if c.Window != nil {
+		if err := c.Window.validate(); err != nil {
+			return err
+		}
+	}
+
+	for _, pc := range c.Pins {
+		if err := pc.validate(); err != nil {
+			return err
+		}
+	}
+
+	if c.Email != nil {
+		if err := c.Email.validate(); err != nil {
+			return err
+		}
+	}
+
+	if c.Metrics != nil {
+		if err := c.Metrics.validate(); err != nil {
+			return err
+		}
+	}
+
+	for i, d := range c.Discover {
+		if err := d.validate(); err != nil {
+			return fmt.Errorf("discover[%v]: %w", i, err)
+		}
+	}
+
+	if c.Artifactory != nil {
+		if err := c.Artifactory.validate(); err != nil {
+			return err
+		}
+	}
+
+	for host, cc := range c.Credentials {
+		if _, err := cc.provider(); err != nil {
+			return fmt.Errorf("credentials[%v]: %w", host, err)
+		}
+	}
+
+	for i, img := range c.Images {
+		if img.Name == "" {
+			return fmt.Errorf("images[%v]: name is required", i)
+		}
+
+		if err := c.validateReferences(img); err != nil {
+			return fmt.Errorf("images[%v] (%v): %w", i, img.Name, err)
+		}
+
+		if img.Retention != nil && img.Retention.KeepRegex != "" {
+			if _, err := regexp.Compile(img.Retention.KeepRegex); err != nil {
+				return fmt.Errorf("images[%v]: invalid keep_regex: %w", i, err)
+			}
+		}
+	}
+
+	if err := c.validateAliases(); err != nil {
+		return err
+	}
+	if err := c.validateArchTags(); err != nil {
+		return err
+	}
+
+	if _, err := c.dependencies(); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// destinationName is the name of img at the destination.
+func (img ImageData) destinationName() string {
+	if img.ToName != "" {
+		return img.ToName
+	}
+	return img.Name
+}
+
+// destinationKey identifies the destination tag an image entry pushes to.
+func (img ImageData) destinationKey() string {
+	img = img.normalized()
+	return fmt.Sprintf("%v%v:%v", img.ToPrefix, img.destinationName(), img.Tag)
+}
+
+// key identifies an image entry when comparing configs.
+func (img ImageData) key() string {
+	return fmt.Sprintf("%v%v:%v -> %v%v:%v", img.FromPrefix, img.Name, img.sourceRef(), img.ToPrefix, img.destinationName(), img.Tag)
+}
+
+// selectedBy reports whether the name, or name:tag, of img matches one of
+// the path.Match patterns. No patterns select every image.
+func (img ImageData) selectedBy(patterns []string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+
+	for _, p := range patterns {
+		if ok, _ := path.Match(p, img.Name); ok {
+			return true
+		}
+		if ok, _ := path.Match(p, img.Name+":"+img.Tag); ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+func validPatterns(patterns []string) error {
+	for _, p := range patterns {
+		if _, err := path.Match(p, ""); err != nil {
+			return fmt.Errorf("invalid pattern '%v': %w", p, err)
+		}
+	}
+
+	return nil
+}
+
+// registries returns the registries of c whose credentials are resolved.
+func (c *Config) registries() []*AuthConfig {
+	acs := []*AuthConfig{&c.FromRepo, &c.ToRepo}
+	if c.WarmCache != nil {
+		acs = append(acs, c.WarmCache)
+	}
+	if c.VerifyAgainst != nil {
+		acs = append(acs, &c.VerifyAgainst.Registry)
+	}
+	return acs
+}
+
+// sourceRef is the tag or, when pinned, the digest the image is pulled by.
+func (img ImageData) sourceRef() string {
+	if img.Digest != "" {
+		return img.Digest
+	}
+	return img.Tag
+}
+
+type Config struct {
+	FromRepo AuthConfig  `json:"from_repo,omitempty"`
+	ToRepo   AuthConfig  `json:"to_repo,omitempty"`
+	Images   []ImageData `json:"images,omitempty"`
+
+	// Credentials maps registry hosts, or glob patterns of hosts, to the
+	// provider of their credentials.
+	Credentials map[string]CredentialConfig `json:"credentials,omitempty"`
+
+	// Discover adds the repositories found under source namespaces to
+	// Images on every run.
+	Discover []DiscoverConfig `json:"discover,omitempty"`
+
+	// Includes lists config fragments, relative to this file and possibly
+	// glob patterns for local files, whose images are merged into the config.
+	Includes []string `json:"includes,omitempty"`
+
+	// EngineHost is the container engine endpoint, e.g.
+	// unix:///run/podman/podman.sock or tcp://builder:2376.
+	EngineHost string    `json:"engine_host,omitempty"`
+	SSH        SSHConfig `json:"ssh,omitempty"`
+
+	// Backend is the local image store used for copying: docker (default)
+	// or containerd, or registry to copy between the registries directly.
+	Backend    string           `json:"backend,omitempty"`
+	Containerd ContainerdConfig `json:"containerd,omitempty"`
+
+	// Cleanup selects the local images removed after a copy: both
+	// (default), source, target or none. CleanupPulledOnly keeps images
+	// that were in the engine before the copy.
+	Cleanup           string `json:"cleanup,omitempty"`
+	CleanupPulledOnly bool   `json:"cleanup_pulled_only,omitempty"`
+
+	// IncludeNonDistributable copies foreign layers, like the base layers of
+	// Windows images, into the destination instead of leaving them at their
+	// urls.
+	IncludeNonDistributable bool `json:"include_non_distributable,omitempty"`
+
+	// Squash merges the layers of every image into one before the push, for
+	// destinations limiting the layer count.
+	Squash bool `json:"squash,omitempty"`
+
+	// Encryption encrypts pushed layers and decrypts encrypted source layers.
+	Encryption *EncryptionConfig `json:"encryption,omitempty"`
+
+	// Referrers copies the signatures, SBOMs, provenance and other
+	// referrers of every image along with it.
+	Referrers bool `json:"referrers,omitempty"`
+
+	// StagingSuffix is appended to tags pushed with `sync -stage`.
+	StagingSuffix string `json:"staging_suffix,omitempty"`
+
+	// Artifactory sets properties on images pushed to an Artifactory
+	// to_repo.
+	Artifactory *ArtifactoryConfig `json:"artifactory,omitempty"`
+
+	// Lock keeps sync, prune and promote runs of this config from
+	// overlapping.
+	Lock *LockConfig `json:"lock,omitempty"`
+
+	// Quota is checked against the estimated transfer before a sync.
+	Quota *QuotaConfig `json:"quota,omitempty"`
+
+	// Events are published after every copy.
+	Events *EventsConfig `json:"events,omitempty"`
+
+	// Email sends the summary of every sync run.
+	Email *EmailConfig `json:"email,omitempty"`
+	// Metrics pushes the metrics of every sync run.
+	Metrics *MetricsConfig `json:"metrics,omitempty"`
+
+	// Hooks run external executables at the extension points of every
+	// copy.
+	Hooks []HookConfig `json:"hooks,omitempty"`
+
+	// Alerts page through PagerDuty or Opsgenie when images keep failing
+	// in daemon mode.
+	Alerts []AlertConfig `json:"alerts,omitempty"`
+
+	// Audit records every registry mutation.
+	Audit *AuditConfig `json:"audit,omitempty"`
+
+	// Logging sends the log to files, syslog or journald as well.
+	Logging *LoggingConfig `json:"logging,omitempty"`
+
+	// Retry retries copies failing with a transient error.
+	Retry *RetryConfig `json:"retry,omitempty"`
+
+	// Rewrite maps the source paths of images without to_prefix or to_name
+	// to destination paths.
+	Rewrite []RewriteRule `json:"rewrite,omitempty"`
+
+	// Groups override settings for the images naming them in group.
+	Groups []GroupConfig `json:"groups,omitempty"`
+
+	// Pins write the digests pushed for images into YAML files.
+	Pins []PinConfig `json:"pins,omitempty"`
+
+	// Window restricts the daemon's copies to a time of day.
+	Window *WindowConfig `json:"window,omitempty"`
+
+	// WarmCache is the pull-through cache `dimco warm` pulls the images
+	// through.
+	WarmCache *AuthConfig `json:"warm_cache,omitempty"`
+
+	// VerifyAgainst checks the digests of from_repo, a mirror, against the
+	// upstream registry before copying.
+	VerifyAgainst *UpstreamConfig `json:"verify_against,omitempty"`
+
+	// Filter copies only images with the labels or annotations it asks for.
+	Filter *FilterConfig `json:"filter,omitempty"`
+	// Policy allows, denies or redirects every copy.
+	Policy *PolicyConfig `json:"policy,omitempty"`
+
+	// WorkDir holds the temporary workspace of every run, the system's
+	// temporary directory by default.
+	WorkDir string `json:"work_dir,omitempty"`
+	// DiskGuard keeps copies from filling the disk.
+	DiskGuard *DiskGuardConfig `json:"disk_guard,omitempty"`
+
+	// workspace is the temporary directory of the current run.
+	workspace string
+	// sources are the config files the config was loaded from.
+	sources []configSource
+	// hash identifies the loaded config, with its includes, in the audit
+	// log.
+	hash string
+}
+
+const defaultStagingSuffix = "-staging"
+
+func (c Config) stagingTag(tag string) string {
+	if c.StagingSuffix == "" {
+		return tag + defaultStagingSuffix
+	}
+
+	return tag + c.StagingSuffix
+}
+
+// SSHConfig configures the ssh client used for ssh:// engine hosts.
+type SSHConfig struct {
+	KnownHosts   string `json:"known_hosts,omitempty"`
+	IdentityFile string `json:"identity_file,omitempty"`
+}
+
+// ContainerdConfig describes how to reach containerd for the containerd backend.
+type ContainerdConfig struct {
+	Address   string `json:"address,omitempty"`
+	Namespace string `json:"namespace,omitempty"`
+}
+
+type AuthConfig struct {
+	BaseAddress   string `json:"base_address,omitempty"`
+	ServerAddress string `json:"server_address,omitempty"`
+	Username      string `json:"username,omitempty"`
+	Password      string `json:"password,omitempty"`
+	// PasswordFile is read instead of Password, e.g. a mounted secret.
+	PasswordFile string `json:"password_file,omitempty"`
+	Insecure     bool   `json:"insecure,omitempty"`
+
+	// Secret reads Username and Password from a Kubernetes Secret.
+	Secret *SecretRef `json:"secret,omitempty"`
+
+	RateLimit *RateLimit `json:"rate_limit,omitempty"`
+
+	// ChunkSize is the size of the chunks of blob uploads in registry mode,
+	// 64MiB by default. Smaller blobs are uploaded at once, and "0" turns
+	// chunked uploads off.
+	ChunkSize string `json:"chunk_size,omitempty"`
+
+	// UserAgent replaces dimco/<version> in the requests to the registry.
+	UserAgent string `json:"user_agent,omitempty"`
+	// Headers are added to every request to the registry, e.g. the API key
+	// of a gateway in front of it. Their values are redacted from the logs.
+	Headers map[string]string `json:"headers,omitempty"`
+}
+
+// ToEncodedString encodes the credentials of ac for X-Registry-Auth. Only
+// what the engine needs is sent, headers and other settings of dimco stay
+// out of requests to the engine.
+func (ac AuthConfig) ToEncodedString() string {
+	serverAddress := ac.ServerAddress
+	if serverAddress == "" {
+		serverAddress = registryHost(ac)
+	}
+	authConfigBytes, _ := json.Marshal(types.AuthConfig{Username: ac.Username, Password: ac.Password, ServerAddress: serverAddress})
+	authConfigEncoded := base64.URLEncoding.EncodeToString(authConfigBytes)
+	return authConfigEncoded
+}
+
+type ImageData struct {
+	Name string `json:"name,omitempty"`
+	Tag  string `json:"tag,omitempty"`
+	// Digest pins the source image; Tag is only applied at the destination.
+	// It can also be given as "name:tag@sha256:...".
+	Digest     string `json:"digest,omitempty"`
+	FromPrefix string `json:"from_prefix,omitempty"`
+	ToPrefix   string `json:"to_prefix,omitempty"`
+	// ToName replaces the name at the destination, the path below
+	// to_prefix. Rewrite rules set it.
+	ToName string `json:"to_name,omitempty"`
+
+	// Priority orders the run: images of a higher priority are copied
+	// before the others start.
+	Priority int `json:"priority,omitempty"`
+	// DependsOn names images, as name, name:tag or to_prefix+name, that must
+	// be copied before this one starts.
+	DependsOn []string `json:"depends_on,omitempty"`
+
+	// ExpiresAfter makes Quay delete the destination tag this long after
+	// the push.
+	ExpiresAfter Duration `json:"expires_after,omitempty"`
+
+	// Squash merges the layers into one before the push, see Config.Squash.
+	Squash bool `json:"squash,omitempty"`
+
+	Retention *RetentionPolicy `json:"retention,omitempty"`
+
+	// Group names one of the groups of the config, whose settings apply.
+	Group string `json:"group,omitempty"`
+
+	// AlsoTag are further destination tags pointed to the pushed manifest,
+	// e.g. moving aliases like stable.
+	AlsoTag []string `json:"also_tag,omitempty"`
+
+	// ArchTags tags the platforms of a multi-platform image as <tag>-<arch>,
+	// "also" next to the index, "only" in its place.
+	ArchTags string `json:"arch_tags,omitempty"`
+}
+
+// RetentionPolicy describes which tags of the destination repository
+// survive `dimco prune`. A tag is kept when any of the rules matches it.
+type RetentionPolicy struct {
+	KeepLast  int      `json:"keep_last,omitempty"`
+	KeepRegex string   `json:"keep_regex,omitempty"`
+	OlderThan Duration `json:"older_than,omitempty"`
+}
+
+// Duration is a time.Duration that can be read from JSON strings like
+// "90d", "2w" or anything accepted by time.ParseDuration.
+type Duration time.Duration
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("duration must be a string: %w", err)
+	}
+
+	v, err := parseDuration(s)
+	if err != nil {
+		return err
+	}
+
+	*d = Duration(v)
+	return nil
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func parseDuration(s string) (time.Duration, error) {
+	units := map[string]time.Duration{
+		"d": 24 * time.Hour,
+		"w": 7 * 24 * time.Hour,
+	}
+
+	for suffix, unit := range units {
+		if !strings.HasSuffix(s, suffix) {
+			continue
+		}
+
+		n, err := strconv.Atoi(strings.TrimSuffix(s, suffix))
+		if err != nil {
+			return 0, fmt.Errorf("invalid duration '%v': %w", s, err)
+		}
+
+		return time.Duration(n) * unit, nil
+	}
+
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid duration '%v': %w", s, err)
+	}
+
+	return v, nil
+}
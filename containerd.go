@@ -0,0 +1,575 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"runtime"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	containersapi "github.com/containerd/containerd/api/services/containers/v1"
+	contentapi "github.com/containerd/containerd/api/services/content/v1"
+	imagesapi "github.com/containerd/containerd/api/services/images/v1"
+	leasesapi "github.com/containerd/containerd/api/services/leases/v1"
+	tasksapi "github.com/containerd/containerd/api/services/tasks/v1"
+	"github.com/containerd/containerd/api/types"
+	"github.com/containerd/containerd/api/types/task"
+	"github.com/containerd/containerd/platforms"
+	godigest "github.com/opencontainers/go-digest"
+	specs "github.com/opencontainers/image-spec/specs-go/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	defaultContainerdAddress   = "/run/containerd/containerd.sock"
+	defaultContainerdNamespace = "default"
+
+	containerdChunkSize = 1 << 20
+
+	// containerdSourceLabel keeps the digest an image was pulled by, the
+	// index of a multi-platform image, on its image record.
+	containerdSourceLabel = "io.dimco.source-digest"
+)
+
+// containerdEngine runs the copy pipeline against containerd's image and
+// content services, without dockerd. Blobs are transferred between the
+// registries and the content store by dimco itself.
+type containerdEngine struct {
+	conn       *grpc.ClientConn
+	namespace  string
+	content    contentapi.ContentClient
+	images     imagesapi.ImagesClient
+	leases     leasesapi.LeasesClient
+	containers containersapi.ContainersClient
+	tasks      tasksapi.TasksClient
+
+	// nonDistributable stores and pushes foreign layers, which are otherwise
+	// left at their urls.
+	nonDistributable bool
+}
+
+func newContainerdEngine(cfg ContainerdConfig, nonDistributable bool) (*containerdEngine, error) {
+	address := cfg.Address
+	if address == "" {
+		address = defaultContainerdAddress
+	}
+
+	namespace := cfg.Namespace
+	if namespace == "" {
+		namespace = defaultContainerdNamespace
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	conn, err := grpc.DialContext(ctx, address,
+		grpc.WithInsecure(),
+		grpc.WithBlock(),
+		grpc.WithContextDialer(func(ctx context.Context, addr string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", addr)
+		}),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("can't connect to containerd at '%v': %w", address, err)
+	}
+
+	return &containerdEngine{
+		conn:       conn,
+		namespace:  namespace,
+		content:    contentapi.NewContentClient(conn),
+		images:     imagesapi.NewImagesClient(conn),
+		leases:     leasesapi.NewLeasesClient(conn),
+		containers: containersapi.NewContainersClient(conn),
+		tasks:      tasksapi.NewTasksClient(conn),
+
+		nonDistributable: nonDistributable,
+	}, nil
+}
+
+func (e *containerdEngine) Close() error {
+	return e.conn.Close()
+}
+
+func (e *containerdEngine) withNamespace(ctx context.Context) context.Context {
+	return metadata.AppendToOutgoingContext(ctx, "containerd-namespace", e.namespace)
+}
+
+// Pull fetches the manifest of the current platform with its config and
+// layers into the content store and creates the image record.
+func (e *containerdEngine) Pull(ctx context.Context, image string, ac AuthConfig) error {
+	ctx = e.withNamespace(ctx)
+
+	rc, repo, tag, err := registryForImage(image, ac)
+	if err != nil {
+		return err
+	}
+
+	// The lease keeps fetched blobs from being garbage collected until the
+	// image record references them.
+	lease, err := e.leases.Create(ctx, &leasesapi.CreateRequest{
+		ID: "dimco-" + strconv.FormatInt(time.Now().UnixNano(), 36),
+		Labels: map[string]string{
+			"containerd.io/gc.expire": time.Now().Add(time.Hour).Format(time.RFC3339),
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("can't create lease: %w", err)
+	}
+	defer func() {
+		if _, err := e.leases.Delete(ctx, &leasesapi.DeleteRequest{ID: lease.Lease.ID}); err != nil {
+			log.Print(fmt.Errorf("can't delete lease '%v': %w", lease.Lease.ID, err))
+		}
+	}()
+	ctx = metadata.AppendToOutgoingContext(ctx, "containerd-lease", lease.Lease.ID)
+
+	data, mediaType, digest, err := rc.GetManifest(ctx, repo, tag)
+	if err != nil {
+		return fmt.Errorf("can't get manifest: %w", err)
+	}
+
+	m := manifest{}
+	if err := json.Unmarshal(data, &m); err != nil {
+		return fmt.Errorf("can't decode manifest: %w", err)
+	}
+	if digest == "" {
+		digest = godigest.FromBytes(data).String()
+	}
+	source := digest
+
+	if len(m.Manifests) > 0 {
+		d, err := selectPlatform(m.Manifests, runtime.GOOS, runtime.GOARCH)
+		if err != nil {
+			return err
+		}
+
+		data, mediaType, digest, err = rc.GetManifest(ctx, repo, d.Digest)
+		if err != nil {
+			return fmt.Errorf("can't get platform manifest: %w", err)
+		}
+
+		m = manifest{}
+		if err := json.Unmarshal(data, &m); err != nil {
+			return fmt.Errorf("can't decode manifest: %w", err)
+		}
+	}
+
+	labels := map[string]string{
+		"containerd.io/gc.ref.content.config": m.Config.Digest,
+	}
+	for i, d := range append([]descriptor{m.Config}, m.Layers...) {
+		if isForeign(d) && !e.nonDistributable {
+			continue
+		}
+		if i > 0 {
+			labels[fmt.Sprintf("containerd.io/gc.ref.content.l.%d", i-1)] = d.Digest
+		}
+
+		if err := e.fetchBlob(ctx, rc, repo, d); err != nil {
+			return fmt.Errorf("can't fetch blob '%v': %w", d.Digest, err)
+		}
+	}
+
+	if digest == "" {
+		digest = godigest.FromBytes(data).String()
+	}
+
+	target := descriptor{MediaType: mediaType, Digest: digest, Size: int64(len(data))}
+	if err := e.writeContent(ctx, target, bytes.NewReader(data), labels); err != nil {
+		return fmt.Errorf("can't store manifest: %w", err)
+	}
+
+	infof("pulled %v (%v)", image, digest)
+
+	return e.setImage(ctx, image, target, map[string]string{containerdSourceLabel: source})
+}
+
+func (e *containerdEngine) fetchBlob(ctx context.Context, rc *registryClient, repo string, d descriptor) error {
+	if e.hasContent(ctx, d.Digest) {
+		return nil
+	}
+
+	body, err := openLayer(ctx, rc, repo, d)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	return e.writeContent(ctx, d, body, nil)
+}
+
+func (e *containerdEngine) hasContent(ctx context.Context, digest string) bool {
+	_, err := e.content.Info(ctx, &contentapi.InfoRequest{Digest: godigest.Digest(digest)})
+	return err == nil
+}
+
+// contentWrites numbers the writes of this process to the content store.
+var contentWrites int64
+
+// writeContent streams r into the content store and commits it under the
+// expected digest of d. Every write has its own ref: copies sharing a base
+// layer write it side by side, the first commit wins, and containerd would
+// refuse a second writer of the same ref.
+func (e *containerdEngine) writeContent(ctx context.Context, d descriptor, r io.Reader, labels map[string]string) (err error) {
+	ref := fmt.Sprintf("dimco-%v-%v-%v", d.Digest, os.Getpid(), atomic.AddInt64(&contentWrites, 1))
+	defer func() {
+		// An unfinished write would stay in the ingest directory.
+		if err != nil {
+			e.content.Abort(ctx, &contentapi.AbortRequest{Ref: ref})
+		}
+	}()
+
+	stream, err := e.content.Write(ctx)
+	if err != nil {
+		return fmt.Errorf("can't open writer: %w", err)
+	}
+
+	send := func(req *contentapi.WriteContentRequest) error {
+		if err := stream.Send(req); err != nil {
+			return err
+		}
+
+		_, err := stream.Recv()
+		return err
+	}
+
+	expected := godigest.Digest(d.Digest)
+
+	buf := make([]byte, containerdChunkSize)
+	offset := int64(0)
+	for {
+		n, readErr := r.Read(buf)
+		if n > 0 {
+			err := send(&contentapi.WriteContentRequest{
+				Action:   contentapi.WriteActionWrite,
+				Ref:      ref,
+				Total:    d.Size,
+				Expected: expected,
+				Offset:   offset,
+				Data:     buf[:n],
+			})
+			if status.Code(err) == codes.AlreadyExists {
+				return nil
+			}
+			if err != nil {
+				return fmt.Errorf("can't write content: %w", err)
+			}
+
+			offset += int64(n)
+			progressFrom(ctx).update(d.Digest, offset, d.Size)
+		}
+
+		if readErr == io.EOF {
+			break
+		}
+		if readErr != nil {
+			return fmt.Errorf("can't read content: %w", readErr)
+		}
+	}
+
+	err = send(&contentapi.WriteContentRequest{
+		Action:   contentapi.WriteActionCommit,
+		Ref:      ref,
+		Total:    offset,
+		Expected: expected,
+		Offset:   offset,
+		Labels:   labels,
+	})
+	if err != nil && status.Code(err) != codes.AlreadyExists {
+		return fmt.Errorf("can't commit content: %w", err)
+	}
+
+	return stream.CloseSend()
+}
+
+func (e *containerdEngine) setImage(ctx context.Context, name string, target descriptor, labels map[string]string) error {
+	img := imagesapi.Image{
+		Name:   name,
+		Labels: labels,
+		Target: types.Descriptor{
+			MediaType: target.MediaType,
+			Digest:    godigest.Digest(target.Digest),
+			Size_:     target.Size,
+		},
+	}
+
+	_, err := e.images.Create(ctx, &imagesapi.CreateImageRequest{Image: img})
+	if status.Code(err) == codes.AlreadyExists {
+		_, err = e.images.Update(ctx, &imagesapi.UpdateImageRequest{Image: img})
+	}
+	if err != nil {
+		return fmt.Errorf("can't save image '%v': %w", name, err)
+	}
+
+	return nil
+}
+
+func (e *containerdEngine) getImage(ctx context.Context, name string) (descriptor, error) {
+	resp, err := e.images.Get(ctx, &imagesapi.GetImageRequest{Name: name})
+	if err != nil {
+		return descriptor{}, fmt.Errorf("can't get image '%v': %w", name, err)
+	}
+
+	t := resp.Image.Target
+	return descriptor{MediaType: t.MediaType, Digest: t.Digest.String(), Size: t.Size_}, nil
+}
+
+func (e *containerdEngine) Tag(ctx context.Context, fromImg, toImg string) error {
+	ctx = e.withNamespace(ctx)
+
+	target, err := e.getImage(ctx, fromImg)
+	if err != nil {
+		return err
+	}
+
+	return e.setImage(ctx, toImg, target, nil)
+}
+
+// Push uploads the blobs missing at the destination and then the manifest.
+func (e *containerdEngine) Push(ctx context.Context, image string, ac AuthConfig) error {
+	ctx = e.withNamespace(ctx)
+
+	rc, repo, tag, err := registryForImage(image, ac)
+	if err != nil {
+		return err
+	}
+
+	target, err := e.getImage(ctx, image)
+	if err != nil {
+		return err
+	}
+
+	data, err := e.readContent(ctx, target.Digest)
+	if err != nil {
+		return fmt.Errorf("can't read manifest: %w", err)
+	}
+
+	m := manifest{}
+	if err := json.Unmarshal(data, &m); err != nil {
+		return fmt.Errorf("can't decode manifest: %w", err)
+	}
+
+	for _, d := range append([]descriptor{m.Config}, m.Layers...) {
+		if isForeign(d) && !e.nonDistributable {
+			continue
+		}
+
+		exists, err := rc.BlobExists(ctx, repo, d.Digest)
+		if err != nil {
+			return fmt.Errorf("can't check blob '%v': %w", d.Digest, err)
+		}
+		if exists {
+			progressFrom(ctx).skip(d.Digest, d.Size)
+			continue
+		}
+
+		r := &progressReader{ReadCloser: e.contentReader(ctx, d.Digest), p: progressFrom(ctx), id: d.Digest, total: d.Size}
+		if err := rc.UploadBlob(ctx, repo, d.Digest, d.Size, r); err != nil {
+			return fmt.Errorf("can't push blob '%v': %w", d.Digest, err)
+		}
+	}
+
+	digest := target.Digest
+	if e.nonDistributable {
+		var changed bool
+		if data, changed, err = distributableManifest(data, m); err != nil {
+			return err
+		}
+		if changed {
+			digest = godigest.FromBytes(data).String()
+		}
+	}
+
+	if err := rc.PutManifest(ctx, repo, tag, target.MediaType, data); err != nil {
+		return fmt.Errorf("can't push manifest: %w", err)
+	}
+
+	infof("pushed %v (%v)", image, digest)
+
+	return nil
+}
+
+func (e *containerdEngine) readContent(ctx context.Context, digest string) ([]byte, error) {
+	r := e.contentReader(ctx, digest)
+	defer r.Close()
+
+	return ioutil.ReadAll(r)
+}
+
+// contentReader streams a blob out of the content store.
+func (e *containerdEngine) contentReader(ctx context.Context, digest string) io.ReadCloser {
+	pr, pw := io.Pipe()
+
+	go func() {
+		stream, err := e.content.Read(ctx, &contentapi.ReadContentRequest{Digest: godigest.Digest(digest)})
+		if err != nil {
+			pw.CloseWithError(fmt.Errorf("can't read content: %w", err))
+			return
+		}
+
+		for {
+			resp, err := stream.Recv()
+			if err == io.EOF {
+				pw.Close()
+				return
+			}
+			if err != nil {
+				pw.CloseWithError(fmt.Errorf("can't read content: %w", err))
+				return
+			}
+
+			if _, err := pw.Write(resp.Data); err != nil {
+				return
+			}
+		}
+	}()
+
+	return pr
+}
+
+func (e *containerdEngine) Remove(ctx context.Context, image string) error {
+	ctx = e.withNamespace(ctx)
+
+	if _, err := e.images.Delete(ctx, &imagesapi.DeleteImageRequest{Name: image, Sync: true}); err != nil {
+		return fmt.Errorf("can't delete image: %w", err)
+	}
+
+	debugf("delete images: %v", image)
+
+	return nil
+}
+
+// HasDigest reports whether the image record of image targets digest or was
+// pulled by it, as the index of the platform it targets.
+func (e *containerdEngine) HasDigest(ctx context.Context, image, digest string) (bool, error) {
+	resp, err := e.images.Get(e.withNamespace(ctx), &imagesapi.GetImageRequest{Name: image})
+	if status.Code(err) == codes.NotFound {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("can't get image '%v': %w", image, err)
+	}
+
+	return resp.Image.Target.Digest.String() == digest || resp.Image.Labels[containerdSourceLabel] == digest, nil
+}
+
+// InUse reports whether a container created from image has a running task.
+func (e *containerdEngine) InUse(ctx context.Context, image string) (bool, error) {
+	ctx = e.withNamespace(ctx)
+
+	containers, err := e.containers.List(ctx, &containersapi.ListContainersRequest{Filters: []string{"image==" + image}})
+	if err != nil {
+		return false, fmt.Errorf("can't list containers: %w", err)
+	}
+	if len(containers.Containers) == 0 {
+		return false, nil
+	}
+
+	tasks, err := e.tasks.List(ctx, &tasksapi.ListTasksRequest{})
+	if err != nil {
+		return false, fmt.Errorf("can't list tasks: %w", err)
+	}
+
+	running := map[string]bool{}
+	for _, t := range tasks.Tasks {
+		if t.Status == task.StatusRunning {
+			running[t.ContainerID] = true
+		}
+	}
+	for _, c := range containers.Containers {
+		if running[c.ID] {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+func (e *containerdEngine) ImageID(ctx context.Context, image string) (string, error) {
+	ctx = e.withNamespace(ctx)
+
+	target, err := e.getImage(ctx, image)
+	if err != nil {
+		return "", err
+	}
+
+	data, err := e.readContent(ctx, target.Digest)
+	if err != nil {
+		return "", fmt.Errorf("can't read manifest: %w", err)
+	}
+
+	m := manifest{}
+	if err := json.Unmarshal(data, &m); err != nil {
+		return "", fmt.Errorf("can't decode manifest: %w", err)
+	}
+
+	return m.Config.Digest, nil
+}
+
+// Layers returns the config and layer digests of the manifest of image.
+func (e *containerdEngine) Layers(ctx context.Context, image string) ([]string, error) {
+	ctx = e.withNamespace(ctx)
+
+	target, err := e.getImage(ctx, image)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := e.readContent(ctx, target.Digest)
+	if err != nil {
+		return nil, fmt.Errorf("can't read manifest: %w", err)
+	}
+
+	m := manifest{}
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, fmt.Errorf("can't decode manifest: %w", err)
+	}
+
+	layers := []string{m.Config.Digest}
+	for _, d := range m.Layers {
+		layers = append(layers, d.Digest)
+	}
+	return layers, nil
+}
+
+// selectPlatform picks the manifest for os/arch from an index. The variant
+// is the host's for its own architecture, e.g. v7 on an arm/v7 host, which
+// runs v6 and v5 too but prefers its own; armv6 hosts never get v7.
+func selectPlatform(manifests []descriptor, os, arch string) (descriptor, error) {
+	want := platforms.DefaultSpec()
+	if want.Architecture != arch {
+		want.Variant = ""
+	}
+	want.OS, want.Architecture = os, arch
+	match := platforms.Only(want)
+
+	found := false
+	var best descriptor
+	for _, d := range manifests {
+		if d.Platform == nil {
+			continue
+		}
+		p := specs.Platform{OS: d.Platform.OS, Architecture: d.Platform.Architecture, Variant: d.Platform.Variant}
+		if !match.Match(p) {
+			continue
+		}
+		if !found || match.Less(p, specs.Platform{OS: best.Platform.OS, Architecture: best.Platform.Architecture, Variant: best.Platform.Variant}) {
+			best, found = d, true
+		}
+	}
+	if !found {
+		return descriptor{}, fmt.Errorf("image has no manifest for %v", platforms.Format(want))
+	}
+
+	return best, nil
+}
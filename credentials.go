@@ -0,0 +1,463 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// CredentialProvider supplies the credentials for a registry host.
+type CredentialProvider interface {
+	Credentials(ctx context.Context, host string) (username, password string, err error)
+}
+
+// Credential provider names used in the config.
+const (
+	providerStatic       = "static"
+	providerEnv          = "env"
+	providerDockerConfig = "docker-config"
+	providerHelper       = "helper"
+	providerECR          = "ecr"
+	providerGCP          = "gcp"
+	providerACR          = "acr"
+	providerVault        = "vault"
+	providerOIDC         = "oidc"
+)
+
+// CredentialConfig selects and configures the provider of a registry host.
+// Only the fields of the chosen provider are used.
+type CredentialConfig struct {
+	Provider string `json:"provider"`
+
+	// static
+	Username string `json:"username,omitempty"`
+	Password string `json:"password,omitempty"`
+
+	// env
+	UsernameEnv string `json:"username_env,omitempty"`
+	PasswordEnv string `json:"password_env,omitempty"`
+
+	// docker-config, defaults to $DOCKER_CONFIG/config.json or ~/.docker/config.json.
+	ConfigFile string `json:"config_file,omitempty"`
+
+	// helper runs docker-credential-<helper>.
+	Helper string `json:"helper,omitempty"`
+
+	// vault reads username and password from a KV secret at path, using
+	// VAULT_ADDR and VAULT_TOKEN.
+	Path string `json:"path,omitempty"`
+
+	// oidc exchanges an ID token of the CI platform for registry credentials.
+	OIDC *OIDCConfig `json:"oidc,omitempty"`
+}
+
+func (cc CredentialConfig) provider() (CredentialProvider, error) {
+	switch cc.Provider {
+	case providerStatic:
+		return staticProvider{cc.Username, cc.Password}, nil
+	case providerEnv:
+		if cc.UsernameEnv == "" || cc.PasswordEnv == "" {
+			return nil, fmt.Errorf("username_env and password_env are required")
+		}
+		return envProvider{cc.UsernameEnv, cc.PasswordEnv}, nil
+	case providerDockerConfig:
+		return dockerConfigProvider{cc.ConfigFile}, nil
+	case providerHelper:
+		if cc.Helper == "" {
+			return nil, fmt.Errorf("helper is required")
+		}
+		return helperProvider{cc.Helper}, nil
+	case providerECR:
+		return ecrProvider{}, nil
+	case providerGCP:
+		return gcpProvider{}, nil
+	case providerACR:
+		return acrProvider{}, nil
+	case providerVault:
+		if cc.Path == "" {
+			return nil, fmt.Errorf("path is required")
+		}
+		return vaultProvider{cc.Path}, nil
+	case providerOIDC:
+		if cc.OIDC == nil {
+			return nil, fmt.Errorf("oidc is required")
+		}
+		if err := cc.OIDC.validate(); err != nil {
+			return nil, err
+		}
+		return oidcProvider{*cc.OIDC}, nil
+	default:
+		return nil, fmt.Errorf("unknown credential provider '%v'", cc.Provider)
+	}
+}
+
+// credentialConfigFor returns the entry of the credentials mapping for host.
+// Exact host names win over glob patterns like *.dkr.ecr.*.amazonaws.com.
+func (c Config) credentialConfigFor(host string) (CredentialConfig, bool) {
+	if cc, ok := c.Credentials[host]; ok {
+		return cc, true
+	}
+
+	patterns := make([]string, 0, len(c.Credentials))
+	for p := range c.Credentials {
+		patterns = append(patterns, p)
+	}
+	sort.Strings(patterns)
+
+	for _, p := range patterns {
+		if ok, _ := path.Match(p, host); ok {
+			return c.Credentials[p], true
+		}
+	}
+
+	return CredentialConfig{}, false
+}
+
+// resolveCredentials asks the mapped provider for the credentials of both
+// registries. Registries without a mapping keep the credentials of their
+// auth config, read from password_file or asked for with -prompt-auth.
+// Cloud tokens expire and files get rotated, so the daemon resolves them
+// again for every run.
+func (c *Config) resolveCredentials(ctx context.Context) error {
+	for _, ac := range c.registries() {
+		host, _ := splitBaseAddress(ac.BaseAddress)
+		cc, ok := c.credentialConfigFor(host)
+		if !ok {
+			if err := ac.readPasswordFile(); err != nil {
+				return err
+			}
+			if err := ac.promptCredentials(); err != nil {
+				return err
+			}
+			continue
+		}
+
+		p, err := cc.provider()
+		if err != nil {
+			return fmt.Errorf("credentials of %v: %w", host, err)
+		}
+
+		username, password, err := p.Credentials(ctx, host)
+		if err != nil {
+			return fmt.Errorf("can't get credentials of %v from %v: %w", host, cc.Provider, err)
+		}
+
+		ac.Username, ac.Password = username, password
+	}
+
+	for _, ac := range c.registries() {
+		registerCredentials(*ac)
+	}
+
+	return nil
+}
+
+type staticProvider struct {
+	username, password string
+}
+
+func (p staticProvider) Credentials(ctx context.Context, host string) (string, string, error) {
+	return p.username, p.password, nil
+}
+
+type envProvider struct {
+	usernameEnv, passwordEnv string
+}
+
+func (p envProvider) Credentials(ctx context.Context, host string) (string, string, error) {
+	password, ok := os.LookupEnv(p.passwordEnv)
+	if !ok {
+		return "", "", fmt.Errorf("%v is not set", p.passwordEnv)
+	}
+
+	return os.Getenv(p.usernameEnv), password, nil
+}
+
+// dockerConfigProvider reads a docker CLI config file, following its
+// credHelpers and credsStore like `docker login` does.
+type dockerConfigProvider struct {
+	file string
+}
+
+func (p dockerConfigProvider) Credentials(ctx context.Context, host string) (string, string, error) {
+	file := p.file
+	if file == "" {
+		dir := os.Getenv("DOCKER_CONFIG")
+		if dir == "" {
+			home, err := os.UserHomeDir()
+			if err != nil {
+				return "", "", fmt.Errorf("can't find docker config: %w", err)
+			}
+			dir = filepath.Join(home, ".docker")
+		}
+		file = filepath.Join(dir, "config.json")
+	}
+
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return "", "", fmt.Errorf("can't read docker config: %w", err)
+	}
+
+	cfg := struct {
+		CredHelpers map[string]string `json:"credHelpers"`
+		CredsStore  string            `json:"credsStore"`
+	}{}
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return "", "", fmt.Errorf("can't decode docker config: %w", err)
+	}
+
+	if helper, ok := cfg.CredHelpers[host]; ok {
+		return helperProvider{helper}.Credentials(ctx, host)
+	}
+
+	ac := AuthConfig{BaseAddress: host}
+	err = ac.applyDockerConfig(data)
+	if err == nil {
+		return ac.Username, ac.Password, nil
+	}
+
+	if cfg.CredsStore != "" {
+		return helperProvider{cfg.CredsStore}.Credentials(ctx, host)
+	}
+
+	return "", "", err
+}
+
+// helperProvider runs a docker credential helper.
+type helperProvider struct {
+	helper string
+}
+
+func (p helperProvider) Credentials(ctx context.Context, host string) (string, string, error) {
+	name := "docker-credential-" + p.helper
+
+	cmd := exec.CommandContext(ctx, name, "get")
+	cmd.Stdin = strings.NewReader(host)
+	out, err := cmd.Output()
+	if err != nil {
+		return "", "", fmt.Errorf("can't run %v: %w", name, err)
+	}
+
+	creds := struct {
+		Username string `json:"Username"`
+		Secret   string `json:"Secret"`
+	}{}
+	if err := json.Unmarshal(out, &creds); err != nil {
+		return "", "", fmt.Errorf("can't decode output of %v: %w", name, err)
+	}
+
+	return creds.Username, creds.Secret, nil
+}
+
+// ecrProvider fetches an authorization token for Amazon ECR with the AWS
+// credentials from the environment.
+type ecrProvider struct{}
+
+func (ecrProvider) Credentials(ctx context.Context, host string) (string, string, error) {
+	creds, err := awsCredentialsFromEnv()
+	if err != nil {
+		return "", "", err
+	}
+
+	return ecrToken(ctx, host, creds)
+}
+
+// ecrToken requests a registry token for an ECR host, which is
+// <account>.dkr.ecr.<region>.amazonaws.com.
+func ecrToken(ctx context.Context, host string, creds awsCredentials) (string, string, error) {
+	parts := strings.Split(host, ".")
+	if len(parts) < 6 || parts[1] != "dkr" || parts[2] != "ecr" {
+		return "", "", fmt.Errorf("'%v' is not an ECR registry", host)
+	}
+	region := parts[3]
+
+	body := []byte("{}")
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, "https://api.ecr."+region+".amazonaws.com/", bytes.NewReader(body))
+	if err != nil {
+		return "", "", fmt.Errorf("can't create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/x-amz-json-1.1")
+	req.Header.Set("X-Amz-Target", "AmazonEC2ContainerRegistry_V20150921.GetAuthorizationToken")
+
+	if err := signAWS(req, creds, "ecr", region, body, time.Now().UTC()); err != nil {
+		return "", "", err
+	}
+
+	out := struct {
+		AuthorizationData []struct {
+			AuthorizationToken string `json:"authorizationToken"`
+		} `json:"authorizationData"`
+	}{}
+	if err := doJSON(req, &out); err != nil {
+		return "", "", err
+	}
+
+	if len(out.AuthorizationData) == 0 {
+		return "", "", fmt.Errorf("ECR returned no authorization data")
+	}
+
+	return splitBasicToken(out.AuthorizationData[0].AuthorizationToken)
+}
+
+// gcpProvider uses the access token of the service account attached to the
+// GCE instance or GKE workload, as accepted by Artifact Registry and GCR.
+type gcpProvider struct{}
+
+func (gcpProvider) Credentials(ctx context.Context, host string) (string, string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet,
+		"http://metadata.google.internal/computeMetadata/v1/instance/service-accounts/default/token", nil)
+	if err != nil {
+		return "", "", fmt.Errorf("can't create request: %w", err)
+	}
+	req.Header.Set("Metadata-Flavor", "Google")
+
+	out := struct {
+		AccessToken string `json:"access_token"`
+	}{}
+	if err := doJSON(req, &out); err != nil {
+		return "", "", err
+	}
+
+	return "oauth2accesstoken", out.AccessToken, nil
+}
+
+// acrProvider exchanges the managed identity token of the Azure VM or pod
+// for an Azure Container Registry refresh token.
+type acrProvider struct{}
+
+func (acrProvider) Credentials(ctx context.Context, host string) (string, string, error) {
+	q := url.Values{"api-version": {"2018-02-01"}, "resource": {"https://management.azure.com/"}}
+	if id := os.Getenv("AZURE_CLIENT_ID"); id != "" {
+		q.Set("client_id", id)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet,
+		"http://169.254.169.254/metadata/identity/oauth2/token?"+q.Encode(), nil)
+	if err != nil {
+		return "", "", fmt.Errorf("can't create request: %w", err)
+	}
+	req.Header.Set("Metadata", "true")
+
+	identity := struct {
+		AccessToken string `json:"access_token"`
+	}{}
+	if err := doJSON(req, &identity); err != nil {
+		return "", "", err
+	}
+
+	return acrRefreshToken(ctx, host, identity.AccessToken)
+}
+
+// acrRefreshToken exchanges an Azure AD access token for ACR credentials.
+func acrRefreshToken(ctx context.Context, host, accessToken string) (string, string, error) {
+	form := url.Values{
+		"grant_type":   {"access_token"},
+		"service":      {host},
+		"access_token": {accessToken},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, "https://"+host+"/oauth2/exchange", strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", "", fmt.Errorf("can't create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	exchange := struct {
+		RefreshToken string `json:"refresh_token"`
+	}{}
+	if err := doJSON(req, &exchange); err != nil {
+		return "", "", err
+	}
+
+	// ACR expects this user name with a refresh token as password.
+	return "00000000-0000-0000-0000-000000000000", exchange.RefreshToken, nil
+}
+
+// vaultProvider reads the username and password fields of a KV secret from
+// HashiCorp Vault, supporting both KV versions.
+type vaultProvider struct {
+	path string
+}
+
+func (p vaultProvider) Credentials(ctx context.Context, host string) (string, string, error) {
+	addr, token := os.Getenv("VAULT_ADDR"), os.Getenv("VAULT_TOKEN")
+	if addr == "" || token == "" {
+		return "", "", fmt.Errorf("VAULT_ADDR and VAULT_TOKEN are required")
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimRight(addr, "/")+"/v1/"+strings.TrimLeft(p.path, "/"), nil)
+	if err != nil {
+		return "", "", fmt.Errorf("can't create request: %w", err)
+	}
+	req.Header.Set("X-Vault-Token", token)
+
+	out := struct {
+		Data map[string]json.RawMessage `json:"data"`
+	}{}
+	if err := doJSON(req, &out); err != nil {
+		return "", "", err
+	}
+
+	fields := out.Data
+	// KV version 2 nests the secret under data.data.
+	if nested, ok := out.Data["data"]; ok {
+		fields = map[string]json.RawMessage{}
+		if err := json.Unmarshal(nested, &fields); err != nil {
+			return "", "", fmt.Errorf("can't decode secret: %w", err)
+		}
+	}
+
+	var username, password string
+	json.Unmarshal(fields["username"], &username)
+	if err := json.Unmarshal(fields["password"], &password); err != nil {
+		return "", "", fmt.Errorf("secret %v has no password field", p.path)
+	}
+
+	return username, password, nil
+}
+
+// doJSON sends a request and decodes the JSON response.
+func doJSON(req *http.Request, out interface{}) error {
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("can't send request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("%v %v: unexpected status %v: %v", req.Method, req.URL.Host, resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("can't decode response: %w", err)
+	}
+
+	return nil
+}
+
+// splitBasicToken splits a base64 encoded user:password pair.
+func splitBasicToken(token string) (string, string, error) {
+	decoded, err := base64.StdEncoding.DecodeString(token)
+	if err != nil {
+		return "", "", fmt.Errorf("invalid token: %w", err)
+	}
+
+	parts := strings.SplitN(string(decoded), ":", 2)
+	if len(parts) != 2 {
+		return "", "", fmt.Errorf("invalid token")
+	}
+
+	return parts[0], parts[1], nil
+}
@@ -0,0 +1,437 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+func newDaemonCommand() *command {
+	fs := flag.NewFlagSet("daemon", flag.ExitOnError)
+	configPath := fs.String("f", "config.json", "config file path")
+	listen := fs.String("listen", ":8080", "address of the health endpoints")
+	interval := fs.Duration("interval", time.Hour, "time between sync runs")
+	sla := fs.Duration("sla", 0, "maximum age of the last successful sync for readiness (default 2 * interval)")
+	maxRun := fs.Duration("max-run", 6*time.Hour, "maximum duration of a sync run before the daemon is considered wedged")
+	watch := fs.Duration("watch", 10*time.Second, "how often to check the config file for changes, 0 disables it (SIGHUP always reloads)")
+	ui := fs.Bool("ui", true, "serve the status page at / of the listen address")
+	quarantineAfter := fs.Int("quarantine-after", 3, "consecutive failed copies after which an image is backed off, 0 disables it")
+	maxBackoff := fs.Duration("max-backoff", 24*time.Hour, "maximum time between copies of a quarantined image")
+	tenantsPath := fs.String("tenants", "", "serve the tenants of this file, each with its own config, instead of -f")
+	tokenFile := fs.String("token-file", "", "file of API tokens, one per line, of which POST /sync requires one")
+	opts := bindSyncOptions(fs)
+
+	return &command{
+		name:  "daemon",
+		usage: "sync periodically and serve /healthz, /readyz and a status page",
+		flags: fs,
+		run: func(ctx context.Context) error {
+			newDaemon := func(c Config) *daemon {
+				d := &daemon{
+					config:   c,
+					wakeup:   make(chan struct{}, 1),
+					opts:     *opts,
+					interval: *interval,
+					sla:      *sla,
+					maxRun:   *maxRun,
+					started:  time.Now(),
+					ui:       *ui,
+					images:   map[string]imageStatus{},
+					alerts:   map[string]alertState{},
+
+					quarantineAfter: *quarantineAfter,
+					maxBackoff:      *maxBackoff,
+					backoff:         map[string]backoffState{},
+
+					scheduled: map[string]time.Time{},
+					queued:    map[string]bool{},
+				}
+				d.opts.Digests = d.ui
+				if d.sla == 0 {
+					d.sla = 2 * d.interval
+				}
+				return d
+			}
+
+			if *tenantsPath != "" {
+				return runTenants(ctx, *tenantsPath, *listen, *watch, newDaemon)
+			}
+
+			c, err := loadConfig(*configPath)
+			if err != nil {
+				return err
+			}
+			if err := c.startLogging(); err != nil {
+				return err
+			}
+
+			d := newDaemon(c)
+			if *tokenFile != "" {
+				tc := TenantConfig{Name: "daemon", TokenFile: *tokenFile}
+				tokens, err := tc.tokens()
+				if err != nil {
+					return err
+				}
+				d.syncAuth = &tenantScope{config: tc, tokens: tokens}
+			}
+			go d.watchConfig(ctx, *configPath, *watch)
+
+			return d.run(ctx, *listen)
+		},
+	}
+}
+
+// daemon runs sync on an interval and reports its state over HTTP.
+type daemon struct {
+	opts     syncOptions
+	interval time.Duration
+	sla      time.Duration
+	maxRun   time.Duration
+	started  time.Time
+	ui       bool
+	// quarantineAfter and maxBackoff configure the backoff of images that
+	// keep failing.
+	quarantineAfter int
+	maxBackoff      time.Duration
+	// wakeup starts a sync run before the next tick.
+	wakeup chan struct{}
+	// tenant is set for the daemon of a tenant, base is then the path its
+	// endpoints are served under.
+	tenant *tenantScope
+	base   string
+	// syncAuth checks the token of POST /sync, nil without -token-file.
+	// Tenants check theirs on every endpoint.
+	syncAuth *tenantScope
+
+	mu          sync.Mutex
+	config      Config
+	running     bool
+	runStarted  time.Time
+	lastRun     time.Time
+	lastSuccess time.Time
+	lastErr     error
+	// images and failures hold the results of past runs for the status page.
+	images   map[string]imageStatus
+	failures []failure
+	// alerts holds the state of every alert group by name.
+	alerts map[string]alertState
+	// scheduled holds the start of the last run of every schedule, by
+	// group name and "" for the daemon's.
+	scheduled map[string]time.Time
+	// queued holds the destinations of images that were due outside their
+	// transfer window, discoverQueued a discovery that was.
+	queued         map[string]bool
+	discoverQueued bool
+	// backoff holds the consecutive failures of images by destination.
+	backoff map[string]backoffState
+}
+
+func (d *daemon) run(ctx context.Context, listen string) error {
+	served, err := serve(ctx, listen, d.handler())
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		d.loop(ctx)
+	}()
+
+	return untilServeFails(served, done, cancel)
+}
+
+// handler serves the health endpoints and the status page of d.
+func (d *daemon) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", d.handleHealthz)
+	mux.HandleFunc("/readyz", d.handleReadyz)
+	if d.ui {
+		var status, syncNow http.Handler = http.HandlerFunc(d.handleStatus), http.HandlerFunc(d.handleSyncNow)
+		if d.syncAuth != nil {
+			status, syncNow = d.syncAuth.withAuth(status), d.syncAuth.withAuth(syncNow)
+		}
+		mux.Handle("/", status)
+		mux.Handle("/sync", syncNow)
+	}
+	return mux
+}
+
+// serve serves h at listen until ctx is done. The address is bound before
+// serve returns, so a port in use fails the daemon at start instead of
+// leaving it running without health endpoints. Later errors of the server
+// are sent on the returned channel.
+func serve(ctx context.Context, listen string, h http.Handler) (<-chan error, error) {
+	l, err := net.Listen("tcp", listen)
+	if err != nil {
+		return nil, fmt.Errorf("can't listen on %v: %w", listen, err)
+	}
+
+	srv := &http.Server{Handler: h}
+	go func() {
+		<-ctx.Done()
+
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		srv.Shutdown(shutdownCtx)
+	}()
+
+	served := make(chan error, 1)
+	go func() {
+		if err := srv.Serve(l); err != nil && err != http.ErrServerClosed {
+			served <- fmt.Errorf("can't serve health endpoints: %w", err)
+		}
+	}()
+
+	return served, nil
+}
+
+// untilServeFails waits for the syncs to be done, or for the server to fail,
+// which cancels them and is returned.
+func untilServeFails(served <-chan error, done <-chan struct{}, cancel func()) error {
+	select {
+	case err := <-served:
+		cancel()
+		<-done
+		return err
+	case <-done:
+		return nil
+	}
+}
+
+// loop runs the syncs of d until ctx is done.
+func (d *daemon) loop(ctx context.Context) {
+	go d.watchAlerts(ctx)
+
+	all := true
+	for {
+		d.syncOnce(ctx, all)
+
+		timer := time.NewTimer(d.untilDue())
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+			all = false
+		case <-d.wakeup:
+			timer.Stop()
+			all = true
+		}
+	}
+}
+
+// untilDue is the time until the next schedule, the daemon's or that of a
+// group with its own interval, is due.
+func (d *daemon) untilDue() time.Duration {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	next := d.interval
+	for key, iv := range d.config.schedules(d.interval) {
+		if wait := time.Until(d.scheduled[key].Add(iv)); wait < next {
+			next = wait
+		}
+	}
+
+	// Queued images start when their window opens.
+	now := time.Now()
+	for _, img := range d.config.Images {
+		if d.queued[img.destinationKey()] {
+			if wait := d.config.window(img).untilOpen(now); wait < next {
+				next = wait
+			}
+		}
+	}
+	if d.discoverQueued {
+		if wait := d.config.Window.untilOpen(now); wait < next {
+			next = wait
+		}
+	}
+	if next < 0 {
+		next = 0
+	}
+	return next
+}
+
+// trigger requests a sync run as soon as the current one, if any, finishes.
+func (d *daemon) trigger() {
+	select {
+	case d.wakeup <- struct{}{}:
+	default:
+	}
+}
+
+// runnable returns c with the images of the due schedules and those queued
+// before, that are in their transfer window at now. The others are queued
+// until their window opens. Quarantined images wait for their backoff unless
+// all is set. It reports false when nothing is left to run. d.mu must be
+// held.
+func (d *daemon) runnable(c Config, due map[string]bool, now time.Time, all bool) (Config, bool) {
+	images := []ImageData{}
+	queued := map[string]bool{}
+	for _, img := range c.Images {
+		key := img.destinationKey()
+		if !due[c.schedule(img)] && !d.queued[key] {
+			continue
+		}
+		if !all && d.backedOff(c, img, now) {
+			continue
+		}
+
+		if c.window(img).untilOpen(now) > 0 {
+			if !d.queued[key] {
+				infof("%v is outside its transfer window, queued", key)
+			}
+			queued[key] = true
+			continue
+		}
+		images = append(images, img)
+	}
+	d.queued = queued
+
+	// Discovered images follow the daemon's schedule and the window of the
+	// config.
+	discover := due[""] || d.discoverQueued
+	if discover && c.Window.untilOpen(now) > 0 {
+		d.discoverQueued, discover = true, false
+	} else if discover {
+		d.discoverQueued = false
+	}
+
+	c = c.withImages(images)
+	if !discover {
+		c.Discover = nil
+	}
+	return c, len(c.Images) > 0 || len(c.Discover) > 0
+}
+
+// syncOnce runs the due schedules, or all of them.
+func (d *daemon) syncOnce(ctx context.Context, all bool) {
+	if d.tenant != nil {
+		d.mu.Lock()
+		backend := d.config.Backend
+		d.mu.Unlock()
+		defer d.tenant.turns.take(backend)()
+	}
+
+	d.mu.Lock()
+	c := d.config
+	now := time.Now()
+	due := c.dueSchedules(d.interval, d.scheduled, now)
+	if all {
+		for key := range c.schedules(d.interval) {
+			due[key] = true
+		}
+	}
+	if len(due) == 0 && len(d.queued) == 0 && !d.discoverQueued {
+		d.mu.Unlock()
+		return
+	}
+	for key := range due {
+		d.scheduled[key] = now
+	}
+
+	c, ok := d.runnable(c, due, now, all)
+	if !ok {
+		// Nothing may be copied now, which isn't the daemon falling
+		// behind.
+		if d.lastErr == nil {
+			d.lastSuccess = now
+		}
+		d.mu.Unlock()
+		return
+	}
+	d.running, d.runStarted = true, now
+	d.mu.Unlock()
+
+	// Every run is its own trace, the daemon itself never finishes.
+	ctx, sp := startSpan(withoutSpan(ctx), "dimco daemon sync")
+	report := newRunReport()
+	// A hanging credential provider would stall every run.
+	resolveCtx, cancel := context.WithTimeout(ctx, configTimeout)
+	err := c.resolveCredentials(resolveCtx)
+	cancel()
+	if err == nil {
+		err = runSync(ctx, c, d.opts, report)
+	}
+	sp.End(err)
+
+	if err := flushTracing(context.Background()); err != nil {
+		log.Print(err)
+	}
+
+	d.mu.Lock()
+	d.running = false
+	d.lastRun = time.Now()
+	d.lastErr = err
+	d.record(report)
+	d.recordBackoff(report)
+	if err == nil {
+		d.lastSuccess = d.lastRun
+		infof("%vsync finished", d.logPrefix())
+	} else {
+		errorf("%vsync failed: %v", d.logPrefix(), err)
+	}
+	changes := d.evaluateAlerts(report, err)
+	d.mu.Unlock()
+
+	d.sendAlerts(ctx, changes)
+}
+
+// handleHealthz fails when a sync run hangs for longer than maxRun, so the
+// orchestrator can restart the daemon.
+func (d *daemon) handleHealthz(w http.ResponseWriter, r *http.Request) {
+	d.mu.Lock()
+	running, runStarted := d.running, d.runStarted
+	d.mu.Unlock()
+
+	if running && time.Since(runStarted) > d.maxRun {
+		http.Error(w, fmt.Sprintf("sync running since %v", runStarted.Format(time.RFC3339)), http.StatusServiceUnavailable)
+		return
+	}
+
+	fmt.Fprintln(w, "ok")
+}
+
+// handleReadyz checks that both registries are reachable and that the last
+// successful sync is within the SLA. A fresh daemon gets one SLA period to
+// finish its first sync.
+func (d *daemon) handleReadyz(w http.ResponseWriter, r *http.Request) {
+	d.mu.Lock()
+	c, lastSuccess := d.config, d.lastSuccess
+	d.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	if err := newRegistryClient(c.FromRepo).Ping(ctx); err != nil {
+		http.Error(w, redact(fmt.Sprintf("source registry unreachable: %v", err)), http.StatusServiceUnavailable)
+		return
+	}
+
+	if err := newRegistryClient(c.ToRepo).Ping(ctx); err != nil {
+		http.Error(w, redact(fmt.Sprintf("destination registry unreachable: %v", err)), http.StatusServiceUnavailable)
+		return
+	}
+
+	since := lastSuccess
+	if since.IsZero() {
+		since = d.started
+	}
+
+	if time.Since(since) > d.sla {
+		http.Error(w, fmt.Sprintf("no successful sync since %v", since.Format(time.RFC3339)), http.StatusServiceUnavailable)
+		return
+	}
+
+	fmt.Fprintln(w, "ok")
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"text/tabwriter"
+)
+
+const (
+	diffSourceOnly      = "source-only"
+	diffDestinationOnly = "destination-only"
+	diffDiffer          = "differ"
+	diffEqual           = "equal"
+)
+
+// tagDiff is a single line of the `dimco diff` report.
+type tagDiff struct {
+	Source      string `json:"source"`
+	Destination string `json:"destination"`
+	Tag         string `json:"tag"`
+	Status      string `json:"status"`
+	FromDigest  string `json:"from_digest,omitempty"`
+	ToDigest    string `json:"to_digest,omitempty"`
+}
+
+func newDiffCommand() *command {
+	fs := flag.NewFlagSet("diff", flag.ExitOnError)
+	configPath := fs.String("f", "config.json", "config file path")
+	output := fs.String("o", "text", "output format: text or json")
+	all := fs.Bool("all", false, "also report tags that are equal on both sides")
+
+	return &command{
+		name:  "diff",
+		usage: "compare tags and digests of the source and the destination registry",
+		flags: fs,
+		run: func(ctx context.Context) error {
+			c, err := loadConfig(*configPath)
+			if err != nil {
+				return err
+			}
+
+			diffs, err := runDiff(ctx, c)
+			if err != nil {
+				return err
+			}
+
+			if !*all {
+				filtered := diffs[:0]
+				for _, d := range diffs {
+					if d.Status != diffEqual {
+						filtered = append(filtered, d)
+					}
+				}
+				diffs = filtered
+			}
+
+			return writeDiff(diffs, *output)
+		},
+	}
+}
+
+func runDiff(ctx context.Context, c Config) ([]tagDiff, error) {
+	src := newRegistryClient(c.FromRepo)
+	dst := newRegistryClient(c.ToRepo)
+
+	diffs := []tagDiff{}
+	failed := 0
+	for _, p := range repositoryPairs(c) {
+		d, err := diffRepository(ctx, src, dst, p)
+		if err != nil {
+			log.Print(fmt.Errorf("can't compare '%v' and '%v': %w", p.from, p.to, err))
+			failed++
+			continue
+		}
+		diffs = append(diffs, d...)
+	}
+
+	if failed > 0 {
+		return diffs, fmt.Errorf("can't compare %v repositories", failed)
+	}
+
+	return diffs, nil
+}
+
+func diffRepository(ctx context.Context, src, dst *registryClient, p repoPair) ([]tagDiff, error) {
+	srcDigests, err := tagDigests(ctx, src, p.from)
+	if err != nil {
+		return nil, fmt.Errorf("can't read source: %w", err)
+	}
+
+	dstDigests, err := tagDigests(ctx, dst, p.to)
+	if err != nil {
+		return nil, fmt.Errorf("can't read destination: %w", err)
+	}
+
+	tags := []string{}
+	for tag := range srcDigests {
+		tags = append(tags, tag)
+	}
+	for tag := range dstDigests {
+		if _, ok := srcDigests[tag]; !ok {
+			tags = append(tags, tag)
+		}
+	}
+	sort.Strings(tags)
+
+	diffs := make([]tagDiff, 0, len(tags))
+	for _, tag := range tags {
+		d := tagDiff{
+			Source:      p.from,
+			Destination: p.to,
+			Tag:         tag,
+			FromDigest:  srcDigests[tag],
+			ToDigest:    dstDigests[tag],
+		}
+
+		switch {
+		case d.ToDigest == "":
+			d.Status = diffSourceOnly
+		case d.FromDigest == "":
+			d.Status = diffDestinationOnly
+		case d.FromDigest != d.ToDigest:
+			d.Status = diffDiffer
+		default:
+			d.Status = diffEqual
+		}
+
+		diffs = append(diffs, d)
+	}
+
+	return diffs, nil
+}
+
+// tagDigests returns the manifest digest of every tag of the repository. A
+// repository that doesn't exist yet has no tags.
+func tagDigests(ctx context.Context, rc *registryClient, repo string) (map[string]string, error) {
+	tags, err := rc.ListTags(ctx, repo)
+	if isNotFound(err) {
+		return map[string]string{}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("can't list tags: %w", err)
+	}
+
+	digests := make(map[string]string, len(tags))
+	for _, tag := range tags {
+		digest, err := rc.ManifestDigest(ctx, repo, tag)
+		if err != nil {
+			return nil, fmt.Errorf("can't resolve tag '%v': %w", tag, err)
+		}
+		digests[tag] = digest
+	}
+
+	return digests, nil
+}
+
+func writeDiff(diffs []tagDiff, format string) error {
+	switch format {
+	case "json":
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(diffs)
+	case "text":
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "SOURCE\tDESTINATION\tTAG\tSTATUS\tSOURCE DIGEST\tDESTINATION DIGEST")
+		for _, d := range diffs {
+			fmt.Fprintf(w, "%v\t%v\t%v\t%v\t%v\t%v\n", d.Source, d.Destination, d.Tag, d.Status, d.FromDigest, d.ToDigest)
+		}
+		return w.Flush()
+	default:
+		return fmt.Errorf("unknown output format '%v'", format)
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+)
+
+const (
+	digestEnvPlain  = "env"
+	digestEnvDotenv = "dotenv"
+	digestEnvJSON   = "json"
+)
+
+func validDigestEnvFormat(format string) error {
+	switch format {
+	case digestEnvPlain, digestEnvDotenv, digestEnvJSON:
+		return nil
+	default:
+		return fmt.Errorf("unknown digest env format '%v'", format)
+	}
+}
+
+// digestVariable is the variable name of the image name, and of its tag when
+// the run has more than one tag of the name: IMAGE_TEAM_APP for team/app,
+// IMAGE_APP_1_2 for app:1.2 next to app:1.3.
+func digestVariable(name, tag string, withTag bool) string {
+	s := name
+	if withTag {
+		s += "_" + tag
+	}
+
+	b := &strings.Builder{}
+	b.WriteString("IMAGE_")
+	for _, r := range strings.ToUpper(s) {
+		if r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' {
+			b.WriteRune(r)
+		} else {
+			b.WriteByte('_')
+		}
+	}
+	return b.String()
+}
+
+// digestVariables returns the variables of the copied images of report:
+// IMAGE_<NAME>_DIGEST with the pushed digest and IMAGE_<NAME>_REF with the
+// destination reference by digest.
+func digestVariables(report *runReport) map[string]string {
+	report.mu.Lock()
+	results := append([]imageResult{}, report.Images...)
+	report.mu.Unlock()
+
+	tags := map[string]map[string]bool{}
+	for _, res := range results {
+		if tags[res.name] == nil {
+			tags[res.name] = map[string]bool{}
+		}
+		tags[res.name][res.tag] = true
+	}
+
+	vars := map[string]string{}
+	for _, res := range results {
+		if res.Status != resultCopied || res.Digest == "" {
+			continue
+		}
+		v := digestVariable(res.name, res.tag, len(tags[res.name]) > 1)
+		vars[v+"_DIGEST"] = res.Digest
+		vars[v+"_REF"] = pinnedReference(res)
+	}
+	return vars
+}
+
+// writeDigestEnv writes the digest variables of the copied images of report
+// to path in format, for the next stages of a pipeline to source.
+func writeDigestEnv(report *runReport, path, format string) error {
+	vars := digestVariables(report)
+
+	names := []string{}
+	for name := range vars {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var data []byte
+	switch format {
+	case digestEnvJSON:
+		var err error
+		if data, err = json.MarshalIndent(vars, "", "  "); err != nil {
+			return fmt.Errorf("can't encode digests: %w", err)
+		}
+		data = append(data, '\n')
+	default:
+		b := &strings.Builder{}
+		for _, name := range names {
+			if format == digestEnvDotenv {
+				fmt.Fprintf(b, "%v=%q\n", name, vars[name])
+			} else {
+				fmt.Fprintf(b, "%v=%v\n", name, vars[name])
+			}
+		}
+		data = []byte(b.String())
+	}
+
+	if err := ioutil.WriteFile(path, data, 0o644); err != nil {
+		return fmt.Errorf("can't write digest env file: %w", err)
+	}
+	return nil
+}
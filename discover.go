@@ -0,0 +1,338 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// Repository listing APIs for discover.
+const (
+	discoverCatalog = "catalog"
+	discoverHarbor  = "harbor"
+	discoverQuay    = "quay"
+)
+
+// defaultMaxTags is the max_tags of discover entries without one.
+const defaultMaxTags = 1000
+
+// DiscoverConfig mirrors every source repository found under a namespace,
+// so the image list doesn't have to follow the vendor's.
+type DiscoverConfig struct {
+	// Prefix is the namespace searched, relative to from_repo, e.g. "vendor/".
+	Prefix string `json:"prefix"`
+	// API lists the repositories: catalog (/v2/_catalog, default), harbor
+	// or quay, for registries that restrict the catalog.
+	API string `json:"api,omitempty"`
+
+	// Include and Exclude are glob patterns of repository names below
+	// Prefix. Without Include every repository is mirrored.
+	Include []string `json:"include,omitempty"`
+	Exclude []string `json:"exclude,omitempty"`
+
+	// Tags are copied of every repository; without them every tag that
+	// matches TagRegex, or just every tag.
+	Tags     []string `json:"tags,omitempty"`
+	TagRegex string   `json:"tag_regex,omitempty"`
+	// MaxTags caps the tags copied of a repository, 1000 by default, so a
+	// repository of CI builds doesn't flood the run. Listing stops there.
+	MaxTags int `json:"max_tags,omitempty"`
+
+	ToPrefix string `json:"to_prefix,omitempty"`
+}
+
+func (d DiscoverConfig) validate() error {
+	switch d.API {
+	case "", discoverCatalog, discoverHarbor, discoverQuay:
+	default:
+		return fmt.Errorf("unknown api '%v'", d.API)
+	}
+
+	for _, p := range append(d.Include, d.Exclude...) {
+		if _, err := path.Match(p, ""); err != nil {
+			return fmt.Errorf("invalid pattern '%v': %w", p, err)
+		}
+	}
+
+	if _, err := regexp.Compile(d.TagRegex); err != nil {
+		return fmt.Errorf("invalid tag_regex: %w", err)
+	}
+
+	if d.MaxTags < 0 {
+		return fmt.Errorf("max_tags can't be negative")
+	}
+
+	return nil
+}
+
+func (d DiscoverConfig) maxTags() int {
+	if d.MaxTags == 0 {
+		return defaultMaxTags
+	}
+	return d.MaxTags
+}
+
+func (d DiscoverConfig) matches(name string) bool {
+	included := len(d.Include) == 0
+	for _, p := range d.Include {
+		if ok, _ := path.Match(p, name); ok {
+			included = true
+		}
+	}
+
+	for _, p := range d.Exclude {
+		if ok, _ := path.Match(p, name); ok {
+			return false
+		}
+	}
+
+	return included
+}
+
+// withDiscovered returns c with the images found by its discover entries
+// appended. Configured images win over discovered ones with the same
+// destination.
+func (c Config) withDiscovered(ctx context.Context) (Config, error) {
+	if len(c.Discover) == 0 {
+		return c, nil
+	}
+
+	seen := map[string]bool{}
+	for _, img := range c.Images {
+		seen[img.destinationKey()] = true
+	}
+
+	images := append([]ImageData{}, c.Images...)
+	src := newRegistryClient(c.FromRepo)
+	for _, d := range c.Discover {
+		found, err := c.discover(ctx, src, d)
+		if err != nil {
+			return Config{}, fmt.Errorf("can't discover repositories under '%v': %w", d.Prefix, err)
+		}
+
+		for _, img := range found {
+			img = c.rewritten(img)
+			if seen[img.destinationKey()] {
+				continue
+			}
+			if err := c.validateReferences(img); err != nil {
+				log.Print(fmt.Errorf("skipping discovered image %v%v:%v: %w", img.FromPrefix, img.Name, img.Tag, err))
+				continue
+			}
+
+			seen[img.destinationKey()] = true
+			images = append(images, img)
+		}
+	}
+
+	infof("discovered %v images", len(images)-len(c.Images))
+	c.Images = images
+
+	return c, nil
+}
+
+// discover lists the repositories under d.Prefix and their tags.
+func (c Config) discover(ctx context.Context, src *registryClient, d DiscoverConfig) ([]ImageData, error) {
+	// Repository names as the registry reports them, including the path of
+	// base_address.
+	namespace := repositoryPath(c.FromRepo, d.Prefix, "")
+
+	var repos []string
+	var err error
+	switch d.API {
+	case discoverHarbor:
+		repos, err = harborRepositories(ctx, c.FromRepo, namespace)
+	case discoverQuay:
+		repos, err = quayRepositories(ctx, c.FromRepo, namespace)
+	default:
+		repos, err = src.Catalog(ctx)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	tagRegex := regexp.MustCompile(d.TagRegex)
+
+	images := []ImageData{}
+	for _, repo := range repos {
+		if !strings.HasPrefix(repo, namespace) {
+			continue
+		}
+
+		name := strings.TrimPrefix(repo, namespace)
+		if name == "" || !d.matches(name) {
+			continue
+		}
+
+		tags := d.Tags
+		if len(tags) == 0 {
+			eachTag := src.EachTag
+			if d.API == discoverHarbor {
+				eachTag = func(ctx context.Context, repo string, fn func(string) error) error {
+					return harborTags(ctx, c.FromRepo, repo, fn)
+				}
+			}
+
+			err := eachTag(ctx, repo, func(tag string) error {
+				if !tagRegex.MatchString(tag) || isReferrersTag(tag) {
+					return nil
+				}
+				if len(tags) == d.maxTags() {
+					log.Printf("%v has more than %v matching tags, copying the first %v, see max_tags", repo, d.maxTags(), d.maxTags())
+					return errStopTags
+				}
+				tags = append(tags, tag)
+				return nil
+			})
+			if err != nil {
+				return nil, fmt.Errorf("can't list tags of %v: %w", repo, err)
+			}
+		}
+
+		for _, tag := range tags {
+			images = append(images, ImageData{Name: name, Tag: tag, FromPrefix: d.Prefix, ToPrefix: d.ToPrefix})
+		}
+	}
+
+	return images, nil
+}
+
+// harborRepositories lists the repositories of the Harbor project that
+// namespace starts with.
+func harborRepositories(ctx context.Context, ac AuthConfig, namespace string) ([]string, error) {
+	const pageSize = 100
+
+	host, _ := splitBaseAddress(ac.BaseAddress)
+	project := strings.SplitN(namespace, "/", 2)[0]
+
+	repos := []string{}
+	for page := 1; ; page++ {
+		u := fmt.Sprintf("%v/api/v2.0/projects/%v/repositories?page=%v&page_size=%v", apiBase(ac, host), url.PathEscape(project), page, pageSize)
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+		if err != nil {
+			return nil, fmt.Errorf("can't create request: %w", err)
+		}
+		if ac.Username != "" {
+			req.SetBasicAuth(ac.Username, ac.Password)
+		}
+
+		var out []struct {
+			Name string `json:"name"`
+		}
+		if err := doJSON(req, &out); err != nil {
+			return nil, err
+		}
+
+		for _, r := range out {
+			repos = append(repos, r.Name)
+		}
+		if len(out) < pageSize {
+			return repos, nil
+		}
+	}
+}
+
+// harborTags calls fn with the tags of repo, page by page of the Harbor
+// artifacts API.
+func harborTags(ctx context.Context, ac AuthConfig, repo string, fn func(tag string) error) error {
+	const pageSize = 100
+
+	host, _ := splitBaseAddress(ac.BaseAddress)
+	parts := strings.SplitN(repo, "/", 2)
+	if len(parts) != 2 {
+		return fmt.Errorf("repository '%v' isn't in a project", repo)
+	}
+	// Harbor wants the slashes of the repository name encoded twice.
+	name := url.PathEscape(url.PathEscape(parts[1]))
+
+	for page := 1; ; page++ {
+		u := fmt.Sprintf("%v/api/v2.0/projects/%v/repositories/%v/artifacts?page=%v&page_size=%v&with_tag=true",
+			apiBase(ac, host), url.PathEscape(parts[0]), name, page, pageSize)
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+		if err != nil {
+			return fmt.Errorf("can't create request: %w", err)
+		}
+		if ac.Username != "" {
+			req.SetBasicAuth(ac.Username, ac.Password)
+		}
+
+		var out []struct {
+			Tags []struct {
+				Name string `json:"name"`
+			} `json:"tags"`
+		}
+		if err := doJSON(req, &out); err != nil {
+			return err
+		}
+
+		for _, a := range out {
+			for _, t := range a.Tags {
+				if err := fn(t.Name); err == errStopTags {
+					return nil
+				} else if err != nil {
+					return err
+				}
+			}
+		}
+		if len(out) < pageSize {
+			return nil
+		}
+	}
+}
+
+// quayRepositories lists the repositories of the Quay organization that
+// namespace starts with, public ones included.
+func quayRepositories(ctx context.Context, ac AuthConfig, namespace string) ([]string, error) {
+	host, _ := splitBaseAddress(ac.BaseAddress)
+	org := strings.SplitN(namespace, "/", 2)[0]
+
+	repos := []string{}
+	next := ""
+	for {
+		q := url.Values{"namespace": {org}, "public": {"true"}}
+		if next != "" {
+			q.Set("next_page", next)
+		}
+
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, apiBase(ac, host)+"/api/v1/repository?"+q.Encode(), nil)
+		if err != nil {
+			return nil, fmt.Errorf("can't create request: %w", err)
+		}
+		if token := os.Getenv(quayTokenEnv); token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+
+		var out struct {
+			Repositories []struct {
+				Namespace string `json:"namespace"`
+				Name      string `json:"name"`
+			} `json:"repositories"`
+			NextPage string `json:"next_page"`
+		}
+		if err := doJSON(req, &out); err != nil {
+			return nil, err
+		}
+
+		for _, r := range out.Repositories {
+			repos = append(repos, r.Namespace+"/"+r.Name)
+		}
+		if out.NextPage == "" {
+			return repos, nil
+		}
+		next = out.NextPage
+	}
+}
+
+// apiBase is the URL of the registry host for vendor APIs.
+func apiBase(ac AuthConfig, host string) string {
+	if ac.Insecure {
+		return "http://" + host
+	}
+	return "https://" + host
+}
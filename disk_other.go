@@ -0,0 +1,10 @@
+//go:build !linux && !darwin && !freebsd
+// +build !linux,!darwin,!freebsd
+
+package main
+
+import "fmt"
+
+func freeSpace(path string) (int64, error) {
+	return 0, fmt.Errorf("disk_guard isn't supported on this platform")
+}
@@ -0,0 +1,15 @@
+//go:build linux || darwin || freebsd
+// +build linux darwin freebsd
+
+package main
+
+import "golang.org/x/sys/unix"
+
+// freeSpace is the space available to dimco on the filesystem of path.
+func freeSpace(path string) (int64, error) {
+	st := unix.Statfs_t{}
+	if err := unix.Statfs(path, &st); err != nil {
+		return 0, err
+	}
+	return int64(uint64(st.Bavail) * uint64(st.Bsize)), nil
+}
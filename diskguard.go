@@ -0,0 +1,268 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"runtime"
+	"sync"
+	"time"
+)
+
+const (
+	defaultMinFree       = "5GiB"
+	defaultContainerRoot = "/var/lib/containerd"
+	// diskPollInterval is how often a copy waiting for disk space checks
+	// again.
+	diskPollInterval = 10 * time.Second
+)
+
+// DiskGuardConfig keeps copies from filling the disk images are pulled to.
+// A copy that wouldn't leave min_free waits for the other copies to clean
+// up, and fails when none is left to do so.
+type DiskGuardConfig struct {
+	// Path is on the filesystem checked: the Docker data root,
+	// /var/lib/containerd or the workspace of the run by default.
+	Path string `json:"path,omitempty"`
+	// MinFree is the space kept free, e.g. "20GiB", 5GiB by default.
+	MinFree string `json:"min_free,omitempty"`
+}
+
+func (dc DiskGuardConfig) validate() error {
+	if dc.MinFree != "" {
+		if _, err := parseBytes(dc.MinFree); err != nil {
+			return fmt.Errorf("disk_guard.min_free: %w", err)
+		}
+	}
+	return nil
+}
+
+// createWorkspace creates the temporary directory of a run in work_dir and
+// returns the function removing it.
+func (c *Config) createWorkspace() (func(), error) {
+	dir, err := ioutil.TempDir(c.WorkDir, "dimco-run-")
+	if err != nil {
+		return nil, fmt.Errorf("can't create workspace: %w", err)
+	}
+	c.workspace = dir
+
+	return func() {
+		if err := os.RemoveAll(dir); err != nil {
+			log.Print(fmt.Errorf("can't remove workspace: %w", err))
+		}
+	}, nil
+}
+
+// diskGuard tracks the space the pulls of a run are about to use.
+type diskGuard struct {
+	path    string
+	minFree int64
+	// factor is how much disk a pull takes for every byte of compressed
+	// layers.
+	factor float64
+
+	mu       sync.Mutex
+	reserved int64
+	// active counts the copies holding local images, waiting those of them
+	// waiting for space.
+	active, waiting int
+	changed         chan struct{}
+}
+
+// newDiskGuard returns the guard of the run, nil when there is nothing to
+// guard: no disk_guard, or the registry backend copying without writing
+// images to disk.
+func (c Config) newDiskGuard(ctx context.Context, e engine) (*diskGuard, error) {
+	dc := c.DiskGuard
+	if dc == nil || c.Backend == backendRegistry && !c.rebuildsAny() {
+		return nil, nil
+	}
+
+	minFree, _ := parseBytes(defaultMinFree)
+	if dc.MinFree != "" {
+		minFree, _ = parseBytes(dc.MinFree)
+	}
+	g := &diskGuard{path: dc.Path, minFree: minFree, factor: 1, changed: make(chan struct{})}
+
+	switch c.Backend {
+	case "", backendDocker:
+		// Layers are extracted, which takes about twice their compressed
+		// size.
+		g.factor = 2
+		if g.path == "" {
+			de, ok := e.(*dockerEngine)
+			if !ok {
+				return nil, fmt.Errorf("set disk_guard.path, the data root of the engine is unknown")
+			}
+			root, err := de.DataRoot(ctx)
+			if err != nil {
+				return nil, err
+			}
+			g.path = root
+		}
+	case backendContainerd:
+		if g.path == "" {
+			g.path = defaultContainerRoot
+		}
+	}
+	if g.path == "" {
+		g.path = c.workspace
+	}
+
+	free, err := freeSpace(g.path)
+	if err != nil {
+		return nil, fmt.Errorf("can't check free space of %v, set disk_guard.path to a local directory on the same filesystem: %w", g.path, err)
+	}
+	debugf("disk guard: %v free at %v, keeping %v", formatBytes(free), g.path, formatBytes(g.minFree))
+
+	return g, nil
+}
+
+// rebuildsAny reports whether any image is rebuilt in the workspace.
+func (c Config) rebuildsAny() bool {
+	for _, img := range c.Images {
+		if c.rebuilds(img) {
+			return true
+		}
+	}
+	return false
+}
+
+// enter registers a copy that is about to store an image locally. leave
+// must be called once the copy is done and cleaned up.
+func (g *diskGuard) enter() (leave func()) {
+	if g == nil {
+		return func() {}
+	}
+
+	g.mu.Lock()
+	g.active++
+	g.mu.Unlock()
+
+	return func() {
+		g.mu.Lock()
+		g.active--
+		g.notify()
+		g.mu.Unlock()
+	}
+}
+
+// notify wakes the copies waiting for space. g.mu must be held.
+func (g *diskGuard) notify() {
+	close(g.changed)
+	g.changed = make(chan struct{})
+}
+
+// reserve waits until need bytes fit on the disk and keeps them for the
+// caller until release. It fails when only copies waiting themselves could
+// free space.
+func (g *diskGuard) reserve(ctx context.Context, image string, need int64) (release func(), err error) {
+
+	waited := false
+	for {
+		free, err := freeSpace(g.path)
+		if err != nil {
+			return nil, fmt.Errorf("can't check free space of %v: %w", g.path, err)
+		}
+
+		g.mu.Lock()
+		if free-g.reserved-need >= g.minFree {
+			g.reserved += need
+			g.mu.Unlock()
+			if waited {
+				infof("%v has disk space now", image)
+			}
+			return func() {
+				g.mu.Lock()
+				g.reserved -= need
+				g.notify()
+				g.mu.Unlock()
+			}, nil
+		}
+
+		// Copies that aren't waiting free space when they finish.
+		others := g.active - 1 - g.waiting
+		if others <= 0 && g.reserved == 0 {
+			g.mu.Unlock()
+			return nil, fmt.Errorf("not enough disk space for %v: it needs about %v, %v are free at %v and disk_guard keeps %v",
+				image, formatBytes(need), formatBytes(free), g.path, formatBytes(g.minFree))
+		}
+		if !waited {
+			infof("%v needs about %v of disk, %v are free at %v, waiting for other copies", image, formatBytes(need), formatBytes(free-g.reserved), g.path)
+			waited = true
+		}
+		g.waiting++
+		changed := g.changed
+		g.mu.Unlock()
+
+		t := time.NewTimer(diskPollInterval)
+		select {
+		case <-changed:
+		case <-t.C:
+		case <-ctx.Done():
+		}
+		t.Stop()
+
+		g.mu.Lock()
+		g.waiting--
+		g.mu.Unlock()
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// guards reports whether the copy of img stores it on the guarded disk.
+func (s *syncer) guards(img ImageData) bool {
+	return s.disk != nil && (s.config.Backend != backendRegistry || s.config.rebuilds(img))
+}
+
+// reserveDisk reserves the space the pull or build of img takes. Images
+// whose size can't be read aren't held up, their pull reports the problem.
+func (s *syncer) reserveDisk(ctx context.Context, img ImageData, fromImg string) (release func(), err error) {
+	if !s.guards(img) {
+		return func() {}, nil
+	}
+
+	size, err := s.config.imageSize(ctx, img)
+	if err != nil {
+		debugf("can't estimate the size of %v: %v", fromImg, err)
+		return func() {}, nil
+	}
+	// Rebuilds keep the compressed layers, engines extract them too.
+	factor := s.disk.factor
+	if s.config.rebuilds(img) {
+		factor = 1
+	}
+
+	return s.disk.reserve(ctx, fromImg, int64(float64(size)*factor))
+}
+
+// imageSize is the compressed size of config and layers of the source of
+// img, for the platform of dimco if it is an index.
+func (c Config) imageSize(ctx context.Context, img ImageData) (int64, error) {
+	src := newRegistryClient(c.FromRepo)
+	repo := repositoryPath(c.FromRepo, img.FromPrefix, img.Name)
+
+	m, _, err := src.FetchManifest(ctx, repo, img.sourceRef())
+	if err != nil {
+		return 0, err
+	}
+	if len(m.Manifests) > 0 {
+		d, err := selectPlatform(m.Manifests, runtime.GOOS, runtime.GOARCH)
+		if err != nil {
+			return 0, err
+		}
+		if m, _, err = src.FetchManifest(ctx, repo, d.Digest); err != nil {
+			return 0, err
+		}
+	}
+
+	size := m.Config.Size
+	for _, l := range m.Layers {
+		size += l.Size
+	}
+	return size, nil
+}
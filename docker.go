@@ -0,0 +1,269 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/docker/distribution/reference"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/client"
+)
+
+// dockerEngine runs the copy pipeline through a Docker compatible daemon.
+type dockerEngine struct {
+	cli *client.Client
+}
+
+// newDockerEngine connects to the container engine at engine_host, or to the
+// one described by the DOCKER_* environment variables when it's not set.
+// Podman's Docker compatible socket works the same way, ssh:// hosts are
+// reached through the ssh client.
+func newDockerEngine(c Config) (*dockerEngine, error) {
+	opts := []client.Opt{
+		client.FromEnv,
+		// Podman and older daemons don't support the API version the client
+		// library defaults to.
+		client.WithAPIVersionNegotiation(),
+	}
+
+	host := c.EngineHost
+	if host == "" {
+		host = os.Getenv("DOCKER_HOST")
+	}
+
+	switch {
+	case strings.HasPrefix(host, "ssh://"):
+		dialer, err := sshDialer(host, c.SSH)
+		if err != nil {
+			return nil, err
+		}
+
+		// The host only names the daemon in requests, the dialer reaches it.
+		// A fresh transport keeps proxy settings from applying to the tunnel.
+		opts = append(opts,
+			client.WithHost("http://docker.example.com"),
+			client.WithHTTPClient(&http.Client{Transport: &http.Transport{DialContext: dialer}}),
+		)
+	case host != "":
+		opts = append(opts, client.WithHost(host))
+	}
+
+	cli, err := client.NewClientWithOpts(opts...)
+	if err != nil {
+		return nil, fmt.Errorf("can't create engine client: %w", err)
+	}
+
+	return &dockerEngine{cli: cli}, nil
+}
+
+func (e *dockerEngine) Close() error {
+	return e.cli.Close()
+}
+
+// DataRoot is the directory the daemon stores images in.
+func (e *dockerEngine) DataRoot(ctx context.Context) (string, error) {
+	info, err := e.cli.Info(ctx)
+	if err != nil {
+		return "", fmt.Errorf("can't get engine info: %w", err)
+	}
+	return info.DockerRootDir, nil
+}
+
+// copyProgress copies the JSON progress stream of a pull or push to out and
+// returns the first error reported in it. Both Docker and Podman report
+// failures inside the stream with a successful HTTP status. Layer progress
+// is passed on to the imageProgress of ctx.
+func copyProgress(ctx context.Context, out io.Writer, r io.Reader) error {
+	p := progressFrom(ctx)
+	dec := json.NewDecoder(r)
+	enc := json.NewEncoder(out)
+
+	for {
+		var msg json.RawMessage
+		if err := dec.Decode(&msg); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("can't decode progress: %w", err)
+		}
+
+		if err := enc.Encode(msg); err != nil {
+			return fmt.Errorf("can't write progress: %w", err)
+		}
+
+		var status struct {
+			ID             string `json:"id"`
+			Status         string `json:"status"`
+			ProgressDetail struct {
+				Current int64 `json:"current"`
+				Total   int64 `json:"total"`
+			} `json:"progressDetail"`
+			Error       string `json:"error"`
+			ErrorDetail struct {
+				Message string `json:"message"`
+			} `json:"errorDetail"`
+		}
+		if err := json.Unmarshal(msg, &status); err != nil {
+			continue
+		}
+
+		switch {
+		case status.ProgressDetail.Total > 0:
+			p.update(status.ID, status.ProgressDetail.Current, status.ProgressDetail.Total)
+		case status.Status == "Layer already exists" || strings.HasPrefix(status.Status, "Mounted from"):
+			p.skip(status.ID, 0)
+		case status.Status == "Download complete" || status.Status == "Pushed":
+			p.complete(status.ID)
+		}
+
+		if status.ErrorDetail.Message != "" {
+			return fmt.Errorf("%v", status.ErrorDetail.Message)
+		}
+		if status.Error != "" {
+			return fmt.Errorf("%v", status.Error)
+		}
+	}
+}
+
+func (e *dockerEngine) Pull(ctx context.Context, image string, ac AuthConfig) error {
+	// The daemon talks to the registry itself, so a pull counts as one request.
+	if err := waitPause(ctx, registryHost(ac)); err != nil {
+		return fmt.Errorf("can't pull image: %w", err)
+	}
+
+	release, err := limiterFor(registryHost(ac), ac.RateLimit).wait(ctx, true)
+	if err != nil {
+		return fmt.Errorf("can't pull image: %w", err)
+	}
+	defer release()
+
+	out, err := e.cli.ImagePull(ctx, image, types.ImagePullOptions{
+		All:          false,
+		RegistryAuth: ac.ToEncodedString(),
+	})
+	if err != nil {
+		return fmt.Errorf("can't pull image: %w", err)
+	}
+	defer out.Close()
+
+	if err := copyProgress(ctx, progressOutput(), out); err != nil {
+		return fmt.Errorf("can't copy image: %w", err)
+	}
+
+	return nil
+}
+
+func (e *dockerEngine) Tag(ctx context.Context, fromImg, toImg string) error {
+	if err := e.cli.ImageTag(ctx, fromImg, toImg); err != nil {
+		return fmt.Errorf("can't tag image: %w", err)
+	}
+
+	return nil
+}
+
+func (e *dockerEngine) Push(ctx context.Context, image string, ac AuthConfig) error {
+	if err := waitPause(ctx, registryHost(ac)); err != nil {
+		return fmt.Errorf("can't push image: %w", err)
+	}
+
+	release, err := limiterFor(registryHost(ac), ac.RateLimit).wait(ctx, false)
+	if err != nil {
+		return fmt.Errorf("can't push image: %w", err)
+	}
+	defer release()
+
+	reader, err := e.cli.ImagePush(ctx, image, types.ImagePushOptions{
+		All:          false,
+		RegistryAuth: ac.ToEncodedString(),
+	})
+	if err != nil {
+		return fmt.Errorf("can't push image: %w", err)
+	}
+	defer reader.Close()
+
+	if err := copyProgress(ctx, progressOutput(), reader); err != nil {
+		return fmt.Errorf("can't copy image: %w", err)
+	}
+
+	return nil
+}
+
+func (e *dockerEngine) Remove(ctx context.Context, img string) error {
+	deletedItems, err := e.cli.ImageRemove(ctx, img, types.ImageRemoveOptions{
+		Force:         true,
+		PruneChildren: true,
+	})
+	if err != nil {
+		return fmt.Errorf("can't remove image: %w", err)
+	}
+
+	debugf("delete images: %v", deletedItems)
+
+	return nil
+}
+
+// Layers returns the image ID and the diff IDs of the layers of img.
+func (e *dockerEngine) Layers(ctx context.Context, img string) ([]string, error) {
+	inspect, _, err := e.cli.ImageInspectWithRaw(ctx, img)
+	if err != nil {
+		return nil, fmt.Errorf("can't inspect image: %w", err)
+	}
+
+	return append([]string{inspect.ID}, inspect.RootFS.Layers...), nil
+}
+
+// HasDigest reports whether img was pulled or pushed as digest of its
+// repository, as recorded in its RepoDigests.
+func (e *dockerEngine) HasDigest(ctx context.Context, img, digest string) (bool, error) {
+	inspect, _, err := e.cli.ImageInspectWithRaw(ctx, img)
+	if client.IsErrNotFound(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("can't inspect image: %w", err)
+	}
+
+	named, err := reference.ParseNormalizedNamed(img)
+	if err != nil {
+		return false, fmt.Errorf("invalid image reference '%v': %w", img, err)
+	}
+
+	for _, rd := range inspect.RepoDigests {
+		local, err := reference.ParseNormalizedNamed(rd)
+		if err != nil {
+			continue
+		}
+		if digested, ok := local.(reference.Digested); ok && local.Name() == named.Name() && digested.Digest().String() == digest {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// InUse reports whether a running container was created from img.
+func (e *dockerEngine) InUse(ctx context.Context, img string) (bool, error) {
+	containers, err := e.cli.ContainerList(ctx, types.ContainerListOptions{
+		Filters: filters.NewArgs(filters.Arg("ancestor", img), filters.Arg("status", "running")),
+	})
+	if err != nil {
+		return false, fmt.Errorf("can't list containers: %w", err)
+	}
+
+	return len(containers) > 0, nil
+}
+
+// ImageID returns the local image ID, which is the digest of the image config.
+func (e *dockerEngine) ImageID(ctx context.Context, img string) (string, error) {
+	inspect, _, err := e.cli.ImageInspectWithRaw(ctx, img)
+	if err != nil {
+		return "", fmt.Errorf("can't inspect image: %w", err)
+	}
+
+	return inspect.ID, nil
+}
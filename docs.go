@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+func newDocsCommand() *command {
+	fs := flag.NewFlagSet("docs", flag.ExitOnError)
+
+	return &command{
+		name:  "docs",
+		usage: "print documentation generated from the commands: docs man",
+		args:  []string{"man"},
+		flags: fs,
+		run: func(ctx context.Context) error {
+			if fs.NArg() != 1 || fs.Arg(0) != "man" {
+				return fmt.Errorf("usage: dimco docs man")
+			}
+
+			return writeManPage(os.Stdout, commands())
+		},
+	}
+}
+
+// writeManPage writes dimco(1) in roff. The flags every command accepts are
+// listed once under COMMON FLAGS.
+func writeManPage(w io.Writer, cmds []*command) error {
+	b := &strings.Builder{}
+	fmt.Fprintf(b, ".TH DIMCO 1 \"\" \"dimco %v\" \"User Commands\"\n", roffEscape(currentBuild().Version))
+	b.WriteString(`.SH NAME
+dimco \- copy container images between registries
+.SH SYNOPSIS
+.B dimco
+[\fIcommand\fR] [\fIflags\fR] [\fIarguments\fR]
+.SH DESCRIPTION
+dimco copies the images listed in a JSON config from a source to a destination registry.
+Without a command it runs \fBsync\fR.
+.SH COMMANDS
+`)
+
+	for _, c := range cmds {
+		fmt.Fprintf(b, ".SS %v\n%v\n", roffEscape("dimco "+c.name), roffEscape(c.usage))
+		writeManFlags(b, c.flags)
+	}
+
+	common := flag.NewFlagSet("", flag.ContinueOnError)
+	bindCommonFlags(common, "")
+	b.WriteString(".SH COMMON FLAGS\nEvery command accepts these flags.\n")
+	writeManFlags(b, common)
+
+	b.WriteString(`.SH ENVIRONMENT
+Credentials, tokens and endpoints that don't belong in the config are read from the environment, see the README.
+.SH SEE ALSO
+.UR https://github.com/SealTV/dimco
+.UE
+`)
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+func writeManFlags(b *strings.Builder, fs *flag.FlagSet) {
+	for _, f := range commandFlags(fs) {
+		b.WriteString(".TP\n")
+		fmt.Fprintf(b, `\fB\-%v\fR`, roffEscape(f.name))
+		if f.value != "" {
+			fmt.Fprintf(b, ` \fI%v\fR`, roffEscape(f.value))
+		}
+		b.WriteString("\n" + roffEscape(f.usage))
+
+		if def := fs.Lookup(f.name).DefValue; f.value != "" && def != "" && def != "0" && def != "0s" {
+			fmt.Fprintf(b, " (default %v)", roffEscape(def))
+		}
+		b.WriteString("\n")
+	}
+}
+
+// roffEscape keeps backslashes, dashes and leading control characters of s
+// from being read as roff.
+func roffEscape(s string) string {
+	s = strings.NewReplacer(`\`, `\e`, "-", `\-`).Replace(s)
+	if strings.HasPrefix(s, ".") || strings.HasPrefix(s, "'") {
+		s = `\&` + s
+	}
+	return s
+}
@@ -0,0 +1,449 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	versionapi "github.com/containerd/containerd/api/services/version/v1"
+	"github.com/docker/docker/api/types"
+	ptypes "github.com/gogo/protobuf/types"
+)
+
+const (
+	// doctorTimeout bounds each check, so an unreachable host doesn't hold
+	// up the others.
+	doctorTimeout = 15 * time.Second
+	// certExpiryWarning is how long before a registry certificate expires
+	// doctor warns about it.
+	certExpiryWarning = 14 * 24 * time.Hour
+)
+
+const (
+	findingOK   = "ok"
+	findingWarn = "warn"
+	findingFail = "fail"
+)
+
+// finding is a single line of the `dimco doctor` report.
+type finding struct {
+	Check  string `json:"check"`
+	Status string `json:"status"`
+	Detail string `json:"detail"`
+	// Hint tells how to fix a warning or failure.
+	Hint string `json:"hint,omitempty"`
+}
+
+func newDoctorCommand() *command {
+	fs := flag.NewFlagSet("doctor", flag.ExitOnError)
+	configPath := fs.String("f", "config.json", "config file path")
+	output := fs.String("o", "text", "output format: text or json")
+
+	return &command{
+		name:  "doctor",
+		usage: "check the engine, registries, credentials, disk space and proxy settings",
+		flags: fs,
+		run: func(ctx context.Context) error {
+			findings := runDoctor(ctx, *configPath)
+			if err := writeDoctor(findings, *output); err != nil {
+				return err
+			}
+
+			failed := 0
+			for _, f := range findings {
+				if f.Status == findingFail {
+					failed++
+				}
+			}
+
+			if failed > 0 {
+				return fmt.Errorf("%v of %v checks failed", failed, len(findings))
+			}
+
+			return nil
+		},
+	}
+}
+
+// doctor collects the findings of the checks.
+type doctor struct {
+	findings []finding
+}
+
+func (d *doctor) add(status, check, detail, hint string) {
+	d.findings = append(d.findings, finding{Check: check, Status: status, Detail: redact(detail), Hint: redact(hint)})
+}
+
+// engineInfo is what the engine check learned for the checks after it.
+type engineInfo struct {
+	// dataRoot is the local directory the engine stores images in, "" when
+	// it's unknown or on another host.
+	dataRoot string
+	// daemon is the info of dockerd with its proxy settings, nil for other
+	// engines.
+	daemon *types.Info
+}
+
+func runDoctor(ctx context.Context, configPath string) []finding {
+	d := &doctor{}
+
+	c, err := loadConfig(configPath)
+	if err != nil {
+		d.add(findingFail, "config", err.Error(), "fix the config, or pass its path with -f; the registry checks are skipped")
+	} else {
+		d.add(findingOK, "config", fmt.Sprintf("%v: %v images", configPath, len(c.Images)), "")
+	}
+
+	info := d.checkEngine(ctx, c)
+	if err == nil {
+		seen := map[string]bool{}
+		for _, ac := range c.registries() {
+			key := registryHost(*ac) + " " + ac.Username
+			if ac.BaseAddress == "" || seen[key] {
+				continue
+			}
+			seen[key] = true
+			d.checkRegistry(ctx, *ac)
+		}
+	}
+	d.checkDisk(c, info)
+	d.checkProxy(c, info)
+
+	return d.findings
+}
+
+// checkEngine connects to the engine of the backend and reports its version.
+func (d *doctor) checkEngine(ctx context.Context, c Config) engineInfo {
+	ctx, cancel := context.WithTimeout(ctx, doctorTimeout)
+	defer cancel()
+
+	switch c.Backend {
+	case "", backendDocker:
+		return d.checkDocker(ctx, c)
+	case backendContainerd:
+		return d.checkContainerd(ctx, c)
+	case backendRegistry:
+		d.add(findingOK, "engine", "registry backend, no engine needed", "")
+	default:
+		d.add(findingFail, "engine", fmt.Sprintf("unknown backend '%v'", c.Backend), "set backend to docker, containerd or registry")
+	}
+	return engineInfo{}
+}
+
+func (d *doctor) checkDocker(ctx context.Context, c Config) engineInfo {
+	e, err := newDockerEngine(c)
+	if err != nil {
+		d.add(findingFail, "engine", err.Error(), "check DOCKER_HOST, or set engine_host")
+		return engineInfo{}
+	}
+	defer e.Close()
+
+	host := e.cli.DaemonHost()
+	v, err := e.cli.ServerVersion(ctx)
+	if err != nil {
+		hint := "start the engine, or point DOCKER_HOST or engine_host at a running one"
+		if errors.Is(err, os.ErrPermission) || strings.Contains(err.Error(), "permission denied") {
+			hint = "run dimco as a user with access to the socket, e.g. in the docker group"
+		}
+		d.add(findingFail, "engine", fmt.Sprintf("can't reach the engine at %v: %v", host, err), hint)
+		return engineInfo{}
+	}
+
+	name := "Docker Engine"
+	for _, comp := range v.Components {
+		if strings.Contains(comp.Name, "Podman") {
+			name = "Podman"
+		}
+	}
+	d.add(findingOK, "engine", fmt.Sprintf("%v %v at %v (API %v, %v/%v)", name, v.Version, host, e.cli.ClientVersion(), v.Os, v.Arch), "")
+
+	info, err := e.cli.Info(ctx)
+	if err != nil {
+		d.add(findingWarn, "engine", fmt.Sprintf("can't get engine info: %v", err), "")
+		return engineInfo{}
+	}
+
+	ei := engineInfo{daemon: &info}
+	if strings.HasPrefix(host, "unix://") {
+		ei.dataRoot = info.DockerRootDir
+	}
+	return ei
+}
+
+func (d *doctor) checkContainerd(ctx context.Context, c Config) engineInfo {
+	address := c.Containerd.Address
+	if address == "" {
+		address = defaultContainerdAddress
+	}
+
+	e, err := newContainerdEngine(c.Containerd, false)
+	if err != nil {
+		d.add(findingFail, "engine", err.Error(), "start containerd, or set containerd.address; the socket usually needs root")
+		return engineInfo{}
+	}
+	defer e.Close()
+
+	v, err := versionapi.NewVersionClient(e.conn).Version(ctx, &ptypes.Empty{})
+	if err != nil {
+		d.add(findingFail, "engine", fmt.Sprintf("can't get the version of containerd at %v: %v", address, err), "")
+		return engineInfo{}
+	}
+	d.add(findingOK, "engine", fmt.Sprintf("containerd %v (%v) at %v, namespace %v", v.Version, v.Revision, address, e.namespace), "")
+
+	return engineInfo{dataRoot: defaultContainerRoot}
+}
+
+// checkRegistry checks that the registry of ac answers the registry API over
+// a valid TLS connection and accepts its credentials.
+func (d *doctor) checkRegistry(ctx context.Context, ac AuthConfig) {
+	ctx, cancel := context.WithTimeout(ctx, doctorTimeout)
+	defer cancel()
+
+	rc := newRegistryClient(ac)
+	check := "registry " + rc.host
+	u := rc.url("")
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		d.add(findingFail, check, err.Error(), "fix base_address")
+		return
+	}
+	ac.setHeaders(req)
+
+	via := ""
+	if proxy, err := http.ProxyFromEnvironment(req); err != nil {
+		d.add(findingFail, check, fmt.Sprintf("invalid proxy setting: %v", err), "fix HTTPS_PROXY or HTTP_PROXY")
+		return
+	} else if proxy != nil {
+		via = " through " + proxy.Redacted()
+	}
+
+	resp, err := rc.client.Do(req)
+	if err != nil {
+		d.add(findingFail, check, fmt.Sprintf("can't reach %v%v: %v", u, via, err), networkHint(err, rc.host))
+		return
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusUnauthorized {
+		d.add(findingFail, check, fmt.Sprintf("%v answers %v%v", u, resp.Status, via), "check that base_address names a registry, not its web UI")
+		return
+	}
+
+	detail := fmt.Sprintf("%v answers%v", u, via)
+	if resp.TLS != nil && len(resp.TLS.PeerCertificates) > 0 {
+		cert := resp.TLS.PeerCertificates[0]
+		detail += fmt.Sprintf(", %v, certificate valid until %v", tlsVersionName(resp.TLS.Version), cert.NotAfter.Format("2006-01-02"))
+		if time.Until(cert.NotAfter) < certExpiryWarning {
+			d.add(findingWarn, check, detail, "renew the certificate of "+rc.host+" before it expires")
+		} else {
+			d.add(findingOK, check, detail, "")
+		}
+	} else {
+		d.add(findingOK, check, detail+", plain HTTP", "")
+	}
+
+	check = "credentials " + rc.host
+	switch {
+	case ac.Username == "":
+		d.add(findingOK, check, "no credentials, anonymous access", "")
+		return
+	case resp.StatusCode == http.StatusOK:
+		d.add(findingOK, check, fmt.Sprintf("%v doesn't ask for credentials at /v2/, those of %v are checked on first use", rc.host, ac.Username), "")
+		return
+	}
+
+	resp, err = rc.do(ctx, http.MethodGet, u, nil, nil)
+	if err != nil {
+		var se *statusError
+		if errors.As(err, &se) && (se.StatusCode == http.StatusUnauthorized || se.StatusCode == http.StatusForbidden) {
+			d.add(findingFail, check, fmt.Sprintf("%v rejects the credentials of %v", rc.host, ac.Username),
+				"check username and password, or the credential provider; tokens may have expired")
+			return
+		}
+		d.add(findingFail, check, fmt.Sprintf("can't log in as %v: %v", ac.Username, err), networkHint(err, rc.host))
+		return
+	}
+	resp.Body.Close()
+	d.add(findingOK, check, fmt.Sprintf("logged in as %v", ac.Username), "")
+}
+
+// networkHint suggests a fix for the connection error err to host.
+func networkHint(err error, host string) string {
+	var (
+		unknownAuthority x509.UnknownAuthorityError
+		hostname         x509.HostnameError
+		invalid          x509.CertificateInvalidError
+		dnsErr           *net.DNSError
+		netErr           net.Error
+	)
+	msg := err.Error()
+
+	switch {
+	case errors.As(err, &unknownAuthority):
+		return "the certificate of " + host + " isn't signed by a trusted CA: add the CA to the system trust store, or point SSL_CERT_FILE at it"
+	case errors.As(err, &hostname):
+		return "the certificate doesn't cover " + host + ", use a name it was issued for in base_address"
+	case errors.As(err, &invalid):
+		return "the certificate of " + host + " has expired or isn't valid yet: renew it, or check the clock"
+	case strings.Contains(msg, "server gave HTTP response to HTTPS client"), strings.Contains(msg, "does not look like a TLS handshake"):
+		return "the registry speaks plain HTTP, set insecure for it"
+	case strings.Contains(msg, "proxyconnect"):
+		return "the proxy failed the connection: check HTTPS_PROXY, or add " + host + " to NO_PROXY"
+	case errors.As(err, &dnsErr):
+		return "can't resolve " + host + ": check DNS, or set HTTPS_PROXY if only a proxy reaches it"
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return "nothing listens at " + host + ", check the host and port of base_address"
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return "the connection timed out, a firewall may drop it; set HTTPS_PROXY if the network needs a proxy"
+	}
+	return ""
+}
+
+func tlsVersionName(v uint16) string {
+	switch v {
+	case tls.VersionTLS10:
+		return "TLS 1.0"
+	case tls.VersionTLS11:
+		return "TLS 1.1"
+	case tls.VersionTLS12:
+		return "TLS 1.2"
+	case tls.VersionTLS13:
+		return "TLS 1.3"
+	}
+	return fmt.Sprintf("TLS %#x", v)
+}
+
+// checkDisk checks the free space of the workspace and of the engine's image
+// store against disk_guard.min_free, or its default.
+func (d *doctor) checkDisk(c Config, info engineInfo) {
+	minFree, _ := parseBytes(defaultMinFree)
+	if c.DiskGuard != nil && c.DiskGuard.MinFree != "" {
+		minFree, _ = parseBytes(c.DiskGuard.MinFree)
+	}
+
+	work := c.WorkDir
+	if work == "" {
+		work = os.TempDir()
+	}
+	paths := []struct{ check, path, hint string }{
+		{"disk workspace", work, "free space, or set work_dir to a larger filesystem"},
+	}
+
+	store := info.dataRoot
+	if c.DiskGuard != nil && c.DiskGuard.Path != "" {
+		store = c.DiskGuard.Path
+	}
+	if store != "" {
+		paths = append(paths, struct{ check, path, hint string }{"disk images", store, "free space, e.g. with docker image prune, or move the data root of the engine"})
+	}
+
+	for _, p := range paths {
+		free, err := freeSpace(p.path)
+		if err != nil {
+			d.add(findingWarn, p.check, fmt.Sprintf("can't check free space of %v: %v", p.path, err), "")
+			continue
+		}
+		detail := fmt.Sprintf("%v free at %v", formatBytes(free), p.path)
+		if free < minFree {
+			d.add(findingWarn, p.check, fmt.Sprintf("%v, less than %v", detail, formatBytes(minFree)), p.hint)
+			continue
+		}
+		d.add(findingOK, p.check, detail, "")
+	}
+}
+
+// proxyEnv returns the proxy variable name of the environment, upper case
+// winning like in net/http, and its value.
+func proxyEnv(name string) string {
+	if v := os.Getenv(name); v != "" {
+		return v
+	}
+	return os.Getenv(strings.ToLower(name))
+}
+
+// checkProxy reports the proxy settings of dimco and whether dockerd, which
+// pulls and pushes for the docker backend, uses the same.
+func (d *doctor) checkProxy(c Config, info engineInfo) {
+	env := map[string]string{}
+	set := []string{}
+	for _, name := range []string{"HTTPS_PROXY", "HTTP_PROXY", "NO_PROXY"} {
+		v := proxyEnv(name)
+		env[name] = v
+		if v == "" {
+			continue
+		}
+		if name != "NO_PROXY" {
+			if _, err := url.Parse(v); err != nil {
+				d.add(findingFail, "proxy", fmt.Sprintf("invalid %v '%v'", name, v), "set it to a URL like http://proxy:3128")
+				return
+			}
+		}
+		set = append(set, name+"="+v)
+	}
+
+	detail := "no proxy set, registries are reached directly"
+	if len(set) > 0 {
+		detail = strings.Join(set, " ")
+	}
+
+	if info.daemon == nil {
+		d.add(findingOK, "proxy", detail, "")
+		return
+	}
+
+	daemon := info.daemon.HTTPSProxy
+	if daemon == "" {
+		daemon = info.daemon.HTTPProxy
+	}
+	mine := env["HTTPS_PROXY"]
+	if mine == "" {
+		mine = env["HTTP_PROXY"]
+	}
+
+	switch {
+	case daemon == "" && mine != "":
+		d.add(findingWarn, "proxy", detail+"; dockerd has no proxy, its pulls and pushes go direct",
+			"configure the proxy of dockerd, in a systemd drop-in or \"proxies\" of daemon.json, if the registries are only reachable through it")
+	case daemon != "" && mine == "":
+		d.add(findingWarn, "proxy", fmt.Sprintf("dimco has no proxy, dockerd pulls through %v", daemon),
+			"export HTTPS_PROXY if the registries are only reachable through it: dimco resolves digests and checks tags itself")
+	case daemon != mine:
+		d.add(findingWarn, "proxy", fmt.Sprintf("%v; dockerd uses %v", detail, daemon), "use the same proxy for dimco and dockerd")
+	default:
+		d.add(findingOK, "proxy", detail+", the same as dockerd", "")
+	}
+}
+
+func writeDoctor(findings []finding, format string) error {
+	switch format {
+	case "json":
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(findings)
+	case "text":
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "STATUS\tCHECK\tDETAIL")
+		for _, f := range findings {
+			fmt.Fprintf(w, "%v\t%v\t%v\n", strings.ToUpper(f.Status), f.Check, f.Detail)
+			if f.Hint != "" {
+				fmt.Fprintf(w, "\t\thint: %v\n", f.Hint)
+			}
+		}
+		return w.Flush()
+	default:
+		return fmt.Errorf("unknown output format '%v'", format)
+	}
+}
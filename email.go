@@ -0,0 +1,227 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"mime"
+	"net"
+	"net/smtp"
+	"os"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// smtpPasswordEnv holds the password of email.username.
+const smtpPasswordEnv = "SMTP_PASSWORD"
+
+const smtpTimeout = 30 * time.Second
+
+// SMTP connection security.
+const (
+	emailStartTLS = "starttls"
+	emailTLS      = "tls"
+	emailNoTLS    = "none"
+)
+
+// When summaries are sent.
+const (
+	emailAlways  = "always"
+	emailFailure = "failure"
+)
+
+const (
+	defaultEmailSubject = `dimco: {{if .Error}}run failed{{else}}{{.Copied}} of {{len .Images}} images copied{{end}}`
+	defaultEmailBody    = `{{if .Error}}The run failed: {{.Error}}
+
+{{end}}{{range .Images}}{{.Status}}	{{.Destination}}{{if .Error}}: {{.Error}}{{end}}
+{{end}}
+Duration: {{printf "%.1f" .Duration}}s
+`
+)
+
+// EmailConfig sends the summary of a sync run by email.
+type EmailConfig struct {
+	// Host is the SMTP server as host:port.
+	Host string   `json:"host"`
+	From string   `json:"from"`
+	To   []string `json:"to"`
+	// TLS is starttls (default), tls for implicit TLS, usually on port
+	// 465, or none.
+	TLS string `json:"tls,omitempty"`
+	// Username authenticates with PLAIN, the password is read from
+	// SMTP_PASSWORD.
+	Username string `json:"username,omitempty"`
+	// When is always (default) or failure, for runs with failed images.
+	When string `json:"when,omitempty"`
+	// Subject and Body are text/template templates of an emailSummary.
+	Subject string `json:"subject,omitempty"`
+	Body    string `json:"body,omitempty"`
+}
+
+func (ec EmailConfig) validate() error {
+	if ec.Host == "" || ec.From == "" || len(ec.To) == 0 {
+		return fmt.Errorf("email needs host, from and to")
+	}
+	if _, _, err := net.SplitHostPort(ec.Host); err != nil {
+		return fmt.Errorf("email.host must be host:port: %w", err)
+	}
+
+	switch ec.TLS {
+	case "", emailStartTLS, emailTLS, emailNoTLS:
+	default:
+		return fmt.Errorf("unknown email.tls '%v', use starttls, tls or none", ec.TLS)
+	}
+
+	switch ec.When {
+	case "", emailAlways, emailFailure:
+	default:
+		return fmt.Errorf("unknown email.when '%v', use always or failure", ec.When)
+	}
+
+	if _, _, err := ec.templates(); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (ec EmailConfig) templates() (subject, body *template.Template, err error) {
+	s, b := ec.Subject, ec.Body
+	if s == "" {
+		s = defaultEmailSubject
+	}
+	if b == "" {
+		b = defaultEmailBody
+	}
+
+	if subject, err = template.New("subject").Parse(s); err != nil {
+		return nil, nil, fmt.Errorf("invalid email.subject: %w", err)
+	}
+	if body, err = template.New("body").Parse(b); err != nil {
+		return nil, nil, fmt.Errorf("invalid email.body: %w", err)
+	}
+	return subject, body, nil
+}
+
+// emailSummary is what the templates see: the report of the run, the
+// counts and the error the run failed with, if any.
+type emailSummary struct {
+	*runReport
+	Copied int
+	Failed int
+	Error  string
+}
+
+// sendSummary mails the summary of a finished run that ended with runErr.
+func (ec EmailConfig) sendSummary(r *runReport, runErr error) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	sum := emailSummary{runReport: r}
+	for _, res := range r.Images {
+		switch res.Status {
+		case resultCopied:
+			sum.Copied++
+		case resultFailed:
+			sum.Failed++
+		}
+	}
+	if runErr != nil {
+		sum.Error = redact(runErr.Error())
+	}
+
+	if ec.When == emailFailure && sum.Failed == 0 && runErr == nil {
+		return nil
+	}
+
+	subjectTmpl, bodyTmpl, err := ec.templates()
+	if err != nil {
+		return err
+	}
+	subject, body := &strings.Builder{}, &strings.Builder{}
+	if err := subjectTmpl.Execute(subject, sum); err != nil {
+		return fmt.Errorf("can't render email subject: %w", err)
+	}
+	if err := bodyTmpl.Execute(body, sum); err != nil {
+		return fmt.Errorf("can't render email body: %w", err)
+	}
+
+	msg := &bytes.Buffer{}
+	fmt.Fprintf(msg, "From: %v\r\n", ec.From)
+	fmt.Fprintf(msg, "To: %v\r\n", strings.Join(ec.To, ", "))
+	fmt.Fprintf(msg, "Subject: %v\r\n", mime.QEncoding.Encode("utf-8", strings.TrimSpace(subject.String())))
+	fmt.Fprintf(msg, "Date: %v\r\n", time.Now().Format(time.RFC1123Z))
+	msg.WriteString("MIME-Version: 1.0\r\nContent-Type: text/plain; charset=utf-8\r\n\r\n")
+	msg.WriteString(strings.ReplaceAll(strings.ReplaceAll(body.String(), "\r\n", "\n"), "\n", "\r\n"))
+
+	if err := ec.send(msg.Bytes()); err != nil {
+		return fmt.Errorf("can't send email: %w", err)
+	}
+
+	debugf("sent run summary to %v", strings.Join(ec.To, ", "))
+
+	return nil
+}
+
+func (ec EmailConfig) send(msg []byte) error {
+	host, _, _ := net.SplitHostPort(ec.Host)
+	dialer := &net.Dialer{Timeout: smtpTimeout}
+
+	var conn net.Conn
+	var err error
+	if ec.TLS == emailTLS {
+		conn, err = tls.DialWithDialer(dialer, "tcp", ec.Host, &tls.Config{ServerName: host})
+	} else {
+		conn, err = dialer.Dial("tcp", ec.Host)
+	}
+	if err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Now().Add(smtpTimeout))
+
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer c.Close()
+
+	if ec.TLS == "" || ec.TLS == emailStartTLS {
+		if ok, _ := c.Extension("STARTTLS"); !ok {
+			return fmt.Errorf("%v doesn't offer STARTTLS, set email.tls to none to send unencrypted", ec.Host)
+		}
+		if err := c.StartTLS(&tls.Config{ServerName: host}); err != nil {
+			return err
+		}
+	}
+
+	if ec.Username != "" {
+		if err := c.Auth(smtp.PlainAuth("", ec.Username, os.Getenv(smtpPasswordEnv), host)); err != nil {
+			return err
+		}
+	}
+
+	if err := c.Mail(ec.From); err != nil {
+		return err
+	}
+	for _, to := range ec.To {
+		if err := c.Rcpt(to); err != nil {
+			return err
+		}
+	}
+
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(msg); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+
+	return c.Quit()
+}
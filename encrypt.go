@@ -0,0 +1,501 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// Layer encryption in the ocicrypt format, which containerd imgcrypt, skopeo,
+// buildah and podman read: layer content is encrypted with
+// AES_256_CTR_HMAC_SHA256 under a random key, which is wrapped for the
+// recipients in a JWE carried in the layer annotations.
+const (
+	encryptedSuffix = "+encrypted"
+	encCipher       = "AES_256_CTR_HMAC_SHA256"
+
+	annotationEncPrefix  = "org.opencontainers.image.enc."
+	annotationEncKeysJWE = "org.opencontainers.image.enc.keys.jwe"
+	annotationEncPubOpts = "org.opencontainers.image.enc.pubopts"
+
+	mediaTypeDockerConfig = "application/vnd.docker.container.image.v1+json"
+	mediaTypeOCIConfig    = "application/vnd.oci.image.config.v1+json"
+)
+
+// EncryptionConfig encrypts the layers pushed to to_repo for the recipients
+// and decrypts encrypted source layers with the decryption keys. Keys are
+// RSA keys in PEM files.
+type EncryptionConfig struct {
+	// Recipients are public keys, as a path or as jwe:path like the
+	// ocicrypt tools take them.
+	Recipients []string `json:"recipients,omitempty"`
+	// DecryptionKeys are private keys, unencrypted PKCS #1 or PKCS #8.
+	DecryptionKeys []string `json:"decryption_keys,omitempty"`
+}
+
+func (ec EncryptionConfig) validate() error {
+	if len(ec.Recipients) == 0 && len(ec.DecryptionKeys) == 0 {
+		return fmt.Errorf("encryption needs recipients or decryption_keys")
+	}
+
+	return nil
+}
+
+// privateOptions and publicOptions are ocicrypt's
+// PrivateLayerBlockCipherOptions and PublicLayerBlockCipherOptions.
+type privateOptions struct {
+	SymmetricKey  []byte            `json:"symkey"`
+	Digest        string            `json:"digest"`
+	CipherOptions map[string][]byte `json:"cipheroptions"`
+}
+
+type publicOptions struct {
+	CipherType    string            `json:"cipher"`
+	Hmac          []byte            `json:"hmac"`
+	CipherOptions map[string][]byte `json:"cipheroptions"`
+}
+
+// encrypt encrypts every layer that isn't encrypted yet. Encrypted images
+// use the OCI media types.
+func (b *builtImage) encrypt(recipients []*rsa.PublicKey) error {
+	b.toOCI()
+
+	n := 0
+	for i, l := range b.layers {
+		if strings.HasSuffix(l.MediaType, encryptedSuffix) || l.file == "" {
+			continue
+		}
+
+		out := b.path(fmt.Sprintf("encrypted-%v", i))
+		enc, err := encryptLayer(l, out, recipients)
+		if err != nil {
+			return fmt.Errorf("can't encrypt layer '%v': %w", l.Digest, err)
+		}
+
+		os.Remove(l.file)
+		b.layers[i] = enc
+		n++
+	}
+
+	infof("encrypted %v layers for %v recipients", n, len(recipients))
+
+	return nil
+}
+
+func encryptLayer(l builtLayer, out string, recipients []*rsa.PublicKey) (builtLayer, error) {
+	key := make([]byte, 32)
+	nonce := make([]byte, aes.BlockSize)
+	if _, err := rand.Read(key); err != nil {
+		return builtLayer{}, err
+	}
+	if _, err := rand.Read(nonce); err != nil {
+		return builtLayer{}, err
+	}
+
+	mac := hmac.New(sha256.New, key)
+	d, size, err := cryptFile(l.file, out, key, nonce, nil, mac)
+	if err != nil {
+		return builtLayer{}, err
+	}
+
+	priv, err := json.Marshal(privateOptions{SymmetricKey: key, Digest: l.Digest, CipherOptions: map[string][]byte{"nonce": nonce}})
+	if err != nil {
+		return builtLayer{}, err
+	}
+	pub, err := json.Marshal(publicOptions{CipherType: encCipher, Hmac: mac.Sum(nil), CipherOptions: map[string][]byte{}})
+	if err != nil {
+		return builtLayer{}, err
+	}
+
+	jwe, err := jweEncrypt(priv, recipients)
+	if err != nil {
+		return builtLayer{}, err
+	}
+
+	enc := builtLayer{descriptor: l.descriptor, file: out}
+	enc.MediaType = l.MediaType + encryptedSuffix
+	enc.Digest, enc.Size = d, size
+	enc.Annotations = map[string]string{}
+	for k, v := range l.Annotations {
+		enc.Annotations[k] = v
+	}
+	enc.Annotations[annotationEncKeysJWE] = base64.StdEncoding.EncodeToString(jwe)
+	enc.Annotations[annotationEncPubOpts] = base64.StdEncoding.EncodeToString(pub)
+
+	return enc, nil
+}
+
+// decrypt decrypts the encrypted layers with the first key they were
+// encrypted for.
+func (b *builtImage) decrypt(keys []*rsa.PrivateKey) error {
+	n := 0
+	for i, l := range b.layers {
+		if !strings.HasSuffix(l.MediaType, encryptedSuffix) {
+			continue
+		}
+
+		out := b.path(fmt.Sprintf("decrypted-%v", i))
+		dec, err := decryptLayer(l, out, keys)
+		if err != nil {
+			return fmt.Errorf("can't decrypt layer '%v': %w", l.Digest, err)
+		}
+
+		os.Remove(l.file)
+		b.layers[i] = dec
+		n++
+	}
+
+	if n > 0 {
+		infof("decrypted %v layers", n)
+		b.changed = true
+	}
+	return nil
+}
+
+func decryptLayer(l builtLayer, out string, keys []*rsa.PrivateKey) (builtLayer, error) {
+	jwe, err := base64.StdEncoding.DecodeString(l.Annotations[annotationEncKeysJWE])
+	if err != nil || len(jwe) == 0 {
+		return builtLayer{}, fmt.Errorf("layer has no jwe key annotation")
+	}
+
+	data, err := jweDecrypt(jwe, keys)
+	if err != nil {
+		return builtLayer{}, err
+	}
+
+	priv := privateOptions{}
+	if err := json.Unmarshal(data, &priv); err != nil {
+		return builtLayer{}, fmt.Errorf("can't decode private options: %w", err)
+	}
+
+	pubData, err := base64.StdEncoding.DecodeString(l.Annotations[annotationEncPubOpts])
+	if err != nil {
+		return builtLayer{}, fmt.Errorf("invalid public options: %w", err)
+	}
+	pub := publicOptions{}
+	if err := json.Unmarshal(pubData, &pub); err != nil {
+		return builtLayer{}, fmt.Errorf("can't decode public options: %w", err)
+	}
+	if pub.CipherType != encCipher {
+		return builtLayer{}, fmt.Errorf("unsupported cipher '%v'", pub.CipherType)
+	}
+
+	mac := hmac.New(sha256.New, priv.SymmetricKey)
+	d, size, err := cryptFile(l.file, out, priv.SymmetricKey, priv.CipherOptions["nonce"], mac, nil)
+	if err != nil {
+		return builtLayer{}, err
+	}
+	if !hmac.Equal(mac.Sum(nil), pub.Hmac) {
+		return builtLayer{}, fmt.Errorf("hmac mismatch")
+	}
+	if d != priv.Digest {
+		return builtLayer{}, fmt.Errorf("decrypted digest %v, expected %v", d, priv.Digest)
+	}
+
+	dec := builtLayer{descriptor: l.descriptor, file: out}
+	dec.MediaType = strings.TrimSuffix(l.MediaType, encryptedSuffix)
+	dec.Digest, dec.Size = d, size
+	dec.Annotations = map[string]string{}
+	for k, v := range l.Annotations {
+		if !strings.HasPrefix(k, annotationEncPrefix) {
+			dec.Annotations[k] = v
+		}
+	}
+
+	return dec, nil
+}
+
+// cryptFile runs in through AES-CTR into out. macIn sees the input, macOut
+// the output. It returns the digest and size of out.
+func cryptFile(in, out string, key, nonce []byte, macIn, macOut hash.Hash) (string, int64, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return "", 0, err
+	}
+	if len(nonce) != aes.BlockSize {
+		return "", 0, fmt.Errorf("invalid nonce")
+	}
+	stream := cipher.NewCTR(block, nonce)
+
+	src, err := os.Open(in)
+	if err != nil {
+		return "", 0, err
+	}
+	defer src.Close()
+
+	dst, err := os.Create(out)
+	if err != nil {
+		return "", 0, err
+	}
+	defer dst.Close()
+
+	digest := sha256.New()
+	size := int64(0)
+	buf := make([]byte, 1<<20)
+	for {
+		n, readErr := src.Read(buf)
+		if n > 0 {
+			p := buf[:n]
+			if macIn != nil {
+				macIn.Write(p)
+			}
+			stream.XORKeyStream(p, p)
+			if macOut != nil {
+				macOut.Write(p)
+			}
+			digest.Write(p)
+			size += int64(n)
+
+			if _, err := dst.Write(p); err != nil {
+				return "", 0, err
+			}
+		}
+
+		if readErr == io.EOF {
+			break
+		}
+		if readErr != nil {
+			return "", 0, readErr
+		}
+	}
+
+	if err := dst.Close(); err != nil {
+		return "", 0, err
+	}
+
+	return "sha256:" + hex.EncodeToString(digest.Sum(nil)), size, nil
+}
+
+// toOCI switches the image to the OCI media types, which have annotations.
+func (b *builtImage) toOCI() {
+	switch b.mediaType {
+	case mediaTypeDockerManifest:
+		b.mediaType = mediaTypeOCIManifest
+	}
+	if b.config.MediaType == mediaTypeDockerConfig {
+		b.config.MediaType = mediaTypeOCIConfig
+	}
+	for i, l := range b.layers {
+		switch l.MediaType {
+		case mediaTypeDockerLayer:
+			b.layers[i].MediaType = mediaTypeOCILayer
+		case mediaTypeDockerForeignLayer:
+			b.layers[i].MediaType = mediaTypeOCINonDistributable + "+gzip"
+		}
+	}
+	b.changed = true
+}
+
+// jweJSON is the JSON serialization of a JWE, general or flattened.
+type jweJSON struct {
+	Protected    string            `json:"protected"`
+	Recipients   []jweRecipient    `json:"recipients,omitempty"`
+	Header       map[string]string `json:"header,omitempty"`
+	EncryptedKey string            `json:"encrypted_key,omitempty"`
+	IV           string            `json:"iv"`
+	Ciphertext   string            `json:"ciphertext"`
+	Tag          string            `json:"tag"`
+}
+
+type jweRecipient struct {
+	Header       map[string]string `json:"header,omitempty"`
+	EncryptedKey string            `json:"encrypted_key"`
+}
+
+var jweEncoding = base64.RawURLEncoding
+
+// jweEncrypt encrypts data with A256GCM and wraps the content key with
+// RSA-OAEP for every recipient.
+func jweEncrypt(data []byte, recipients []*rsa.PublicKey) ([]byte, error) {
+	cek := make([]byte, 32)
+	iv := make([]byte, 12)
+	if _, err := rand.Read(cek); err != nil {
+		return nil, err
+	}
+	if _, err := rand.Read(iv); err != nil {
+		return nil, err
+	}
+
+	j := jweJSON{Protected: jweEncoding.EncodeToString([]byte(`{"enc":"A256GCM"}`)), IV: jweEncoding.EncodeToString(iv)}
+	for _, pub := range recipients {
+		key, err := rsa.EncryptOAEP(sha1.New(), rand.Reader, pub, cek, nil)
+		if err != nil {
+			return nil, fmt.Errorf("can't wrap key: %w", err)
+		}
+		j.Recipients = append(j.Recipients, jweRecipient{Header: map[string]string{"alg": "RSA-OAEP"}, EncryptedKey: jweEncoding.EncodeToString(key)})
+	}
+
+	gcm, err := newGCM(cek)
+	if err != nil {
+		return nil, err
+	}
+	sealed := gcm.Seal(nil, iv, data, []byte(j.Protected))
+	j.Ciphertext = jweEncoding.EncodeToString(sealed[:len(sealed)-gcm.Overhead()])
+	j.Tag = jweEncoding.EncodeToString(sealed[len(sealed)-gcm.Overhead():])
+
+	return json.Marshal(j)
+}
+
+func jweDecrypt(data []byte, keys []*rsa.PrivateKey) ([]byte, error) {
+	j := jweJSON{}
+	if err := json.Unmarshal(data, &j); err != nil {
+		return nil, fmt.Errorf("can't decode jwe: %w", err)
+	}
+
+	protectedData, err := jweEncoding.DecodeString(j.Protected)
+	if err != nil {
+		return nil, fmt.Errorf("invalid jwe header: %w", err)
+	}
+	protected := map[string]string{}
+	if err := json.Unmarshal(protectedData, &protected); err != nil {
+		return nil, fmt.Errorf("invalid jwe header: %w", err)
+	}
+	if protected["enc"] != "A256GCM" {
+		return nil, fmt.Errorf("unsupported jwe encryption '%v'", protected["enc"])
+	}
+
+	recipients := j.Recipients
+	if j.EncryptedKey != "" {
+		recipients = append(recipients, jweRecipient{Header: j.Header, EncryptedKey: j.EncryptedKey})
+	}
+
+	iv, _ := jweEncoding.DecodeString(j.IV)
+	ciphertext, _ := jweEncoding.DecodeString(j.Ciphertext)
+	tag, _ := jweEncoding.DecodeString(j.Tag)
+
+	for _, r := range recipients {
+		alg := r.Header["alg"]
+		if alg == "" {
+			alg = protected["alg"]
+		}
+
+		var h hash.Hash
+		switch alg {
+		case "RSA-OAEP":
+			h = sha1.New()
+		case "RSA-OAEP-256":
+			h = sha256.New()
+		default:
+			continue
+		}
+
+		wrapped, err := jweEncoding.DecodeString(r.EncryptedKey)
+		if err != nil {
+			continue
+		}
+
+		for _, key := range keys {
+			cek, err := rsa.DecryptOAEP(h, rand.Reader, key, wrapped, nil)
+			if err != nil {
+				continue
+			}
+
+			gcm, err := newGCM(cek)
+			if err != nil {
+				return nil, err
+			}
+			plain, err := gcm.Open(nil, iv, append(ciphertext, tag...), []byte(j.Protected))
+			if err != nil {
+				return nil, fmt.Errorf("can't decrypt jwe: %w", err)
+			}
+			return plain, nil
+		}
+	}
+
+	return nil, fmt.Errorf("none of the decryption keys is a recipient")
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func (ec EncryptionConfig) publicKeys() ([]*rsa.PublicKey, error) {
+	keys := []*rsa.PublicKey{}
+	for _, r := range ec.Recipients {
+		file := strings.TrimPrefix(r, "jwe:")
+		block, err := readPEM(file)
+		if err != nil {
+			return nil, err
+		}
+
+		var key interface{}
+		switch block.Type {
+		case "RSA PUBLIC KEY":
+			key, err = x509.ParsePKCS1PublicKey(block.Bytes)
+		default:
+			key, err = x509.ParsePKIXPublicKey(block.Bytes)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("can't parse public key '%v': %w", file, err)
+		}
+
+		pub, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return nil, fmt.Errorf("public key '%v' isn't an RSA key", file)
+		}
+		keys = append(keys, pub)
+	}
+
+	return keys, nil
+}
+
+func (ec EncryptionConfig) privateKeys() ([]*rsa.PrivateKey, error) {
+	keys := []*rsa.PrivateKey{}
+	for _, file := range ec.DecryptionKeys {
+		block, err := readPEM(file)
+		if err != nil {
+			return nil, err
+		}
+
+		var key interface{}
+		switch block.Type {
+		case "RSA PRIVATE KEY":
+			key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+		default:
+			key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("can't parse private key '%v': %w", file, err)
+		}
+
+		priv, ok := key.(*rsa.PrivateKey)
+		if !ok {
+			return nil, fmt.Errorf("private key '%v' isn't an RSA key", file)
+		}
+		keys = append(keys, priv)
+	}
+
+	return keys, nil
+}
+
+func readPEM(file string) (*pem.Block, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("can't read key: %w", err)
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("'%v' isn't a PEM file", file)
+	}
+	return block, nil
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/docker/distribution/reference"
+)
+
+const (
+	backendDocker     = "docker"
+	backendContainerd = "containerd"
+	backendRegistry   = "registry"
+)
+
+// engine is a local image store the copy pipeline pulls images into, tags
+// them and pushes them from.
+type engine interface {
+	Pull(ctx context.Context, image string, ac AuthConfig) error
+	Tag(ctx context.Context, fromImg, toImg string) error
+	Push(ctx context.Context, image string, ac AuthConfig) error
+	Remove(ctx context.Context, image string) error
+	// ImageID returns the digest of the image config.
+	ImageID(ctx context.Context, image string) (string, error)
+	// HasDigest reports whether the local image is the manifest digest of
+	// its repository, so pulling it again can be skipped.
+	HasDigest(ctx context.Context, image, digest string) (bool, error)
+	// InUse reports whether running containers use the local image.
+	InUse(ctx context.Context, image string) (bool, error)
+	// Layers identifies the layers, and the config, of the local image.
+	// Images sharing some of them depend on each other in the engine.
+	Layers(ctx context.Context, image string) ([]string, error)
+	Close() error
+}
+
+func newEngine(c Config) (engine, error) {
+	switch c.Backend {
+	case "", backendDocker:
+		return newDockerEngine(c)
+	case backendContainerd:
+		return newContainerdEngine(c.Containerd, c.IncludeNonDistributable)
+	case backendRegistry:
+		return newRegistryEngine(c.IncludeNonDistributable), nil
+	default:
+		return nil, fmt.Errorf("unknown backend '%v'", c.Backend)
+	}
+}
+
+// splitImage splits an image reference into the registry host, the
+// repository path and the tag, or the digest of pinned references.
+func splitImage(image string) (host, repo, tag string, err error) {
+	named, err := reference.ParseNormalizedNamed(image)
+	if err != nil {
+		return "", "", "", fmt.Errorf("invalid image reference '%v': %w", image, err)
+	}
+
+	tag = "latest"
+	if tagged, ok := named.(reference.Tagged); ok {
+		tag = tagged.Tag()
+	}
+	if digested, ok := named.(reference.Digested); ok {
+		tag = digested.Digest().String()
+	}
+
+	return reference.Domain(named), reference.Path(named), tag, nil
+}
+
+// registryForImage returns a client for the registry hosting image, using
+// the credentials of ac.
+func registryForImage(image string, ac AuthConfig) (*registryClient, string, string, error) {
+	host, repo, tag, err := splitImage(image)
+	if err != nil {
+		return nil, "", "", err
+	}
+
+	ac.BaseAddress = host
+	return newRegistryClient(ac), repo, tag, nil
+}
+
+// tracedEngine records a span for every engine operation.
+type tracedEngine struct {
+	engine
+}
+
+func (e tracedEngine) Pull(ctx context.Context, image string, ac AuthConfig) (err error) {
+	ctx, sp := startSpan(ctx, "pull", "image", image)
+	defer func() { sp.End(err) }()
+	return e.engine.Pull(ctx, image, ac)
+}
+
+func (e tracedEngine) Tag(ctx context.Context, fromImg, toImg string) (err error) {
+	ctx, sp := startSpan(ctx, "tag", "image.source", fromImg, "image.destination", toImg)
+	defer func() { sp.End(err) }()
+	return e.engine.Tag(ctx, fromImg, toImg)
+}
+
+func (e tracedEngine) Push(ctx context.Context, image string, ac AuthConfig) (err error) {
+	ctx, sp := startSpan(ctx, "push", "image", image)
+	defer func() { sp.End(err) }()
+	return e.engine.Push(ctx, image, ac)
+}
+
+func (e tracedEngine) Remove(ctx context.Context, image string) (err error) {
+	ctx, sp := startSpan(ctx, "remove", "image", image)
+	defer func() { sp.End(err) }()
+	return e.engine.Remove(ctx, image)
+}
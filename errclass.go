@@ -0,0 +1,253 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/docker/docker/errdefs"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Error classes of failed copies, in logs, reports and statistics.
+const (
+	classAuth             = "auth"
+	classNotFound         = "not-found"
+	classRateLimited      = "rate-limited"
+	classNetwork          = "network"
+	classQuota            = "quota"
+	classDigestMismatch   = "digest-mismatch"
+	classUpstreamMismatch = "upstream-mismatch"
+	classCanceled         = "canceled"
+	classDiskFull         = "disk-full"
+	classOther            = "other"
+)
+
+const defaultRetryBackoff = 10 * time.Second
+
+// RetryConfig retries copies that failed with a transient error: rate
+// limits, network errors and digest mismatches. Authentication, not found,
+// quota, full disk and upstream mismatch errors won't go away by retrying
+// and fail right away.
+type RetryConfig struct {
+	// Attempts is the number of retries after the first failure.
+	Attempts int `json:"attempts"`
+	// Backoff is the wait before the first retry, doubled for every further
+	// one, 10s by default. A Retry-After of the registry takes precedence.
+	Backoff Duration `json:"backoff,omitempty"`
+}
+
+func (rc RetryConfig) validate() error {
+	if rc.Attempts < 0 || rc.Backoff < 0 {
+		return fmt.Errorf("retry attempts and backoff can't be negative")
+	}
+	return nil
+}
+
+// classifiedError is an error with its class.
+type classifiedError struct {
+	class string
+	err   error
+}
+
+func (e *classifiedError) Error() string {
+	return e.err.Error()
+}
+
+func (e *classifiedError) Unwrap() error {
+	return e.err
+}
+
+// classify wraps err with its class, see errorClass.
+func classify(err error) error {
+	if err == nil {
+		return nil
+	}
+
+	var ce *classifiedError
+	if errors.As(err, &ce) {
+		return err
+	}
+	return &classifiedError{class: errorClass(err), err: err}
+}
+
+// errorClass tells what kind of failure err is: typed registry and network
+// errors first, then the messages of the container engines, which only
+// reach dimco as text.
+func errorClass(err error) string {
+	var ce *classifiedError
+	if errors.As(err, &ce) {
+		return ce.class
+	}
+
+	if errors.Is(err, context.Canceled) {
+		return classCanceled
+	}
+	if errors.Is(err, syscall.ENOSPC) {
+		return classDiskFull
+	}
+
+	var se *statusError
+	if errors.As(err, &se) {
+		body := strings.ToLower(se.Body)
+		switch {
+		case strings.Contains(body, "quota"):
+			return classQuota
+		case se.StatusCode == http.StatusUnauthorized || se.StatusCode == http.StatusForbidden:
+			return classAuth
+		case se.StatusCode == http.StatusNotFound:
+			return classNotFound
+		case se.StatusCode == http.StatusTooManyRequests:
+			return classRateLimited
+		case strings.Contains(body, "digest_invalid"):
+			return classDigestMismatch
+		case se.StatusCode == http.StatusServiceUnavailable && se.RetryAfter > 0:
+			return classRateLimited
+		case se.StatusCode >= 500:
+			return classNetwork
+		}
+	}
+
+	// errdefs doesn't follow Unwrap, the docker errors are looked for in
+	// the chain.
+	switch {
+	case inChain(err, errdefs.IsUnauthorized) || inChain(err, errdefs.IsForbidden):
+		return classAuth
+	case inChain(err, errdefs.IsNotFound):
+		return classNotFound
+	case inChain(err, errdefs.IsUnavailable):
+		return classNetwork
+	}
+
+	if code, ok := grpcCode(err); ok {
+		switch code {
+		case codes.Unauthenticated, codes.PermissionDenied:
+			return classAuth
+		case codes.NotFound:
+			return classNotFound
+		case codes.ResourceExhausted:
+			return classRateLimited
+		case codes.Unavailable, codes.DeadlineExceeded:
+			return classNetwork
+		}
+	}
+
+	var ne net.Error
+	if errors.As(err, &ne) || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, context.DeadlineExceeded) {
+		return classNetwork
+	}
+
+	msg := strings.ToLower(err.Error())
+	switch {
+	case containsAny(msg, "no space left on device", "not enough disk space"):
+		return classDiskFull
+	case containsAny(msg, "quota"):
+		return classQuota
+	case containsAny(msg, "toomanyrequests", "too many requests", "rate limit"):
+		return classRateLimited
+	case containsAny(msg, "unauthorized", "authentication required", "denied", "forbidden", "no basic auth credentials"):
+		return classAuth
+	case containsAny(msg, "manifest unknown", "not found", "name unknown", "no such image"):
+		return classNotFound
+	case containsAny(msg, "digest mismatch", "digest invalid", "unexpected commit digest", "verification failed", "did not match"):
+		return classDigestMismatch
+	case containsAny(msg, "connection refused", "connection reset", "i/o timeout", "no such host", "tls handshake timeout",
+		"unexpected eof", "broken pipe", "network is unreachable", "server misbehaving", "bad gateway", "service unavailable"):
+		return classNetwork
+	}
+
+	return classOther
+}
+
+func inChain(err error, is func(error) bool) bool {
+	for ; err != nil; err = errors.Unwrap(err) {
+		if is(err) {
+			return true
+		}
+	}
+	return false
+}
+
+// grpcCode is the code of the first gRPC status in the chain of err, as
+// returned by containerd.
+func grpcCode(err error) (codes.Code, bool) {
+	for ; err != nil; err = errors.Unwrap(err) {
+		if se, ok := err.(interface{ GRPCStatus() *status.Status }); ok {
+			return se.GRPCStatus().Code(), true
+		}
+	}
+	return codes.OK, false
+}
+
+func containsAny(s string, substrs ...string) bool {
+	for _, sub := range substrs {
+		if strings.Contains(s, sub) {
+			return true
+		}
+	}
+	return false
+}
+
+// retryable reports whether a copy that failed with class may succeed when
+// tried again.
+func retryable(class string) bool {
+	switch class {
+	case classRateLimited, classNetwork, classDigestMismatch:
+		return true
+	default:
+		return false
+	}
+}
+
+// retryAfter is the wait the registry asked for with Retry-After, 0 if it
+// didn't.
+func retryAfter(err error) time.Duration {
+	var se *statusError
+	if errors.As(err, &se) {
+		return se.RetryAfter
+	}
+	return 0
+}
+
+// parseRetryAfter reads a Retry-After header, in seconds or as an HTTP date.
+func parseRetryAfter(h string) time.Duration {
+	if h == "" {
+		return 0
+	}
+
+	if s, err := strconv.Atoi(strings.TrimSpace(h)); err == nil && s > 0 {
+		return time.Duration(s) * time.Second
+	}
+	if t, err := http.ParseTime(h); err == nil {
+		if d := time.Until(t); d > 0 {
+			return d
+		}
+	}
+
+	return 0
+}
+
+// retryDelay is the wait before retry number attempt, starting at 1.
+func (rc RetryConfig) retryDelay(attempt int, err error) time.Duration {
+	if d := retryAfter(err); d > 0 {
+		return d
+	}
+
+	d := time.Duration(rc.Backoff)
+	if d == 0 {
+		d = defaultRetryBackoff
+	}
+	for i := 1; i < attempt && d < time.Hour; i++ {
+		d *= 2
+	}
+	return d
+}
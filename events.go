@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// eventTimeout bounds publishing the event of one copy.
+const eventTimeout = 10 * time.Second
+
+// EventsConfig publishes an event after every copy, for deploy triggers or
+// inventories that would otherwise poll the reports.
+type EventsConfig struct {
+	NATS  *NATSConfig  `json:"nats,omitempty"`
+	Kafka *KafkaConfig `json:"kafka,omitempty"`
+}
+
+func (ec EventsConfig) validate() error {
+	if ec.NATS == nil && ec.Kafka == nil {
+		return fmt.Errorf("events needs nats or kafka")
+	}
+
+	if ec.NATS != nil {
+		if err := ec.NATS.validate(); err != nil {
+			return err
+		}
+	}
+
+	if ec.Kafka != nil {
+		if err := ec.Kafka.validate(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// copyEvent is the event published after a copy.
+type copyEvent struct {
+	Time              time.Time `json:"time"`
+	Source            string    `json:"source"`
+	SourceDigest      string    `json:"source_digest,omitempty"`
+	Destination       string    `json:"destination"`
+	DestinationDigest string    `json:"destination_digest,omitempty"`
+	Status            string    `json:"status"`
+	Duration          float64   `json:"duration_seconds"`
+	Error             string    `json:"error,omitempty"`
+	ErrorClass        string    `json:"error_class,omitempty"`
+}
+
+// eventPublisher delivers a message to a NATS subject or a Kafka topic,
+// keyed by destination so consumers can keep per-image order.
+type eventPublisher interface {
+	publish(ctx context.Context, key string, data []byte) error
+	Close() error
+}
+
+// eventSink publishes the events of a run to every configured system. The
+// connections are opened with the first event and reused.
+type eventSink struct {
+	config EventsConfig
+
+	mu         sync.Mutex
+	publishers []eventPublisher
+}
+
+func newEventSink(ec EventsConfig) *eventSink {
+	return &eventSink{config: ec}
+}
+
+// send publishes the event of res. Failed deliveries are logged, they don't
+// fail the copy.
+func (s *eventSink) send(res imageResult, sourceDigest string) {
+	if s == nil {
+		return
+	}
+
+	data, err := json.Marshal(copyEvent{
+		Time:              time.Now().UTC(),
+		Source:            res.Source,
+		SourceDigest:      sourceDigest,
+		Destination:       res.Destination,
+		DestinationDigest: res.Digest,
+		Status:            res.Status,
+		Duration:          res.Duration,
+		Error:             res.Error,
+		ErrorClass:        res.ErrorClass,
+	})
+	if err != nil {
+		log.Print(fmt.Errorf("can't encode event: %w", err))
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), eventTimeout)
+	defer cancel()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.publishers == nil {
+		if s.config.NATS != nil {
+			s.publishers = append(s.publishers, newNATSPublisher(*s.config.NATS))
+		}
+		if s.config.Kafka != nil {
+			s.publishers = append(s.publishers, newKafkaPublisher(*s.config.Kafka))
+		}
+	}
+
+	for _, p := range s.publishers {
+		if err := p.publish(ctx, res.Destination, data); err != nil {
+			log.Print(fmt.Errorf("can't publish event of %v: %w", res.Destination, err))
+		}
+	}
+}
+
+func (s *eventSink) Close() error {
+	if s == nil {
+		return nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, p := range s.publishers {
+		p.Close()
+	}
+	s.publishers = nil
+
+	return nil
+}
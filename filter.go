@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+)
+
+// FilterConfig copies only the images whose labels, or annotations, carry
+// the distribution policy set at build time. Entries are "key", for a key
+// that is set, or "key=value", where value is a path.Match pattern.
+type FilterConfig struct {
+	// Labels all must match the labels of the image config.
+	Labels []string `json:"labels,omitempty"`
+	// ExcludeLabels skip images with any of them.
+	ExcludeLabels []string `json:"exclude_labels,omitempty"`
+	// Annotations and ExcludeAnnotations match the annotations of the
+	// manifest, or of the index of multi-platform images.
+	Annotations        []string `json:"annotations,omitempty"`
+	ExcludeAnnotations []string `json:"exclude_annotations,omitempty"`
+	// Images limits the filter to these patterns of image names, or
+	// name:tag, as understood by path.Match.
+	Images []string `json:"images,omitempty"`
+}
+
+func (fc FilterConfig) validate() error {
+	all := [][]string{fc.Labels, fc.ExcludeLabels, fc.Annotations, fc.ExcludeAnnotations}
+	empty := true
+	for _, entries := range all {
+		for _, e := range entries {
+			empty = false
+			key, value, _ := splitFilter(e)
+			if key == "" {
+				return fmt.Errorf("filter: invalid entry '%v'", e)
+			}
+			if _, err := path.Match(value, ""); err != nil {
+				return fmt.Errorf("filter: invalid pattern in '%v': %w", e, err)
+			}
+		}
+	}
+	if empty {
+		return fmt.Errorf("filter needs labels or annotations")
+	}
+
+	if err := validPatterns(fc.Images); err != nil {
+		return fmt.Errorf("filter: %w", err)
+	}
+
+	return nil
+}
+
+// splitFilter splits a filter entry into key and value pattern, reporting
+// whether it has a value.
+func splitFilter(entry string) (string, string, bool) {
+	parts := strings.SplitN(entry, "=", 2)
+	if len(parts) == 1 {
+		return parts[0], "", false
+	}
+	return parts[0], parts[1], true
+}
+
+// matchesFilter reports whether values have the key of entry with a value
+// its pattern matches.
+func matchesFilter(entry string, values map[string]string) bool {
+	key, pattern, hasValue := splitFilter(entry)
+	v, ok := values[key]
+	if !ok {
+		return false
+	}
+	if !hasValue {
+		return true
+	}
+	matched, _ := path.Match(pattern, v)
+	return matched
+}
+
+// filterReason checks values against required and excluded entries and
+// returns why the image is left out, or "".
+func filterReason(kind string, values map[string]string, required, excluded []string) string {
+	for _, e := range required {
+		if !matchesFilter(e, values) {
+			return fmt.Sprintf("%v '%v' doesn't match", kind, e)
+		}
+	}
+	for _, e := range excluded {
+		if matchesFilter(e, values) {
+			return fmt.Sprintf("%v '%v' is excluded", kind, e)
+		}
+	}
+	return ""
+}
+
+// checkFilter reads the labels and annotations of the source of img and
+// returns why the filter leaves it out, or "" to copy it.
+func (s *syncer) checkFilter(ctx context.Context, img ImageData) (string, error) {
+	fc := s.config.Filter
+	if fc == nil || !img.selectedBy(fc.Images) {
+		return "", nil
+	}
+
+	fromImg, _ := s.references(img)
+	src := newRegistryClient(s.config.FromRepo)
+	repo := repositoryPath(s.config.FromRepo, img.FromPrefix, img.Name)
+
+	m, _, err := src.FetchManifest(ctx, repo, img.sourceRef())
+	if err != nil {
+		return "", fmt.Errorf("can't filter '%v': %w", fromImg, err)
+	}
+
+	if reason := filterReason("annotation", m.Annotations, fc.Annotations, fc.ExcludeAnnotations); reason != "" {
+		return reason, nil
+	}
+
+	if len(fc.Labels) == 0 && len(fc.ExcludeLabels) == 0 {
+		return "", nil
+	}
+	labels, err := sourceLabels(ctx, src, repo, m)
+	if err != nil {
+		return "", fmt.Errorf("can't filter '%v': %w", fromImg, err)
+	}
+	return filterReason("label", labels, fc.Labels, fc.ExcludeLabels), nil
+}
+
+// sourceLabels reads the labels of the config of m. The labels of the first
+// platform of an index stand for the image, they are the same for every
+// platform of a build.
+func sourceLabels(ctx context.Context, src *registryClient, repo string, m manifest) (map[string]string, error) {
+	if len(m.Manifests) > 0 {
+		platforms := append([]descriptor{}, m.Manifests...)
+		// Attestation manifests have no platform of their own.
+		sort.SliceStable(platforms, func(i, j int) bool {
+			return platforms[i].Platform != nil && platforms[i].Platform.OS != "unknown" &&
+				(platforms[j].Platform == nil || platforms[j].Platform.OS == "unknown")
+		})
+
+		pm, _, err := src.FetchManifest(ctx, repo, platforms[0].Digest)
+		if err != nil {
+			return nil, err
+		}
+		m = pm
+	}
+	if m.Config.Digest == "" {
+		return nil, nil
+	}
+	return configLabels(ctx, src, repo, m.Config.Digest)
+}
+
+// configLabels reads the labels of the image config blob digest.
+func configLabels(ctx context.Context, src *registryClient, repo, digest string) (map[string]string, error) {
+	cfg, err := src.GetBlob(ctx, repo, digest)
+	if err != nil {
+		return nil, fmt.Errorf("can't get image config: %w", err)
+	}
+	var ic struct {
+		Config struct {
+			Labels map[string]string `json:"Labels"`
+		} `json:"config"`
+	}
+	// Artifacts may have configs of their own format, without labels.
+	if err := json.Unmarshal(cfg, &ic); err != nil {
+		return nil, nil
+	}
+	return ic.Config.Labels, nil
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+// Media types of layers that registries don't have to distribute, like the
+// Windows base layers, which are fetched from their urls instead.
+const (
+	mediaTypeDockerForeignLayer  = "application/vnd.docker.image.rootfs.foreign.diff.tar.gzip"
+	mediaTypeOCINonDistributable = "application/vnd.oci.image.layer.nondistributable.v1.tar"
+)
+
+// isForeign reports whether d is a foreign or non-distributable layer.
+func isForeign(d descriptor) bool {
+	return d.MediaType == mediaTypeDockerForeignLayer || strings.HasPrefix(d.MediaType, mediaTypeOCINonDistributable)
+}
+
+// distributable is d as a regular layer, once its blob is copied.
+func distributable(d descriptor) descriptor {
+	switch {
+	case d.MediaType == mediaTypeDockerForeignLayer:
+		d.MediaType = mediaTypeDockerLayer
+	case strings.HasPrefix(d.MediaType, mediaTypeOCINonDistributable):
+		d.MediaType = "application/vnd.oci.image.layer.v1.tar" + strings.TrimPrefix(d.MediaType, mediaTypeOCINonDistributable)
+	}
+	d.URLs = nil
+	return d
+}
+
+// openLayer streams a layer from the registry or, for foreign layers it
+// doesn't have, from the urls of the descriptor.
+func openLayer(ctx context.Context, rc *registryClient, repo string, d descriptor) (io.ReadCloser, error) {
+	body, _, err := rc.OpenBlob(ctx, repo, d.Digest)
+	if err == nil || !isForeign(d) || !isNotFound(err) || len(d.URLs) == 0 {
+		return body, err
+	}
+
+	for _, u := range d.URLs {
+		req, rerr := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+		if rerr != nil {
+			err = rerr
+			continue
+		}
+
+		resp, rerr := http.DefaultClient.Do(req)
+		if rerr != nil {
+			err = rerr
+			continue
+		}
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			err = fmt.Errorf("GET %v: unexpected status %v", u, resp.StatusCode)
+			continue
+		}
+
+		debugf("fetching foreign layer %v from %v", d.Digest, u)
+		return resp.Body, nil
+	}
+
+	return nil, fmt.Errorf("can't fetch foreign layer: %w", err)
+}
+
+// openLayerAt streams a layer from offset on.
+func openLayerAt(ctx context.Context, rc *registryClient, repo string, d descriptor, offset int64) (io.ReadCloser, error) {
+	if offset == 0 {
+		return openLayer(ctx, rc, repo, d)
+	}
+
+	body, err := rc.OpenBlobAt(ctx, repo, d.Digest, offset)
+	if err == nil || !isForeign(d) || !isNotFound(err) {
+		return body, err
+	}
+
+	// The urls of foreign layers are read from the start.
+	if body, err = openLayer(ctx, rc, repo, d); err != nil {
+		return nil, err
+	}
+	if _, err := io.CopyN(ioutil.Discard, body, offset); err != nil {
+		body.Close()
+		return nil, fmt.Errorf("can't read foreign layer: %w", err)
+	}
+	return body, nil
+}
+
+// rewriteDescriptors replaces the descriptors under key, layers or
+// manifests, of a raw manifest, keeping every other field of the manifest
+// and the descriptors.
+func rewriteDescriptors(data []byte, key string, ds []descriptor) ([]byte, error) {
+	m := map[string]json.RawMessage{}
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, fmt.Errorf("can't decode manifest: %w", err)
+	}
+
+	raw := []map[string]json.RawMessage{}
+	if err := json.Unmarshal(m[key], &raw); err != nil {
+		return nil, fmt.Errorf("can't decode %v: %w", key, err)
+	}
+	if len(raw) != len(ds) {
+		return nil, fmt.Errorf("manifest has %v %v, not %v", len(raw), key, len(ds))
+	}
+
+	for i, l := range ds {
+		if l.MediaType != "" {
+			raw[i]["mediaType"], _ = json.Marshal(l.MediaType)
+		}
+		raw[i]["digest"], _ = json.Marshal(l.Digest)
+		raw[i]["size"], _ = json.Marshal(l.Size)
+		delete(raw[i], "urls")
+		if len(l.URLs) > 0 {
+			raw[i]["urls"], _ = json.Marshal(l.URLs)
+		}
+	}
+
+	var err error
+	if m[key], err = json.Marshal(raw); err != nil {
+		return nil, err
+	}
+	return json.Marshal(m)
+}
+
+// distributableManifest returns data with its foreign layers turned into
+// regular ones, and whether there were any.
+func distributableManifest(data []byte, m manifest) ([]byte, bool, error) {
+	changed := false
+	layers := make([]descriptor, len(m.Layers))
+	for i, l := range m.Layers {
+		layers[i] = l
+		if isForeign(l) {
+			layers[i] = distributable(l)
+			changed = true
+		}
+	}
+	if !changed {
+		return data, false, nil
+	}
+
+	data, err := rewriteDescriptors(data, "layers", layers)
+	return data, true, err
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// GroupConfig gives the images naming it in group their own settings, e.g.
+// for third-party base images that are copied less often and kept in a
+// separate namespace.
+type GroupConfig struct {
+	Name string `json:"name"`
+
+	// Concurrency caps the images of the group copied at a time.
+	Concurrency int `json:"concurrency,omitempty"`
+	// Retry replaces the retry settings of the config.
+	Retry *RetryConfig `json:"retry,omitempty"`
+	// Interval is the time between the daemon's runs of the group, the
+	// -interval of the daemon when unset.
+	Interval Duration `json:"interval,omitempty"`
+	// ToPrefix is the to_prefix of images that don't set one.
+	ToPrefix string `json:"to_prefix,omitempty"`
+	// Cleanup replaces the cleanup of the config.
+	Cleanup string `json:"cleanup,omitempty"`
+	// Window replaces the transfer window of the config.
+	Window *WindowConfig `json:"window,omitempty"`
+}
+
+func (gc GroupConfig) validate() error {
+	if gc.Name == "" {
+		return fmt.Errorf("group name is required")
+	}
+
+	if gc.Concurrency < 0 || gc.Interval < 0 {
+		return fmt.Errorf("group '%v': concurrency and interval can't be negative", gc.Name)
+	}
+
+	if gc.Retry != nil {
+		if err := gc.Retry.validate(); err != nil {
+			return fmt.Errorf("group '%v': %w", gc.Name, err)
+		}
+	}
+
+	if err := validCleanup(gc.Cleanup); err != nil {
+		return fmt.Errorf("group '%v': %w", gc.Name, err)
+	}
+
+	if gc.Window != nil {
+		if err := gc.Window.validate(); err != nil {
+			return fmt.Errorf("group '%v': %w", gc.Name, err)
+		}
+	}
+
+	return nil
+}
+
+func (c Config) validateGroups() error {
+	names := map[string]bool{}
+	for _, gc := range c.Groups {
+		if err := gc.validate(); err != nil {
+			return err
+		}
+		if names[gc.Name] {
+			return fmt.Errorf("duplicate group '%v'", gc.Name)
+		}
+		names[gc.Name] = true
+	}
+
+	for i, img := range c.Images {
+		if img.Group != "" && !names[img.Group] {
+			return fmt.Errorf("images[%v] (%v): unknown group '%v'", i, img.Name, img.Group)
+		}
+	}
+
+	return nil
+}
+
+// group returns the group of img, nil for images without one.
+func (c Config) group(img ImageData) *GroupConfig {
+	for i := range c.Groups {
+		if c.Groups[i].Name == img.Group && img.Group != "" {
+			return &c.Groups[i]
+		}
+	}
+	return nil
+}
+
+// withGroupPrefixes sets the to_prefix of the group on images without one
+// or a to_name.
+func (c Config) withGroupPrefixes(images []ImageData) []ImageData {
+	for i, img := range images {
+		if gc := c.group(img); gc != nil && img.ToPrefix == "" && img.ToName == "" {
+			images[i].ToPrefix = gc.ToPrefix
+		}
+	}
+	return images
+}
+
+// retryConfig is the retry setting for img.
+func (c Config) retryConfig(img ImageData) RetryConfig {
+	if gc := c.group(img); gc != nil && gc.Retry != nil {
+		return *gc.Retry
+	}
+	if c.Retry != nil {
+		return *c.Retry
+	}
+	return RetryConfig{}
+}
+
+// cleanup is the cleanup setting for img.
+func (c Config) cleanup(img ImageData) string {
+	if gc := c.group(img); gc != nil && gc.Cleanup != "" {
+		return gc.Cleanup
+	}
+	return c.Cleanup
+}
+
+// groupSlots limits the copies running at a time per group.
+type groupSlots map[string]chan struct{}
+
+func newGroupSlots(c Config) groupSlots {
+	slots := groupSlots{}
+	for _, gc := range c.Groups {
+		if gc.Concurrency > 0 {
+			slots[gc.Name] = make(chan struct{}, gc.Concurrency)
+		}
+	}
+	return slots
+}
+
+// acquire blocks until an image of group may be copied and returns the
+// function that frees its slot.
+func (gs groupSlots) acquire(ctx context.Context, group string) (func(), error) {
+	slots, ok := gs[group]
+	if !ok {
+		return func() {}, nil
+	}
+
+	select {
+	case slots <- struct{}{}:
+		return func() { <-slots }, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// dueSchedules returns the schedules of c, by group name and "" for the
+// images without an interval of their own, that are due at now after the
+// runs in last.
+func (c Config) dueSchedules(interval time.Duration, last map[string]time.Time, now time.Time) map[string]bool {
+	due := map[string]bool{}
+	for key, iv := range c.schedules(interval) {
+		if now.Sub(last[key]) >= iv {
+			due[key] = true
+		}
+	}
+	return due
+}
+
+// schedules returns the interval of every schedule of c.
+func (c Config) schedules(interval time.Duration) map[string]time.Duration {
+	s := map[string]time.Duration{"": interval}
+	for _, gc := range c.Groups {
+		if gc.Interval > 0 {
+			s[gc.Name] = time.Duration(gc.Interval)
+		}
+	}
+	return s
+}
+
+// schedule is the key of the schedule img follows.
+func (c Config) schedule(img ImageData) string {
+	if gc := c.group(img); gc != nil && gc.Interval > 0 {
+		return gc.Name
+	}
+	return ""
+}
+
+// withImages returns c with only images, part of the images of c, for a
+// daemon run of some of the schedules.
+func (c Config) withImages(images []ImageData) Config {
+	// Dependencies outside the run were copied by runs of their own.
+	for i, img := range images {
+		deps := []string{}
+		for _, want := range img.DependsOn {
+			for _, other := range images {
+				if other.matches(want) {
+					deps = append(deps, want)
+					break
+				}
+			}
+		}
+		images[i].DependsOn = deps
+	}
+
+	c.Images = images
+	return c
+}
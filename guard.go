@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+)
+
+// checkTagConflict refuses to replace a destination tag that already points
+// to a different image than the local one. With overwrite it only warns.
+func checkTagConflict(ctx context.Context, e engine, dst *registryClient, localImg, repo, tag string, overwrite bool) error {
+	imageID, err := e.ImageID(ctx, localImg)
+	if err != nil {
+		return err
+	}
+
+	return checkConfigConflict(ctx, dst, imageID, repo, tag, overwrite)
+}
+
+// checkConfigConflict is checkTagConflict for an image with the config
+// digest imageID.
+func checkConfigConflict(ctx context.Context, dst *registryClient, imageID, repo, tag string, overwrite bool) error {
+	m, digest, err := dst.FetchManifest(ctx, repo, tag)
+	if isNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("can't check destination tag: %w", err)
+	}
+
+	// The local image ID is the digest of its config, so it matches the
+	// destination when the tag or one of its platforms uses the same config.
+	configs := []string{m.Config.Digest}
+	for _, d := range m.Manifests {
+		pm, _, err := dst.FetchManifest(ctx, repo, d.Digest)
+		if err != nil {
+			return fmt.Errorf("can't check destination tag: %w", err)
+		}
+		configs = append(configs, pm.Config.Digest)
+	}
+
+	for _, c := range configs {
+		if c == imageID {
+			return nil
+		}
+	}
+
+	if overwrite {
+		log.Printf("overwriting %v:%v, it pointed to %v", repo, tag, digest)
+		return nil
+	}
+
+	return fmt.Errorf("destination tag '%v:%v' already points to %v, use -overwrite to replace it", repo, tag, digest)
+}
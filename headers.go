@@ -0,0 +1,49 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// userAgent identifies dimco to registries that don't configure another
+// user agent.
+func userAgent() string {
+	return "dimco/" + currentBuild().Version
+}
+
+// setHeaders sets the user agent and the extra headers of the registry on
+// req.
+func (ac AuthConfig) setHeaders(req *http.Request) {
+	for k, v := range ac.Headers {
+		req.Header.Set(k, v)
+	}
+
+	ua := ac.UserAgent
+	if ua == "" {
+		ua = userAgent()
+	}
+	req.Header.Set("User-Agent", ua)
+}
+
+// validHeaders rejects header names that aren't tokens and the headers dimco
+// sets itself.
+func validHeaders(headers map[string]string) error {
+	for k, v := range headers {
+		if k == "" || strings.ContainsAny(k, " \t:()<>@,;\\\"/[]?={}") {
+			return fmt.Errorf("invalid header name '%v'", k)
+		}
+		if strings.ContainsAny(v, "\r\n") {
+			return fmt.Errorf("invalid value of header %v", k)
+		}
+
+		switch http.CanonicalHeaderKey(k) {
+		case "User-Agent":
+			return fmt.Errorf("set user_agent instead of header %v", k)
+		case "Authorization", "Content-Type", "Content-Length", "Content-Range", "Host":
+			return fmt.Errorf("header %v is set by dimco", k)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"strings"
+	"time"
+
+	godigest "github.com/opencontainers/go-digest"
+)
+
+const defaultHookTimeout = time.Minute
+
+// Extension points of the copy pipeline.
+const (
+	// hookResolve runs before the copy. It may pin the source digest, skip
+	// the image or refuse it.
+	hookResolve = "resolve"
+	// hookTransform runs once the image is tagged in the engine, before the
+	// push. It may change the local image or name another one to push.
+	hookTransform = "transform"
+	// hookDestination runs after the push with the pushed digest.
+	hookDestination = "destination"
+)
+
+// HookConfig runs an executable at an extension point of every copy. It
+// reads a hookRequest as JSON on stdin and answers with a hookResponse on
+// stdout; a non-zero exit fails the copy with its stderr.
+type HookConfig struct {
+	Point   string   `json:"point"`
+	Command []string `json:"command"`
+	// Images limits the hook to these patterns of image names, or
+	// name:tag, as understood by path.Match.
+	Images  []string `json:"images,omitempty"`
+	Timeout Duration `json:"timeout,omitempty"`
+}
+
+func (hc HookConfig) validate(backend string) error {
+	switch hc.Point {
+	case hookResolve, hookDestination:
+	case hookTransform:
+		if backend == backendRegistry {
+			return fmt.Errorf("transform hooks need an engine, the registry backend copies without one")
+		}
+	default:
+		return fmt.Errorf("unknown hook point '%v', use resolve, transform or destination", hc.Point)
+	}
+
+	if len(hc.Command) == 0 {
+		return fmt.Errorf("%v hook needs a command", hc.Point)
+	}
+
+	if err := validPatterns(hc.Images); err != nil {
+		return fmt.Errorf("%v hook: %w", hc.Point, err)
+	}
+
+	return nil
+}
+
+// hookRequest is what hooks read on stdin.
+type hookRequest struct {
+	Point       string `json:"point"`
+	Name        string `json:"name"`
+	Tag         string `json:"tag"`
+	Digest      string `json:"digest,omitempty"`
+	Source      string `json:"source"`
+	Destination string `json:"destination"`
+	// Image is the local image to push, for transform hooks.
+	Image   string `json:"image,omitempty"`
+	Backend string `json:"backend"`
+	// PushedDigest is the digest of the pushed image, for destination
+	// hooks.
+	PushedDigest string `json:"pushed_digest,omitempty"`
+}
+
+// hookResponse is what hooks write on stdout. Empty output changes nothing.
+type hookResponse struct {
+	// Digest pins the source, for resolve hooks.
+	Digest string `json:"digest,omitempty"`
+	// Skip leaves the image out of the run with this reason, for resolve
+	// hooks.
+	Skip string `json:"skip,omitempty"`
+	// Image is pushed instead of the tagged source, for transform hooks.
+	Image string `json:"image,omitempty"`
+	// Error fails the copy.
+	Error string `json:"error,omitempty"`
+}
+
+// runHooks runs the hooks of point that cover img in config order. Every
+// hook sees the changes of the previous ones.
+func (c Config) runHooks(ctx context.Context, point string, img ImageData, req hookRequest) (hookResponse, error) {
+	req.Point, req.Name, req.Tag, req.Backend = point, img.Name, img.Tag, c.Backend
+	if req.Backend == "" {
+		req.Backend = backendDocker
+	}
+	if req.Digest == "" {
+		req.Digest = img.Digest
+	}
+
+	result := hookResponse{}
+	for _, hc := range c.Hooks {
+		if hc.Point != point || !img.selectedBy(hc.Images) {
+			continue
+		}
+
+		resp, err := hc.run(ctx, req)
+		if err != nil {
+			return hookResponse{}, fmt.Errorf("%v hook %v: %w", point, hc.Command[0], err)
+		}
+		if resp.Error != "" {
+			return hookResponse{}, fmt.Errorf("%v hook %v: %v", point, hc.Command[0], resp.Error)
+		}
+		if resp.Skip != "" {
+			return resp, nil
+		}
+
+		if resp.Digest != "" {
+			req.Digest, result.Digest = resp.Digest, resp.Digest
+		}
+		if resp.Image != "" {
+			req.Image, result.Image = resp.Image, resp.Image
+		}
+	}
+
+	return result, nil
+}
+
+func (hc HookConfig) run(ctx context.Context, req hookRequest) (hookResponse, error) {
+	timeout := time.Duration(hc.Timeout)
+	if timeout == 0 {
+		timeout = defaultHookTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	in, err := json.Marshal(req)
+	if err != nil {
+		return hookResponse{}, err
+	}
+
+	stderr := &bytes.Buffer{}
+	cmd := exec.CommandContext(ctx, hc.Command[0], hc.Command[1:]...)
+	cmd.Stdin = bytes.NewReader(in)
+	cmd.Stderr = stderr
+	out, err := cmd.Output()
+	if err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return hookResponse{}, fmt.Errorf("%w: %v", err, msg)
+		}
+		return hookResponse{}, err
+	}
+
+	if msg := strings.TrimSpace(stderr.String()); msg != "" {
+		debugf("%v hook %v: %v", req.Point, hc.Command[0], msg)
+	}
+
+	resp := hookResponse{}
+	if len(bytes.TrimSpace(out)) == 0 {
+		return resp, nil
+	}
+	if err := json.Unmarshal(out, &resp); err != nil {
+		return hookResponse{}, fmt.Errorf("can't decode output: %w", err)
+	}
+	tracef("%v hook %v answered %s", req.Point, hc.Command[0], bytes.TrimSpace(out))
+
+	return resp, nil
+}
+
+func (c Config) hasHooks(point string, img ImageData) bool {
+	for _, hc := range c.Hooks {
+		if hc.Point == point && img.selectedBy(hc.Images) {
+			return true
+		}
+	}
+	return false
+}
+
+// resolveSource runs the resolve hooks of img and returns it with the source
+// digest they pinned, or the reason they skipped it.
+func (s *syncer) resolveSource(ctx context.Context, img ImageData) (ImageData, string, error) {
+	if !s.config.hasHooks(hookResolve, img) {
+		return img, "", nil
+	}
+
+	fromImg, toImg := s.references(img)
+	resp, err := s.config.runHooks(ctx, hookResolve, img, hookRequest{Source: fromImg, Destination: toImg})
+	if err != nil {
+		return img, "", err
+	}
+	if resp.Skip != "" {
+		return img, resp.Skip, nil
+	}
+
+	if resp.Digest != "" && resp.Digest != img.Digest {
+		if _, err := godigest.Parse(resp.Digest); err != nil {
+			return img, "", fmt.Errorf("resolve hook returned invalid digest '%v': %w", resp.Digest, err)
+		}
+		debugf("resolve hooks pinned %v to %v", fromImg, resp.Digest)
+		img.Digest = resp.Digest
+	}
+
+	return img, "", nil
+}
+
+// transform runs the transform hooks on the local toImg and tags the image
+// they name instead, if any.
+func (s *syncer) transform(ctx context.Context, img ImageData, fromImg, toImg string) error {
+	if !s.config.hasHooks(hookTransform, img) {
+		return nil
+	}
+
+	resp, err := s.config.runHooks(ctx, hookTransform, img, hookRequest{Source: fromImg, Destination: toImg, Image: toImg})
+	if err != nil {
+		return err
+	}
+
+	if resp.Image != "" && resp.Image != toImg {
+		debugf("transform hooks replaced %v with %v", toImg, resp.Image)
+		if err := s.engine.Tag(ctx, resp.Image, toImg); err != nil {
+			return fmt.Errorf("can't tag image '%v', '%v': %w", resp.Image, toImg, err)
+		}
+	}
+
+	return nil
+}
+
+// destinationHooks runs the destination hooks of the pushed repo:tag.
+func (s *syncer) destinationHooks(ctx context.Context, img ImageData, fromImg, toImg, repo, tag string) error {
+	if !s.config.hasHooks(hookDestination, img) {
+		return nil
+	}
+
+	digest, err := s.dst.ManifestDigest(ctx, repo, tag)
+	if err != nil {
+		return fmt.Errorf("can't resolve pushed digest of '%v': %w", toImg, err)
+	}
+
+	_, err = s.config.runHooks(ctx, hookDestination, img, hookRequest{Source: fromImg, Destination: toImg, PushedDigest: digest})
+	return err
+}
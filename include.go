@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+)
+
+// configFragment is an included config file. Fragments only contribute
+// images, the registries and settings belong to the main file.
+type configFragment struct {
+	Images   []ImageData `json:"images"`
+	Includes []string    `json:"includes"`
+}
+
+// mergeIncludes appends the images of every included fragment, following
+// nested includes, and fails when two entries push to the same destination.
+func (c *Config) mergeIncludes(ctx context.Context, src configSource) error {
+	origins := map[string]string{}
+	for _, img := range c.Images {
+		if prev, ok := origins[img.destinationKey()]; ok {
+			return fmt.Errorf("duplicate destination '%v' in %v and %v", img.destinationKey(), prev, src)
+		}
+		origins[img.destinationKey()] = src.String()
+	}
+
+	seen := map[string]bool{sourceKey(src): true}
+	c.sources = []configSource{src}
+
+	return c.include(ctx, src, c.Includes, seen, origins)
+}
+
+// sourceKey identifies a source for cycle detection.
+func sourceKey(src configSource) string {
+	if f, ok := src.(fileSource); ok {
+		if abs, err := filepath.Abs(string(f)); err == nil {
+			return abs
+		}
+	}
+
+	return src.String()
+}
+
+func (c *Config) include(ctx context.Context, from configSource, patterns []string, seen map[string]bool, origins map[string]string) error {
+	for _, pattern := range patterns {
+		matches, err := from.Include(pattern)
+		if err != nil {
+			return fmt.Errorf("invalid include '%v' in %v: %w", pattern, from, err)
+		}
+		if len(matches) == 0 {
+			return fmt.Errorf("include '%v' in %v matches no files", pattern, from)
+		}
+
+		for _, src := range matches {
+			if seen[sourceKey(src)] {
+				continue
+			}
+			seen[sourceKey(src)] = true
+
+			data, _, err := src.Read(ctx)
+			if err != nil {
+				return fmt.Errorf("can't read included config '%v': %w", src, err)
+			}
+
+			f := configFragment{}
+			dec := json.NewDecoder(bytes.NewReader(data))
+			dec.DisallowUnknownFields()
+			if err := dec.Decode(&f); err != nil {
+				return fmt.Errorf("can't unmarshal included config '%v', only images and includes are allowed: %w", src, err)
+			}
+
+			f.Images = c.withDestinations(f.Images)
+			for _, img := range f.Images {
+				if prev, ok := origins[img.destinationKey()]; ok {
+					return fmt.Errorf("duplicate destination '%v' in %v and %v", img.destinationKey(), prev, src)
+				}
+				origins[img.destinationKey()] = src.String()
+			}
+
+			c.Images = append(c.Images, f.Images...)
+			c.sources = append(c.sources, src)
+
+			if err := c.include(ctx, src, f.Includes, seen, origins); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
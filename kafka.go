@@ -0,0 +1,426 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"hash/fnv"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"time"
+)
+
+// kafkaPasswordEnv holds the SASL/PLAIN password of kafka.username.
+const kafkaPasswordEnv = "KAFKA_PASSWORD"
+
+// Kafka API keys and the versions dimco speaks. These are the oldest
+// versions Kafka 4 still accepts, and recent enough for every broker since
+// Kafka 1.0.
+const (
+	kafkaProduce          = 0
+	kafkaMetadata         = 3
+	kafkaSaslHandshake    = 17
+	kafkaSaslAuthenticate = 36
+
+	kafkaProduceVersion  = 3
+	kafkaMetadataVersion = 4
+)
+
+// KafkaConfig names the brokers and the topic events are produced to.
+type KafkaConfig struct {
+	// Brokers are host:port bootstrap addresses.
+	Brokers []string `json:"brokers"`
+	Topic   string   `json:"topic"`
+	TLS     bool     `json:"tls,omitempty"`
+	// Username authenticates with SASL/PLAIN, the password is read from
+	// KAFKA_PASSWORD.
+	Username string `json:"username,omitempty"`
+}
+
+func (kc KafkaConfig) validate() error {
+	if len(kc.Brokers) == 0 || kc.Topic == "" {
+		return fmt.Errorf("events.kafka needs brokers and topic")
+	}
+
+	return nil
+}
+
+// kafkaPublisher produces every event as a single record to the partition
+// chosen by the hash of its key, waiting for the leader's acknowledgement.
+type kafkaPublisher struct {
+	config KafkaConfig
+
+	// leaders maps partitions to broker addresses, conns the brokers to
+	// open connections.
+	leaders []string
+	conns   map[string]*kafkaConn
+}
+
+func newKafkaPublisher(kc KafkaConfig) *kafkaPublisher {
+	return &kafkaPublisher{config: kc, conns: map[string]*kafkaConn{}}
+}
+
+func (p *kafkaPublisher) publish(ctx context.Context, key string, data []byte) (err error) {
+	defer func() {
+		// Leadership may have moved, look it up again with the next event.
+		if err != nil {
+			p.Close()
+		}
+	}()
+
+	if p.leaders == nil {
+		if err := p.loadMetadata(ctx); err != nil {
+			return err
+		}
+	}
+
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	partition := int(h.Sum32() % uint32(len(p.leaders)))
+
+	conn, err := p.conn(ctx, p.leaders[partition])
+	if err != nil {
+		return err
+	}
+
+	batch := kafkaRecordBatch([]byte(key), data, time.Now())
+
+	w := &kafkaWriter{}
+	w.int16(-1) // transactional_id
+	w.int16(1)  // acks: the leader
+	w.int32(int32(eventTimeout / time.Millisecond))
+	w.int32(1)
+	w.string(p.config.Topic)
+	w.int32(1)
+	w.int32(int32(partition))
+	w.bytes(batch)
+
+	r, err := conn.roundTrip(ctx, kafkaProduce, kafkaProduceVersion, w.buf.Bytes())
+	if err != nil {
+		return fmt.Errorf("can't produce to Kafka: %w", err)
+	}
+
+	for topics := r.int32(); topics > 0; topics-- {
+		r.string()
+		for partitions := r.int32(); partitions > 0; partitions-- {
+			r.int32()
+			if code := r.int16(); code != 0 && r.err == nil {
+				return fmt.Errorf("Kafka rejected the event: error code %v", code)
+			}
+			r.int64()
+			r.int64()
+		}
+	}
+	if r.err != nil {
+		return fmt.Errorf("can't decode produce response: %w", r.err)
+	}
+
+	tracef("published event of %v to Kafka topic %v, partition %v", key, p.config.Topic, partition)
+
+	return nil
+}
+
+// loadMetadata finds the leaders of the partitions of the topic through
+// the first bootstrap broker that answers.
+func (p *kafkaPublisher) loadMetadata(ctx context.Context) error {
+	var lastErr error
+	for _, addr := range p.config.Brokers {
+		conn, err := p.conn(ctx, addr)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+
+		w := &kafkaWriter{}
+		w.int32(1)
+		w.string(p.config.Topic)
+		w.int8(0) // allow_auto_topic_creation
+
+		r, err := conn.roundTrip(ctx, kafkaMetadata, kafkaMetadataVersion, w.buf.Bytes())
+		if err != nil {
+			lastErr = err
+			continue
+		}
+
+		r.int32() // throttle_time_ms
+		brokers := map[int32]string{}
+		for n := r.int32(); n > 0 && r.err == nil; n-- {
+			id, host, port := r.int32(), r.string(), r.int32()
+			r.string() // rack
+			brokers[id] = net.JoinHostPort(host, strconv.Itoa(int(port)))
+		}
+		r.string() // cluster_id
+		r.int32()  // controller_id
+
+		leaders := []string{}
+		for n := r.int32(); n > 0 && r.err == nil; n-- {
+			code := r.int16()
+			r.string()
+			r.int8()
+			if code != 0 {
+				return fmt.Errorf("can't get Kafka topic '%v': error code %v", p.config.Topic, code)
+			}
+
+			for m := r.int32(); m > 0 && r.err == nil; m-- {
+				r.int16()
+				partition, leader := r.int32(), r.int32()
+				r.int32s()
+				r.int32s()
+
+				for int(partition) >= len(leaders) {
+					leaders = append(leaders, "")
+				}
+				leaders[partition] = brokers[leader]
+			}
+		}
+		if r.err != nil {
+			return fmt.Errorf("can't decode Kafka metadata: %w", r.err)
+		}
+
+		for i, l := range leaders {
+			if l == "" {
+				return fmt.Errorf("partition %v of Kafka topic '%v' has no leader", i, p.config.Topic)
+			}
+		}
+		if len(leaders) == 0 {
+			return fmt.Errorf("Kafka topic '%v' doesn't exist", p.config.Topic)
+		}
+
+		p.leaders = leaders
+		return nil
+	}
+
+	return fmt.Errorf("can't reach Kafka: %w", lastErr)
+}
+
+func (p *kafkaPublisher) conn(ctx context.Context, addr string) (*kafkaConn, error) {
+	if c, ok := p.conns[addr]; ok {
+		return c, nil
+	}
+
+	c, err := dialKafka(ctx, addr, p.config)
+	if err != nil {
+		return nil, err
+	}
+	p.conns[addr] = c
+
+	return c, nil
+}
+
+func (p *kafkaPublisher) Close() error {
+	for addr, c := range p.conns {
+		c.conn.Close()
+		delete(p.conns, addr)
+	}
+	p.leaders = nil
+
+	return nil
+}
+
+// kafkaConn is a connection to one broker.
+type kafkaConn struct {
+	conn          net.Conn
+	correlationID int32
+}
+
+func dialKafka(ctx context.Context, addr string, kc KafkaConfig) (*kafkaConn, error) {
+	conn, err := (&net.Dialer{}).DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("can't connect to Kafka broker '%v': %w", addr, err)
+	}
+
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	if kc.TLS {
+		host, _, _ := net.SplitHostPort(addr)
+		tc := tls.Client(conn, &tls.Config{ServerName: host})
+		if err := tc.Handshake(); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("can't establish TLS with Kafka broker '%v': %w", addr, err)
+		}
+		conn = tc
+	}
+
+	c := &kafkaConn{conn: conn}
+	if kc.Username != "" {
+		if err := c.authenticate(ctx, kc.Username, os.Getenv(kafkaPasswordEnv)); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("can't authenticate with Kafka broker '%v': %w", addr, err)
+		}
+	}
+
+	return c, nil
+}
+
+// authenticate runs the SASL/PLAIN exchange.
+func (c *kafkaConn) authenticate(ctx context.Context, username, password string) error {
+	w := &kafkaWriter{}
+	w.string("PLAIN")
+	r, err := c.roundTrip(ctx, kafkaSaslHandshake, 1, w.buf.Bytes())
+	if err != nil {
+		return err
+	}
+	if code := r.int16(); code != 0 {
+		return fmt.Errorf("broker doesn't support PLAIN: error code %v", code)
+	}
+
+	w = &kafkaWriter{}
+	w.bytes([]byte("\x00" + username + "\x00" + password))
+	if r, err = c.roundTrip(ctx, kafkaSaslAuthenticate, 0, w.buf.Bytes()); err != nil {
+		return err
+	}
+	if code, msg := r.int16(), r.string(); code != 0 {
+		return fmt.Errorf("%v (error code %v)", msg, code)
+	}
+
+	return nil
+}
+
+// roundTrip sends a request and returns a reader of the response after its
+// correlation ID.
+func (c *kafkaConn) roundTrip(ctx context.Context, apiKey, version int16, body []byte) (*kafkaReader, error) {
+	if deadline, ok := ctx.Deadline(); ok {
+		c.conn.SetDeadline(deadline)
+	}
+
+	c.correlationID++
+	h := &kafkaWriter{}
+	h.int16(apiKey)
+	h.int16(version)
+	h.int32(c.correlationID)
+	h.string("dimco")
+
+	msg := &kafkaWriter{}
+	msg.int32(int32(h.buf.Len() + len(body)))
+	msg.buf.Write(h.buf.Bytes())
+	msg.buf.Write(body)
+	if _, err := c.conn.Write(msg.buf.Bytes()); err != nil {
+		return nil, err
+	}
+
+	var size int32
+	if err := binary.Read(c.conn, binary.BigEndian, &size); err != nil {
+		return nil, err
+	}
+	resp := make([]byte, size)
+	if _, err := io.ReadFull(c.conn, resp); err != nil {
+		return nil, err
+	}
+
+	r := &kafkaReader{buf: resp}
+	if id := r.int32(); id != c.correlationID && r.err == nil {
+		return nil, fmt.Errorf("response %v to request %v", id, c.correlationID)
+	}
+	return r, r.err
+}
+
+// kafkaRecordBatch encodes a record batch, format version 2, of one
+// uncompressed record.
+func kafkaRecordBatch(key, value []byte, now time.Time) []byte {
+	record := &kafkaWriter{}
+	record.int8(0)   // attributes
+	record.varint(0) // timestamp delta
+	record.varint(0) // offset delta
+	record.varint(int64(len(key)))
+	record.buf.Write(key)
+	record.varint(int64(len(value)))
+	record.buf.Write(value)
+	record.varint(0) // headers
+
+	ms := now.UnixNano() / int64(time.Millisecond)
+
+	// Everything after the CRC, which covers it.
+	tail := &kafkaWriter{}
+	tail.int16(0) // attributes
+	tail.int32(0) // last offset delta
+	tail.int64(ms)
+	tail.int64(ms)
+	tail.int64(-1) // producer ID
+	tail.int16(-1) // producer epoch
+	tail.int32(-1) // base sequence
+	tail.int32(1)
+	tail.varint(int64(record.buf.Len()))
+	tail.buf.Write(record.buf.Bytes())
+
+	batch := &kafkaWriter{}
+	batch.int64(0)                                 // base offset
+	batch.int32(int32(4 + 1 + 4 + tail.buf.Len())) // batch length
+	batch.int32(-1)                                // partition leader epoch
+	batch.int8(2)                                  // magic
+	batch.int32(int32(crc32.Checksum(tail.buf.Bytes(), crc32.MakeTable(crc32.Castagnoli))))
+	batch.buf.Write(tail.buf.Bytes())
+
+	return batch.buf.Bytes()
+}
+
+// kafkaWriter encodes the primitive types of the Kafka protocol.
+type kafkaWriter struct {
+	buf bytes.Buffer
+}
+
+func (w *kafkaWriter) int8(v int8)   { w.buf.WriteByte(byte(v)) }
+func (w *kafkaWriter) int16(v int16) { binary.Write(&w.buf, binary.BigEndian, v) }
+func (w *kafkaWriter) int32(v int32) { binary.Write(&w.buf, binary.BigEndian, v) }
+func (w *kafkaWriter) int64(v int64) { binary.Write(&w.buf, binary.BigEndian, v) }
+
+func (w *kafkaWriter) string(s string) {
+	w.int16(int16(len(s)))
+	w.buf.WriteString(s)
+}
+
+func (w *kafkaWriter) bytes(b []byte) {
+	w.int32(int32(len(b)))
+	w.buf.Write(b)
+}
+
+func (w *kafkaWriter) varint(v int64) {
+	b := make([]byte, binary.MaxVarintLen64)
+	w.buf.Write(b[:binary.PutVarint(b, v)])
+}
+
+// kafkaReader decodes a response, keeping the first error.
+type kafkaReader struct {
+	buf []byte
+	err error
+}
+
+func (r *kafkaReader) next(n int) []byte {
+	if r.err != nil {
+		return make([]byte, n)
+	}
+	if len(r.buf) < n {
+		r.err = io.ErrUnexpectedEOF
+		return make([]byte, n)
+	}
+
+	b := r.buf[:n]
+	r.buf = r.buf[n:]
+	return b
+}
+
+func (r *kafkaReader) int8() int8   { return int8(r.next(1)[0]) }
+func (r *kafkaReader) int16() int16 { return int16(binary.BigEndian.Uint16(r.next(2))) }
+func (r *kafkaReader) int32() int32 { return int32(binary.BigEndian.Uint32(r.next(4))) }
+func (r *kafkaReader) int64() int64 { return int64(binary.BigEndian.Uint64(r.next(8))) }
+
+// string reads a string or a nullable string, null being "".
+func (r *kafkaReader) string() string {
+	n := r.int16()
+	if n < 0 {
+		return ""
+	}
+	return string(r.next(int(n)))
+}
+
+func (r *kafkaReader) int32s() {
+	for n := r.int32(); n > 0 && r.err == nil; n-- {
+		r.int32()
+	}
+}
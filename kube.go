@@ -0,0 +1,334 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+const serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+// kubeClient reads objects from the API server of the cluster dimco runs in,
+// authenticated with the pod's service account.
+type kubeClient struct {
+	base      string
+	namespace string
+	client    *http.Client
+}
+
+func newKubeClient() (*kubeClient, error) {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, fmt.Errorf("not running in a kubernetes cluster")
+	}
+
+	ca, err := ioutil.ReadFile(serviceAccountDir + "/ca.crt")
+	if err != nil {
+		return nil, fmt.Errorf("can't read service account ca: %w", err)
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return nil, fmt.Errorf("invalid service account ca")
+	}
+
+	namespace, err := ioutil.ReadFile(serviceAccountDir + "/namespace")
+	if err != nil {
+		return nil, fmt.Errorf("can't read service account namespace: %w", err)
+	}
+
+	return &kubeClient{
+		base:      "https://" + net.JoinHostPort(host, port),
+		namespace: strings.TrimSpace(string(namespace)),
+		client: &http.Client{
+			Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}},
+		},
+	}, nil
+}
+
+// kubeObject holds the parts of a ConfigMap or Secret dimco uses.
+type kubeObject struct {
+	Metadata struct {
+		ResourceVersion string `json:"resourceVersion"`
+	} `json:"metadata"`
+	Data map[string]json.RawMessage `json:"data"`
+}
+
+// get fetches a configmaps or secrets object. An empty namespace is the
+// namespace of the service account.
+func (k *kubeClient) get(ctx context.Context, resource, namespace, name string) (kubeObject, error) {
+	if namespace == "" {
+		namespace = k.namespace
+	}
+
+	obj := kubeObject{}
+	path := fmt.Sprintf("/api/v1/namespaces/%v/%v/%v", url.PathEscape(namespace), resource, url.PathEscape(name))
+	status, err := k.do(ctx, http.MethodGet, path, nil, &obj)
+	if err != nil {
+		return kubeObject{}, fmt.Errorf("can't get %v %v/%v: %w", resource, namespace, name, err)
+	}
+	if status != http.StatusOK {
+		return kubeObject{}, fmt.Errorf("can't get %v %v/%v: unexpected status %v", resource, namespace, name, status)
+	}
+
+	return obj, nil
+}
+
+// do sends in as JSON to path of the API server and decodes successful
+// responses into out. Error statuses are returned for the caller to handle.
+func (k *kubeClient) do(ctx context.Context, method, path string, in, out interface{}) (int, error) {
+	// The token is read for every request, projected tokens are rotated.
+	token, err := ioutil.ReadFile(serviceAccountDir + "/token")
+	if err != nil {
+		return 0, fmt.Errorf("can't read service account token: %w", err)
+	}
+
+	var body io.Reader
+	if in != nil {
+		data, err := json.Marshal(in)
+		if err != nil {
+			return 0, fmt.Errorf("can't encode request: %w", err)
+		}
+		body = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, k.base+path, body)
+	if err != nil {
+		return 0, fmt.Errorf("can't create request: %w", err)
+	}
+	registerSecret(strings.TrimSpace(string(token)))
+	req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	req.Header.Set("Accept", "application/json")
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := k.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 || out == nil {
+		return resp.StatusCode, nil
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return resp.StatusCode, fmt.Errorf("can't decode response: %w", err)
+	}
+
+	return resp.StatusCode, nil
+}
+
+// value returns a data entry, decoding base64 for secrets.
+func (o kubeObject) value(resource, key string) ([]byte, bool, error) {
+	raw, ok := o.Data[key]
+	if !ok {
+		return nil, false, nil
+	}
+
+	var s string
+	if err := json.Unmarshal(raw, &s); err != nil {
+		return nil, false, err
+	}
+
+	if resource != "secrets" {
+		return []byte(s), true, nil
+	}
+
+	data, err := base64.StdEncoding.DecodeString(s)
+	return data, true, err
+}
+
+const defaultConfigMapKey = "config.json"
+
+// kubeSource is a key of a ConfigMap or Secret, addressed as
+// configmap://name?key=config.json&namespace=ns. The resourceVersion of the
+// object is used as version.
+type kubeSource struct {
+	resource  string
+	namespace string
+	name      string
+	key       string
+}
+
+func parseKubeSource(location string) (*kubeSource, error) {
+	u, err := url.Parse(location)
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("invalid config location '%v'", location)
+	}
+
+	key := u.Query().Get("key")
+	if key == "" {
+		key = defaultConfigMapKey
+	}
+
+	return &kubeSource{resource: "configmaps", namespace: u.Query().Get("namespace"), name: u.Host, key: key}, nil
+}
+
+func (s *kubeSource) String() string {
+	if s.resource == "secrets" {
+		return "secret " + s.name
+	}
+
+	loc := "configmap://" + s.name + "?key=" + url.QueryEscape(s.key)
+	if s.namespace != "" {
+		loc += "&namespace=" + url.QueryEscape(s.namespace)
+	}
+	return loc
+}
+
+func (s *kubeSource) object(ctx context.Context) (kubeObject, error) {
+	k, err := newKubeClient()
+	if err != nil {
+		return kubeObject{}, err
+	}
+
+	return k.get(ctx, s.resource, s.namespace, s.name)
+}
+
+func (s *kubeSource) Read(ctx context.Context) ([]byte, string, error) {
+	obj, err := s.object(ctx)
+	if err != nil {
+		return nil, "", err
+	}
+
+	data, ok, err := obj.value(s.resource, s.key)
+	if err != nil {
+		return nil, "", fmt.Errorf("can't decode key '%v' of %v: %w", s.key, s, err)
+	}
+	if !ok {
+		return nil, "", fmt.Errorf("key '%v' not found in %v", s.key, s)
+	}
+
+	return data, obj.Metadata.ResourceVersion, nil
+}
+
+func (s *kubeSource) Version(ctx context.Context) (string, error) {
+	obj, err := s.object(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	return obj.Metadata.ResourceVersion, nil
+}
+
+func (s *kubeSource) Include(pattern string) ([]configSource, error) {
+	if strings.Contains(pattern, "://") {
+		src, err := openSource(pattern)
+		if err != nil {
+			return nil, err
+		}
+		return []configSource{src}, nil
+	}
+
+	if strings.ContainsAny(pattern, "*?[") {
+		return nil, fmt.Errorf("glob patterns are only supported for local files")
+	}
+
+	return []configSource{&kubeSource{resource: s.resource, namespace: s.namespace, name: s.name, key: pattern}}, nil
+}
+
+// SecretRef names a Kubernetes Secret holding registry credentials, either of
+// type kubernetes.io/basic-auth or kubernetes.io/dockerconfigjson.
+type SecretRef struct {
+	Name      string `json:"name,omitempty"`
+	Namespace string `json:"namespace,omitempty"`
+}
+
+// resolveSecrets fills the credentials of registries configured with a
+// secret. The secrets are added to the config sources, so the daemon
+// reloads when they change.
+func (c *Config) resolveSecrets(ctx context.Context) error {
+	for _, ac := range c.registries() {
+		if ac.Secret == nil {
+			continue
+		}
+
+		src := &kubeSource{resource: "secrets", namespace: ac.Secret.Namespace, name: ac.Secret.Name}
+		obj, err := src.object(ctx)
+		if err != nil {
+			return fmt.Errorf("can't read credentials of %v: %w", ac.BaseAddress, err)
+		}
+
+		if err := ac.applySecret(obj); err != nil {
+			return fmt.Errorf("can't read credentials of %v from secret %v: %w", ac.BaseAddress, ac.Secret.Name, err)
+		}
+
+		c.sources = append(c.sources, src)
+	}
+
+	return nil
+}
+
+func (ac *AuthConfig) applySecret(obj kubeObject) error {
+	if data, ok, err := obj.value("secrets", ".dockerconfigjson"); err != nil {
+		return err
+	} else if ok {
+		return ac.applyDockerConfig(data)
+	}
+
+	username, _, err := obj.value("secrets", "username")
+	if err != nil {
+		return err
+	}
+	password, ok, err := obj.value("secrets", "password")
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("secret has neither .dockerconfigjson nor password")
+	}
+
+	ac.Username, ac.Password = string(username), string(password)
+	return nil
+}
+
+// applyDockerConfig picks the entry of a docker config.json for the registry.
+func (ac *AuthConfig) applyDockerConfig(data []byte) error {
+	cfg := struct {
+		Auths map[string]struct {
+			Username string `json:"username"`
+			Password string `json:"password"`
+			Auth     string `json:"auth"`
+		} `json:"auths"`
+	}{}
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return fmt.Errorf("invalid .dockerconfigjson: %w", err)
+	}
+
+	host, _ := splitBaseAddress(ac.BaseAddress)
+	for server, entry := range cfg.Auths {
+		server, _ = splitBaseAddress(server)
+		if server == "index.docker.io" {
+			server = "docker.io"
+		}
+		if server != host {
+			continue
+		}
+
+		if entry.Auth != "" {
+			username, password, err := splitBasicToken(entry.Auth)
+			if err != nil {
+				return fmt.Errorf("invalid auth for %v: %w", server, err)
+			}
+			entry.Username, entry.Password = username, password
+		}
+
+		ac.Username, ac.Password = entry.Username, entry.Password
+		return nil
+	}
+
+	return fmt.Errorf("no credentials for %v in .dockerconfigjson", host)
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+)
+
+const (
+	defaultLeaseTTL = 2 * time.Minute
+	lockRetry       = 5 * time.Second
+
+	// kubeMicroTime is the timestamp format of Lease objects.
+	kubeMicroTime = "2006-01-02T15:04:05.000000Z07:00"
+)
+
+// LockConfig serializes runs of the same config, so overlapping cron runs
+// don't push and delete the same tags at once.
+type LockConfig struct {
+	// File is a lock file for runs on one host.
+	File string `json:"file,omitempty"`
+	// Lease is the name of a Kubernetes Lease for runs in a cluster. It
+	// expires after TTL when its holder stops renewing it.
+	Lease     string   `json:"lease,omitempty"`
+	Namespace string   `json:"namespace,omitempty"`
+	TTL       Duration `json:"ttl,omitempty"`
+	// Wait is how long to wait for a held lock before giving up.
+	Wait Duration `json:"wait,omitempty"`
+}
+
+func (lc LockConfig) validate() error {
+	if (lc.File == "") == (lc.Lease == "") {
+		return fmt.Errorf("lock needs either file or lease")
+	}
+
+	return nil
+}
+
+// lockedError is returned while another run holds the lock.
+type lockedError struct {
+	holder string
+}
+
+func (e lockedError) Error() string {
+	return fmt.Sprintf("lock held by %v", e.holder)
+}
+
+// acquireLock takes the run lock of c, if one is configured, and returns the
+// context of the run with the function that releases the lock. The context
+// is cancelled when the lock is lost, so the run stops before another one
+// takes over.
+func (c Config) acquireLock(ctx context.Context) (context.Context, func(), error) {
+	if c.Lock == nil {
+		return ctx, func() {}, nil
+	}
+
+	lc := *c.Lock
+	deadline := time.Now().Add(time.Duration(lc.Wait))
+	for {
+		runCtx, cancel := context.WithCancel(ctx)
+		var release func()
+		var err error
+		if lc.File != "" {
+			release, err = lockFile(lc.File)
+		} else {
+			release, err = lc.acquireLease(runCtx, cancel)
+		}
+
+		var locked lockedError
+		if err == nil {
+			return runCtx, func() {
+				release()
+				cancel()
+			}, nil
+		}
+		cancel()
+		if !errors.As(err, &locked) || time.Now().After(deadline) {
+			return nil, nil, fmt.Errorf("can't acquire run lock: %w", err)
+		}
+
+		infof("%v, waiting", err)
+		select {
+		case <-ctx.Done():
+			return nil, nil, ctx.Err()
+		case <-time.After(lockRetry):
+		}
+	}
+}
+
+// lockHolder identifies this process in lock files and leases.
+func lockHolder() string {
+	host, _ := os.Hostname()
+	return fmt.Sprintf("%v/%v", host, os.Getpid())
+}
+
+// kubeLease is a coordination.k8s.io/v1 Lease.
+type kubeLease struct {
+	APIVersion string `json:"apiVersion"`
+	Kind       string `json:"kind"`
+	Metadata   struct {
+		Name            string `json:"name"`
+		ResourceVersion string `json:"resourceVersion,omitempty"`
+	} `json:"metadata"`
+	Spec struct {
+		HolderIdentity       string `json:"holderIdentity,omitempty"`
+		LeaseDurationSeconds int    `json:"leaseDurationSeconds,omitempty"`
+		AcquireTime          string `json:"acquireTime,omitempty"`
+		RenewTime            string `json:"renewTime,omitempty"`
+	} `json:"spec"`
+}
+
+// held reports whether another holder renewed the lease within its duration.
+func (l kubeLease) held(now time.Time) bool {
+	if l.Spec.HolderIdentity == "" || l.Spec.HolderIdentity == lockHolder() {
+		return false
+	}
+
+	renewed, err := time.Parse(kubeMicroTime, l.Spec.RenewTime)
+	if err != nil {
+		return false
+	}
+
+	return now.Before(renewed.Add(time.Duration(l.Spec.LeaseDurationSeconds) * time.Second))
+}
+
+// acquireLease takes the Lease and renews it until released. Concurrent
+// takeovers are detected by the resourceVersion of the update. When the
+// lease is taken over, or can't be renewed before it expires, lost is
+// called.
+func (lc LockConfig) acquireLease(ctx context.Context, lost func()) (func(), error) {
+	k, err := newKubeClient()
+	if err != nil {
+		return nil, err
+	}
+
+	namespace := lc.Namespace
+	if namespace == "" {
+		namespace = k.namespace
+	}
+	leases := fmt.Sprintf("/apis/coordination.k8s.io/v1/namespaces/%v/leases", url.PathEscape(namespace))
+	path := leases + "/" + url.PathEscape(lc.Lease)
+
+	ttl := time.Duration(lc.TTL)
+	if ttl <= 0 {
+		ttl = defaultLeaseTTL
+	}
+
+	lease := kubeLease{}
+	status, err := k.do(ctx, http.MethodGet, path, nil, &lease)
+	if err != nil {
+		return nil, fmt.Errorf("can't get lease %v/%v: %w", namespace, lc.Lease, err)
+	}
+
+	now := time.Now()
+	switch status {
+	case http.StatusNotFound:
+		lease = kubeLease{APIVersion: "coordination.k8s.io/v1", Kind: "Lease"}
+		lease.Metadata.Name = lc.Lease
+	case http.StatusOK:
+		if lease.held(now) {
+			return nil, lockedError{holder: lease.Spec.HolderIdentity}
+		}
+	default:
+		return nil, fmt.Errorf("can't get lease %v/%v: unexpected status %v", namespace, lc.Lease, status)
+	}
+
+	lease.Spec.HolderIdentity = lockHolder()
+	lease.Spec.LeaseDurationSeconds = int(ttl.Seconds())
+	lease.Spec.AcquireTime = now.UTC().Format(kubeMicroTime)
+	lease.Spec.RenewTime = lease.Spec.AcquireTime
+
+	if status == http.StatusNotFound {
+		status, err = k.do(ctx, http.MethodPost, leases, lease, &lease)
+	} else {
+		status, err = k.do(ctx, http.MethodPut, path, lease, &lease)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("can't take lease %v/%v: %w", namespace, lc.Lease, err)
+	}
+	switch status {
+	case http.StatusOK, http.StatusCreated:
+	case http.StatusConflict:
+		return nil, lockedError{holder: "a concurrent run"}
+	default:
+		return nil, fmt.Errorf("can't take lease %v/%v: unexpected status %v", namespace, lc.Lease, status)
+	}
+
+	update := func() (int, error) {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		status, err := k.do(ctx, http.MethodPut, path, lease, &lease)
+		if err == nil && status != http.StatusOK {
+			err = fmt.Errorf("unexpected status %v", status)
+		}
+		if err != nil {
+			log.Print(fmt.Errorf("can't update lease %v/%v: %w", namespace, lc.Lease, err))
+		}
+		return status, err
+	}
+
+	renewEvery := ttl / 3
+	stop, stopped := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(stopped)
+
+		ticker := time.NewTicker(renewEvery)
+		defer ticker.Stop()
+		renewed := now
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				lease.Spec.RenewTime = time.Now().UTC().Format(kubeMicroTime)
+				status, err := update()
+				if err == nil {
+					renewed = time.Now()
+					continue
+				}
+
+				// The next renewal would come after the lease expired.
+				if status == http.StatusConflict || time.Since(renewed)+renewEvery >= ttl {
+					errorf("lost lease %v/%v, stopping the run", namespace, lc.Lease)
+					lost()
+					return
+				}
+			}
+		}
+	}()
+
+	return func() {
+		close(stop)
+		<-stopped
+
+		lease.Spec.HolderIdentity = ""
+		update()
+	}, nil
+}
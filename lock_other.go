@@ -0,0 +1,10 @@
+//go:build !linux && !darwin && !freebsd && !netbsd && !openbsd
+// +build !linux,!darwin,!freebsd,!netbsd,!openbsd
+
+package main
+
+import "fmt"
+
+func lockFile(path string) (func(), error) {
+	return nil, fmt.Errorf("lock files aren't supported on this platform, use a lease")
+}
@@ -0,0 +1,40 @@
+//go:build linux || darwin || freebsd || netbsd || openbsd
+// +build linux darwin freebsd netbsd openbsd
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// lockFile takes an exclusive flock on path, which the kernel drops when the
+// process dies, and records the holder in the file.
+func lockFile(path string) (func(), error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	fd := int(f.Fd())
+	if err := unix.Flock(fd, unix.LOCK_EX|unix.LOCK_NB); err != nil {
+		holder, _ := ioutil.ReadAll(f)
+		f.Close()
+		if err == unix.EWOULDBLOCK {
+			return nil, lockedError{holder: strings.TrimSpace(string(holder))}
+		}
+		return nil, err
+	}
+
+	f.Truncate(0)
+	f.WriteAt([]byte(lockHolder()+"\n"), 0)
+
+	return func() {
+		f.Truncate(0)
+		unix.Flock(fd, unix.LOCK_UN)
+		f.Close()
+	}, nil
+}
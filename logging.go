@@ -0,0 +1,396 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// LoggingConfig sends the log of dimco to further destinations next to
+// stderr, each with its own level, e.g. a rotated file on a VM.
+type LoggingConfig struct {
+	Sinks []LogSink `json:"sinks"`
+}
+
+// Log sink types.
+const (
+	sinkStdout   = "stdout"
+	sinkFile     = "file"
+	sinkSyslog   = "syslog"
+	sinkJournald = "journald"
+)
+
+// LogSink is one destination of the log.
+type LogSink struct {
+	// Type is stdout, file, syslog or journald.
+	Type string `json:"type"`
+	// Level is error, info, debug or trace, like -q, the default, -v and
+	// -vv. info when unset.
+	Level string `json:"level,omitempty"`
+
+	// Path is the file of a file sink.
+	Path string `json:"path,omitempty"`
+	// MaxSize rotates the file when it would grow past it, e.g. 100MB.
+	MaxSize string `json:"max_size,omitempty"`
+	// MaxAge removes rotated files older than this.
+	MaxAge Duration `json:"max_age,omitempty"`
+	// MaxBackups is how many rotated files are kept, 5 when unset.
+	MaxBackups int `json:"max_backups,omitempty"`
+}
+
+const defaultMaxBackups = 5
+
+const journaldSocket = "/run/systemd/journal/socket"
+
+func (lc LoggingConfig) validate() error {
+	for i, s := range lc.Sinks {
+		if _, err := parseLogLevel(s.Level); err != nil {
+			return fmt.Errorf("logging.sinks[%v]: %w", i, err)
+		}
+
+		switch s.Type {
+		case sinkFile:
+			if s.Path == "" {
+				return fmt.Errorf("logging.sinks[%v]: path is required for file sinks", i)
+			}
+			if s.MaxSize != "" {
+				if _, err := parseBytes(s.MaxSize); err != nil {
+					return fmt.Errorf("logging.sinks[%v]: invalid max_size: %w", i, err)
+				}
+			}
+			if s.MaxAge < 0 || s.MaxBackups < 0 {
+				return fmt.Errorf("logging.sinks[%v]: max_age and max_backups can't be negative", i)
+			}
+		case sinkStdout, sinkSyslog, sinkJournald:
+		default:
+			return fmt.Errorf("logging.sinks[%v]: unknown type '%v', use %v, %v, %v or %v", i, s.Type, sinkStdout, sinkFile, sinkSyslog, sinkJournald)
+		}
+	}
+
+	return nil
+}
+
+func parseLogLevel(s string) (int, error) {
+	switch s {
+	case "error":
+		return levelQuiet, nil
+	case "", "info":
+		return levelNormal, nil
+	case "debug":
+		return levelVerbose, nil
+	case "trace":
+		return levelDebug, nil
+	default:
+		return 0, fmt.Errorf("unknown level '%v', use error, info, debug or trace", s)
+	}
+}
+
+// levelWriter is the destination of a sink. stamp is the time of the line as
+// printed on stderr, for destinations that don't keep their own.
+type levelWriter interface {
+	writeLevel(level int, stamp, msg string) error
+	Close() error
+}
+
+type logSink struct {
+	name   string
+	level  int
+	w      levelWriter
+	failed bool
+}
+
+// logRouter is the output of package log and of infof and friends. It
+// prints to the console at the level of -q and -v and to the sinks of the
+// logging config at theirs. Everything is redacted first.
+type logRouter struct {
+	mu      sync.Mutex
+	console io.Writer
+	config  *LoggingConfig
+	sinks   []*logSink
+	// maxLevel is the most verbose level of a sink, read without mu on
+	// every debugf.
+	maxLevel int32
+}
+
+var logs = &logRouter{console: os.Stderr, maxLevel: levelQuiet}
+
+// Write takes the output of package log, warnings and errors that don't fail
+// anything, like a failed notification. Every sink prints them, with the
+// warning priority; errorf marks failures.
+func (r *logRouter) Write(p []byte) (int, error) {
+	r.emit(levelQuiet, string(p))
+	return len(p), nil
+}
+
+// enabled reports whether the console or a sink prints level.
+func (r *logRouter) enabled(level int) bool {
+	return verbosity >= level || int(atomic.LoadInt32(&r.maxLevel)) >= level
+}
+
+func (r *logRouter) emit(level int, msg string) {
+	msg = redact(strings.TrimSuffix(msg, "\n"))
+	stamp := time.Now().Format("2006/01/02 15:04:05 ")
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if verbosity >= level {
+		io.WriteString(r.console, stamp+msg+"\n")
+	}
+	for _, s := range r.sinks {
+		if s.level < level {
+			continue
+		}
+		if err := s.w.writeLevel(level, stamp, msg); err != nil {
+			// Reported once, a full disk would print it on every line.
+			if !s.failed {
+				io.WriteString(r.console, stamp+fmt.Sprintf("can't write to log sink %v: %v\n", s.name, err))
+			}
+			s.failed = true
+		} else {
+			s.failed = false
+		}
+	}
+}
+
+// setConsole replaces stderr, e.g. with the buffer of the dashboard.
+func (r *logRouter) setConsole(w io.Writer) {
+	r.mu.Lock()
+	r.console = w
+	r.mu.Unlock()
+}
+
+// startLogging opens the sinks of the logging config of c in place of those
+// of the previous config. Sinks that can't be opened fail the command, like
+// a missing audit log. The same config keeps its sinks open.
+func (c Config) startLogging() error {
+	logs.mu.Lock()
+	defer logs.mu.Unlock()
+
+	if reflect.DeepEqual(logs.config, c.Logging) {
+		return nil
+	}
+
+	sinks := []*logSink{}
+	maxLevel := levelQuiet
+	if c.Logging != nil {
+		for _, ls := range c.Logging.Sinks {
+			s, err := openLogSink(ls)
+			if err != nil {
+				for _, s := range sinks {
+					s.w.Close()
+				}
+				return err
+			}
+			sinks = append(sinks, s)
+			if s.level > maxLevel {
+				maxLevel = s.level
+			}
+		}
+	}
+
+	for _, s := range logs.sinks {
+		s.w.Close()
+	}
+	logs.config, logs.sinks = c.Logging, sinks
+	atomic.StoreInt32(&logs.maxLevel, int32(maxLevel))
+
+	return nil
+}
+
+func openLogSink(ls LogSink) (*logSink, error) {
+	level, _ := parseLogLevel(ls.Level)
+	s := &logSink{name: ls.Type, level: level}
+
+	var err error
+	switch ls.Type {
+	case sinkStdout:
+		s.w = stdoutSink{}
+	case sinkFile:
+		s.name = ls.Path
+		s.w, err = openRotatingFile(ls)
+	case sinkSyslog:
+		s.w, err = openSyslogSink()
+	case sinkJournald:
+		s.w, err = openJournaldSink()
+	}
+	if err != nil {
+		return nil, fmt.Errorf("can't open log sink %v: %w", s.name, err)
+	}
+
+	return s, nil
+}
+
+type stdoutSink struct{}
+
+func (stdoutSink) writeLevel(level int, stamp, msg string) error {
+	// The dashboard owns the terminal and shows the log itself.
+	if dashboardActive {
+		return nil
+	}
+	_, err := io.WriteString(os.Stdout, stamp+msg+"\n")
+	return err
+}
+
+func (stdoutSink) Close() error { return nil }
+
+// rotatingFile appends to path and renames it to path.<time> when it would
+// grow past maxSize, keeping maxBackups of the rotated files and none older
+// than maxAge.
+type rotatingFile struct {
+	path       string
+	maxSize    int64
+	maxAge     time.Duration
+	maxBackups int
+
+	f    *os.File
+	size int64
+}
+
+func openRotatingFile(ls LogSink) (*rotatingFile, error) {
+	rf := &rotatingFile{path: ls.Path, maxAge: time.Duration(ls.MaxAge), maxBackups: ls.MaxBackups}
+	if ls.MaxSize != "" {
+		rf.maxSize, _ = parseBytes(ls.MaxSize)
+	}
+	if rf.maxBackups == 0 {
+		rf.maxBackups = defaultMaxBackups
+	}
+
+	if err := os.MkdirAll(filepath.Dir(rf.path), 0o755); err != nil {
+		return nil, err
+	}
+	if err := rf.open(); err != nil {
+		return nil, err
+	}
+	rf.prune()
+
+	return rf, nil
+}
+
+func (rf *rotatingFile) open() error {
+	f, err := os.OpenFile(rf.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	rf.f, rf.size = f, fi.Size()
+	return nil
+}
+
+func (rf *rotatingFile) writeLevel(level int, stamp, msg string) error {
+	line := stamp + msg + "\n"
+
+	if rf.f != nil && rf.maxSize > 0 && rf.size > 0 && rf.size+int64(len(line)) > rf.maxSize {
+		if err := rf.rotate(); err != nil {
+			return err
+		}
+	}
+	// A failed rotation leaves the file closed, the next line tries again.
+	if rf.f == nil {
+		if err := rf.open(); err != nil {
+			return err
+		}
+	}
+
+	n, err := io.WriteString(rf.f, line)
+	rf.size += int64(n)
+	return err
+}
+
+func (rf *rotatingFile) rotate() error {
+	rf.f.Close()
+	rf.f = nil
+
+	rotated := rf.path + "." + time.Now().UTC().Format("20060102T150405.000")
+	if err := os.Rename(rf.path, rotated); err != nil {
+		return fmt.Errorf("can't rotate: %w", err)
+	}
+	rf.prune()
+
+	return rf.open()
+}
+
+// prune removes the rotated files beyond maxBackups and older than maxAge.
+func (rf *rotatingFile) prune() {
+	rotated, _ := filepath.Glob(rf.path + ".2*")
+	// The time suffix sorts by age, newest first.
+	sort.Sort(sort.Reverse(sort.StringSlice(rotated)))
+
+	for i, path := range rotated {
+		old := false
+		if rf.maxAge > 0 {
+			if fi, err := os.Stat(path); err == nil && time.Since(fi.ModTime()) > rf.maxAge {
+				old = true
+			}
+		}
+		if i >= rf.maxBackups || old {
+			os.Remove(path)
+		}
+	}
+}
+
+func (rf *rotatingFile) Close() error {
+	if rf.f == nil {
+		return nil
+	}
+	return rf.f.Close()
+}
+
+// journaldSink sends entries with their priority to the native socket of
+// systemd-journald.
+type journaldSink struct {
+	conn net.Conn
+}
+
+func openJournaldSink() (*journaldSink, error) {
+	conn, err := net.Dial("unixgram", journaldSocket)
+	if err != nil {
+		return nil, err
+	}
+	return &journaldSink{conn: conn}, nil
+}
+
+func (j *journaldSink) writeLevel(level int, stamp, msg string) error {
+	priority := "7"
+	switch level {
+	case levelError:
+		priority = "3"
+	case levelQuiet:
+		priority = "4"
+	case levelNormal:
+		priority = "6"
+	}
+
+	b := &strings.Builder{}
+	b.WriteString("PRIORITY=" + priority + "\nSYSLOG_IDENTIFIER=dimco\n")
+	if strings.Contains(msg, "\n") {
+		// Values with newlines are sent with their length in front.
+		size := make([]byte, 8)
+		binary.LittleEndian.PutUint64(size, uint64(len(msg)))
+		b.WriteString("MESSAGE\n")
+		b.Write(size)
+		b.WriteString(msg + "\n")
+	} else {
+		b.WriteString("MESSAGE=" + msg + "\n")
+	}
+
+	_, err := io.WriteString(j.conn, b.String())
+	return err
+}
+
+func (j *journaldSink) Close() error {
+	return j.conn.Close()
+}
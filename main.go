@@ -2,37 +2,75 @@ package main
 
 import (
 	"context"
-	"encoding/base64"
-	"encoding/json"
 	"flag"
 	"fmt"
-	"io"
-	"io/ioutil"
 	"log"
 	"os"
 	"os/signal"
+	"strings"
 	"sync"
 	"syscall"
-
-	"github.com/docker/docker/api/types"
-	"github.com/docker/docker/client"
+	"time"
 )
 
-var (
-	configPath = flag.String("f", "config.json", "config file path")
-)
+// command is a dimco subcommand with its own set of flags.
+type command struct {
+	name  string
+	usage string
+	// args are the positional arguments, offered by shell completion.
+	args  []string
+	flags *flag.FlagSet
+	run   func(ctx context.Context) error
+}
+
+func commands() []*command {
+	return []*command{
+		newSyncCommand(),
+		newPruneCommand(),
+		newDiffCommand(),
+		newPlanCommand(),
+		newApplyCommand(),
+		newVerifyCommand(),
+		newDoctorCommand(),
+		newPromoteCommand(),
+		newDaemonCommand(),
+		newWarmCommand(),
+		newVersionCommand(),
+		newSelfUpdateCommand(),
+		newCompletionCommand(),
+		newDocsCommand(),
+	}
+}
 
 func main() {
-	c, err := loadConfig(*configPath)
-	if err != nil {
-		log.Fatal(err)
+	log.SetFlags(0)
+	log.SetOutput(logs)
+
+	cmds := commands()
+
+	name, args := "sync", os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		name, args = args[0], args[1:]
 	}
 
-	cli, err := client.NewClientWithOpts(client.FromEnv)
-	if err != nil {
+	var cmd *command
+	for _, c := range cmds {
+		if c.name == name {
+			cmd = c
+		}
+	}
+
+	if cmd == nil {
+		printUsage(cmds)
+		os.Exit(2)
+	}
+
+	applyCommonFlags := bindCommonFlags(cmd.flags, cmd.name)
+
+	if err := cmd.flags.Parse(args); err != nil {
 		log.Fatal(err)
 	}
-	defer cli.Close()
+	applyCommonFlags()
 
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
@@ -45,136 +83,740 @@ func main() {
 		<-cChan
 	}()
 
-	wg := sync.WaitGroup{}
-	defer wg.Wait()
+	runCtx, sp := startSpan(ctx, "dimco "+cmd.name)
+	err := cmd.run(runCtx)
+	sp.End(err)
 
-	for _, image := range c.Images {
-		wg.Add(1)
-		go func(img ImageData) {
-			defer wg.Done()
+	if err := flushTracing(context.Background()); err != nil {
+		log.Print(err)
+	}
+
+	if err != nil {
+		errorf("%v", err)
+		os.Exit(1)
+	}
+}
 
-			fromImg := fmt.Sprintf("%v/%v%v:%v", c.FromRepo.BaseAddress, img.FromPrefix, img.Name, img.Tag)
-			toImg := fmt.Sprintf("%v/%v%v:%v", c.ToRepo.BaseAddress, img.ToPrefix, img.Name, img.Tag)
+// bindCommonFlags registers the flags every command accepts and returns the
+// function that applies them after parsing.
+func bindCommonFlags(fs *flag.FlagSet, command string) func() {
+	fs.BoolVar(&promptAuth, "prompt-auth", false, "ask on the terminal for registry credentials that aren't configured")
+	applyOutputFlags := bindOutputFlags(fs)
+	bindAuditFlags(fs, command)
 
-			if err := pullImage(ctx, cli, fromImg, c.FromRepo); err != nil {
-				log.Print(fmt.Errorf("can't pull image '%v': %w", fromImg, err))
-				return
+	return applyOutputFlags
+}
+
+func printUsage(cmds []*command) {
+	fmt.Fprintf(os.Stderr, "Usage: dimco <command> [flags]\n\nCommands:\n")
+	for _, c := range cmds {
+		fmt.Fprintf(os.Stderr, "  %-10v %v\n", c.name, c.usage)
+	}
+}
+
+func newSyncCommand() *command {
+	fs := flag.NewFlagSet("sync", flag.ExitOnError)
+	configPath := fs.String("f", "config.json", "config file path")
+	opts := bindSyncOptions(fs)
+	fs.BoolVar(&opts.TUI, "tui", false, "show a live table of the images, with keys to retry or cancel them")
+
+	return &command{
+		name:  "sync",
+		usage: "copy configured images from the source to the destination registry (default)",
+		flags: fs,
+		run: func(ctx context.Context) error {
+			c, err := loadConfig(*configPath)
+			if err != nil {
+				return err
 			}
 
-			if err := tagImage(ctx, cli, fromImg, toImg); err != nil {
-				log.Print(fmt.Errorf("can't tag image '%v', '%v': %w", fromImg, toImg, err))
-				return
+			return runSync(ctx, c, *opts, newRunReport())
+		},
+	}
+}
+
+// syncOptions controls how runSync copies images.
+type syncOptions struct {
+	// Overwrite allows replacing destination tags that point to a different image.
+	Overwrite bool
+	// Atomic rolls back every destination tag pushed during the run when any image fails.
+	Atomic bool
+	// FailFast cancels the rest of the run when an image fails.
+	FailFast bool
+	// Stage pushes to staging tags that `dimco promote` copies to the final tags later.
+	Stage bool
+	// Delete reports destination tags that don't exist at the source anymore
+	// and deletes them with ApplyDelete.
+	Delete      bool
+	ApplyDelete bool
+	// DockerHost overrides engine_host of the config.
+	DockerHost string
+	// IncludeNonDistributable sets include_non_distributable of the config.
+	IncludeNonDistributable bool
+	// Report is the file the results of the run are written to, in
+	// ReportFormat.
+	Report       string
+	ReportFormat string
+	// AttestOutput is the file listing the pushed references and digests,
+	// signed with cosign when AttestKey is set.
+	AttestOutput string
+	AttestKey    string
+	// TUI shows the live dashboard instead of log lines.
+	TUI bool
+	// Stats prints the transfer statistics of the run as a table.
+	Stats bool
+	// Digests records digest and size of the pushed images in the report,
+	// which Report and CI runs imply.
+	Digests bool
+	// Preflight resolves every source reference before the first copy.
+	Preflight bool
+	// PinOutput is the YAML file mapping every copied destination to its
+	// reference by digest.
+	PinOutput string
+	// DigestEnvFile is the file the digest variables of the copied images
+	// are written to, in DigestEnvFormat.
+	DigestEnvFile   string
+	DigestEnvFormat string
+	// CheckpointDir keeps the progress of chunked uploads for the next run
+	// to continue.
+	CheckpointDir string
+	// Deadline stops the copies of a run after this long, e.g. before the
+	// timeout of the job running it.
+	Deadline time.Duration
+}
+
+// bindSyncOptions registers the flags shared by the commands that sync images.
+func bindSyncOptions(fs *flag.FlagSet) *syncOptions {
+	opts := &syncOptions{}
+	fs.BoolVar(&opts.Delete, "delete", false, "delete destination tags that no longer exist at the source")
+	fs.BoolVar(&opts.ApplyDelete, "yes", false, "perform deletions requested by -delete instead of only reporting them")
+	fs.BoolVar(&opts.Overwrite, "overwrite", false, "replace destination tags that already point to a different image")
+	fs.BoolVar(&opts.Atomic, "atomic", false, "roll back all tags pushed during the run if any image fails")
+	fs.BoolVar(&opts.FailFast, "fail-fast", false, "cancel the remaining and running copies when an image fails")
+	fs.BoolVar(&opts.Stage, "stage", false, "push to staging tags instead of the final tags, see promote")
+	fs.StringVar(&opts.DockerHost, "docker-host", "", "engine endpoint, overrides engine_host (e.g. ssh://user@builder01)")
+	fs.BoolVar(&opts.IncludeNonDistributable, "include-non-distributable", false, "copy foreign layers, like Windows base layers, instead of keeping their urls")
+	fs.StringVar(&opts.Report, "report", "", "write per-image results to this file")
+	fs.StringVar(&opts.ReportFormat, "report-format", reportJSON, "format of -report: json, junit or csv")
+	fs.BoolVar(&opts.Stats, "stats", false, "print transfer statistics per registry and the slowest images after the run")
+	fs.BoolVar(&opts.Preflight, "preflight", false, "check that every source image resolves before copying any")
+	fs.StringVar(&opts.PinOutput, "pin-output", "", "write every copied destination with its digest to this YAML file")
+	fs.StringVar(&opts.DigestEnvFile, "digest-env-file", "", "write IMAGE_<NAME>_DIGEST and IMAGE_<NAME>_REF of every copied image to this file")
+	fs.StringVar(&opts.DigestEnvFormat, "digest-env-format", digestEnvPlain, "format of -digest-env-file: env, dotenv or json")
+	fs.StringVar(&opts.CheckpointDir, "checkpoint-dir", "", "keep the progress of large uploads here, so the next run continues them")
+	fs.DurationVar(&opts.Deadline, "deadline", 0, "stop copying after this long, e.g. before the job times out")
+	bindAttestFlags(fs, opts)
+
+	return opts
+}
+
+// syncer copies the configured images through a local engine.
+type syncer struct {
+	engine  engine
+	dst     *registryClient
+	config  Config
+	opts    syncOptions
+	journal *pushJournal
+	events  *eventSink
+	pulls   pullGroup
+	groups  groupSlots
+	disk    *diskGuard
+	holds   *layerHolds
+}
+
+// runSync copies the images of c and collects their results in report.
+func runSync(ctx context.Context, c Config, opts syncOptions, report *runReport) (err error) {
+	if opts.DockerHost != "" {
+		c.EngineHost = opts.DockerHost
+	}
+	if opts.IncludeNonDistributable {
+		c.IncludeNonDistributable = true
+	}
+
+	if opts.Report != "" {
+		if err := validReportFormat(opts.ReportFormat); err != nil {
+			return err
+		}
+	}
+	if opts.DigestEnvFile != "" {
+		if err := validDigestEnvFormat(opts.DigestEnvFormat); err != nil {
+			return err
+		}
+	}
+	if opts.PinOutput != "" || len(c.Pins) > 0 || opts.DigestEnvFile != "" {
+		opts.Digests = true
+	}
+
+	if err := c.startLogging(); err != nil {
+		return err
+	}
+
+	defer func() {
+		report.finish()
+
+		if opts.Stats {
+			if werr := report.Stats.write(os.Stdout); werr != nil {
+				log.Print(werr)
+			}
+		}
+
+		if opts.Report != "" {
+			if werr := report.write(opts.Report, opts.ReportFormat); werr != nil && err == nil {
+				err = werr
+			}
+		}
+
+		if opts.AttestOutput != "" {
+			if aerr := writeAttestation(context.Background(), report, opts.AttestOutput, opts.AttestKey); aerr != nil && err == nil {
+				err = aerr
 			}
+		}
 
-			if err := pushImage(ctx, cli, toImg, c.ToRepo); err != nil {
-				log.Print(fmt.Errorf("can't push image '%v': %w", toImg, err))
-				return
+		if opts.PinOutput != "" {
+			if perr := writePins(report, opts.PinOutput); perr != nil && err == nil {
+				err = perr
 			}
+		}
+		if perr := updatePins(report, c.Pins); perr != nil && err == nil {
+			err = perr
+		}
+
+		if opts.DigestEnvFile != "" {
+			if derr := writeDigestEnv(report, opts.DigestEnvFile, opts.DigestEnvFormat); derr != nil && err == nil {
+				err = derr
+			}
+		}
+
+		if cerr := publishCI(report); cerr != nil {
+			log.Print(cerr)
+		}
 
-			if err := removeImages(ctx, cli, fromImg); err != nil {
-				log.Print(fmt.Errorf("can't delete image '%v': %w", fromImg, err))
+		if c.Email != nil {
+			if eerr := c.Email.sendSummary(report, err); eerr != nil {
+				log.Print(eerr)
 			}
+		}
 
-			if err := removeImages(ctx, cli, toImg); err != nil {
-				log.Print(fmt.Errorf("can't delete image '%v': %w", toImg, err))
+		if c.Metrics != nil {
+			if merr := c.Metrics.push(report, err); merr != nil {
+				log.Print(merr)
 			}
+		}
+	}()
+
+	if opts.Deadline > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, opts.Deadline)
+		defer cancel()
 
-		}(image)
+		defer func() {
+			if err != nil && ctx.Err() == context.DeadlineExceeded {
+				err = fmt.Errorf("deadline of %v reached: %w", opts.Deadline, err)
+			}
+		}()
 	}
-}
 
-func pullImage(ctx context.Context, cli *client.Client, image string, ac AuthConfig) error {
-	out, err := cli.ImagePull(ctx, image, types.ImagePullOptions{
-		All:          false,
-		RegistryAuth: ac.ToEncodedString(),
-	})
+	ctx, unlock, err := c.acquireLock(ctx)
 	if err != nil {
-		return fmt.Errorf("can't pull image: %w", err)
+		return err
 	}
-	defer out.Close()
+	defer unlock()
 
-	if _, err := io.Copy(os.Stdout, out); err != nil {
-		return fmt.Errorf("can't copy image: %w", err)
+	removeWorkspace, err := c.createWorkspace()
+	if err != nil {
+		return err
+	}
+	defer removeWorkspace()
+
+	if opts.CheckpointDir != "" {
+		cps, err := openCheckpoints(opts.CheckpointDir)
+		if err != nil {
+			return err
+		}
+		ctx = withCheckpoints(ctx, cps)
 	}
 
-	return nil
-}
+	if err := c.startAudit(); err != nil {
+		return err
+	}
 
-func tagImage(ctx context.Context, cli *client.Client, fromImg, toImg string) error {
-	if err := cli.ImageTag(ctx, fromImg, toImg); err != nil {
-		return fmt.Errorf("can't tag image: %w", err)
+	c, err = c.withDiscovered(ctx)
+	if err != nil {
+		return err
 	}
 
-	return nil
-}
+	if opts.Preflight {
+		if err := c.preflight(ctx, report); err != nil {
+			return err
+		}
+	}
+
+	if c.Quota != nil {
+		if c, err = c.checkQuota(ctx, opts, report); err != nil {
+			return err
+		}
+	}
+
+	e, err := newEngine(c)
+	if err != nil {
+		return err
+	}
+	defer e.Close()
+
+	disk, err := c.newDiskGuard(ctx, e)
+	if err != nil {
+		return err
+	}
+
+	if tracer != nil {
+		e = tracedEngine{engine: e}
+	}
+
+	s := &syncer{
+		engine:  e,
+		dst:     newRegistryClient(c.ToRepo),
+		config:  c,
+		opts:    opts,
+		journal: &pushJournal{},
+		groups:  newGroupSlots(c),
+		disk:    disk,
+		holds:   &layerHolds{},
+	}
+	if c.Events != nil {
+		s.events = newEventSink(*c.Events)
+		defer s.events.Close()
+	}
+
+	runCtx, cancelRun := context.WithCancel(ctx)
+	defer cancelRun()
+	var failFast sync.Once
 
-func pushImage(ctx context.Context, cli *client.Client, image string, ac AuthConfig) error {
-	reader, err := cli.ImagePush(ctx, image, types.ImagePushOptions{
-		All:          false,
-		RegistryAuth: ac.ToEncodedString(),
-	})
+	plan, err := newRunPlan(c)
 	if err != nil {
-		return fmt.Errorf("can't push image: %w", err)
+		return err
+	}
+	copyImage := func(ctx context.Context, i int) imageResult {
+		res := s.syncPlanned(ctx, plan, i)
+		// Images left out on purpose don't hold up their dependents.
+		plan.finish(i, res.Status == resultCopied || res.Status == resultSkipped && !res.blocked)
+
+		if opts.FailFast && res.Status == resultFailed && runCtx.Err() == nil {
+			failFast.Do(func() {
+				log.Printf("%v failed, cancelling the remaining images", res.Destination)
+				cancelRun()
+			})
+		}
+		return res
+	}
+
+	var results []imageResult
+	if opts.TUI {
+		ui, err := newDashboard(s, c.Images)
+		if err != nil {
+			return err
+		}
+
+		results = ui.run(runCtx, copyImage)
+		ui.close()
+	} else {
+		results = make([]imageResult, len(c.Images))
+
+		wg := sync.WaitGroup{}
+		for i := range c.Images {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				results[i] = copyImage(withProgress(runCtx, newImageProgress()), i)
+			}(i)
+		}
+		wg.Wait()
+	}
+
+	// Images skipped by a hook, the policy or a filter were left out on
+	// purpose and don't fail the run.
+	failed, skipped := 0, 0
+	for _, res := range results {
+		switch res.Status {
+		case resultFailed:
+			failed++
+		case resultSkipped:
+			skipped++
+		}
+		report.add(res)
+	}
+
+	if opts.Atomic && (failed > 0 || ctx.Err() != nil) {
+		errorf("%v images failed, rolling back %v pushed tags", failed, s.journal.len())
+
+		// The run context may already be cancelled, the rollback must still happen.
+		if err := s.journal.rollback(context.Background(), s.dst); err != nil {
+			return fmt.Errorf("can't roll back: %w", err)
+		}
+		report.markRolledBack()
+
+		return fmt.Errorf("%v images failed, pushed tags were rolled back", failed)
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%v of %v images failed", failed, len(c.Images))
+	}
+
+	if skipped > 0 {
+		log.Printf("synced %v images, %v skipped", len(c.Images)-skipped, skipped)
+	} else {
+		log.Printf("synced %v images", len(c.Images))
 	}
-	defer reader.Close()
 
-	if _, err := io.Copy(os.Stdout, reader); err != nil {
-		return fmt.Errorf("can't copy image: %w", err)
+	if opts.Delete {
+		return propagateDeletions(ctx, c, opts.ApplyDelete)
 	}
 
 	return nil
 }
 
-func loadConfig(filepath string) (Config, error) {
-	data, err := ioutil.ReadFile(filepath)
+// syncPlanned copies image i once the plan lets it start.
+func (s *syncer) syncPlanned(ctx context.Context, plan *runPlan, i int) imageResult {
+	img := s.config.Images[i]
+	if err := plan.wait(ctx, i); err != nil {
+		fromImg, toImg := s.references(img)
+		res := imageResult{Source: fromImg, Destination: toImg, Status: resultSkipped, Error: err.Error(), name: img.Name, tag: img.Tag, blocked: true}
+		if ctx.Err() != nil {
+			res.Status = resultFailed
+		}
+		log.Print(fmt.Errorf("skipping '%v': %w", toImg, err))
+		return res
+	}
+
+	release, err := s.groups.acquire(ctx, img.Group)
 	if err != nil {
-		return Config{}, fmt.Errorf("can't read config file")
+		fromImg, toImg := s.references(img)
+		return imageResult{Source: fromImg, Destination: toImg, Status: resultFailed, Error: err.Error(), ErrorClass: errorClass(err), name: img.Name, tag: img.Tag}
+	}
+	defer release()
+
+	return s.syncImage(ctx, img)
+}
+
+// syncImage copies img and returns its result for the report.
+func (s *syncer) syncImage(ctx context.Context, img ImageData) imageResult {
+	start := time.Now()
+	img, skip, err := s.resolveSource(ctx, img)
+	if err == nil && skip == "" {
+		img, err = s.verifyUpstream(ctx, img)
+	}
+	if err == nil && skip == "" {
+		skip, err = s.checkFilter(ctx, img)
+	}
+	if err == nil && skip == "" {
+		img, skip, err = s.checkPolicy(ctx, img)
+	}
+	if err == nil && skip == "" {
+		skip, err = s.checkArchTags(ctx, img)
 	}
 
-	c := Config{}
-	if err := json.Unmarshal(data, &c); err != nil {
-		return Config{}, fmt.Errorf("can't unmarshal config")
+	fromImg, toImg := s.references(img)
+	res := imageResult{Source: fromImg, Destination: toImg, Status: resultCopied, name: img.Name, tag: img.Tag}
+	if skip != "" {
+		infof("%v skipped, %v", toImg, skip)
+		res.Status, res.Error = resultSkipped, skip
+		return res
 	}
 
-	return c, nil
+	if err == nil {
+		err = s.copyWithRetry(ctx, img, toImg)
+	}
+	res.Duration = time.Since(start).Seconds()
+	res.transferStats = progressFrom(ctx).transfers()
+
+	if err != nil {
+		res.ErrorClass = errorClass(err)
+		errorf("%v [%v]", err, res.ErrorClass)
+		res.Status, res.Error = resultFailed, redact(err.Error())
+	} else if s.opts.Digests || s.opts.Report != "" || s.opts.AttestOutput != "" || s.events != nil || ciDetected() {
+		res.Digest, res.Size = s.pushedManifest(ctx, img)
+	}
+
+	if s.events != nil {
+		s.events.send(res, s.sourceDigest(ctx, img))
+	}
+
+	return res
 }
 
-func removeImages(ctx context.Context, cli *client.Client, img string) error {
-	deletedItems, err := cli.ImageRemove(ctx, img, types.ImageRemoveOptions{
-		Force:         true,
-		PruneChildren: true,
-	})
+// copyWithRetry copies img, retrying transient failures as configured in
+// retry of its group or the config.
+func (s *syncer) copyWithRetry(ctx context.Context, img ImageData, toImg string) error {
+	rc := s.config.retryConfig(img)
+
+	for attempt := 1; ; attempt++ {
+		err := s.copyImage(ctx, img)
+		if err == nil {
+			return nil
+		}
+
+		class := errorClass(err)
+		if attempt > rc.Attempts || !retryable(class) {
+			return classify(err)
+		}
+
+		delay := rc.retryDelay(attempt, err)
+		infof("%v failed [%v], retrying in %v: %v", toImg, class, delay, redact(err.Error()))
+
+		t := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return classify(err)
+		case <-t.C:
+		}
+	}
+}
+
+// sourceDigest is the pinned digest of img or the one its tag points to, ""
+// if the source can't tell.
+func (s *syncer) sourceDigest(ctx context.Context, img ImageData) string {
+	if img.Digest != "" {
+		return img.Digest
+	}
+
+	c := s.config
+	d, err := newRegistryClient(c.FromRepo).ManifestDigest(ctx, repositoryPath(c.FromRepo, img.FromPrefix, img.Name), img.Tag)
 	if err != nil {
-		return fmt.Errorf("can't tag image: %w", err)
+		debugf("can't resolve source digest of %v: %v", img.Name, err)
+		return ""
 	}
+	return d
+}
 
-	log.Printf("delete images: %v", deletedItems)
+// references returns the source and destination image references of img.
+func (s *syncer) references(img ImageData) (fromImg, toImg string) {
+	c := s.config
+	fromImg = referenceString(c.FromRepo, img.FromPrefix, img.Name, img.sourceRef())
+	toImg = referenceString(c.ToRepo, img.ToPrefix, img.destinationName(), s.destinationTag(img))
+	return fromImg, toImg
+}
 
-	return nil
+// destinationTag is the tag img is pushed to, the staging tag with -stage.
+func (s *syncer) destinationTag(img ImageData) string {
+	if s.opts.Stage {
+		return s.config.stagingTag(img.Tag)
+	}
+	return img.Tag
 }
 
-type Config struct {
-	FromRepo AuthConfig  `json:"from_repo,omitempty"`
-	ToRepo   AuthConfig  `json:"to_repo,omitempty"`
-	Images   []ImageData `json:"images,omitempty"`
+// auditPush records the push of repo:tag with the digest the tag points to
+// now.
+func (s *syncer) auditPush(ctx context.Context, repo, tag string) {
+	if !auditing() {
+		return
+	}
+
+	digest, err := s.dst.ManifestDigest(ctx, repo, tag)
+	if err != nil {
+		log.Print(fmt.Errorf("can't resolve pushed digest of %v:%v for the audit log: %w", repo, tag, err))
+	}
+	recordAudit(auditPush, qualifiedReference(s.dst.host, repo, tag), digest)
 }
 
-type AuthConfig struct {
-	BaseAddress   string `json:"base_address,omitempty"`
-	ServerAddress string `json:"server_address,omitempty"`
-	Username      string `json:"username,omitempty"`
-	Password      string `json:"password,omitempty"`
+// pushedManifest returns the digest and the compressed size of config and
+// layers of the pushed image, for the report.
+func (s *syncer) pushedManifest(ctx context.Context, img ImageData) (string, int64) {
+	repo := repositoryPath(s.config.ToRepo, img.ToPrefix, img.destinationName())
+	m, digest, err := s.dst.FetchManifest(ctx, repo, s.destinationTag(img))
+	// arch_tags only deleted the index.
+	if isNotFound(err) && img.ArchTags == archTagsOnly {
+		return "", 0
+	}
+	if err != nil {
+		log.Print(fmt.Errorf("can't read pushed manifest of %v: %w", repo, err))
+		return "", 0
+	}
+
+	size := m.Config.Size
+	for _, l := range m.Layers {
+		size += l.Size
+	}
+	for _, child := range m.Manifests {
+		size += child.Size
+	}
+
+	return digest, size
 }
 
-func (ac AuthConfig) ToEncodedString() string {
-	authConfigBytes, _ := json.Marshal(ac)
-	authConfigEncoded := base64.URLEncoding.EncodeToString(authConfigBytes)
-	return authConfigEncoded
+// pulledAlready reports whether the engine has the source image with the
+// digest the source registry has now, e.g. on a CI runner that just built
+// and pushed it. Lookup errors only mean pulling.
+func (s *syncer) pulledAlready(ctx context.Context, img ImageData, fromImg string) bool {
+	// The registry engine keeps nothing between runs.
+	if s.config.Backend == backendRegistry {
+		return false
+	}
+
+	digest := s.sourceDigest(ctx, img)
+	if digest == "" {
+		return false
+	}
+
+	ok, err := s.engine.HasDigest(ctx, fromImg, digest)
+	if err != nil {
+		debugf("can't look up %v in the engine, pulling it: %v", fromImg, err)
+		return false
+	}
+	return ok
 }
 
-type ImageData struct {
-	Name       string `json:"name,omitempty"`
-	Tag        string `json:"tag,omitempty"`
-	FromPrefix string `json:"from_prefix,omitempty"`
-	ToPrefix   string `json:"to_prefix,omitempty"`
+// copyImage pulls the source image, pushes it to the destination and removes
+// both from the local engine.
+func (s *syncer) copyImage(ctx context.Context, img ImageData) (err error) {
+	c := s.config
+	fromImg, toImg := s.references(img)
+	toTag := s.destinationTag(img)
+
+	ctx, sp := startSpan(ctx, "copy", "image.source", fromImg, "image.destination", toImg)
+	defer func() { sp.End(err) }()
+
+	// Staging tags are replaced on every run, the final tags are guarded by promote.
+	toRepo := repositoryPath(c.ToRepo, img.ToPrefix, img.destinationName())
+	overwrite := s.opts.Overwrite || s.opts.Stage
+
+	// Squashed and encrypted images are built from the source registry, the
+	// engine isn't involved.
+	var built *builtImage
+	var cleanup localCleanup
+	// Other destinations of the source may still need it, the last copy
+	// removes it.
+	var release func(remove bool) bool
+	removeSource := false
+	// The layers of the pulled image are held from the pull until the copy
+	// cleans up.
+	unhold := func() {}
+	if s.guards(img) {
+		defer s.disk.enter()()
+	}
+	defer func() {
+		if release != nil && release(removeSource) {
+			s.removeLocal(ctx, fromImg)
+		}
+	}()
+	progressFrom(ctx).setPhase(phasePulling)
+	if c.rebuilds(img) {
+		var unreserve func()
+		if unreserve, err = s.reserveDisk(ctx, img, fromImg); err != nil {
+			return fmt.Errorf("can't build image '%v': %w", fromImg, err)
+		}
+		built, err = c.buildImage(ctx, img)
+		unreserve()
+		if err != nil {
+			return fmt.Errorf("can't build image '%v': %w", fromImg, err)
+		}
+		defer built.Close()
+
+		if err := checkConfigConflict(ctx, s.dst, built.config.Digest, toRepo, toTag, overwrite); err != nil {
+			return fmt.Errorf("can't push image '%v': %w", toImg, err)
+		}
+	} else {
+		cleanup = s.planCleanup(ctx, img, fromImg, toImg)
+		release, err = s.pulls.acquire(ctx, fromImg, func() error {
+			if s.pulledAlready(ctx, img, fromImg) {
+				infof("%v is in the engine already, skipping the pull", fromImg)
+				return nil
+			}
+			unreserve, err := s.reserveDisk(ctx, img, fromImg)
+			if err != nil {
+				return err
+			}
+			defer unreserve()
+			return s.engine.Pull(ctx, fromImg, c.FromRepo)
+		})
+		if err != nil {
+			return fmt.Errorf("can't pull image '%v': %w", fromImg, err)
+		}
+		unhold = s.holdLayers(ctx, fromImg)
+		defer unhold()
+
+		if err := checkTagConflict(ctx, s.engine, s.dst, fromImg, toRepo, toTag, overwrite); err != nil {
+			removeSource = cleanup.source
+			return fmt.Errorf("can't push image '%v': %w", toImg, err)
+		}
+
+		if err := s.engine.Tag(ctx, fromImg, toImg); err != nil {
+			return fmt.Errorf("can't tag image '%v', '%v': %w", fromImg, toImg, err)
+		}
+
+		if err := s.transform(ctx, img, fromImg, toImg); err != nil {
+			return fmt.Errorf("can't transform image '%v': %w", toImg, err)
+		}
+	}
+
+	var entry pushEntry
+	if s.opts.Atomic {
+		e, err := snapshotTag(ctx, s.dst, toRepo, toTag)
+		if err != nil {
+			return fmt.Errorf("can't push image '%v': %w", toImg, err)
+		}
+		entry = e
+	}
+
+	progressFrom(ctx).setPhase(phasePushing)
+	if built != nil {
+		err = built.push(ctx, s.dst, toRepo, toTag)
+	} else {
+		err = s.engine.Push(ctx, toImg, c.ToRepo)
+	}
+	if err != nil {
+		return fmt.Errorf("can't push image '%v': %w", toImg, err)
+	}
+	progressFrom(ctx).endPhase()
+	s.auditPush(ctx, toRepo, toTag)
+
+	if s.opts.Atomic {
+		if err := s.journal.add(ctx, s.dst, entry); err != nil {
+			return fmt.Errorf("can't record push of '%v': %w", toImg, err)
+		}
+	}
+
+	if img.ExpiresAfter > 0 {
+		at := time.Now().Add(time.Duration(img.ExpiresAfter))
+		if err := setQuayExpiration(ctx, c.ToRepo, toRepo, toTag, at); err != nil {
+			return fmt.Errorf("can't set expiration of '%v': %w", toImg, err)
+		}
+		recordAudit(auditExpire, qualifiedReference(s.dst.host, toRepo, toTag), "")
+	}
+
+	if c.Artifactory != nil {
+		if err := s.annotateArtifactory(ctx, img, toRepo, toTag); err != nil {
+			return fmt.Errorf("can't annotate '%v' in artifactory: %w", toImg, err)
+		}
+		recordAudit(auditProps, qualifiedReference(s.dst.host, toRepo, toTag), "")
+	}
+
+	// Staged images get their aliases when they are promoted.
+	if !s.opts.Stage {
+		if err := s.tagAliases(ctx, img, toRepo, toTag); err != nil {
+			return err
+		}
+		if err := s.tagArchitectures(ctx, img, toRepo, toTag); err != nil {
+			return err
+		}
+	}
+
+	if c.Referrers {
+		if err := s.copyReferrers(ctx, img, toRepo, toTag); err != nil {
+			return fmt.Errorf("can't copy referrers of '%v': %w", fromImg, err)
+		}
+	}
+
+	if err := s.destinationHooks(ctx, img, fromImg, toImg, toRepo, toTag); err != nil {
+		return err
+	}
+
+	removeSource = cleanup.source
+	unhold()
+	if cleanup.target {
+		s.removeLocal(ctx, toImg)
+	}
+
+	infof("copied %v to %v", fromImg, toImg)
+
+	return nil
 }
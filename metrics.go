@@ -0,0 +1,320 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultMetricsJob     = "dimco"
+	defaultMetricsTimeout = 10 * time.Second
+	// maxStatsDPacket keeps datagrams under the usual MTU.
+	maxStatsDPacket = 1400
+)
+
+// MetricsConfig pushes the metrics of every sync run to a Prometheus
+// Pushgateway or a StatsD server, for runs that live too short to be
+// scraped.
+type MetricsConfig struct {
+	// Pushgateway is the URL of the Pushgateway, e.g.
+	// http://pushgateway:9091.
+	Pushgateway string `json:"pushgateway,omitempty"`
+	// StatsD is the host:port of a StatsD server, metrics are sent over UDP
+	// with DogStatsD tags.
+	StatsD string `json:"statsd,omitempty"`
+	// Job and Instance label the metrics, dimco and the host name by
+	// default.
+	Job      string `json:"job,omitempty"`
+	Instance string `json:"instance,omitempty"`
+	// Labels are further grouping labels, e.g. the environment.
+	Labels  map[string]string `json:"labels,omitempty"`
+	Timeout Duration          `json:"timeout,omitempty"`
+}
+
+func (mc MetricsConfig) validate() error {
+	if mc.Pushgateway == "" && mc.StatsD == "" {
+		return fmt.Errorf("metrics needs pushgateway or statsd")
+	}
+
+	if mc.Pushgateway != "" {
+		u, err := url.Parse(mc.Pushgateway)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("metrics.pushgateway must be an http or https URL")
+		}
+	}
+	if mc.StatsD != "" {
+		if _, _, err := net.SplitHostPort(mc.StatsD); err != nil {
+			return fmt.Errorf("metrics.statsd must be host:port: %w", err)
+		}
+	}
+
+	for name := range mc.Labels {
+		if !validMetricName(name) || name == "job" || name == "instance" || strings.HasPrefix(name, "__") {
+			return fmt.Errorf("invalid metrics label '%v'", name)
+		}
+	}
+
+	return nil
+}
+
+func validMetricName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for i, r := range name {
+		if !(r == '_' || r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || i > 0 && r >= '0' && r <= '9') {
+			return false
+		}
+	}
+	return true
+}
+
+// metric is one sample of the metrics of a run.
+type metric struct {
+	name   string
+	help   string
+	labels [][2]string
+	value  float64
+}
+
+// runMetrics returns the metrics of the finished run r and whether it
+// succeeded: runErr is nil and no image failed.
+func runMetrics(r *runReport, runErr error) ([]metric, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	statuses := map[string]int{resultCopied: 0, resultSkipped: 0, resultFailed: 0, resultRolledBack: 0}
+	for _, res := range r.Images {
+		statuses[res.Status]++
+	}
+
+	success := 1.0
+	if runErr != nil || statuses[resultFailed] > 0 {
+		success = 0
+	}
+
+	ms := []metric{
+		{name: "dimco_last_run_timestamp_seconds", help: "Start of the last sync run.", value: float64(r.Started.Unix())},
+		{name: "dimco_last_run_duration_seconds", help: "Duration of the last sync run.", value: r.Duration},
+		{name: "dimco_last_run_success", help: "Whether the last sync run copied every image.", value: success},
+	}
+	if success == 1 {
+		ms = append(ms, metric{name: "dimco_last_success_timestamp_seconds", help: "Start of the last sync run that copied every image.", value: float64(r.Started.Unix())})
+	}
+
+	for _, status := range sortedKeys(statuses) {
+		ms = append(ms, metric{name: "dimco_last_run_images", help: "Images of the last sync run by status.",
+			labels: [][2]string{{"status", status}}, value: float64(statuses[status])})
+	}
+
+	if r.Stats != nil {
+		ms = append(ms,
+			metric{name: "dimco_last_run_pulled_bytes", help: "Bytes pulled by the last sync run.", value: float64(r.Stats.Pulled)},
+			metric{name: "dimco_last_run_pushed_bytes", help: "Bytes pushed by the last sync run.", value: float64(r.Stats.Pushed)},
+			metric{name: "dimco_last_run_skipped_layers", help: "Layers the last sync run found at the destination.", value: float64(r.Stats.SkippedLayers)},
+		)
+		for _, class := range sortedKeys(r.Stats.Errors) {
+			ms = append(ms, metric{name: "dimco_last_run_errors", help: "Failed images of the last sync run by error class.",
+				labels: [][2]string{{"class", class}}, value: float64(r.Stats.Errors[class])})
+		}
+		for _, rs := range r.Stats.Registries {
+			ms = append(ms, metric{name: "dimco_last_run_transferred_bytes", help: "Bytes transferred by the last sync run by registry.",
+				labels: [][2]string{{"registry", rs.Registry}, {"direction", rs.Direction}}, value: float64(rs.Bytes)})
+		}
+	}
+
+	return ms, success == 1
+}
+
+func sortedKeys(m map[string]int) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// push sends the metrics of the finished run r to the configured servers.
+func (mc MetricsConfig) push(r *runReport, runErr error) error {
+	timeout := time.Duration(mc.Timeout)
+	if timeout == 0 {
+		timeout = defaultMetricsTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	ms, success := runMetrics(r, runErr)
+
+	var errs []string
+	if mc.Pushgateway != "" {
+		if err := mc.pushGateway(ctx, ms, success); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	if mc.StatsD != "" {
+		if err := mc.sendStatsD(ctx, ms); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("can't push metrics: %v", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// groupingLabels are the labels of the group the metrics are pushed to, job
+// first.
+func (mc MetricsConfig) groupingLabels() [][2]string {
+	job := mc.Job
+	if job == "" {
+		job = defaultMetricsJob
+	}
+	instance := mc.Instance
+	if instance == "" {
+		instance, _ = os.Hostname()
+	}
+
+	labels := [][2]string{{"job", job}, {"instance", instance}}
+	names := []string{}
+	for name := range mc.Labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		labels = append(labels, [2]string{name, mc.Labels[name]})
+	}
+	return labels
+}
+
+// pushGateway sends the metrics to their group. A successful run replaces
+// the group with PUT; failed runs are POSTed, which replaces only the metrics
+// sent, so the last success survives them.
+func (mc MetricsConfig) pushGateway(ctx context.Context, ms []metric, success bool) error {
+	u := strings.TrimSuffix(mc.Pushgateway, "/") + "/metrics"
+	for _, l := range mc.groupingLabels() {
+		u += "/" + groupingSegment(l[0], l[1])
+	}
+
+	method := http.MethodPost
+	if success {
+		method = http.MethodPut
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u, bytes.NewReader(formatPrometheus(ms)))
+	if err != nil {
+		return fmt.Errorf("can't create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "text/plain; version=0.0.4")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("can't send request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		data, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+		return &statusError{Method: method, URL: u, StatusCode: resp.StatusCode, Body: string(data)}
+	}
+	return nil
+}
+
+// groupingSegment is the path of a grouping label, base64 encoded when the
+// value doesn't fit into a path segment.
+func groupingSegment(name, value string) string {
+	if value == "" {
+		return name + "@base64/="
+	}
+	if strings.Contains(value, "/") {
+		return name + "@base64/" + base64.RawURLEncoding.EncodeToString([]byte(value))
+	}
+	return name + "/" + url.PathEscape(value)
+}
+
+// formatPrometheus renders the metrics in the Prometheus text format.
+// Samples of one name are next to each other.
+func formatPrometheus(ms []metric) []byte {
+	b := &bytes.Buffer{}
+	last := ""
+	for _, m := range ms {
+		if m.name != last {
+			fmt.Fprintf(b, "# HELP %v %v\n# TYPE %v gauge\n", m.name, m.help, m.name)
+			last = m.name
+		}
+		b.WriteString(m.name)
+		if len(m.labels) > 0 {
+			pairs := []string{}
+			for _, l := range m.labels {
+				pairs = append(pairs, fmt.Sprintf("%v=%q", l[0], l[1]))
+			}
+			b.WriteString("{" + strings.Join(pairs, ",") + "}")
+		}
+		fmt.Fprintf(b, " %v\n", formatValue(m.value))
+	}
+	return b.Bytes()
+}
+
+// sendStatsD sends the metrics as gauges, the labels and the grouping
+// labels as tags.
+func (mc MetricsConfig) sendStatsD(ctx context.Context, ms []metric) error {
+	d := net.Dialer{}
+	conn, err := d.DialContext(ctx, "udp", mc.StatsD)
+	if err != nil {
+		return fmt.Errorf("can't connect to %v: %w", mc.StatsD, err)
+	}
+	defer conn.Close()
+
+	grouping := mc.groupingLabels()
+	packet := &bytes.Buffer{}
+	flush := func() error {
+		if packet.Len() == 0 {
+			return nil
+		}
+		_, err := conn.Write(bytes.TrimSuffix(packet.Bytes(), []byte("\n")))
+		packet.Reset()
+		return err
+	}
+
+	for _, m := range ms {
+		tags := []string{}
+		for _, ls := range [][][2]string{grouping, m.labels} {
+			for _, l := range ls {
+				tags = append(tags, l[0]+":"+statsDTag(l[1]))
+			}
+		}
+		line := fmt.Sprintf("%v:%v|g|#%v\n", strings.Replace(m.name, "_", ".", 1), formatValue(m.value), strings.Join(tags, ","))
+
+		if packet.Len()+len(line) > maxStatsDPacket {
+			if err := flush(); err != nil {
+				return fmt.Errorf("can't send to %v: %w", mc.StatsD, err)
+			}
+		}
+		packet.WriteString(line)
+	}
+	if err := flush(); err != nil {
+		return fmt.Errorf("can't send to %v: %w", mc.StatsD, err)
+	}
+	return nil
+}
+
+// formatValue writes values without exponent, which StatsD doesn't read.
+func formatValue(v float64) string {
+	return strconv.FormatFloat(v, 'f', -1, 64)
+}
+
+// statsDTag replaces the characters that separate tags.
+func statsDTag(value string) string {
+	return strings.NewReplacer(",", "_", "|", "_", "#", "_", "\n", "_").Replace(value)
+}
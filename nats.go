@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// natsTokenEnv holds the token for NATS servers using token authentication.
+const natsTokenEnv = "NATS_TOKEN"
+
+// NATSConfig names the server and the subject events are published to.
+type NATSConfig struct {
+	// URL is nats://host:4222, or tls://host:4222, with optional
+	// user:password.
+	URL     string `json:"url"`
+	Subject string `json:"subject"`
+}
+
+func (nc NATSConfig) validate() error {
+	if nc.URL == "" || nc.Subject == "" {
+		return fmt.Errorf("events.nats needs url and subject")
+	}
+
+	u, err := url.Parse(nc.URL)
+	if err != nil || u.Host == "" {
+		return fmt.Errorf("invalid events.nats.url '%v'", nc.URL)
+	}
+	switch u.Scheme {
+	case "nats", "tls":
+	default:
+		return fmt.Errorf("events.nats.url must be nats:// or tls://")
+	}
+
+	return nil
+}
+
+// natsPublisher speaks the text protocol of NATS core: CONNECT once, then
+// PUB followed by PING, whose PONG confirms the server processed the
+// message, or returns its -ERR.
+type natsPublisher struct {
+	config NATSConfig
+	conn   net.Conn
+	r      *bufio.Reader
+}
+
+func newNATSPublisher(nc NATSConfig) *natsPublisher {
+	return &natsPublisher{config: nc}
+}
+
+func (p *natsPublisher) connect(ctx context.Context) error {
+	u, _ := url.Parse(p.config.URL)
+	host := u.Host
+	if u.Port() == "" {
+		host = net.JoinHostPort(u.Hostname(), "4222")
+	}
+
+	conn, err := (&net.Dialer{}).DialContext(ctx, "tcp", host)
+	if err != nil {
+		return fmt.Errorf("can't connect to NATS at '%v': %w", host, err)
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	r := bufio.NewReader(conn)
+	line, err := r.ReadString('\n')
+	if err != nil || !strings.HasPrefix(line, "INFO ") {
+		conn.Close()
+		return fmt.Errorf("can't read NATS server info: %v", strings.TrimSpace(line))
+	}
+	var info struct {
+		TLSRequired bool `json:"tls_required"`
+	}
+	json.Unmarshal([]byte(strings.TrimPrefix(line, "INFO ")), &info)
+
+	if u.Scheme == "tls" || info.TLSRequired {
+		tc := tls.Client(conn, &tls.Config{ServerName: u.Hostname()})
+		if err := tc.Handshake(); err != nil {
+			conn.Close()
+			return fmt.Errorf("can't establish TLS with NATS: %w", err)
+		}
+		conn, r = tc, bufio.NewReader(tc)
+	}
+
+	opts := map[string]interface{}{"verbose": false, "pedantic": false, "name": "dimco", "lang": "go"}
+	if u.User != nil {
+		opts["user"] = u.User.Username()
+		opts["pass"], _ = u.User.Password()
+	}
+	if token := os.Getenv(natsTokenEnv); token != "" {
+		opts["auth_token"] = token
+	}
+	connect, _ := json.Marshal(opts)
+	if _, err := fmt.Fprintf(conn, "CONNECT %s\r\n", connect); err != nil {
+		conn.Close()
+		return fmt.Errorf("can't send CONNECT: %w", err)
+	}
+
+	p.conn, p.r = conn, r
+	return nil
+}
+
+func (p *natsPublisher) publish(ctx context.Context, key string, data []byte) (err error) {
+	if p.conn == nil {
+		if err := p.connect(ctx); err != nil {
+			return err
+		}
+	}
+	defer func() {
+		if err != nil {
+			p.Close()
+		}
+	}()
+
+	if deadline, ok := ctx.Deadline(); ok {
+		p.conn.SetDeadline(deadline)
+	}
+
+	if _, err := fmt.Fprintf(p.conn, "PUB %v %v\r\n%s\r\nPING\r\n", p.config.Subject, len(data), data); err != nil {
+		return fmt.Errorf("can't publish to NATS: %w", err)
+	}
+
+	for {
+		line, err := p.r.ReadString('\n')
+		if err != nil {
+			return fmt.Errorf("can't read NATS reply: %w", err)
+		}
+
+		switch line = strings.TrimSpace(line); {
+		case line == "PONG":
+			tracef("published event of %v to NATS subject %v", key, p.config.Subject)
+			return nil
+		case line == "PING":
+			fmt.Fprint(p.conn, "PONG\r\n")
+		case strings.HasPrefix(line, "-ERR"):
+			return fmt.Errorf("NATS: %v", strings.TrimSpace(strings.TrimPrefix(line, "-ERR")))
+		}
+	}
+}
+
+func (p *natsPublisher) Close() error {
+	if p.conn == nil {
+		return nil
+	}
+
+	err := p.conn.Close()
+	p.conn, p.r = nil, nil
+	return err
+}
@@ -0,0 +1,333 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// OIDC exchange targets.
+const (
+	exchangeAWS   = "aws"
+	exchangeGCP   = "gcp"
+	exchangeAzure = "azure"
+	exchangeNone  = "none"
+)
+
+// OIDCConfig describes how to trade the ID token of a CI job or workload for
+// registry credentials through workload identity federation.
+type OIDCConfig struct {
+	// Issuer, when set, must match the iss claim of the ID token.
+	Issuer string `json:"issuer,omitempty"`
+	// Audience is requested for the ID token. It defaults to the audience
+	// the exchange target expects.
+	Audience string `json:"audience,omitempty"`
+
+	// TokenFile or TokenEnv hold an ID token issued by the platform, like
+	// GitLab id_tokens or a projected Kubernetes service account token.
+	// Without them the token is requested from GitHub Actions.
+	TokenFile string `json:"token_file,omitempty"`
+	TokenEnv  string `json:"token_env,omitempty"`
+
+	// Exchange is aws (ECR), gcp (Artifact Registry, GCR), azure (ACR) or
+	// none, which presents the ID token itself as password.
+	Exchange string `json:"exchange"`
+
+	// aws
+	RoleARN string `json:"role_arn,omitempty"`
+	// gcp, the full resource name of the provider and an optional service
+	// account to impersonate.
+	WorkloadIdentityProvider string `json:"workload_identity_provider,omitempty"`
+	ServiceAccount           string `json:"service_account,omitempty"`
+	// azure
+	TenantID string `json:"tenant_id,omitempty"`
+	ClientID string `json:"client_id,omitempty"`
+	// none
+	Username string `json:"username,omitempty"`
+}
+
+func (oc OIDCConfig) validate() error {
+	switch oc.Exchange {
+	case exchangeAWS:
+		if oc.RoleARN == "" {
+			return fmt.Errorf("oidc.role_arn is required")
+		}
+	case exchangeGCP:
+		if oc.WorkloadIdentityProvider == "" {
+			return fmt.Errorf("oidc.workload_identity_provider is required")
+		}
+	case exchangeAzure:
+		if oc.TenantID == "" || oc.ClientID == "" {
+			return fmt.Errorf("oidc.tenant_id and oidc.client_id are required")
+		}
+	case exchangeNone:
+	default:
+		return fmt.Errorf("unknown oidc exchange '%v'", oc.Exchange)
+	}
+
+	return nil
+}
+
+func (oc OIDCConfig) audience() string {
+	if oc.Audience != "" {
+		return oc.Audience
+	}
+
+	switch oc.Exchange {
+	case exchangeAWS:
+		return "sts.amazonaws.com"
+	case exchangeGCP:
+		return "https://iam.googleapis.com/" + strings.TrimPrefix(oc.WorkloadIdentityProvider, "//iam.googleapis.com/")
+	case exchangeAzure:
+		return "api://AzureADTokenExchange"
+	}
+
+	return ""
+}
+
+type oidcProvider struct {
+	config OIDCConfig
+}
+
+func (p oidcProvider) Credentials(ctx context.Context, host string) (string, string, error) {
+	token, err := p.config.idToken(ctx)
+	if err != nil {
+		return "", "", fmt.Errorf("can't get id token: %w", err)
+	}
+
+	switch p.config.Exchange {
+	case exchangeAWS:
+		creds, err := assumeRoleWithWebIdentity(ctx, p.config.RoleARN, token)
+		if err != nil {
+			return "", "", err
+		}
+		return ecrToken(ctx, host, creds)
+	case exchangeGCP:
+		accessToken, err := p.config.gcpAccessToken(ctx, token)
+		if err != nil {
+			return "", "", err
+		}
+		return "oauth2accesstoken", accessToken, nil
+	case exchangeAzure:
+		accessToken, err := p.config.azureAccessToken(ctx, token)
+		if err != nil {
+			return "", "", err
+		}
+		return acrRefreshToken(ctx, host, accessToken)
+	default:
+		return p.config.Username, token, nil
+	}
+}
+
+// idToken reads or requests the ID token and checks its issuer.
+func (oc OIDCConfig) idToken(ctx context.Context) (string, error) {
+	var token string
+	switch {
+	case oc.TokenFile != "":
+		data, err := ioutil.ReadFile(oc.TokenFile)
+		if err != nil {
+			return "", err
+		}
+		token = strings.TrimSpace(string(data))
+	case oc.TokenEnv != "":
+		token = os.Getenv(oc.TokenEnv)
+		if token == "" {
+			return "", fmt.Errorf("%v is not set", oc.TokenEnv)
+		}
+	default:
+		t, err := githubActionsToken(ctx, oc.audience())
+		if err != nil {
+			return "", err
+		}
+		token = t
+	}
+
+	registerSecret(token)
+
+	if oc.Issuer != "" {
+		iss, err := tokenIssuer(token)
+		if err != nil {
+			return "", err
+		}
+		if strings.TrimRight(iss, "/") != strings.TrimRight(oc.Issuer, "/") {
+			return "", fmt.Errorf("token issued by '%v', expected '%v'", iss, oc.Issuer)
+		}
+	}
+
+	return token, nil
+}
+
+// githubActionsToken requests an ID token from GitHub Actions, which needs
+// the `id-token: write` permission.
+func githubActionsToken(ctx context.Context, audience string) (string, error) {
+	u, token := os.Getenv("ACTIONS_ID_TOKEN_REQUEST_URL"), os.Getenv("ACTIONS_ID_TOKEN_REQUEST_TOKEN")
+	if u == "" || token == "" {
+		return "", fmt.Errorf("no token_file or token_env set and not running in GitHub Actions with id-token permission")
+	}
+
+	if audience != "" {
+		u += "&audience=" + url.QueryEscape(audience)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return "", fmt.Errorf("can't create request: %w", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	out := struct {
+		Value string `json:"value"`
+	}{}
+	if err := doJSON(req, &out); err != nil {
+		return "", err
+	}
+
+	return out.Value, nil
+}
+
+// tokenIssuer returns the iss claim of a JWT without verifying it; that is
+// up to the party the token is exchanged with.
+func tokenIssuer(token string) (string, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return "", fmt.Errorf("id token is not a JWT")
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return "", fmt.Errorf("can't decode id token: %w", err)
+	}
+
+	claims := struct {
+		Issuer string `json:"iss"`
+	}{}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return "", fmt.Errorf("can't decode id token: %w", err)
+	}
+
+	return claims.Issuer, nil
+}
+
+// assumeRoleWithWebIdentity trades the ID token for temporary AWS credentials.
+func assumeRoleWithWebIdentity(ctx context.Context, roleARN, token string) (awsCredentials, error) {
+	form := url.Values{
+		"Action":           {"AssumeRoleWithWebIdentity"},
+		"Version":          {"2011-06-15"},
+		"RoleArn":          {roleARN},
+		"RoleSessionName":  {"dimco"},
+		"WebIdentityToken": {token},
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, "https://sts.amazonaws.com/", strings.NewReader(form.Encode()))
+	if err != nil {
+		return awsCredentials{}, fmt.Errorf("can't create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+
+	out := struct {
+		Response struct {
+			Result struct {
+				Credentials struct {
+					AccessKeyID     string `json:"AccessKeyId"`
+					SecretAccessKey string `json:"SecretAccessKey"`
+					SessionToken    string `json:"SessionToken"`
+				} `json:"Credentials"`
+			} `json:"AssumeRoleWithWebIdentityResult"`
+		} `json:"AssumeRoleWithWebIdentityResponse"`
+	}{}
+	if err := doJSON(req, &out); err != nil {
+		return awsCredentials{}, fmt.Errorf("can't assume role %v: %w", roleARN, err)
+	}
+
+	c := out.Response.Result.Credentials
+	registerSecret(c.SecretAccessKey)
+	registerSecret(c.SessionToken)
+
+	return awsCredentials{AccessKeyID: c.AccessKeyID, SecretAccessKey: c.SecretAccessKey, SessionToken: c.SessionToken}, nil
+}
+
+// gcpAccessToken trades the ID token at Google STS and, when configured,
+// impersonates the service account with the federated token.
+func (oc OIDCConfig) gcpAccessToken(ctx context.Context, token string) (string, error) {
+	const scope = "https://www.googleapis.com/auth/cloud-platform"
+
+	form := url.Values{
+		"grant_type":           {"urn:ietf:params:oauth:grant-type:token-exchange"},
+		"audience":             {"//iam.googleapis.com/" + strings.TrimPrefix(oc.WorkloadIdentityProvider, "//iam.googleapis.com/")},
+		"scope":                {scope},
+		"requested_token_type": {"urn:ietf:params:oauth:token-type:access_token"},
+		"subject_token_type":   {"urn:ietf:params:oauth:token-type:jwt"},
+		"subject_token":        {token},
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, "https://sts.googleapis.com/v1/token", strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", fmt.Errorf("can't create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	federated := struct {
+		AccessToken string `json:"access_token"`
+	}{}
+	if err := doJSON(req, &federated); err != nil {
+		return "", fmt.Errorf("can't exchange token: %w", err)
+	}
+
+	if oc.ServiceAccount == "" {
+		return federated.AccessToken, nil
+	}
+
+	body, _ := json.Marshal(map[string][]string{"scope": {scope}})
+	u := "https://iamcredentials.googleapis.com/v1/projects/-/serviceAccounts/" + url.PathEscape(oc.ServiceAccount) + ":generateAccessToken"
+	req, err = http.NewRequestWithContext(ctx, http.MethodPost, u, bytes.NewReader(body))
+	if err != nil {
+		return "", fmt.Errorf("can't create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+federated.AccessToken)
+
+	impersonated := struct {
+		AccessToken string `json:"accessToken"`
+	}{}
+	if err := doJSON(req, &impersonated); err != nil {
+		return "", fmt.Errorf("can't impersonate %v: %w", oc.ServiceAccount, err)
+	}
+
+	return impersonated.AccessToken, nil
+}
+
+// azureAccessToken uses the ID token as client assertion of the federated
+// app registration.
+func (oc OIDCConfig) azureAccessToken(ctx context.Context, token string) (string, error) {
+	form := url.Values{
+		"grant_type":            {"client_credentials"},
+		"client_id":             {oc.ClientID},
+		"scope":                 {"https://management.azure.com/.default"},
+		"client_assertion_type": {"urn:ietf:params:oauth:client-assertion-type:jwt-bearer"},
+		"client_assertion":      {token},
+	}
+
+	u := "https://login.microsoftonline.com/" + url.PathEscape(oc.TenantID) + "/oauth2/v2.0/token"
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", fmt.Errorf("can't create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	out := struct {
+		AccessToken string `json:"access_token"`
+	}{}
+	if err := doJSON(req, &out); err != nil {
+		return "", fmt.Errorf("can't exchange token: %w", err)
+	}
+
+	return out.AccessToken, nil
+}
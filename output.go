@@ -0,0 +1,87 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+// Output levels selected with -q, -v and -vv.
+const (
+	levelQuiet   = -1
+	levelNormal  = 0
+	levelVerbose = 1
+	levelDebug   = 2
+)
+
+// verbosity is the output level of the process. Errors and final summaries
+// are printed at every level.
+var verbosity = levelNormal
+
+// bindOutputFlags registers -q, -v and -vv, which every command accepts, and
+// returns the function that applies them after parsing.
+func bindOutputFlags(fs *flag.FlagSet) func() {
+	quiet := fs.Bool("q", false, "only print errors and the final summary")
+	verbose := fs.Bool("v", false, "also print per-layer progress of the engine")
+	debug := fs.Bool("vv", false, "like -v and log every registry API request")
+
+	return func() {
+		switch {
+		case *debug:
+			verbosity = levelDebug
+		case *verbose:
+			verbosity = levelVerbose
+		case *quiet:
+			verbosity = levelQuiet
+		}
+	}
+}
+
+// levelError marks the failures of images and runs, which are printed at
+// every level like the rest of the output of package log, but get the error
+// priority in syslog and journald.
+const levelError = levelQuiet - 1
+
+// errorf logs a failed image or run.
+func errorf(format string, args ...interface{}) {
+	logs.emit(levelError, fmt.Sprintf(format, args...))
+}
+
+// infof logs progress messages, which -q suppresses. Sinks of the logging
+// config print them at their own level.
+func infof(format string, args ...interface{}) {
+	if logs.enabled(levelNormal) {
+		logs.emit(levelNormal, fmt.Sprintf(format, args...))
+	}
+}
+
+// debugf logs details printed with -v.
+func debugf(format string, args ...interface{}) {
+	if logs.enabled(levelVerbose) {
+		logs.emit(levelVerbose, fmt.Sprintf(format, args...))
+	}
+}
+
+// tracef logs registry traffic printed with -vv.
+func tracef(format string, args ...interface{}) {
+	if logs.enabled(levelDebug) {
+		logs.emit(levelDebug, fmt.Sprintf(format, args...))
+	}
+}
+
+// redactedStdout is stdout for engine progress, shared by every pull and
+// push.
+var redactedStdout = newRedactingWriter(os.Stdout)
+
+// progressOutput is where engine progress goes: stdout with -v, nowhere
+// otherwise or while the dashboard is shown. Errors in the stream are
+// reported either way.
+func progressOutput() io.Writer {
+	if verbosity >= levelVerbose && !dashboardActive {
+		return redactedStdout
+	}
+
+	return ioutil.Discard
+}
@@ -0,0 +1,327 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// PinConfig writes the digest a run pushed for one image into a YAML file,
+// e.g. the values of a Helm chart, so deployments reference exactly what was
+// mirrored.
+type PinConfig struct {
+	// File is the YAML file updated in place.
+	File string `json:"file"`
+	// Path selects the scalar replaced, as keys separated by dots with [n]
+	// for list items, e.g. spec.template.spec.containers[0].image.
+	Path string `json:"path"`
+	// Image is the configured image pinned, as name or name:tag.
+	Image string `json:"image"`
+}
+
+func (pc PinConfig) validate() error {
+	if pc.File == "" || pc.Path == "" || pc.Image == "" {
+		return fmt.Errorf("pins need file, path and image")
+	}
+
+	if _, err := parseYAMLPath(pc.Path); err != nil {
+		return err
+	}
+
+	return validPatterns([]string{pc.Image})
+}
+
+// pinnedReference is the destination reference with the digest of res.
+func pinnedReference(res imageResult) string {
+	return res.Destination + "@" + res.Digest
+}
+
+// writePins writes the copied images of report to path as a YAML map of
+// destination reference to pinned reference.
+func writePins(report *runReport, path string) error {
+	report.mu.Lock()
+	pins := map[string]string{}
+	for _, res := range report.Images {
+		if res.Status == resultCopied && res.Digest != "" {
+			pins[res.Destination] = pinnedReference(res)
+		}
+	}
+	report.mu.Unlock()
+
+	refs := []string{}
+	for ref := range pins {
+		refs = append(refs, ref)
+	}
+	sort.Strings(refs)
+
+	b := &strings.Builder{}
+	b.WriteString("# Images pinned by dimco sync, destination: destination@digest\n")
+	for _, ref := range refs {
+		// JSON strings are YAML scalars that need no further escaping.
+		k, _ := json.Marshal(ref)
+		v, _ := json.Marshal(pins[ref])
+		fmt.Fprintf(b, "%s: %s\n", k, v)
+	}
+
+	if err := ioutil.WriteFile(path, []byte(b.String()), 0o644); err != nil {
+		return fmt.Errorf("can't write pin file: %w", err)
+	}
+	return nil
+}
+
+// updatePins sets the pinned references of the copied images in the YAML
+// files of pins.
+func updatePins(report *runReport, pins []PinConfig) error {
+	report.mu.Lock()
+	results := append([]imageResult{}, report.Images...)
+	report.mu.Unlock()
+
+	for _, pc := range pins {
+		var pinned []imageResult
+		for _, res := range results {
+			img := ImageData{Name: res.name, Tag: res.tag}
+			if res.Status == resultCopied && res.Digest != "" && img.selectedBy([]string{pc.Image}) {
+				pinned = append(pinned, res)
+			}
+		}
+
+		switch len(pinned) {
+		case 0:
+			infof("%v wasn't copied, leaving %v of %v", pc.Image, pc.Path, pc.File)
+			continue
+		case 1:
+		default:
+			return fmt.Errorf("pin of %v in %v matches %v images, name the tag", pc.Image, pc.File, len(pinned))
+		}
+
+		if err := updateYAMLFile(pc.File, pc.Path, pinnedReference(pinned[0])); err != nil {
+			return fmt.Errorf("can't pin %v in %v: %w", pc.Image, pc.File, err)
+		}
+		infof("pinned %v at %v of %v", pinnedReference(pinned[0]), pc.Path, pc.File)
+	}
+
+	return nil
+}
+
+func updateYAMLFile(path, expr, value string) error {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	out, err := setYAMLScalar(string(data), expr, value)
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(path, []byte(out), fi.Mode())
+}
+
+// yamlStep is a key or, when key is empty, a list index of a path.
+type yamlStep struct {
+	key   string
+	index int
+}
+
+func parseYAMLPath(expr string) ([]yamlStep, error) {
+	steps := []yamlStep{}
+	for _, part := range strings.Split(expr, ".") {
+		key := part
+		if i := strings.IndexByte(part, '['); i >= 0 {
+			key = part[:i]
+		}
+		if key != "" {
+			steps = append(steps, yamlStep{key: key})
+		}
+
+		rest := strings.TrimPrefix(part, key)
+		for rest != "" {
+			end := strings.IndexByte(rest, ']')
+			if !strings.HasPrefix(rest, "[") || end < 0 {
+				return nil, fmt.Errorf("invalid path '%v'", expr)
+			}
+			n, err := strconv.Atoi(rest[1:end])
+			if err != nil || n < 0 {
+				return nil, fmt.Errorf("invalid index in path '%v'", expr)
+			}
+			steps = append(steps, yamlStep{index: n})
+			rest = rest[end+1:]
+		}
+
+		if key == "" && part == "" {
+			return nil, fmt.Errorf("invalid path '%v'", expr)
+		}
+	}
+
+	if len(steps) == 0 || steps[len(steps)-1].key == "" {
+		return nil, fmt.Errorf("path '%v' must end in a key", expr)
+	}
+	return steps, nil
+}
+
+// yamlLine is the content of a line starting at col. List items are
+// entered by moving col past their "- ".
+type yamlLine struct {
+	n    int
+	col  int
+	text string
+}
+
+// setYAMLScalar replaces the scalar at expr in doc, keeping the rest of the
+// file, comments included, as it is. It understands block mappings and
+// lists, which is what deployment manifests and chart values are written
+// in, not flow style or anchors.
+func setYAMLScalar(doc, expr, value string) (string, error) {
+	steps, err := parseYAMLPath(expr)
+	if err != nil {
+		return "", err
+	}
+
+	raw := strings.Split(doc, "\n")
+	lines := []yamlLine{}
+	for n, l := range raw {
+		text := strings.TrimLeft(l, " ")
+		if text == "" || strings.HasPrefix(text, "#") || text == "---" {
+			continue
+		}
+		lines = append(lines, yamlLine{n: n, col: len(l) - len(text), text: text})
+	}
+
+	target := -1
+	for i, step := range steps {
+		if len(lines) == 0 {
+			return "", fmt.Errorf("%v not found", expr)
+		}
+		col := lines[0].col
+
+		found := -1
+		count := 0
+		for j, l := range lines {
+			if l.col < col {
+				break
+			}
+			if l.col != col {
+				continue
+			}
+			if step.key == "" && strings.HasPrefix(l.text+" ", "- ") {
+				if count == step.index {
+					found = j
+					break
+				}
+				count++
+			}
+			if step.key != "" && yamlKey(l.text) == step.key {
+				found = j
+				break
+			}
+		}
+		if found < 0 {
+			return "", fmt.Errorf("%v not found", expr)
+		}
+
+		// The children of the entry are the lines indented deeper, up to
+		// the next entry of the same level. The items of a list may be
+		// indented like its key.
+		end := found + 1
+		for end < len(lines) && (lines[end].col > col || step.key != "" && lines[end].col == col && strings.HasPrefix(lines[end].text+" ", "- ")) {
+			end++
+		}
+
+		entry := lines[found]
+		if step.key == "" {
+			// The content of the item, if on the same line, starts after "- ".
+			item := strings.TrimLeft(strings.TrimPrefix(entry.text+" ", "- "), " ")
+			children := []yamlLine{}
+			if item = strings.TrimSuffix(item, " "); item != "" {
+				children = append(children, yamlLine{n: entry.n, col: entry.col + len(entry.text) - len(item), text: item})
+			}
+			lines = append(children, lines[found+1:end]...)
+			continue
+		}
+
+		if i == len(steps)-1 {
+			target = found
+			break
+		}
+		if yamlValue(entry.text) != "" {
+			return "", fmt.Errorf("%v is a scalar, not a mapping or list", step.key)
+		}
+		lines = lines[found+1 : end]
+	}
+
+	l := lines[target]
+	old := yamlValue(l.text)
+	if old == "" || strings.HasPrefix(old, "|") || strings.HasPrefix(old, ">") {
+		return "", fmt.Errorf("%v isn't a scalar", expr)
+	}
+
+	quoted := value
+	switch old[0] {
+	case '"':
+		b, _ := json.Marshal(value)
+		quoted = string(b)
+	case '\'':
+		quoted = "'" + strings.ReplaceAll(value, "'", "''") + "'"
+	}
+
+	line := raw[l.n]
+	colon := strings.Index(l.text+" ", ": ")
+	start := l.col + colon + strings.Index(l.text[colon:], old)
+	raw[l.n] = line[:start] + quoted + line[start+len(old):]
+	return strings.Join(raw, "\n"), nil
+}
+
+// yamlKey is the key of a "key: value" line, unquoted.
+func yamlKey(text string) string {
+	i := strings.Index(text+" ", ": ")
+	if i < 0 {
+		return ""
+	}
+	key := text[:i]
+	if len(key) >= 2 && (key[0] == '"' || key[0] == '\'') && key[len(key)-1] == key[0] {
+		key = key[1 : len(key)-1]
+	}
+	return key
+}
+
+// yamlValue is the inline value of a "key: value" line without a trailing
+// comment.
+func yamlValue(text string) string {
+	i := strings.Index(text+" ", ": ")
+	if i < 0 {
+		return ""
+	}
+	v := strings.TrimSpace(text[i+1:])
+
+	if strings.HasPrefix(v, `"`) || strings.HasPrefix(v, "'") {
+		// The closing quote ends the value, a doubled ' is part of it.
+		for j := 1; j < len(v); j++ {
+			if v[0] == '"' && v[j] == '\\' {
+				j++
+				continue
+			}
+			if v[j] == v[0] {
+				if v[0] == '\'' && j+1 < len(v) && v[j+1] == '\'' {
+					j++
+					continue
+				}
+				return v[:j+1]
+			}
+		}
+		return v
+	}
+
+	if j := strings.Index(v, " #"); j >= 0 {
+		v = strings.TrimSpace(v[:j])
+	}
+	return v
+}
@@ -0,0 +1,429 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"runtime"
+	"text/tabwriter"
+	"time"
+)
+
+// Actions of a plan change.
+const (
+	planCreate    = "create"
+	planOverwrite = "overwrite"
+	planSkip      = "skip"
+	planConflict  = "conflict"
+	planDelete    = "delete"
+)
+
+// syncPlan is the output of `dimco plan`, which `dimco apply` executes.
+type syncPlan struct {
+	Created   time.Time    `json:"created"`
+	Overwrite bool         `json:"overwrite,omitempty"`
+	Stage     bool         `json:"stage,omitempty"`
+	Changes   []planChange `json:"changes"`
+	// Size and Transfer add up the changes that copy an image.
+	Size     int64 `json:"size"`
+	Transfer int64 `json:"transfer"`
+}
+
+// planChange is what happens to one destination tag. Size is the compressed
+// size of the image for the platform of dimco, Transfer the part of it whose
+// blobs the destination repository doesn't have yet.
+type planChange struct {
+	Action            string     `json:"action"`
+	Source            string     `json:"source,omitempty"`
+	Destination       string     `json:"destination"`
+	SourceDigest      string     `json:"source_digest,omitempty"`
+	DestinationDigest string     `json:"destination_digest,omitempty"`
+	Size              int64      `json:"size,omitempty"`
+	Transfer          int64      `json:"transfer,omitempty"`
+	Image             *ImageData `json:"image,omitempty"`
+
+	// Repository and Tag locate deleted tags.
+	Repository string `json:"repository,omitempty"`
+	Tag        string `json:"tag,omitempty"`
+}
+
+func (pc planChange) copies() bool {
+	return pc.Action == planCreate || pc.Action == planOverwrite
+}
+
+func newPlanCommand() *command {
+	fs := flag.NewFlagSet("plan", flag.ExitOnError)
+	configPath := fs.String("f", "config.json", "config file path")
+	out := fs.String("out", "", "write the plan to this file for apply")
+	overwrite := fs.Bool("overwrite", false, "plan to replace destination tags that point to a different image")
+	stage := fs.Bool("stage", false, "plan pushes to the staging tags, see promote")
+	del := fs.Bool("delete", false, "plan to delete destination tags that no longer exist at the source")
+
+	return &command{
+		name:  "plan",
+		usage: "show which destination tags a sync would create, overwrite, skip and delete",
+		flags: fs,
+		run: func(ctx context.Context) error {
+			c, err := loadConfig(*configPath)
+			if err != nil {
+				return err
+			}
+
+			p, err := makePlan(ctx, c, *overwrite, *stage, *del)
+			if err != nil {
+				return err
+			}
+
+			if err := writePlanSummary(p); err != nil {
+				return err
+			}
+
+			if *out != "" {
+				return p.write(*out)
+			}
+			return nil
+		},
+	}
+}
+
+func newApplyCommand() *command {
+	fs := flag.NewFlagSet("apply", flag.ExitOnError)
+	configPath := fs.String("f", "config.json", "config file path")
+	planPath := fs.String("plan", "plan.json", "plan written by `dimco plan -out`")
+	opts := &syncOptions{}
+	fs.BoolVar(&opts.Atomic, "atomic", false, "roll back all tags pushed during the run if any image fails")
+	fs.BoolVar(&opts.FailFast, "fail-fast", false, "cancel the remaining and running copies when an image fails")
+	fs.StringVar(&opts.DockerHost, "docker-host", "", "engine endpoint, overrides engine_host (e.g. ssh://user@builder01)")
+	fs.StringVar(&opts.Report, "report", "", "write per-image results to this file")
+	fs.StringVar(&opts.ReportFormat, "report-format", reportJSON, "format of -report: json, junit or csv")
+	fs.BoolVar(&opts.Stats, "stats", false, "print transfer statistics per registry and the slowest images after the run")
+	bindAttestFlags(fs, opts)
+
+	return &command{
+		name:  "apply",
+		usage: "execute a plan written by plan",
+		flags: fs,
+		run: func(ctx context.Context) error {
+			c, err := loadConfig(*configPath)
+			if err != nil {
+				return err
+			}
+
+			p, err := readPlan(*planPath)
+			if err != nil {
+				return err
+			}
+
+			return runApply(ctx, c, p, *opts)
+		},
+	}
+}
+
+// makePlan compares every image of c with its destination tag, like sync
+// with the given flags would.
+func makePlan(ctx context.Context, c Config, overwrite, stage, del bool) (syncPlan, error) {
+	c, err := c.withDiscovered(ctx)
+	if err != nil {
+		return syncPlan{}, err
+	}
+
+	src := newRegistryClient(c.FromRepo)
+	dst := newRegistryClient(c.ToRepo)
+
+	p := syncPlan{Created: time.Now().UTC(), Overwrite: overwrite, Stage: stage, Changes: []planChange{}}
+	failed := 0
+	for _, img := range c.Images {
+		pc, err := planImage(ctx, c, src, dst, img, overwrite, stage)
+		if err != nil {
+			log.Print(fmt.Errorf("can't plan %v%v:%v: %w", img.ToPrefix, img.destinationName(), img.Tag, err))
+			failed++
+			continue
+		}
+
+		if pc.copies() {
+			p.Size += pc.Size
+			p.Transfer += pc.Transfer
+		}
+		p.Changes = append(p.Changes, pc)
+	}
+
+	if del {
+		owned := map[string]map[string]bool{}
+		if err := ownedArchTags(ctx, c, src, owned); err != nil {
+			return p, err
+		}
+
+		host, _ := splitBaseAddress(c.ToRepo.BaseAddress)
+		for _, rp := range repositoryPairs(c) {
+			stale, err := staleTags(ctx, src, dst, rp.from, rp.to, owned[rp.to])
+			if err != nil {
+				log.Print(fmt.Errorf("can't plan deletions in '%v': %w", rp.to, err))
+				failed++
+				continue
+			}
+
+			for _, t := range stale {
+				p.Changes = append(p.Changes, planChange{
+					Action:            planDelete,
+					Destination:       fmt.Sprintf("%v/%v:%v", host, rp.to, t.tag),
+					DestinationDigest: t.digest,
+					Repository:        rp.to,
+					Tag:               t.tag,
+				})
+			}
+		}
+	}
+
+	if failed > 0 {
+		return p, fmt.Errorf("can't plan %v images or repositories", failed)
+	}
+
+	return p, nil
+}
+
+func planImage(ctx context.Context, c Config, src, dst *registryClient, img ImageData, overwrite, stage bool) (planChange, error) {
+	fromRepo := repositoryPath(c.FromRepo, img.FromPrefix, img.Name)
+	toRepo := repositoryPath(c.ToRepo, img.ToPrefix, img.destinationName())
+	toTag := img.Tag
+	if stage {
+		toTag = c.stagingTag(img.Tag)
+	}
+
+	pc := planChange{
+		Source:      referenceString(c.FromRepo, img.FromPrefix, img.Name, img.sourceRef()),
+		Destination: referenceString(c.ToRepo, img.ToPrefix, img.destinationName(), toTag),
+		Image:       &img,
+	}
+
+	m, digest, err := src.FetchManifest(ctx, fromRepo, img.sourceRef())
+	if err != nil {
+		return planChange{}, fmt.Errorf("can't fetch source manifest: %w", err)
+	}
+	pc.SourceDigest = digest
+
+	pc.DestinationDigest, err = dst.ManifestDigest(ctx, toRepo, toTag)
+	switch {
+	case isNotFound(err) && img.ArchTags == archTagsOnly && !stage:
+		// The index was deleted after tagging its platforms.
+		pc.Action = planCreate
+		if _, _, ok, _ := verifyArchTags(ctx, src, dst, fromRepo, toRepo, img.sourceRef(), toTag, false); ok {
+			pc.Action = planSkip
+		}
+	case isNotFound(err):
+		pc.Action = planCreate
+	case err != nil:
+		return planChange{}, fmt.Errorf("can't resolve destination tag: %w", err)
+	default:
+		// The same comparison as verify -layers: a push from the engine is
+		// one platform of a source index.
+		_, _, ok, _ := verifyImage(ctx, src, dst, fromRepo, toRepo, img.sourceRef(), toTag, true)
+		switch {
+		case ok:
+			pc.Action = planSkip
+		case overwrite:
+			pc.Action = planOverwrite
+		default:
+			pc.Action = planConflict
+		}
+	}
+
+	if !pc.copies() {
+		return pc, nil
+	}
+
+	// The engine pulls a single platform of an index.
+	if len(m.Manifests) > 0 {
+		d, err := selectPlatform(m.Manifests, "linux", runtime.GOARCH)
+		if err != nil {
+			d = m.Manifests[0]
+		}
+		if m, _, err = src.FetchManifest(ctx, fromRepo, d.Digest); err != nil {
+			return planChange{}, fmt.Errorf("can't fetch platform manifest: %w", err)
+		}
+	}
+
+	for _, b := range append([]descriptor{m.Config}, m.Layers...) {
+		if isForeign(b) && !c.IncludeNonDistributable {
+			continue
+		}
+		pc.Size += b.Size
+
+		exists, err := dst.BlobExists(ctx, toRepo, b.Digest)
+		if err != nil {
+			return planChange{}, fmt.Errorf("can't check destination blob: %w", err)
+		}
+		if !exists {
+			pc.Transfer += b.Size
+		}
+	}
+
+	return pc, nil
+}
+
+func (p syncPlan) write(path string) error {
+	data, err := json.MarshalIndent(p, "", "  ")
+	if err != nil {
+		return fmt.Errorf("can't encode plan: %w", err)
+	}
+
+	if err := ioutil.WriteFile(path, append(data, '\n'), 0o644); err != nil {
+		return fmt.Errorf("can't write plan: %w", err)
+	}
+
+	return nil
+}
+
+func readPlan(path string) (syncPlan, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return syncPlan{}, fmt.Errorf("can't read plan: %w", err)
+	}
+
+	p := syncPlan{}
+	if err := json.Unmarshal(data, &p); err != nil {
+		return syncPlan{}, fmt.Errorf("can't unmarshal plan: %w", err)
+	}
+
+	return p, nil
+}
+
+func writePlanSummary(p syncPlan) error {
+	counts := map[string]int{}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ACTION\tDESTINATION\tSOURCE\tSIZE\tTRANSFER")
+	for _, pc := range p.Changes {
+		counts[pc.Action]++
+
+		size, transfer := "", ""
+		if pc.copies() {
+			size, transfer = formatBytes(pc.Size), formatBytes(pc.Transfer)
+		}
+		fmt.Fprintf(w, "%v\t%v\t%v\t%v\t%v\n", pc.Action, pc.Destination, pc.Source, size, transfer)
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	fmt.Printf("\nPlan: %v to create, %v to overwrite, %v to skip, %v to delete, %v conflicts. %v, about %v to transfer.\n",
+		counts[planCreate], counts[planOverwrite], counts[planSkip], counts[planDelete], counts[planConflict],
+		formatBytes(p.Size), formatBytes(p.Transfer))
+
+	return nil
+}
+
+// runApply executes p. It refuses to start when a destination tag changed
+// since the plan was made, and pulls the source digests the plan recorded,
+// so exactly the planned images are pushed.
+func runApply(ctx context.Context, c Config, p syncPlan, opts syncOptions) error {
+	dst := newRegistryClient(c.ToRepo)
+
+	images := []ImageData{}
+	deletions := []planChange{}
+	for _, pc := range p.Changes {
+		switch pc.Action {
+		case planConflict:
+			return fmt.Errorf("plan has a conflict at %v, make a new plan with -overwrite", pc.Destination)
+		case planSkip:
+			continue
+		}
+
+		repo, tag := pc.Repository, pc.Tag
+		if pc.copies() {
+			if pc.Image == nil {
+				return fmt.Errorf("plan change for %v has no image", pc.Destination)
+			}
+			repo = repositoryPath(c.ToRepo, pc.Image.ToPrefix, pc.Image.destinationName())
+			tag = pc.Image.Tag
+			if p.Stage {
+				tag = c.stagingTag(tag)
+			}
+		}
+
+		digest, err := dst.ManifestDigest(ctx, repo, tag)
+		if err != nil && !isNotFound(err) {
+			return fmt.Errorf("can't resolve %v: %w", pc.Destination, err)
+		}
+		if digest != pc.DestinationDigest {
+			return fmt.Errorf("%v changed since the plan was made, make a new plan", pc.Destination)
+		}
+
+		if pc.copies() {
+			img := *pc.Image
+			img.Digest = pc.SourceDigest
+			images = append(images, img)
+		} else {
+			deletions = append(deletions, pc)
+		}
+	}
+
+	if len(images) == 0 && len(deletions) == 0 {
+		log.Print("nothing to apply")
+		return nil
+	}
+
+	if len(images) > 0 {
+		// Discovery happened when the plan was made. Dependencies on
+		// skipped images are met already.
+		c.Images, c.Discover = images, nil
+		for i := range c.Images {
+			deps := []string{}
+			for _, want := range c.Images[i].DependsOn {
+				for j, other := range c.Images {
+					if j != i && other.matches(want) {
+						deps = append(deps, want)
+						break
+					}
+				}
+			}
+			c.Images[i].DependsOn = deps
+		}
+		opts.Overwrite, opts.Stage = p.Overwrite, p.Stage
+
+		if err := runSync(ctx, c, opts, newRunReport()); err != nil {
+			return err
+		}
+	}
+
+	if len(deletions) == 0 {
+		return nil
+	}
+
+	if err := c.startLogging(); err != nil {
+		return err
+	}
+
+	ctx, unlock, err := c.acquireLock(ctx)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	if err := c.startAudit(); err != nil {
+		return err
+	}
+
+	deleted := map[string]bool{}
+	for _, pc := range deletions {
+		key := pc.Repository + "@" + pc.DestinationDigest
+		if deleted[key] {
+			continue
+		}
+
+		if err := dst.DeleteManifest(ctx, pc.Repository, pc.DestinationDigest); err != nil {
+			return fmt.Errorf("can't delete %v: %w", pc.Destination, err)
+		}
+		deleted[key] = true
+		recordAudit(auditDelete, qualifiedReference(dst.host, pc.Repository, pc.DestinationDigest), pc.DestinationDigest)
+
+		infof("deleted %v (%v)", pc.Destination, pc.DestinationDigest)
+	}
+
+	log.Printf("deleted %v tags", len(deletions))
+
+	return nil
+}
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os/exec"
+	"strings"
+	"time"
+
+	godigest "github.com/opencontainers/go-digest"
+)
+
+// defaultPolicyTimeout covers the scan, which takes a while for large images.
+const defaultPolicyTimeout = 5 * time.Minute
+
+// PolicyConfig decides every copy centrally before anything is pulled. The
+// policy gets the metadata of the source image and allows the copy, denies
+// it or changes its destination. Rego policies are evaluated by an OPA
+// server at URL; Command runs any other engine, e.g. a CEL evaluator.
+type PolicyConfig struct {
+	// URL is the OPA data API document of the decision, e.g.
+	// http://opa:8181/v1/data/dimco/copy.
+	URL string `json:"url,omitempty"`
+	// Command reads the policy input as JSON on stdin and writes the
+	// decision on stdout.
+	Command []string `json:"command,omitempty"`
+	// Scan runs with the source reference as its last argument before the
+	// policy is evaluated. Its JSON output is the scan of the input.
+	Scan []string `json:"scan,omitempty"`
+	// Images limits the policy to these patterns of image names, or
+	// name:tag, as understood by path.Match.
+	Images  []string `json:"images,omitempty"`
+	Timeout Duration `json:"timeout,omitempty"`
+}
+
+func (pc PolicyConfig) validate() error {
+	if (pc.URL == "") == (len(pc.Command) == 0) {
+		return fmt.Errorf("policy needs either url or command")
+	}
+
+	if err := validPatterns(pc.Images); err != nil {
+		return fmt.Errorf("policy: %w", err)
+	}
+
+	return nil
+}
+
+// policyInput is the input of the policy, the document OPA evaluates as
+// input.
+type policyInput struct {
+	Name        string `json:"name"`
+	Tag         string `json:"tag"`
+	Source      string `json:"source"`
+	Destination string `json:"destination"`
+	Digest      string `json:"digest"`
+	MediaType   string `json:"media_type"`
+	// Platforms are the os/arch of multi-platform images.
+	Platforms []string `json:"platforms,omitempty"`
+	// Size is the size of the manifests, configs and layers.
+	Size   int64             `json:"size"`
+	Labels map[string]string `json:"labels,omitempty"`
+	Scan   json.RawMessage   `json:"scan,omitempty"`
+}
+
+// policyDecision is the result of the policy. A policy may also return a
+// bare boolean.
+type policyDecision struct {
+	Allow  bool   `json:"allow"`
+	Reason string `json:"reason,omitempty"`
+	// Tag and ToPrefix change the destination of an allowed copy.
+	Tag      string `json:"tag,omitempty"`
+	ToPrefix string `json:"to_prefix,omitempty"`
+}
+
+// checkPolicy evaluates the policy of img and returns it with the
+// destination the policy chose, or the reason it denied the copy. Images the
+// policy can't be evaluated for fail.
+func (s *syncer) checkPolicy(ctx context.Context, img ImageData) (ImageData, string, error) {
+	pc := s.config.Policy
+	if pc == nil || !img.selectedBy(pc.Images) {
+		return img, "", nil
+	}
+
+	timeout := time.Duration(pc.Timeout)
+	if timeout == 0 {
+		timeout = defaultPolicyTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	input, err := s.policyInput(ctx, img)
+	if err != nil {
+		return img, "", fmt.Errorf("can't evaluate policy of '%v': %w", input.Source, err)
+	}
+
+	var decision policyDecision
+	if pc.URL != "" {
+		decision, err = pc.evaluateOPA(ctx, input)
+	} else {
+		decision, err = pc.evaluateCommand(ctx, input)
+	}
+	if err != nil {
+		return img, "", fmt.Errorf("can't evaluate policy of '%v': %w", input.Source, err)
+	}
+
+	if !decision.Allow {
+		reason := decision.Reason
+		if reason == "" {
+			reason = "no reason given"
+		}
+		return img, "denied by policy: " + reason, nil
+	}
+
+	if decision.Tag != "" && decision.Tag != img.Tag {
+		debugf("policy changed the destination tag of %v to %v", input.Destination, decision.Tag)
+		img.Tag = decision.Tag
+	}
+	if decision.ToPrefix != "" && decision.ToPrefix != img.ToPrefix {
+		debugf("policy changed the destination prefix of %v to %v", input.Destination, decision.ToPrefix)
+		img.ToPrefix = decision.ToPrefix
+	}
+
+	return img, "", nil
+}
+
+// policyInput reads the metadata of the source of img from the registry.
+func (s *syncer) policyInput(ctx context.Context, img ImageData) (policyInput, error) {
+	c := s.config
+	fromImg, toImg := s.references(img)
+	input := policyInput{Name: img.Name, Tag: img.Tag, Source: fromImg, Destination: toImg}
+
+	src := newRegistryClient(c.FromRepo)
+	repo := repositoryPath(c.FromRepo, img.FromPrefix, img.Name)
+	data, mediaType, digest, err := src.GetManifest(ctx, repo, img.sourceRef())
+	if err != nil {
+		return input, err
+	}
+	if digest == "" {
+		digest = godigest.FromBytes(data).String()
+	}
+	input.Digest, input.MediaType, input.Size = digest, mediaType, int64(len(data))
+
+	m := manifest{}
+	if err := json.Unmarshal(data, &m); err != nil {
+		return input, fmt.Errorf("can't decode manifest: %w", err)
+	}
+
+	manifests := []manifest{m}
+	if len(m.Manifests) > 0 {
+		manifests = manifests[:0]
+		for _, d := range m.Manifests {
+			if d.Platform != nil {
+				input.Platforms = append(input.Platforms, d.Platform.OS+"/"+d.Platform.Architecture)
+			}
+
+			pm, _, err := src.FetchManifest(ctx, repo, d.Digest)
+			if err != nil {
+				return input, err
+			}
+			input.Size += d.Size
+			manifests = append(manifests, pm)
+		}
+	}
+
+	for _, pm := range manifests {
+		input.Size += pm.Config.Size
+		for _, l := range pm.Layers {
+			input.Size += l.Size
+		}
+	}
+
+	// The labels of the first platform stand for the image, they are the
+	// same for every platform of a build.
+	if len(manifests) > 0 && manifests[0].Config.Digest != "" {
+		if input.Labels, err = configLabels(ctx, src, repo, manifests[0].Config.Digest); err != nil {
+			return input, err
+		}
+	}
+
+	if len(c.Policy.Scan) > 0 {
+		if input.Scan, err = c.Policy.scan(ctx, fromImg); err != nil {
+			return input, err
+		}
+	}
+
+	return input, nil
+}
+
+func (pc PolicyConfig) scan(ctx context.Context, ref string) (json.RawMessage, error) {
+	stderr := &bytes.Buffer{}
+	cmd := exec.CommandContext(ctx, pc.Scan[0], append(pc.Scan[1:], ref)...)
+	cmd.Stderr = stderr
+	out, err := cmd.Output()
+	if err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return nil, fmt.Errorf("scan %v: %w: %v", pc.Scan[0], err, msg)
+		}
+		return nil, fmt.Errorf("scan %v: %w", pc.Scan[0], err)
+	}
+
+	if !json.Valid(out) {
+		return nil, fmt.Errorf("scan %v didn't write JSON", pc.Scan[0])
+	}
+	return out, nil
+}
+
+// evaluateOPA queries the decision from the OPA data API. An undefined
+// decision denies the copy.
+func (pc PolicyConfig) evaluateOPA(ctx context.Context, input policyInput) (policyDecision, error) {
+	body, err := json.Marshal(map[string]interface{}{"input": input})
+	if err != nil {
+		return policyDecision{}, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, pc.URL, bytes.NewReader(body))
+	if err != nil {
+		return policyDecision{}, fmt.Errorf("can't create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return policyDecision{}, fmt.Errorf("can't send request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		data, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+		return policyDecision{}, &statusError{Method: http.MethodPost, URL: pc.URL, StatusCode: resp.StatusCode, Body: string(data)}
+	}
+
+	var out struct {
+		Result json.RawMessage `json:"result"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		return policyDecision{}, fmt.Errorf("can't decode decision: %w", err)
+	}
+	if len(out.Result) == 0 {
+		return policyDecision{Reason: "the policy is undefined for the image"}, nil
+	}
+
+	return decodeDecision(out.Result)
+}
+
+// evaluateCommand runs the policy command with the input on stdin.
+func (pc PolicyConfig) evaluateCommand(ctx context.Context, input policyInput) (policyDecision, error) {
+	in, err := json.Marshal(input)
+	if err != nil {
+		return policyDecision{}, err
+	}
+
+	stderr := &bytes.Buffer{}
+	cmd := exec.CommandContext(ctx, pc.Command[0], pc.Command[1:]...)
+	cmd.Stdin = bytes.NewReader(in)
+	cmd.Stderr = stderr
+	out, err := cmd.Output()
+	if err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return policyDecision{}, fmt.Errorf("%v: %w: %v", pc.Command[0], err, msg)
+		}
+		return policyDecision{}, fmt.Errorf("%v: %w", pc.Command[0], err)
+	}
+
+	return decodeDecision(bytes.TrimSpace(out))
+}
+
+func decodeDecision(data []byte) (policyDecision, error) {
+	var allow bool
+	if err := json.Unmarshal(data, &allow); err == nil {
+		return policyDecision{Allow: allow}, nil
+	}
+
+	decision := policyDecision{}
+	if err := json.Unmarshal(data, &decision); err != nil {
+		return policyDecision{}, fmt.Errorf("can't decode decision: %w", err)
+	}
+	return decision, nil
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+)
+
+// preflightWorkers is how many source references the pre-flight resolves at
+// a time. The rate limit of from_repo still applies.
+const preflightWorkers = 8
+
+// preflight resolves the source reference of every image before anything is
+// copied, so that typos and missing credentials fail the run right away.
+// The images that don't resolve are added to report as failed.
+func (c Config) preflight(ctx context.Context, report *runReport) error {
+	src := newRegistryClient(c.FromRepo)
+
+	errs := make([]error, len(c.Images))
+	next := make(chan int)
+	wg := sync.WaitGroup{}
+	for w := 0; w < preflightWorkers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				img := c.Images[i]
+				_, errs[i] = src.ManifestDigest(ctx, repositoryPath(c.FromRepo, img.FromPrefix, img.Name), img.sourceRef())
+			}
+		}()
+	}
+
+	for i := range c.Images {
+		next <- i
+	}
+	close(next)
+	wg.Wait()
+
+	failed := 0
+	for i, err := range errs {
+		if err == nil {
+			continue
+		}
+		failed++
+
+		img := c.Images[i]
+		res := imageResult{
+			Source:      referenceString(c.FromRepo, img.FromPrefix, img.Name, img.sourceRef()),
+			Destination: referenceString(c.ToRepo, img.ToPrefix, img.destinationName(), img.Tag),
+			Status:      resultFailed,
+			Error:       redact(err.Error()),
+			ErrorClass:  errorClass(err),
+			name:        img.Name,
+			tag:         img.Tag,
+		}
+		log.Printf("pre-flight: can't resolve %v: %v [%v]", res.Source, res.Error, res.ErrorClass)
+		report.add(res)
+	}
+
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("pre-flight: %v of %v source images can't be resolved, nothing was copied", failed, len(c.Images))
+	}
+
+	infof("pre-flight: all %v source images resolved", len(c.Images))
+	return nil
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+)
+
+// Image copy phases, as shown by the dashboards.
+const (
+	phaseQueued    = "queued"
+	phasePulling   = "pulling"
+	phasePushing   = "pushing"
+	phaseCancelled = "cancelled"
+)
+
+// imageProgress is the live state of one image copy. Engines find it in the
+// context and report the bytes transferred per layer; a nil *imageProgress
+// ignores all updates, so engines don't have to check.
+type imageProgress struct {
+	mu        sync.Mutex
+	status    string
+	layers    map[string]layerProgress
+	started   time.Time
+	err       string
+	cancel    context.CancelFunc
+	cancelled bool
+
+	// phaseStarted and totals measure the transfers of the attempt.
+	phaseStarted time.Time
+	totals       transferStats
+}
+
+type layerProgress struct {
+	current, total int64
+	// skipped layers were at the target already.
+	skipped bool
+}
+
+// transferStats are what an image copy transferred, in bytes, and how long
+// pulling and pushing took. Skipped layers were at the destination already;
+// their size is only known when the engine reports it.
+type transferStats struct {
+	Pulled        int64   `json:"pulled_bytes,omitempty"`
+	Pushed        int64   `json:"pushed_bytes,omitempty"`
+	SkippedLayers int     `json:"skipped_layers,omitempty"`
+	SkippedBytes  int64   `json:"skipped_bytes,omitempty"`
+	PullSeconds   float64 `json:"pull_seconds,omitempty"`
+	PushSeconds   float64 `json:"push_seconds,omitempty"`
+}
+
+func (t *transferStats) add(o transferStats) {
+	t.Pulled += o.Pulled
+	t.Pushed += o.Pushed
+	t.SkippedLayers += o.SkippedLayers
+	t.SkippedBytes += o.SkippedBytes
+	t.PullSeconds += o.PullSeconds
+	t.PushSeconds += o.PushSeconds
+}
+
+type progressKey struct{}
+
+func withProgress(ctx context.Context, p *imageProgress) context.Context {
+	return context.WithValue(ctx, progressKey{}, p)
+}
+
+func progressFrom(ctx context.Context) *imageProgress {
+	p, _ := ctx.Value(progressKey{}).(*imageProgress)
+	return p
+}
+
+func newImageProgress() *imageProgress {
+	return &imageProgress{status: phaseQueued, layers: map[string]layerProgress{}}
+}
+
+// start resets p for a new attempt that cancel aborts.
+func (p *imageProgress) start(cancel context.CancelFunc) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.status, p.err = phaseQueued, ""
+	p.layers = map[string]layerProgress{}
+	p.started = time.Now()
+	p.cancel, p.cancelled = cancel, false
+	p.phaseStarted, p.totals = time.Time{}, transferStats{}
+}
+
+// setPhase starts counting the layers of the next transfer.
+func (p *imageProgress) setPhase(phase string) {
+	if p == nil {
+		return
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.endPhaseLocked()
+	p.status = phase
+	p.layers = map[string]layerProgress{}
+	p.phaseStarted = time.Now()
+}
+
+// endPhase adds the transfers of the current phase to the totals, so work
+// after the push doesn't count as push time.
+func (p *imageProgress) endPhase() {
+	if p == nil {
+		return
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.endPhaseLocked()
+}
+
+func (p *imageProgress) endPhaseLocked() {
+	if p.phaseStarted.IsZero() {
+		return
+	}
+
+	seconds := time.Since(p.phaseStarted).Seconds()
+	p.phaseStarted = time.Time{}
+
+	var transferred int64
+	for _, l := range p.layers {
+		if !l.skipped {
+			transferred += l.current
+		}
+	}
+
+	switch p.status {
+	case phasePulling:
+		p.totals.Pulled += transferred
+		p.totals.PullSeconds += seconds
+	case phasePushing:
+		p.totals.Pushed += transferred
+		p.totals.PushSeconds += seconds
+		for _, l := range p.layers {
+			if l.skipped {
+				p.totals.SkippedLayers++
+				p.totals.SkippedBytes += l.total
+			}
+		}
+	}
+}
+
+// transfers returns the totals of the attempt.
+func (p *imageProgress) transfers() transferStats {
+	if p == nil {
+		return transferStats{}
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.endPhaseLocked()
+	return p.totals
+}
+
+// update records the bytes transferred of layer id.
+func (p *imageProgress) update(id string, current, total int64) {
+	if p == nil {
+		return
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.layers[id] = layerProgress{current: current, total: total}
+}
+
+// complete marks layer id as fully transferred.
+func (p *imageProgress) complete(id string) {
+	if p == nil {
+		return
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if l, ok := p.layers[id]; ok {
+		l.current = l.total
+		p.layers[id] = l
+	}
+}
+
+// skip marks layer id of size bytes, 0 if unknown, as present at the target
+// already.
+func (p *imageProgress) skip(id string, size int64) {
+	if p == nil {
+		return
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	l := p.layers[id]
+	if l.total == 0 {
+		l.total = size
+	}
+	l.current, l.skipped = l.total, true
+	p.layers[id] = l
+}
+
+// finish records the outcome of the attempt.
+func (p *imageProgress) finish(res imageResult) {
+	if p == nil {
+		return
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.status, p.err, p.cancel = res.Status, res.Error, nil
+	if p.cancelled && res.Status == resultFailed {
+		p.status = phaseCancelled
+	}
+}
+
+// abort cancels a running attempt.
+func (p *imageProgress) abort() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.cancel != nil {
+		p.cancelled = true
+		p.cancel()
+	}
+}
+
+// progressSnapshot is a consistent copy of an imageProgress.
+type progressSnapshot struct {
+	Status  string
+	Current int64
+	Total   int64
+	Started time.Time
+	Error   string
+	Running bool
+}
+
+func (p *imageProgress) snapshot() progressSnapshot {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	s := progressSnapshot{Status: p.status, Started: p.started, Error: p.err, Running: p.cancel != nil}
+	for _, l := range p.layers {
+		s.Current += l.current
+		s.Total += l.total
+	}
+	return s
+}
+
+// progressReader reports the bytes read from r as progress of layer id.
+type progressReader struct {
+	io.ReadCloser
+	p     *imageProgress
+	id    string
+	total int64
+	n     int64
+}
+
+func (r *progressReader) Read(b []byte) (int, error) {
+	n, err := r.ReadCloser.Read(b)
+	r.n += int64(n)
+	r.p.update(r.id, r.n, r.total)
+	return n, err
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+)
+
+func newPromoteCommand() *command {
+	fs := flag.NewFlagSet("promote", flag.ExitOnError)
+	configPath := fs.String("f", "config.json", "config file path")
+	overwrite := fs.Bool("overwrite", false, "replace final tags that already point to a different image")
+
+	return &command{
+		name:  "promote",
+		usage: "copy staging tags pushed by `sync -stage` to their final tags",
+		flags: fs,
+		run: func(ctx context.Context) error {
+			c, err := loadConfig(*configPath)
+			if err != nil {
+				return err
+			}
+
+			return runPromote(ctx, c, *overwrite)
+		},
+	}
+}
+
+func runPromote(ctx context.Context, c Config, overwrite bool) error {
+	if err := c.startLogging(); err != nil {
+		return err
+	}
+
+	ctx, unlock, err := c.acquireLock(ctx)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	if err := c.startAudit(); err != nil {
+		return err
+	}
+
+	dst := newRegistryClient(c.ToRepo)
+	s := &syncer{config: c, dst: dst}
+
+	failed := 0
+	for _, img := range c.Images {
+		repo := repositoryPath(c.ToRepo, img.ToPrefix, img.destinationName())
+		if err := promoteTag(ctx, dst, repo, c.stagingTag(img.Tag), img.Tag, overwrite); err != nil {
+			log.Print(fmt.Errorf("can't promote '%v:%v': %w", repo, img.Tag, err))
+			failed++
+			continue
+		}
+
+		if err := s.tagAliases(ctx, img, repo, img.Tag); err != nil {
+			log.Print(err)
+			failed++
+			continue
+		}
+		if err := s.tagArchitectures(ctx, img, repo, img.Tag); err != nil {
+			log.Print(err)
+			failed++
+		}
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("can't promote %v images", failed)
+	}
+
+	return nil
+}
+
+// promoteTag points the final tag to the manifest of the staging tag. The
+// manifest is copied inside the registry, so no layers are transferred.
+func promoteTag(ctx context.Context, dst *registryClient, repo, staging, final string, overwrite bool) error {
+	data, mediaType, digest, err := dst.GetManifest(ctx, repo, staging)
+	if err != nil {
+		return fmt.Errorf("can't get staging manifest: %w", err)
+	}
+
+	current, err := dst.ManifestDigest(ctx, repo, final)
+	switch {
+	case isNotFound(err):
+	case err != nil:
+		return fmt.Errorf("can't check final tag: %w", err)
+	case current == digest:
+		infof("%v:%v already points to %v", repo, final, digest)
+		return nil
+	case !overwrite:
+		return fmt.Errorf("final tag already points to %v, use -overwrite to replace it", current)
+	default:
+		log.Printf("overwriting %v:%v, it pointed to %v", repo, final, current)
+	}
+
+	if err := dst.PutManifest(ctx, repo, final, mediaType, data); err != nil {
+		return fmt.Errorf("can't put final manifest: %w", err)
+	}
+	recordAudit(auditPromote, qualifiedReference(dst.host, repo, final), digest)
+
+	infof("promoted %v:%v to %v:%v (%v)", repo, staging, repo, final, digest)
+
+	return nil
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+)
+
+// promptAuth is set by -prompt-auth, which every command accepts.
+var promptAuth bool
+
+// prompted keeps the credentials entered per registry host for the lifetime
+// of the process, so the daemon asks only once.
+var prompted = struct {
+	mu    sync.Mutex
+	creds map[string][2]string
+}{creds: map[string][2]string{}}
+
+// readPasswordFile fills the password from password_file. Trailing newlines
+// are dropped, as most secret mounts and editors add one.
+func (ac *AuthConfig) readPasswordFile() error {
+	if ac.PasswordFile == "" {
+		return nil
+	}
+
+	data, err := ioutil.ReadFile(ac.PasswordFile)
+	if err != nil {
+		return fmt.Errorf("can't read password file of %v: %w", ac.BaseAddress, err)
+	}
+
+	ac.Password = strings.TrimRight(string(data), "\r\n")
+	return nil
+}
+
+// promptCredentials asks on the terminal for the credentials of a registry
+// that has no password configured.
+func (ac *AuthConfig) promptCredentials() error {
+	if !promptAuth || ac.Password != "" {
+		return nil
+	}
+
+	host, _ := splitBaseAddress(ac.BaseAddress)
+
+	prompted.mu.Lock()
+	defer prompted.mu.Unlock()
+
+	if creds, ok := prompted.creds[host]; ok {
+		ac.Username, ac.Password = creds[0], creds[1]
+		return nil
+	}
+
+	tty, err := os.OpenFile("/dev/tty", os.O_RDWR, 0)
+	if err != nil {
+		return fmt.Errorf("can't prompt for credentials of %v: %w", host, err)
+	}
+	defer tty.Close()
+
+	r := bufio.NewReader(tty)
+
+	username := ac.Username
+	if username == "" {
+		fmt.Fprintf(tty, "Username for %v: ", host)
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return fmt.Errorf("can't read username: %w", err)
+		}
+		username = strings.TrimSpace(line)
+	}
+
+	fmt.Fprintf(tty, "Password for %v@%v: ", username, host)
+	password, err := readHidden(tty, r)
+	fmt.Fprintln(tty)
+	if err != nil {
+		return fmt.Errorf("can't read password: %w", err)
+	}
+
+	prompted.creds[host] = [2]string{username, password}
+	ac.Username, ac.Password = username, password
+
+	return nil
+}
+
+// readHidden reads a line from the terminal with echo turned off.
+func readHidden(tty *os.File, r *bufio.Reader) (string, error) {
+	restore, err := disableEcho(tty)
+	if err != nil {
+		return "", err
+	}
+	defer restore()
+
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimRight(line, "\r\n"), nil
+}
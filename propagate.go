@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+)
+
+// propagateDeletions deletes destination tags of the configured repositories
+// that don't exist at the source anymore. Without apply it only reports them.
+func propagateDeletions(ctx context.Context, c Config, apply bool) error {
+	src := newRegistryClient(c.FromRepo)
+	dst := newRegistryClient(c.ToRepo)
+
+	// Architecture tags have no tag of their own at the source.
+	owned := map[string]map[string]bool{}
+	if err := ownedArchTags(ctx, c, src, owned); err != nil {
+		return err
+	}
+
+	failed := 0
+	for _, p := range repositoryPairs(c) {
+		if err := propagateRepository(ctx, src, dst, p.from, p.to, owned[p.to], apply); err != nil {
+			log.Print(fmt.Errorf("can't propagate deletions to '%v': %w", p.to, err))
+			failed++
+		}
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("can't propagate deletions to %v repositories", failed)
+	}
+
+	return nil
+}
+
+func propagateRepository(ctx context.Context, src, dst *registryClient, from, to string, owned map[string]bool, apply bool) error {
+	stale, err := staleTags(ctx, src, dst, from, to, owned)
+	if err != nil {
+		return err
+	}
+
+	deleted := map[string]bool{}
+	for _, t := range stale {
+		if !apply {
+			log.Printf("would delete %v:%v (%v), it doesn't exist at the source", to, t.tag, t.digest)
+			continue
+		}
+
+		if deleted[t.digest] {
+			continue
+		}
+
+		if err := dst.DeleteManifest(ctx, to, t.digest); err != nil {
+			return fmt.Errorf("can't delete tag '%v': %w", t.tag, err)
+		}
+		deleted[t.digest] = true
+		recordAudit(auditDelete, qualifiedReference(dst.host, to, t.tag), t.digest)
+
+		infof("deleted %v:%v (%v), it doesn't exist at the source", to, t.tag, t.digest)
+	}
+
+	return nil
+}
+
+// staleTag is a destination tag that doesn't exist at the source anymore.
+type staleTag struct {
+	tag    string
+	digest string
+}
+
+// staleTags lists the destination tags of to that don't exist in from,
+// other than the owned ones. Tags sharing their digest with a kept tag, or
+// pointing to a platform of a kept index, are kept too: deleting the
+// manifest would remove both or break the index.
+func staleTags(ctx context.Context, src, dst *registryClient, from, to string, owned map[string]bool) ([]staleTag, error) {
+	srcTags, err := src.ListTags(ctx, from)
+	if err != nil {
+		return nil, fmt.Errorf("can't list source tags: %w", err)
+	}
+
+	dstTags, err := dst.ListTags(ctx, to)
+	if err != nil {
+		return nil, fmt.Errorf("can't list destination tags: %w", err)
+	}
+
+	upstream := map[string]bool{}
+	for _, tag := range srcTags {
+		upstream[tag] = true
+	}
+	for tag := range owned {
+		upstream[tag] = true
+	}
+
+	digests := map[string]string{}
+	keepDigests := map[string]bool{}
+	for _, tag := range dstTags {
+		if !upstream[tag] {
+			digest, err := dst.ManifestDigest(ctx, to, tag)
+			if err != nil {
+				return nil, fmt.Errorf("can't resolve '%v:%v': %w", to, tag, err)
+			}
+			digests[tag] = digest
+			continue
+		}
+
+		m, digest, err := dst.FetchManifest(ctx, to, tag)
+		if err != nil {
+			return nil, fmt.Errorf("can't resolve '%v:%v': %w", to, tag, err)
+		}
+		digests[tag] = digest
+		keepDigests[digest] = true
+		for _, d := range m.Manifests {
+			keepDigests[d.Digest] = true
+		}
+	}
+
+	stale := []staleTag{}
+	for _, tag := range dstTags {
+		if upstream[tag] || isReferrersTag(tag) {
+			continue
+		}
+
+		digest := digests[tag]
+		if keepDigests[digest] {
+			infof("%v:%v shares digest %v with a kept tag, skipping", to, tag, digest)
+			continue
+		}
+
+		stale = append(stale, staleTag{tag: tag, digest: digest})
+	}
+
+	return stale, nil
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"regexp"
+	"sort"
+	"time"
+)
+
+func newPruneCommand() *command {
+	fs := flag.NewFlagSet("prune", flag.ExitOnError)
+	configPath := fs.String("f", "config.json", "config file path")
+	yes := fs.Bool("yes", false, "delete tags instead of only reporting them")
+
+	return &command{
+		name:  "prune",
+		usage: "delete destination tags not covered by the image retention policy",
+		flags: fs,
+		run: func(ctx context.Context) error {
+			c, err := loadConfig(*configPath)
+			if err != nil {
+				return err
+			}
+
+			return runPrune(ctx, c, *yes)
+		},
+	}
+}
+
+func runPrune(ctx context.Context, c Config, apply bool) error {
+	if err := c.startLogging(); err != nil {
+		return err
+	}
+
+	ctx, unlock, err := c.acquireLock(ctx)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	if err := c.startAudit(); err != nil {
+		return err
+	}
+
+	rc := newRegistryClient(c.ToRepo)
+
+	// Every configured tag is kept even if it's only referenced by an image
+	// entry without a retention policy, and so are its architecture tags.
+	configured := map[string]map[string]bool{}
+	for _, img := range c.Images {
+		repo := repositoryPath(c.ToRepo, img.ToPrefix, img.destinationName())
+		if configured[repo] == nil {
+			configured[repo] = map[string]bool{}
+		}
+		configured[repo][img.Tag] = true
+	}
+	if err := ownedArchTags(ctx, c, newRegistryClient(c.FromRepo), configured); err != nil {
+		return err
+	}
+
+	failed := 0
+	for _, img := range c.Images {
+		if img.Retention == nil {
+			continue
+		}
+
+		repo := repositoryPath(c.ToRepo, img.ToPrefix, img.destinationName())
+		if err := pruneRepository(ctx, rc, repo, *img.Retention, configured[repo], apply); err != nil {
+			log.Print(fmt.Errorf("can't prune repository '%v': %w", repo, err))
+			failed++
+		}
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("can't prune %v repositories", failed)
+	}
+
+	return nil
+}
+
+type tagInfo struct {
+	Tag     string
+	Digest  string
+	Created time.Time
+	// Platforms are the manifests of an index.
+	Platforms []string
+}
+
+func pruneRepository(ctx context.Context, rc *registryClient, repo string, policy RetentionPolicy, keepTags map[string]bool, apply bool) error {
+	var keepRegex *regexp.Regexp
+	if policy.KeepRegex != "" {
+		re, err := regexp.Compile(policy.KeepRegex)
+		if err != nil {
+			return fmt.Errorf("invalid keep_regex: %w", err)
+		}
+		keepRegex = re
+	}
+
+	tags, err := rc.ListTags(ctx, repo)
+	if err != nil {
+		return fmt.Errorf("can't list tags: %w", err)
+	}
+
+	infos := make([]tagInfo, 0, len(tags))
+	for _, tag := range tags {
+		if isReferrersTag(tag) {
+			continue
+		}
+		info, err := fetchTagInfo(ctx, rc, repo, tag)
+		if err != nil {
+			return fmt.Errorf("can't inspect tag '%v': %w", tag, err)
+		}
+		infos = append(infos, info)
+	}
+
+	sort.SliceStable(infos, func(i, j int) bool {
+		return infos[i].Created.After(infos[j].Created)
+	})
+
+	var keep, drop []tagInfo
+	for i, info := range infos {
+		switch {
+		case keepTags[info.Tag],
+			i < policy.KeepLast,
+			keepRegex != nil && keepRegex.MatchString(info.Tag),
+			info.Created.IsZero(),
+			policy.OlderThan > 0 && time.Since(info.Created) < time.Duration(policy.OlderThan):
+			keep = append(keep, info)
+		default:
+			drop = append(drop, info)
+		}
+	}
+
+	// Deleting a manifest removes every tag pointing to it, so digests shared
+	// with a kept tag must survive, and so must the platforms of kept
+	// indexes.
+	keepDigests := map[string]bool{}
+	for _, info := range keep {
+		keepDigests[info.Digest] = true
+		for _, d := range info.Platforms {
+			keepDigests[d] = true
+		}
+	}
+
+	deleted := map[string]bool{}
+	for _, info := range drop {
+		if keepDigests[info.Digest] {
+			infof("%v:%v shares digest %v with a kept tag, skipping", repo, info.Tag, info.Digest)
+			continue
+		}
+
+		if !apply {
+			log.Printf("would delete %v:%v (%v, created %v)", repo, info.Tag, info.Digest, info.Created.Format(time.RFC3339))
+			continue
+		}
+
+		if deleted[info.Digest] {
+			continue
+		}
+
+		if err := rc.DeleteManifest(ctx, repo, info.Digest); err != nil {
+			return fmt.Errorf("can't delete tag '%v': %w", info.Tag, err)
+		}
+		deleted[info.Digest] = true
+		recordAudit(auditDelete, qualifiedReference(rc.host, repo, info.Tag), info.Digest)
+
+		infof("deleted %v:%v (%v)", repo, info.Tag, info.Digest)
+	}
+
+	return nil
+}
+
+// fetchTagInfo resolves the digest and creation time of a tag. The creation
+// time is left zero when it can't be determined from the image config.
+func fetchTagInfo(ctx context.Context, rc *registryClient, repo, tag string) (tagInfo, error) {
+	m, digest, err := rc.FetchManifest(ctx, repo, tag)
+	if err != nil {
+		return tagInfo{}, err
+	}
+
+	info := tagInfo{Tag: tag, Digest: digest}
+
+	// For multi-platform images the first platform is representative enough.
+	if len(m.Manifests) > 0 {
+		for _, d := range m.Manifests {
+			info.Platforms = append(info.Platforms, d.Digest)
+		}
+		m, _, err = rc.FetchManifest(ctx, repo, m.Manifests[0].Digest)
+		if err != nil {
+			return tagInfo{}, err
+		}
+	}
+	if m.Config.Digest == "" {
+		return info, nil
+	}
+
+	data, err := rc.GetBlob(ctx, repo, m.Config.Digest)
+	if err != nil {
+		return tagInfo{}, fmt.Errorf("can't get image config: %w", err)
+	}
+
+	cfg := imageConfig{}
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return tagInfo{}, fmt.Errorf("can't decode image config: %w", err)
+	}
+	info.Created = cfg.Created
+
+	return info, nil
+}
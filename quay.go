@@ -0,0 +1,54 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// quayTokenEnv holds the OAuth token for the Quay API. Robot accounts can
+// push, but only application tokens can change tags.
+const quayTokenEnv = "QUAY_API_TOKEN"
+
+// setQuayExpiration makes Quay delete tag of repo at the given time. The
+// registry API can't express expiration and the quay.expires-after label
+// would change the image, so this goes through the Quay API.
+func setQuayExpiration(ctx context.Context, ac AuthConfig, repo, tag string, at time.Time) error {
+	token := os.Getenv(quayTokenEnv)
+	if token == "" {
+		return fmt.Errorf("%v is not set", quayTokenEnv)
+	}
+
+	host, _ := splitBaseAddress(ac.BaseAddress)
+	body, _ := json.Marshal(map[string]int64{"expiration": at.Unix()})
+	u := fmt.Sprintf("%v/api/v1/repository/%v/tag/%v", apiBase(ac, host), repo, url.PathEscape(tag))
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, u, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("can't create request: %w", err)
+	}
+	ac.setHeaders(req)
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("can't send request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		data, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("PUT %v: unexpected status %v: %v", u, resp.StatusCode, strings.TrimSpace(string(data)))
+	}
+
+	debugf("%v/%v:%v expires at %v", host, repo, tag, at.Format(time.RFC3339))
+
+	return nil
+}
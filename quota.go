@@ -0,0 +1,266 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// QuotaConfig describes the storage left at the destination. Runs that
+// would push more are aborted, or trimmed, before anything is pushed.
+type QuotaConfig struct {
+	// Limit is the storage available at the destination, e.g. "200GiB".
+	Limit string `json:"limit,omitempty"`
+	// Harbor reads the storage left in the quota of every Harbor project
+	// images are pushed to.
+	Harbor bool `json:"harbor,omitempty"`
+	// Trim leaves out the images that don't fit instead of aborting.
+	Trim bool `json:"trim,omitempty"`
+}
+
+func (q QuotaConfig) validate() error {
+	if q.Limit == "" && !q.Harbor {
+		return fmt.Errorf("quota needs limit or harbor")
+	}
+
+	if q.Limit != "" {
+		if _, err := parseBytes(q.Limit); err != nil {
+			return fmt.Errorf("quota.limit: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// parseBytes parses sizes like 500MB or 1.5GiB.
+func parseBytes(s string) (int64, error) {
+	units := []struct {
+		suffix string
+		size   float64
+	}{
+		{"KiB", 1 << 10}, {"MiB", 1 << 20}, {"GiB", 1 << 30}, {"TiB", 1 << 40},
+		{"KB", 1e3}, {"MB", 1e6}, {"GB", 1e9}, {"TB", 1e12},
+		{"B", 1},
+	}
+
+	n, unit := strings.TrimSpace(s), 1.0
+	for _, u := range units {
+		if strings.HasSuffix(n, u.suffix) {
+			n, unit = strings.TrimSpace(strings.TrimSuffix(n, u.suffix)), u.size
+			break
+		}
+	}
+
+	f, err := strconv.ParseFloat(n, 64)
+	if err != nil || f < 0 {
+		return 0, fmt.Errorf("invalid size '%v'", s)
+	}
+	return int64(f * unit), nil
+}
+
+// quotaBudget is the storage left in one place: the whole destination for
+// quota.limit, or a Harbor project.
+type quotaBudget struct {
+	name      string
+	available int64
+	needed    int64
+}
+
+// checkQuota estimates what every image transfers, as `dimco plan` does, and
+// compares the sum with the quota. Blobs shared by images are counted for
+// each of them, so the estimate errs on the safe side. With Trim the images
+// that don't fit, and the images depending on them, are left out in run
+// order and reported as skipped.
+func (c Config) checkQuota(ctx context.Context, opts syncOptions, report *runReport) (Config, error) {
+	q := *c.Quota
+	src := newRegistryClient(c.FromRepo)
+	dst := newRegistryClient(c.ToRepo)
+
+	limit := (*quotaBudget)(nil)
+	if q.Limit != "" {
+		n, _ := parseBytes(q.Limit)
+		limit = &quotaBudget{name: c.ToRepo.BaseAddress, available: n}
+	}
+	projects := map[string]*quotaBudget{}
+
+	changes := make([]planChange, len(c.Images))
+	budgets := make([][]*quotaBudget, len(c.Images))
+	for i, img := range c.Images {
+		pc, err := planImage(ctx, c, src, dst, img, opts.Overwrite, opts.Stage)
+		if err != nil {
+			// The copy reports the error.
+			debugf("can't estimate %v%v:%v: %v", img.ToPrefix, img.destinationName(), img.Tag, err)
+			continue
+		}
+		changes[i] = pc
+		if pc.Transfer == 0 {
+			continue
+		}
+
+		if limit != nil {
+			budgets[i] = append(budgets[i], limit)
+		}
+		if q.Harbor {
+			project := strings.SplitN(repositoryPath(c.ToRepo, img.ToPrefix, img.destinationName()), "/", 2)[0]
+			b, ok := projects[project]
+			if !ok {
+				available, err := harborQuotaLeft(ctx, c.ToRepo, project)
+				if err != nil {
+					return c, fmt.Errorf("can't get quota of Harbor project '%v': %w", project, err)
+				}
+				b = &quotaBudget{name: "Harbor project " + project, available: available}
+				projects[project] = b
+			}
+			if b.available >= 0 {
+				budgets[i] = append(budgets[i], b)
+			}
+		}
+	}
+
+	order := make([]int, len(c.Images))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(a, b int) bool {
+		return c.Images[order[a]].Priority > c.Images[order[b]].Priority
+	})
+
+	deps, _ := c.dependencies()
+	// trimmed is why an image is left out.
+	trimmed := make([]string, len(c.Images))
+	exceeded := map[*quotaBudget]bool{}
+	for _, i := range order {
+		fits := true
+		for _, b := range budgets[i] {
+			if b.needed+changes[i].Transfer > b.available {
+				fits = false
+				if !q.Trim {
+					exceeded[b] = true
+				}
+			}
+		}
+		if q.Trim {
+			if !fits {
+				trimmed[i] = fmt.Sprintf("%v don't fit the destination quota", formatBytes(changes[i].Transfer))
+				continue
+			}
+			for _, j := range deps[i] {
+				if trimmed[j] != "" {
+					trimmed[i] = fmt.Sprintf("depends on %v, which doesn't fit the destination quota", changes[j].Destination)
+					break
+				}
+			}
+			if trimmed[i] != "" {
+				continue
+			}
+		}
+
+		for _, b := range budgets[i] {
+			b.needed += changes[i].Transfer
+		}
+	}
+
+	// A dependent of the same priority can come before the image it depends
+	// on, which is trimmed after it.
+	for changed := q.Trim; changed; {
+		changed = false
+		for i := range c.Images {
+			if trimmed[i] != "" {
+				continue
+			}
+			for _, j := range deps[i] {
+				if trimmed[j] != "" {
+					trimmed[i] = fmt.Sprintf("depends on %v, which doesn't fit the destination quota", changes[j].Destination)
+					changed = true
+					break
+				}
+			}
+		}
+	}
+
+	if len(exceeded) > 0 {
+		msgs := []string{}
+		for _, b := range append([]*quotaBudget{limit}, sortedBudgets(projects)...) {
+			if exceeded[b] {
+				msgs = append(msgs, fmt.Sprintf("%v needs about %v, %v are left", b.name, formatBytes(b.needed), formatBytes(b.available)))
+			}
+		}
+		return c, fmt.Errorf("run exceeds the destination quota: %v; free up storage or set quota.trim", strings.Join(msgs, ", "))
+	}
+
+	images := []ImageData{}
+	for i, img := range c.Images {
+		if trimmed[i] == "" {
+			images = append(images, img)
+			continue
+		}
+
+		pc := changes[i]
+		log.Printf("%v skipped, %v", pc.Destination, trimmed[i])
+		report.add(imageResult{Source: pc.Source, Destination: pc.Destination, Status: resultSkipped, Error: trimmed[i], name: img.Name, tag: img.Tag})
+	}
+	if len(images) < len(c.Images) {
+		log.Printf("trimmed %v of %v images to fit the destination quota", len(c.Images)-len(images), len(c.Images))
+	}
+	return c.withImages(images), nil
+}
+
+func sortedBudgets(m map[string]*quotaBudget) []*quotaBudget {
+	names := make([]string, 0, len(m))
+	for name := range m {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	out := make([]*quotaBudget, len(names))
+	for i, name := range names {
+		out[i] = m[name]
+	}
+	return out
+}
+
+// harborQuotaLeft returns the storage left in the quota of a Harbor project,
+// or -1 if it has none.
+func harborQuotaLeft(ctx context.Context, ac AuthConfig, project string) (int64, error) {
+	host, _ := splitBaseAddress(ac.BaseAddress)
+
+	u := fmt.Sprintf("%v/api/v2.0/projects/%v/summary", apiBase(ac, host), url.PathEscape(project))
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return 0, fmt.Errorf("can't create request: %w", err)
+	}
+	if ac.Username != "" {
+		req.SetBasicAuth(ac.Username, ac.Password)
+	}
+
+	var out struct {
+		Quota *struct {
+			Hard map[string]int64 `json:"hard"`
+			Used map[string]int64 `json:"used"`
+		} `json:"quota"`
+	}
+	if err := doJSON(req, &out); err != nil {
+		return 0, err
+	}
+
+	if out.Quota == nil {
+		return -1, nil
+	}
+	hard, ok := out.Quota.Hard["storage"]
+	if !ok || hard < 0 {
+		return -1, nil
+	}
+
+	left := hard - out.Quota.Used["storage"]
+	if left < 0 {
+		left = 0
+	}
+	debugf("Harbor project %v has %v of %v left", project, formatBytes(left), formatBytes(hard))
+
+	return left, nil
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// RateLimit bounds the load dimco puts on a registry. Zero values mean no
+// limit.
+type RateLimit struct {
+	RequestsPerSecond float64 `json:"requests_per_second,omitempty"`
+	// Burst is the number of requests allowed at once before
+	// RequestsPerSecond applies, 1 when unset.
+	Burst int `json:"burst,omitempty"`
+	// MaxConcurrent is the number of slots blob downloads and other
+	// requests, engine pulls and pushes included, each get.
+	MaxConcurrent int `json:"max_concurrent,omitempty"`
+}
+
+// hostLimiter is a token bucket plus semaphores for the downloads and the
+// other requests to one registry host.
+type hostLimiter struct {
+	limit     RateLimit
+	slots     chan struct{}
+	downloads chan struct{}
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+var limiters = struct {
+	mu sync.Mutex
+	m  map[string]*hostLimiter
+}{m: map[string]*hostLimiter{}}
+
+// limiterFor returns the limiter shared by every client of host. It is
+// replaced when the limit changes, e.g. after a config reload.
+func limiterFor(host string, limit *RateLimit) *hostLimiter {
+	if limit == nil || (limit.RequestsPerSecond <= 0 && limit.MaxConcurrent <= 0) {
+		return nil
+	}
+
+	normalized := *limit
+	if normalized.Burst <= 0 {
+		normalized.Burst = 1
+	}
+
+	limiters.mu.Lock()
+	defer limiters.mu.Unlock()
+
+	if l, ok := limiters.m[host]; ok && l.limit == normalized {
+		return l
+	}
+
+	l := &hostLimiter{limit: normalized, tokens: float64(normalized.Burst), last: time.Now()}
+	if normalized.MaxConcurrent > 0 {
+		l.slots = make(chan struct{}, normalized.MaxConcurrent)
+		l.downloads = make(chan struct{}, normalized.MaxConcurrent)
+	}
+
+	limiters.m[host] = l
+	return l
+}
+
+// wait blocks until a request, a blob download or another one, may be sent
+// and returns the function that gives its concurrency slot back. A nil
+// limiter never blocks.
+func (l *hostLimiter) wait(ctx context.Context, download bool) (func(), error) {
+	if l == nil {
+		return func() {}, nil
+	}
+
+	slots := l.slots
+	if download {
+		slots = l.downloads
+	}
+	if slots != nil {
+		select {
+		case slots <- struct{}{}:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+
+	release := func() {
+		if slots != nil {
+			<-slots
+		}
+	}
+
+	if err := l.take(ctx); err != nil {
+		release()
+		return nil, err
+	}
+
+	var once sync.Once
+	return func() { once.Do(release) }, nil
+}
+
+// take removes a token from the bucket, sleeping until one is available.
+func (l *hostLimiter) take(ctx context.Context) error {
+	if l.limit.RequestsPerSecond <= 0 {
+		return nil
+	}
+
+	for {
+		l.mu.Lock()
+		now := time.Now()
+		l.tokens += now.Sub(l.last).Seconds() * l.limit.RequestsPerSecond
+		if max := float64(l.limit.Burst); l.tokens > max {
+			l.tokens = max
+		}
+		l.last = now
+
+		if l.tokens >= 1 {
+			l.tokens--
+			l.mu.Unlock()
+			return nil
+		}
+
+		delay := time.Duration((1 - l.tokens) / l.limit.RequestsPerSecond * float64(time.Second))
+		l.mu.Unlock()
+
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+const (
+	// maxPause bounds how long a Retry-After pauses a registry, longer
+	// waits fail the request.
+	maxPause = 15 * time.Minute
+	// maxThrottledRetries is how often a paused request is sent again.
+	maxThrottledRetries = 5
+)
+
+// pauses holds the time until which each registry host asked to be left
+// alone with a 429 or 503 and Retry-After. Every client of the host waits,
+// not only the one that got the answer.
+var pauses = struct {
+	mu sync.Mutex
+	m  map[string]time.Time
+}{m: map[string]time.Time{}}
+
+// pauseHost holds the requests to host back for d. It returns false when
+// d is longer than maxPause.
+func pauseHost(host string, d time.Duration) bool {
+	if d > maxPause {
+		return false
+	}
+
+	until := time.Now().Add(d)
+
+	pauses.mu.Lock()
+	defer pauses.mu.Unlock()
+	if until.After(pauses.m[host]) {
+		if pauses.m[host].Before(time.Now()) {
+			infof("%v asked to retry after %v, pausing its requests", host, d.Round(time.Second))
+		}
+		pauses.m[host] = until
+	}
+	return true
+}
+
+// waitPause blocks while host is paused.
+func waitPause(ctx context.Context, host string) error {
+	for {
+		pauses.mu.Lock()
+		delay := time.Until(pauses.m[host])
+		pauses.mu.Unlock()
+		if delay <= 0 {
+			return nil
+		}
+
+		t := time.NewTimer(delay)
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			t.Stop()
+			return ctx.Err()
+		}
+	}
+}
+
+// throttled returns the wait resp asks for when it is a 429 or 503 with
+// Retry-After, 0 otherwise.
+func throttled(resp *http.Response) time.Duration {
+	if resp.StatusCode != http.StatusTooManyRequests && resp.StatusCode != http.StatusServiceUnavailable {
+		return 0
+	}
+	return parseRetryAfter(resp.Header.Get("Retry-After"))
+}
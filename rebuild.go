@@ -0,0 +1,273 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+
+	godigest "github.com/opencontainers/go-digest"
+)
+
+// builtImage is a source image downloaded by dimco to be changed before the
+// push, by squashing or by encrypting or decrypting its layers. Layers are
+// kept in a temporary directory.
+type builtImage struct {
+	dir       string
+	mediaType string
+	config    descriptor
+	configRaw []byte
+	layers    []builtLayer
+
+	// raw is the source manifest, pushed unchanged unless changed is set,
+	// so untouched images keep their digest.
+	raw     []byte
+	changed bool
+}
+
+type builtLayer struct {
+	descriptor
+	file string
+}
+
+// rebuilds reports whether dimco builds img itself instead of the engine.
+func (c Config) rebuilds(img ImageData) bool {
+	return c.Squash || img.Squash || c.Encryption != nil
+}
+
+// buildImage downloads the source image of img and decrypts, squashes and
+// encrypts it as configured.
+func (c Config) buildImage(ctx context.Context, img ImageData) (b *builtImage, err error) {
+	b, err = loadImage(ctx, c.FromRepo, repositoryPath(c.FromRepo, img.FromPrefix, img.Name), img.sourceRef(), c.IncludeNonDistributable, c.workspace)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err != nil {
+			b.Close()
+		}
+	}()
+
+	ec := c.Encryption
+	if ec != nil && len(ec.DecryptionKeys) > 0 {
+		keys, err := ec.privateKeys()
+		if err != nil {
+			return nil, err
+		}
+		if err := b.decrypt(keys); err != nil {
+			return nil, err
+		}
+	}
+
+	if c.Squash || img.Squash {
+		if err := b.squash(); err != nil {
+			return nil, err
+		}
+	}
+
+	if ec != nil && len(ec.Recipients) > 0 {
+		keys, err := ec.publicKeys()
+		if err != nil {
+			return nil, err
+		}
+		if err := b.encrypt(keys); err != nil {
+			return nil, err
+		}
+	}
+
+	return b, nil
+}
+
+// loadImage downloads the image ref of repo, for the platform of dimco if ref
+// is an index. Foreign layers are only downloaded with nonDistributable, and
+// then become regular layers; otherwise they stay at their urls. The layers
+// are stored in a new directory of workspace.
+func loadImage(ctx context.Context, ac AuthConfig, repo, ref string, nonDistributable bool, workspace string) (b *builtImage, err error) {
+	rc := newRegistryClient(ac)
+
+	data, mediaType, _, err := rc.GetManifest(ctx, repo, ref)
+	if err != nil {
+		return nil, fmt.Errorf("can't fetch manifest: %w", err)
+	}
+
+	m := manifest{}
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, fmt.Errorf("can't decode manifest: %w", err)
+	}
+
+	if len(m.Manifests) > 0 {
+		d, err := selectPlatform(m.Manifests, runtime.GOOS, runtime.GOARCH)
+		if err != nil {
+			return nil, err
+		}
+
+		if data, mediaType, _, err = rc.GetManifest(ctx, repo, d.Digest); err != nil {
+			return nil, fmt.Errorf("can't fetch platform manifest: %w", err)
+		}
+		m = manifest{}
+		if err := json.Unmarshal(data, &m); err != nil {
+			return nil, fmt.Errorf("can't decode manifest: %w", err)
+		}
+	}
+	if mediaType == "" {
+		mediaType = m.MediaType
+	}
+
+	dir, err := ioutil.TempDir(workspace, "dimco-build-")
+	if err != nil {
+		return nil, fmt.Errorf("can't create temporary directory: %w", err)
+	}
+	b = &builtImage{dir: dir, mediaType: mediaType, config: m.Config, raw: data}
+	defer func() {
+		if err != nil {
+			b.Close()
+		}
+	}()
+
+	if b.configRaw, err = rc.GetBlob(ctx, repo, m.Config.Digest); err != nil {
+		return nil, fmt.Errorf("can't fetch config: %w", err)
+	}
+
+	for i, l := range m.Layers {
+		if isForeign(l) && !nonDistributable {
+			b.layers = append(b.layers, builtLayer{descriptor: l})
+			continue
+		}
+
+		file := b.path(fmt.Sprintf("layer-%v", i))
+		if err := downloadBlob(ctx, rc, repo, l, file); err != nil {
+			return nil, fmt.Errorf("can't download layer '%v': %w", l.Digest, err)
+		}
+		if isForeign(l) {
+			l = distributable(l)
+			b.changed = true
+		}
+		b.layers = append(b.layers, builtLayer{descriptor: l, file: file})
+	}
+
+	return b, nil
+}
+
+func downloadBlob(ctx context.Context, rc *registryClient, repo string, d descriptor, file string) error {
+	body, err := openLayer(ctx, rc, repo, d)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	f, err := os.Create(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	r := &progressReader{ReadCloser: body, p: progressFrom(ctx), id: d.Digest, total: d.Size}
+	if _, err := io.Copy(f, r); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+func (b *builtImage) path(name string) string {
+	return filepath.Join(b.dir, name)
+}
+
+// setConfig replaces the config of the image.
+func (b *builtImage) setConfig(data []byte) {
+	b.configRaw = data
+	b.config.Digest = godigest.FromBytes(data).String()
+	b.config.Size = int64(len(data))
+	b.changed = true
+}
+
+// manifest returns the manifest to push.
+func (b *builtImage) manifest() ([]byte, error) {
+	if !b.changed {
+		return b.raw, nil
+	}
+
+	m := manifest{SchemaVersion: 2, MediaType: b.mediaType, Config: b.config}
+	for _, l := range b.layers {
+		m.Layers = append(m.Layers, l.descriptor)
+	}
+
+	data, err := json.Marshal(m)
+	if err != nil {
+		return nil, fmt.Errorf("can't encode manifest: %w", err)
+	}
+	return data, nil
+}
+
+// push uploads the layers, the config and the manifest.
+func (b *builtImage) push(ctx context.Context, dst *registryClient, repo, tag string) error {
+	for _, l := range b.layers {
+		if l.file == "" {
+			continue
+		}
+		if err := uploadFile(ctx, dst, repo, l.descriptor, l.file); err != nil {
+			return fmt.Errorf("can't push blob '%v': %w", l.Digest, err)
+		}
+	}
+
+	exists, err := dst.BlobExists(ctx, repo, b.config.Digest)
+	if err != nil {
+		return fmt.Errorf("can't check config: %w", err)
+	}
+	if exists {
+		progressFrom(ctx).skip(b.config.Digest, b.config.Size)
+	} else {
+		r := &progressReader{ReadCloser: ioutil.NopCloser(bytes.NewReader(b.configRaw)), p: progressFrom(ctx), id: b.config.Digest, total: b.config.Size}
+		if err := dst.UploadBlob(ctx, repo, b.config.Digest, b.config.Size, r); err != nil {
+			return fmt.Errorf("can't push config: %w", err)
+		}
+	}
+
+	data, err := b.manifest()
+	if err != nil {
+		return err
+	}
+
+	if err := dst.PutManifest(ctx, repo, tag, b.mediaType, data); err != nil {
+		return fmt.Errorf("can't push manifest: %w", err)
+	}
+
+	return nil
+}
+
+func uploadFile(ctx context.Context, dst *registryClient, repo string, d descriptor, file string) error {
+	exists, err := dst.BlobExists(ctx, repo, d.Digest)
+	if err != nil {
+		return err
+	}
+	if exists {
+		progressFrom(ctx).skip(d.Digest, d.Size)
+		return nil
+	}
+
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	r := &progressReader{ReadCloser: f, p: progressFrom(ctx), id: d.Digest, total: d.Size}
+	return dst.UploadBlob(ctx, repo, d.Digest, d.Size, r)
+}
+
+func (b *builtImage) Close() error {
+	return os.RemoveAll(b.dir)
+}
+
+type countingWriter struct {
+	n int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	w.n += int64(len(p))
+	return len(p), nil
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const redacted = "[REDACTED]"
+
+// minSecretLength keeps very short values, that would match everywhere,
+// out of the exact-match redaction. Patterns still catch them in context.
+const minSecretLength = 4
+
+// secrets holds every credential dimco has seen, so they can be scrubbed from
+// anything it prints, including errors relayed from the engine.
+var secrets = struct {
+	mu     sync.RWMutex
+	values map[string]bool
+	sorted []string
+}{values: map[string]bool{}}
+
+// secretEnv are environment variables that carry credentials.
+var secretEnv = []string{
+	"AWS_SECRET_ACCESS_KEY",
+	"AWS_SESSION_TOKEN",
+	"VAULT_TOKEN",
+	"DIMCO_CONFIG_TOKEN",
+	"QUAY_API_TOKEN",
+	"ARTIFACTORY_ACCESS_TOKEN",
+	"ACTIONS_ID_TOKEN_REQUEST_TOKEN",
+	"GITHUB_TOKEN",
+	"CI_JOB_TOKEN",
+	"CI_JOB_JWT",
+}
+
+func init() {
+	for _, name := range secretEnv {
+		registerSecret(os.Getenv(name))
+	}
+}
+
+// secretPatterns scrub credentials dimco never saw itself, like tokens in
+// relayed HTTP errors or user info in URLs.
+var secretPatterns = []struct {
+	re   *regexp.Regexp
+	repl string
+}{
+	{regexp.MustCompile(`(?i)(authorization:\s*(?:bearer|basic)\s+)[^\s"]+`), "${1}" + redacted},
+	{regexp.MustCompile(`(?i)\b(bearer\s+)[A-Za-z0-9\-._~+/]{16,}=*`), "${1}" + redacted},
+	{regexp.MustCompile(`([a-zA-Z][a-zA-Z0-9+.\-]*://[^/\s:@]+:)[^@\s/]+@`), "${1}" + redacted + "@"},
+	{regexp.MustCompile(`(?i)("(?:password|secret|token|access_token|refresh_token|identitytoken|registrytoken|auth)"\s*:\s*")[^"]*"`), "${1}" + redacted + `"`},
+}
+
+// registerSecret adds a value that must never be printed.
+func registerSecret(value string) {
+	if len(value) < minSecretLength {
+		return
+	}
+
+	secrets.mu.Lock()
+	defer secrets.mu.Unlock()
+
+	if secrets.values[value] {
+		return
+	}
+	secrets.values[value] = true
+
+	// Longest first, so a secret containing another one is replaced whole.
+	secrets.sorted = append(secrets.sorted, value)
+	sort.Slice(secrets.sorted, func(i, j int) bool { return len(secrets.sorted[i]) > len(secrets.sorted[j]) })
+}
+
+// registerCredentials registers the username and password of ac and the
+// encodings they are sent in: the basic auth pair and the engine's registry
+// auth header. Usernames are redacted too, robot accounts name the
+// organization and what the token may do; well known ones like
+// oauth2accesstoken cost nothing to hide.
+func registerCredentials(ac AuthConfig) {
+	for _, v := range ac.Headers {
+		registerSecret(v)
+	}
+
+	if ac.Password == "" {
+		return
+	}
+
+	registerSecret(ac.Username)
+	registerSecret(ac.Password)
+	registerSecret(base64.StdEncoding.EncodeToString([]byte(ac.Username + ":" + ac.Password)))
+	registerSecret(ac.ToEncodedString())
+}
+
+// registerAuthorization registers the credentials of an Authorization header.
+func registerAuthorization(header string) {
+	if i := strings.IndexByte(header, ' '); i >= 0 {
+		registerSecret(header[i+1:])
+	}
+}
+
+// redact replaces known secrets and credential-looking values in s.
+func redact(s string) string {
+	secrets.mu.RLock()
+	for _, v := range secrets.sorted {
+		if strings.Contains(s, v) {
+			s = strings.ReplaceAll(s, v, redacted)
+		}
+	}
+	secrets.mu.RUnlock()
+
+	for _, p := range secretPatterns {
+		s = p.re.ReplaceAllString(s, p.repl)
+	}
+
+	return s
+}
+
+// maxRedactLine bounds what redactingWriter holds back waiting for the end
+// of a line.
+const maxRedactLine = 64 << 10
+
+// redactingWriter redacts everything written through it. Output is passed
+// on by lines, ended by \n or the \r of progress bars, so a secret split
+// across writes is still found; Flush writes the rest.
+type redactingWriter struct {
+	mu  sync.Mutex
+	w   io.Writer
+	buf []byte
+}
+
+func newRedactingWriter(w io.Writer) *redactingWriter {
+	return &redactingWriter{w: w}
+}
+
+func (r *redactingWriter) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.buf = append(r.buf, p...)
+	end := bytes.LastIndexAny(r.buf, "\r\n") + 1
+	if end == 0 && len(r.buf) < maxRedactLine {
+		return len(p), nil
+	}
+	if end == 0 {
+		end = len(r.buf)
+	}
+
+	line := r.buf[:end]
+	r.buf = append([]byte{}, r.buf[end:]...)
+	if _, err := io.WriteString(r.w, redact(string(line))); err != nil {
+		return 0, err
+	}
+
+	return len(p), nil
+}
+
+// Flush writes what is left of an unfinished line.
+func (r *redactingWriter) Flush() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if len(r.buf) == 0 {
+		return nil
+	}
+	_, err := io.WriteString(r.w, redact(string(r.buf)))
+	r.buf = nil
+	return err
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/docker/distribution/reference"
+	godigest "github.com/opencontainers/go-digest"
+)
+
+// imageReference returns the normalized reference of an image in the
+// registry described by ac: "nginx" on docker.io becomes
+// docker.io/library/nginx and registry ports are kept. tag may also be a
+// digest, which references the image by content.
+func imageReference(ac AuthConfig, prefix, name, tag string) (reference.Named, error) {
+	host, _ := splitBaseAddress(ac.BaseAddress)
+	if !strings.ContainsAny(host, ".:") && host != "localhost" {
+		return nil, fmt.Errorf("registry host '%v' must contain a '.' or a port, or be localhost", host)
+	}
+
+	s := host + "/" + repositoryPath(ac, prefix, name)
+	named, err := reference.ParseNamed(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid repository '%v': %w", s, err)
+	}
+
+	if d, err := godigest.Parse(tag); err == nil {
+		return reference.WithDigest(named, d)
+	}
+
+	tagged, err := reference.WithTag(named, tag)
+	if err != nil {
+		return nil, fmt.Errorf("invalid tag '%v': %w", tag, err)
+	}
+
+	return tagged, nil
+}
+
+// referenceString returns the normalized reference for configs that passed
+// validation, which checked that imageReference succeeds.
+func referenceString(ac AuthConfig, prefix, name, tag string) string {
+	ref, err := imageReference(ac, prefix, name, tag)
+	if err != nil {
+		host, _ := splitBaseAddress(ac.BaseAddress)
+		return host + "/" + repositoryPath(ac, prefix, name) + ":" + tag
+	}
+
+	return ref.String()
+}
+
+// normalizeImages splits tags and digests written into name or tag and
+// defaults missing tags to latest.
+func (c *Config) normalizeImages() {
+	for i, img := range c.Images {
+		c.Images[i] = img.normalized()
+		if img.Tag == "" && c.Images[i].Tag == "latest" {
+			log.Printf("images[%v] (%v): no tag, using latest", i, c.Images[i].Name)
+		}
+	}
+}
+
+// normalized returns img with a reference like "app:1.2@sha256:..." in name
+// or tag split into name, tag and digest, and latest as default tag.
+func (img ImageData) normalized() ImageData {
+	if j := strings.LastIndexByte(img.Name, '@'); j >= 0 && img.Digest == "" {
+		img.Name, img.Digest = img.Name[:j], img.Name[j+1:]
+	}
+	if j := strings.LastIndexByte(img.Name, ':'); j > strings.LastIndexByte(img.Name, '/') && img.Tag == "" {
+		img.Name, img.Tag = img.Name[:j], img.Name[j+1:]
+	}
+	if j := strings.LastIndexByte(img.Tag, '@'); j >= 0 && img.Digest == "" {
+		img.Tag, img.Digest = img.Tag[:j], img.Tag[j+1:]
+	}
+
+	if img.Tag == "" && img.Name != "" {
+		img.Tag = "latest"
+	}
+
+	return img
+}
+
+// validateReferences checks that img yields valid source and destination
+// references, so malformed names fail at load time instead of mid-run.
+func (c Config) validateReferences(img ImageData) error {
+	for _, part := range []struct{ field, value string }{
+		{"name", img.Name},
+		{"from_prefix", img.FromPrefix},
+		{"to_prefix", img.ToPrefix},
+		{"to_name", img.ToName},
+	} {
+		if strings.ContainsAny(part.value, ":@") {
+			return fmt.Errorf("%v '%v' must not contain a tag or digest, use tag", part.field, part.value)
+		}
+	}
+
+	if img.Digest != "" {
+		if _, err := godigest.Parse(img.Digest); err != nil {
+			return fmt.Errorf("invalid digest '%v': %w", img.Digest, err)
+		}
+	}
+
+	if _, err := imageReference(c.FromRepo, img.FromPrefix, img.Name, img.sourceRef()); err != nil {
+		return fmt.Errorf("invalid source reference: %w", err)
+	}
+
+	if _, err := godigest.Parse(img.Tag); err == nil {
+		return fmt.Errorf("tag '%v' is a digest, use digest and give the destination a tag", img.Tag)
+	}
+
+	for _, tag := range []string{img.Tag, c.stagingTag(img.Tag)} {
+		if _, err := imageReference(c.ToRepo, img.ToPrefix, img.destinationName(), tag); err != nil {
+			return fmt.Errorf("invalid destination reference: %w", err)
+		}
+	}
+
+	return nil
+}
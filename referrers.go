@@ -0,0 +1,261 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+
+	godigest "github.com/opencontainers/go-digest"
+)
+
+// maxReferrerDepth bounds the referrer graph followed, a signature of an
+// SBOM of an image is depth 2.
+const maxReferrerDepth = 8
+
+// copyReferrers copies the referrers graph of the source of img, the
+// signatures, SBOMs, provenance and scan reports attached to it, to the image
+// pushed to toRepo:toTag. Referrers of a subject whose digest changed on the
+// way get the pushed subject, which changes their own digests.
+func (s *syncer) copyReferrers(ctx context.Context, img ImageData, toRepo, toTag string) error {
+	c := s.config
+	src := newRegistryClient(c.FromRepo)
+	fromRepo := repositoryPath(c.FromRepo, img.FromPrefix, img.Name)
+
+	subject, err := src.ManifestDigest(ctx, fromRepo, img.sourceRef())
+	if err != nil {
+		return fmt.Errorf("can't resolve source digest: %w", err)
+	}
+
+	data, mediaType, digest, err := s.dst.GetManifest(ctx, toRepo, toTag)
+	if err != nil {
+		return fmt.Errorf("can't get pushed manifest: %w", err)
+	}
+	if digest == "" {
+		digest = godigest.FromBytes(data).String()
+	}
+	pushed := descriptor{MediaType: mediaType, Digest: digest, Size: int64(len(data))}
+
+	n, err := copyReferrerGraph(ctx, src, fromRepo, s.dst, toRepo, subject, pushed, 0)
+	if err != nil {
+		return err
+	}
+	if n > 0 {
+		infof("copied %v referrers of %v", n, subject)
+		if subject != pushed.Digest {
+			log.Printf("%v was pushed as %v, signatures over the source digest won't verify against %v:%v", subject, pushed.Digest, toRepo, toTag)
+		}
+	}
+
+	return nil
+}
+
+// copyReferrerGraph copies the referrers of subject in fromRepo, and theirs,
+// to toRepo with pushed as their subject. It returns how many it copied.
+func copyReferrerGraph(ctx context.Context, src *registryClient, fromRepo string, dst *registryClient, toRepo, subject string, pushed descriptor, depth int) (int, error) {
+	if depth == maxReferrerDepth {
+		log.Printf("referrers of %v nest deeper than %v, not following them", subject, maxReferrerDepth)
+		return 0, nil
+	}
+
+	referrers, err := listReferrers(ctx, src, fromRepo, subject)
+	if err != nil {
+		return 0, fmt.Errorf("can't list referrers of %v: %w", subject, err)
+	}
+	if len(referrers) == 0 {
+		return 0, nil
+	}
+
+	copied := []descriptor{}
+	n := 0
+	for _, r := range referrers {
+		d, err := copyReferrer(ctx, src, fromRepo, dst, toRepo, r, subject, pushed)
+		if err != nil {
+			return n, fmt.Errorf("can't copy referrer %v: %w", r.Digest, err)
+		}
+		copied = append(copied, d)
+		n++
+
+		m, err := copyReferrerGraph(ctx, src, fromRepo, dst, toRepo, r.Digest, d, depth+1)
+		n += m
+		if err != nil {
+			return n, err
+		}
+	}
+
+	// Registries without the referrers API find them by the fallback tag.
+	if _, supported, err := referrersAPI(ctx, dst, toRepo, pushed.Digest); err != nil {
+		return n, fmt.Errorf("can't check referrers of %v: %w", pushed.Digest, err)
+	} else if !supported {
+		if err := addFallbackReferrers(ctx, dst, toRepo, pushed.Digest, copied); err != nil {
+			return n, err
+		}
+	}
+
+	return n, nil
+}
+
+// copyReferrer copies the manifest r with its blobs, rewriting its subject
+// to pushed when the digest of the subject changed.
+func copyReferrer(ctx context.Context, src *registryClient, fromRepo string, dst *registryClient, toRepo string, r descriptor, subject string, pushed descriptor) (descriptor, error) {
+	data, mediaType, _, err := src.GetManifest(ctx, fromRepo, r.Digest)
+	if err != nil {
+		return descriptor{}, fmt.Errorf("can't get manifest: %w", err)
+	}
+
+	m := manifest{}
+	if err := json.Unmarshal(data, &m); err != nil {
+		return descriptor{}, fmt.Errorf("can't decode manifest: %w", err)
+	}
+	if mediaType == "" {
+		mediaType = m.MediaType
+	}
+
+	for _, d := range m.Manifests {
+		if _, err := newRegistryEngine(false).copyManifest(ctx, src, fromRepo, dst, toRepo, d.Digest, d.Digest, &layerReuse{}); err != nil {
+			return descriptor{}, err
+		}
+	}
+
+	blobs := m.Layers
+	if m.Config.Digest != "" {
+		blobs = append([]descriptor{m.Config}, blobs...)
+	}
+	for _, d := range blobs {
+		if _, err := copyBlob(ctx, src, fromRepo, dst, toRepo, d); err != nil {
+			return descriptor{}, fmt.Errorf("can't copy blob '%v': %w", d.Digest, err)
+		}
+	}
+
+	if subject != pushed.Digest {
+		if data, err = rewriteSubject(data, pushed); err != nil {
+			return descriptor{}, err
+		}
+	}
+
+	d := descriptor{MediaType: mediaType, Digest: godigest.FromBytes(data).String(), Size: int64(len(data)), ArtifactType: r.ArtifactType, Annotations: r.Annotations}
+	if d.ArtifactType == "" {
+		d.ArtifactType = m.Config.MediaType
+	}
+	if err := dst.PutManifest(ctx, toRepo, d.Digest, mediaType, data); err != nil {
+		return descriptor{}, fmt.Errorf("can't push manifest: %w", err)
+	}
+
+	return d, nil
+}
+
+// rewriteSubject points the subject of the manifest data to d.
+func rewriteSubject(data []byte, d descriptor) ([]byte, error) {
+	m := map[string]json.RawMessage{}
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, fmt.Errorf("can't decode manifest: %w", err)
+	}
+
+	subject, err := json.Marshal(descriptor{MediaType: d.MediaType, Digest: d.Digest, Size: d.Size})
+	if err != nil {
+		return nil, err
+	}
+	m["subject"] = subject
+
+	return json.Marshal(m)
+}
+
+// listReferrers returns the referrers of digest, from the referrers API or,
+// for registries without it, the fallback tag.
+func listReferrers(ctx context.Context, rc *registryClient, repo, digest string) ([]descriptor, error) {
+	referrers, supported, err := referrersAPI(ctx, rc, repo, digest)
+	if err != nil || supported {
+		return referrers, err
+	}
+
+	index, err := fallbackReferrers(ctx, rc, repo, digest)
+	if err != nil {
+		return nil, err
+	}
+	return index.Manifests, nil
+}
+
+// referrersAPI queries the referrers API, reporting false when the registry
+// doesn't have it.
+func referrersAPI(ctx context.Context, rc *registryClient, repo, digest string) ([]descriptor, bool, error) {
+	header := http.Header{"Accept": []string{mediaTypeOCIIndex}}
+	resp, err := rc.do(ctx, http.MethodGet, rc.url("%v/referrers/%v", repo, digest), header, nil)
+	if isNotFound(err) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	defer resp.Body.Close()
+
+	// A registry serving the path as something else doesn't have the API.
+	if !strings.HasPrefix(resp.Header.Get("Content-Type"), mediaTypeOCIIndex) {
+		return nil, false, nil
+	}
+
+	index := manifest{}
+	if err := json.NewDecoder(resp.Body).Decode(&index); err != nil {
+		return nil, false, fmt.Errorf("can't decode referrers: %w", err)
+	}
+	return index.Manifests, true, nil
+}
+
+// fallbackTag is the tag schema for referrers of digest, sha256-<hex>.
+func fallbackTag(digest string) string {
+	return strings.Replace(digest, ":", "-", 1)
+}
+
+// referrersTag matches fallback tags, which follow the image they belong to
+// rather than being images themselves.
+var referrersTag = regexp.MustCompile(`^sha256-[0-9a-f]{64}$`)
+
+func isReferrersTag(tag string) bool {
+	return referrersTag.MatchString(tag)
+}
+
+func fallbackReferrers(ctx context.Context, rc *registryClient, repo, digest string) (manifest, error) {
+	index, _, err := rc.FetchManifest(ctx, repo, fallbackTag(digest))
+	if isNotFound(err) {
+		return manifest{}, nil
+	}
+	return index, err
+}
+
+// addFallbackReferrers adds referrers to the fallback tag of digest.
+func addFallbackReferrers(ctx context.Context, rc *registryClient, repo, digest string, referrers []descriptor) error {
+	index, err := fallbackReferrers(ctx, rc, repo, digest)
+	if err != nil {
+		return fmt.Errorf("can't get referrers tag of %v: %w", digest, err)
+	}
+
+	known := map[string]bool{}
+	for _, d := range index.Manifests {
+		known[d.Digest] = true
+	}
+	changed := false
+	for _, d := range referrers {
+		if !known[d.Digest] {
+			index.Manifests = append(index.Manifests, d)
+			changed = true
+		}
+	}
+	if !changed {
+		return nil
+	}
+
+	data, err := json.Marshal(struct {
+		SchemaVersion int          `json:"schemaVersion"`
+		MediaType     string       `json:"mediaType"`
+		Manifests     []descriptor `json:"manifests"`
+	}{2, mediaTypeOCIIndex, index.Manifests})
+	if err != nil {
+		return err
+	}
+	if err := rc.PutManifest(ctx, repo, fallbackTag(digest), mediaTypeOCIIndex, data); err != nil {
+		return fmt.Errorf("can't push referrers tag of %v: %w", digest, err)
+	}
+	return nil
+}
@@ -0,0 +1,795 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	mediaTypeDockerManifest     = "application/vnd.docker.distribution.manifest.v2+json"
+	mediaTypeDockerManifestList = "application/vnd.docker.distribution.manifest.list.v2+json"
+	mediaTypeOCIManifest        = "application/vnd.oci.image.manifest.v1+json"
+	mediaTypeOCIIndex           = "application/vnd.oci.image.index.v1+json"
+)
+
+var manifestMediaTypes = []string{
+	mediaTypeDockerManifest,
+	mediaTypeDockerManifestList,
+	mediaTypeOCIManifest,
+	mediaTypeOCIIndex,
+}
+
+// descriptor, manifest and imageConfig cover the parts of the image
+// manifest, index and config formats dimco works with.
+type descriptor struct {
+	MediaType string    `json:"mediaType,omitempty"`
+	Digest    string    `json:"digest"`
+	Size      int64     `json:"size"`
+	Platform  *platform `json:"platform,omitempty"`
+	// URLs locate foreign layers outside the registry.
+	URLs []string `json:"urls,omitempty"`
+	// ArtifactType is the type of referrers in a referrers index.
+	ArtifactType string `json:"artifactType,omitempty"`
+
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+type platform struct {
+	Architecture string `json:"architecture"`
+	OS           string `json:"os"`
+	Variant      string `json:"variant,omitempty"`
+}
+
+type manifest struct {
+	SchemaVersion int          `json:"schemaVersion"`
+	MediaType     string       `json:"mediaType,omitempty"`
+	Config        descriptor   `json:"config"`
+	Layers        []descriptor `json:"layers,omitempty"`
+	Manifests     []descriptor `json:"manifests,omitempty"`
+
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+type imageConfig struct {
+	Created time.Time `json:"created"`
+}
+
+// statusError is returned when the registry answers with an unexpected status code.
+type statusError struct {
+	Method     string
+	URL        string
+	StatusCode int
+	Body       string
+	// RetryAfter is the wait the registry asked for before trying again.
+	RetryAfter time.Duration
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("%v %v: unexpected status %v: %v", e.Method, e.URL, e.StatusCode, strings.TrimSpace(e.Body))
+}
+
+// isNotFound reports whether err is a registry 404 response.
+func isNotFound(err error) bool {
+	var se *statusError
+	return errors.As(err, &se) && se.StatusCode == http.StatusNotFound
+}
+
+// registryTransport is shared by the registry clients. A stalled connection
+// fails while dialing, in the TLS handshake or waiting for the response
+// headers; bodies take as long as the layer needs.
+var registryTransport = &http.Transport{
+	Proxy: http.ProxyFromEnvironment,
+	DialContext: (&net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+	}).DialContext,
+	ForceAttemptHTTP2:     true,
+	MaxIdleConns:          100,
+	IdleConnTimeout:       90 * time.Second,
+	TLSHandshakeTimeout:   10 * time.Second,
+	ResponseHeaderTimeout: 5 * time.Minute,
+	ExpectContinueTimeout: time.Second,
+}
+
+// registryClient talks to a registry through the Docker Registry HTTP API V2.
+type registryClient struct {
+	scheme string
+	host   string
+	auth   AuthConfig
+	client *http.Client
+
+	// limiter is shared with every other client of the host.
+	limiter *hostLimiter
+
+	// tokens is shared with the other clients of the host with the same
+	// credentials.
+	tokens *authCache
+}
+
+func newRegistryClient(ac AuthConfig) *registryClient {
+	host := registryHost(ac)
+
+	scheme := "https"
+	if ac.Insecure {
+		scheme = "http"
+	}
+
+	return &registryClient{
+		scheme: scheme,
+		host:   host,
+		auth:   ac,
+		client: &http.Client{Transport: registryTransport},
+
+		limiter: limiterFor(host, ac.RateLimit),
+
+		tokens: authCacheFor(host, ac),
+	}
+}
+
+// registryHost returns the host serving the registry API for ac.
+func registryHost(ac AuthConfig) string {
+	host, _ := splitBaseAddress(ac.BaseAddress)
+	if host == "docker.io" {
+		return "registry-1.docker.io"
+	}
+
+	return host
+}
+
+// splitBaseAddress splits a base address like "registry.local:5000/team" into
+// the registry host and the repository path prefix.
+func splitBaseAddress(base string) (host, path string) {
+	base = strings.TrimPrefix(strings.TrimPrefix(base, "https://"), "http://")
+	base = strings.Trim(base, "/")
+	if i := strings.Index(base, "/"); i >= 0 {
+		return base[:i], base[i+1:]
+	}
+
+	return base, ""
+}
+
+// repositoryPath returns the repository path of an image inside the registry
+// described by ac, without the registry host.
+func repositoryPath(ac AuthConfig, prefix, name string) string {
+	host, path := splitBaseAddress(ac.BaseAddress)
+	repo := prefix + name
+	if path != "" {
+		repo = path + "/" + repo
+	}
+
+	if host == "docker.io" && !strings.Contains(repo, "/") {
+		repo = "library/" + repo
+	}
+
+	return repo
+}
+
+// repoPair is a source repository and the destination repository it is mirrored to.
+type repoPair struct {
+	from, to string
+}
+
+// repositoryPairs returns the distinct repository pairs of the configured images.
+func repositoryPairs(c Config) []repoPair {
+	pairs := []repoPair{}
+	seen := map[repoPair]bool{}
+	for _, img := range c.Images {
+		p := repoPair{
+			from: repositoryPath(c.FromRepo, img.FromPrefix, img.Name),
+			to:   repositoryPath(c.ToRepo, img.ToPrefix, img.destinationName()),
+		}
+		if !seen[p] {
+			seen[p] = true
+			pairs = append(pairs, p)
+		}
+	}
+
+	return pairs
+}
+
+func (r *registryClient) url(format string, args ...interface{}) string {
+	return fmt.Sprintf("%v://%v/v2/", r.scheme, r.host) + fmt.Sprintf(format, args...)
+}
+
+// Ping checks that the registry API is reachable. An authentication
+// challenge counts as reachable.
+func (r *registryClient) Ping(ctx context.Context) error {
+	resp, err := r.send(ctx, http.MethodGet, r.url(""), nil, nil, 0, "")
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusUnauthorized {
+		return fmt.Errorf("unexpected status %v", resp.StatusCode)
+	}
+
+	return nil
+}
+
+// tagPageSize is the page size asked for when listing tags.
+const tagPageSize = 1000
+
+// errStopTags ends EachTag early without an error.
+var errStopTags = errors.New("stop listing tags")
+
+// ListTags returns all tags of the repository.
+func (r *registryClient) ListTags(ctx context.Context, repo string) ([]string, error) {
+	tags := []string{}
+	err := r.EachTag(ctx, repo, func(tag string) error {
+		tags = append(tags, tag)
+		return nil
+	})
+	return tags, err
+}
+
+// EachTag calls fn with every tag of the repository as the pages of the
+// list arrive, following Link headers or, for registries that only honor
+// n and last, asking for the tags after the last one of a full page. fn
+// returning errStopTags ends the listing.
+func (r *registryClient) EachTag(ctx context.Context, repo string, fn func(tag string) error) error {
+	u, prevLast := r.url("%v/tags/list?n=%v", repo, tagPageSize), ""
+	for u != "" {
+		resp, err := r.do(ctx, http.MethodGet, u, nil, nil)
+		if err != nil {
+			return err
+		}
+
+		count, last, err := decodeTags(resp.Body, fn)
+		resp.Body.Close()
+		if err == errStopTags {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		// A registry ignoring last would answer the same page forever.
+		next := nextLink(u, resp.Header.Get("Link"))
+		if next == "" && resp.Header.Get("Link") == "" && count == tagPageSize && last != prevLast {
+			next = r.url("%v/tags/list?n=%v&last=%v", repo, tagPageSize, url.QueryEscape(last))
+		}
+		u, prevLast = next, last
+	}
+
+	return nil
+}
+
+// decodeTags streams the tags of a tag list page to fn and returns how many
+// there were and the last one.
+func decodeTags(body io.Reader, fn func(tag string) error) (int, string, error) {
+	dec := json.NewDecoder(body)
+	if _, err := dec.Token(); err != nil {
+		return 0, "", fmt.Errorf("can't decode tag list: %w", err)
+	}
+
+	count, last := 0, ""
+	for dec.More() {
+		key, err := dec.Token()
+		if err != nil {
+			return count, last, fmt.Errorf("can't decode tag list: %w", err)
+		}
+
+		if key != "tags" {
+			var skip json.RawMessage
+			if err := dec.Decode(&skip); err != nil {
+				return count, last, fmt.Errorf("can't decode tag list: %w", err)
+			}
+			continue
+		}
+
+		// Registries answer null for repositories without tags.
+		t, err := dec.Token()
+		if err != nil {
+			return count, last, fmt.Errorf("can't decode tag list: %w", err)
+		}
+		if t == nil {
+			continue
+		}
+
+		for dec.More() {
+			var tag string
+			if err := dec.Decode(&tag); err != nil {
+				return count, last, fmt.Errorf("can't decode tag list: %w", err)
+			}
+			count, last = count+1, tag
+			if err := fn(tag); err != nil {
+				return count, last, err
+			}
+		}
+		if _, err := dec.Token(); err != nil {
+			return count, last, fmt.Errorf("can't decode tag list: %w", err)
+		}
+	}
+
+	return count, last, nil
+}
+
+// Catalog returns the names of all repositories of the registry, following
+// the Link headers of the paginated list.
+func (r *registryClient) Catalog(ctx context.Context) ([]string, error) {
+	repos := []string{}
+	u := r.url("_catalog?n=1000")
+	for u != "" {
+		resp, err := r.do(ctx, http.MethodGet, u, nil, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		var out struct {
+			Repositories []string `json:"repositories"`
+		}
+		err = json.NewDecoder(resp.Body).Decode(&out)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("can't decode catalog: %w", err)
+		}
+		repos = append(repos, out.Repositories...)
+
+		u = nextLink(u, resp.Header.Get("Link"))
+	}
+
+	return repos, nil
+}
+
+// nextLink resolves the rel="next" target of a Link header against u.
+func nextLink(u, link string) string {
+	if link == "" || !strings.Contains(link, `rel="next"`) {
+		return ""
+	}
+
+	start, end := strings.IndexByte(link, '<'), strings.IndexByte(link, '>')
+	if start < 0 || end < start {
+		return ""
+	}
+
+	base, err := url.Parse(u)
+	if err != nil {
+		return ""
+	}
+	next, err := base.Parse(link[start+1 : end])
+	if err != nil {
+		return ""
+	}
+
+	return next.String()
+}
+
+// ManifestDigest returns the digest of the manifest referenced by ref.
+func (r *registryClient) ManifestDigest(ctx context.Context, repo, ref string) (string, error) {
+	header := http.Header{"Accept": manifestMediaTypes}
+	resp, err := r.do(ctx, http.MethodHead, r.url("%v/manifests/%v", repo, ref), header, nil)
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+
+	digest := resp.Header.Get("Docker-Content-Digest")
+	if digest == "" {
+		return "", fmt.Errorf("registry didn't return digest for '%v:%v'", repo, ref)
+	}
+
+	return digest, nil
+}
+
+// GetManifest returns the raw manifest referenced by ref with its media type and digest.
+func (r *registryClient) GetManifest(ctx context.Context, repo, ref string) ([]byte, string, string, error) {
+	header := http.Header{"Accept": manifestMediaTypes}
+	resp, err := r.do(ctx, http.MethodGet, r.url("%v/manifests/%v", repo, ref), header, nil)
+	if err != nil {
+		return nil, "", "", err
+	}
+	defer resp.Body.Close()
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, "", "", fmt.Errorf("can't read manifest: %w", err)
+	}
+
+	return data, resp.Header.Get("Content-Type"), resp.Header.Get("Docker-Content-Digest"), nil
+}
+
+// FetchManifest returns the decoded manifest referenced by ref and its digest.
+func (r *registryClient) FetchManifest(ctx context.Context, repo, ref string) (manifest, string, error) {
+	data, _, digest, err := r.GetManifest(ctx, repo, ref)
+	if err != nil {
+		return manifest{}, "", err
+	}
+
+	m := manifest{}
+	if err := json.Unmarshal(data, &m); err != nil {
+		return manifest{}, "", fmt.Errorf("can't decode manifest: %w", err)
+	}
+
+	return m, digest, nil
+}
+
+// PutManifest uploads a raw manifest under ref, which is a tag or a digest.
+func (r *registryClient) PutManifest(ctx context.Context, repo, ref, mediaType string, data []byte) error {
+	header := http.Header{"Content-Type": []string{mediaType}}
+	resp, err := r.do(ctx, http.MethodPut, r.url("%v/manifests/%v", repo, ref), header, data)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	return nil
+}
+
+// GetBlob returns the content of a blob. It's meant for small blobs like image configs.
+func (r *registryClient) GetBlob(ctx context.Context, repo, digest string) ([]byte, error) {
+	resp, err := r.do(ctx, http.MethodGet, r.url("%v/blobs/%v", repo, digest), nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("can't read blob: %w", err)
+	}
+
+	return data, nil
+}
+
+// OpenBlob streams the content of a blob and returns its size.
+func (r *registryClient) OpenBlob(ctx context.Context, repo, digest string) (io.ReadCloser, int64, error) {
+	resp, err := r.do(ctx, http.MethodGet, r.url("%v/blobs/%v", repo, digest), nil, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return resp.Body, resp.ContentLength, nil
+}
+
+// OpenBlobAt streams the content of a blob from offset on.
+func (r *registryClient) OpenBlobAt(ctx context.Context, repo, digest string, offset int64) (io.ReadCloser, error) {
+	header := http.Header{"Range": []string{fmt.Sprintf("bytes=%d-", offset)}}
+	resp, err := r.do(ctx, http.MethodGet, r.url("%v/blobs/%v", repo, digest), header, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	// Registries without range requests send the whole blob.
+	if resp.StatusCode != http.StatusPartialContent {
+		if _, err := io.CopyN(ioutil.Discard, resp.Body, offset); err != nil {
+			resp.Body.Close()
+			return nil, fmt.Errorf("can't read blob: %w", err)
+		}
+	}
+
+	return resp.Body, nil
+}
+
+// BlobExists reports whether the repository already has the blob.
+func (r *registryClient) BlobExists(ctx context.Context, repo, digest string) (bool, error) {
+	resp, err := r.do(ctx, http.MethodHead, r.url("%v/blobs/%v", repo, digest), nil, nil)
+	if isNotFound(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	resp.Body.Close()
+
+	return true, nil
+}
+
+// UploadBlob uploads a blob of known digest and size, in chunks when it's
+// larger than the chunk size of the registry and with a monolithic upload
+// otherwise.
+func (r *registryClient) UploadBlob(ctx context.Context, repo, digest string, size int64, content io.Reader) error {
+	return r.uploadBlob(ctx, repo, digest, size, func(offset int64) (io.ReadCloser, error) {
+		// Local content is read up to where a resumed upload continues.
+		if _, err := io.CopyN(ioutil.Discard, content, offset); err != nil {
+			return nil, fmt.Errorf("can't read blob: %w", err)
+		}
+		return ioutil.NopCloser(content), nil
+	})
+}
+
+// uploadBlob uploads the blob open returns from offset on. Chunked uploads
+// continue the upload session of a checkpoint, if there is one, at the
+// offset the registry has.
+func (r *registryClient) uploadBlob(ctx context.Context, repo, digest string, size int64, open func(offset int64) (io.ReadCloser, error)) error {
+	chunk := r.auth.chunkSize()
+	chunked := chunk > 0 && size > chunk
+
+	var location *url.URL
+	var offset int64
+	if chunked {
+		location, offset = r.resumeUpload(ctx, repo, digest, size)
+	}
+
+	if location == nil {
+		resp, err := r.do(ctx, http.MethodPost, r.url("%v/blobs/uploads/", repo), nil, nil)
+		if err != nil {
+			return fmt.Errorf("can't start upload: %w", err)
+		}
+		resp.Body.Close()
+
+		if location, err = r.location(resp); err != nil {
+			return err
+		}
+	}
+
+	content, err := open(offset)
+	if err != nil {
+		return err
+	}
+	defer content.Close()
+
+	if chunked {
+		return r.uploadChunked(ctx, repo, location, digest, content, chunk, offset)
+	}
+
+	q := location.Query()
+	q.Set("digest", digest)
+	location.RawQuery = q.Encode()
+
+	header := http.Header{"Content-Type": []string{"application/octet-stream"}}
+	resp, err := r.doStream(ctx, http.MethodPut, location.String(), header, content, size)
+	if err != nil {
+		return fmt.Errorf("can't upload blob: %w", err)
+	}
+	resp.Body.Close()
+
+	return nil
+}
+
+// location resolves the Location header of an upload response.
+func (r *registryClient) location(resp *http.Response) (*url.URL, error) {
+	loc := resp.Header.Get("Location")
+	if loc == "" {
+		return nil, fmt.Errorf("registry didn't return upload location")
+	}
+
+	u, err := resp.Request.URL.Parse(loc)
+	if err != nil {
+		return nil, fmt.Errorf("invalid upload location '%v': %w", loc, err)
+	}
+
+	return u, nil
+}
+
+// DeleteManifest deletes the manifest and therefore every tag pointing to it.
+func (r *registryClient) DeleteManifest(ctx context.Context, repo, digest string) error {
+	resp, err := r.do(ctx, http.MethodDelete, r.url("%v/manifests/%v", repo, digest), nil, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	return nil
+}
+
+// do sends the request and answers an authentication challenge if the
+// registry returns one. Responses with status >= 300 are turned into errors.
+func (r *registryClient) do(ctx context.Context, method, u string, header http.Header, body []byte) (resp *http.Response, err error) {
+	repo := repositoryFromURL(u)
+
+	ctx, sp := startSpan(ctx, "registry "+method, "http.method", method, "http.url", u)
+	defer func() { sp.End(err) }()
+
+	access := accessOf(method)
+	authorization, err := r.authorization(ctx, repo, access)
+	if err != nil {
+		return nil, fmt.Errorf("can't authorize: %w", err)
+	}
+
+	resp, err = r.sendReplayable(ctx, method, u, header, body, authorization)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode == http.StatusUnauthorized {
+		ch := newAuthChallenge(resp.Header.Get("WWW-Authenticate"), repo, access)
+		resp.Body.Close()
+
+		// A token the registry rejected, revoked or with too little scope,
+		// isn't sent again.
+		if t, ok := r.tokens.token(ch.key(), time.Now()); ok && t.authorization == authorization {
+			r.tokens.forget(ch.key())
+		}
+
+		authorization, err := r.authorize(ctx, ch)
+		if err != nil {
+			return nil, fmt.Errorf("can't authorize: %w", err)
+		}
+
+		resp, err = r.sendReplayable(ctx, method, u, header, body, authorization)
+		if err != nil {
+			return nil, err
+		}
+
+		if resp.StatusCode != http.StatusUnauthorized {
+			r.tokens.setChallenge(repo, access, ch)
+		} else {
+			r.tokens.forget(ch.key())
+		}
+	}
+
+	sp.SetAttribute("http.status_code", strconv.Itoa(resp.StatusCode))
+	return checkStatus(method, u, resp)
+}
+
+// sendReplayable sends a request with a body in memory, sending it again
+// when the registry pauses it with Retry-After.
+func (r *registryClient) sendReplayable(ctx context.Context, method, u string, header http.Header, body []byte, authorization string) (*http.Response, error) {
+	for i := 0; ; i++ {
+		resp, err := r.send(ctx, method, u, header, bytes.NewReader(body), int64(len(body)), authorization)
+		if err != nil {
+			return nil, err
+		}
+
+		if d := throttled(resp); d == 0 || d > maxPause || i == maxThrottledRetries {
+			return resp, nil
+		}
+		resp.Body.Close()
+	}
+}
+
+// doStream sends a request with a body that can't be replayed. It relies on
+// a challenge answered by a previous request to the same repository.
+func (r *registryClient) doStream(ctx context.Context, method, u string, header http.Header, body io.Reader, size int64) (resp *http.Response, err error) {
+	ctx, sp := startSpan(ctx, "registry "+method, "http.method", method, "http.url", u)
+	defer func() { sp.End(err) }()
+
+	authorization, err := r.authorization(ctx, repositoryFromURL(u), accessOf(method))
+	if err != nil {
+		return nil, fmt.Errorf("can't authorize: %w", err)
+	}
+
+	resp, err = r.send(ctx, method, u, header, body, size, authorization)
+	if err != nil {
+		return nil, err
+	}
+
+	sp.SetAttribute("http.status_code", strconv.Itoa(resp.StatusCode))
+	return checkStatus(method, u, resp)
+}
+
+func checkStatus(method, u string, resp *http.Response) (*http.Response, error) {
+	if resp.StatusCode >= 300 {
+		defer resp.Body.Close()
+		data, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+		return nil, &statusError{Method: method, URL: u, StatusCode: resp.StatusCode, Body: string(data),
+			RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After"))}
+	}
+
+	return resp, nil
+}
+
+func (r *registryClient) send(ctx context.Context, method, u string, header http.Header, body io.Reader, size int64, authorization string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, u, body)
+	if err != nil {
+		return nil, fmt.Errorf("can't create request: %w", err)
+	}
+	req.ContentLength = size
+	r.auth.setHeaders(req)
+
+	for k, v := range header {
+		req.Header[k] = v
+	}
+
+	if authorization != "" {
+		req.Header.Set("Authorization", authorization)
+	}
+
+	if tp := traceparent(ctx); tp != "" {
+		req.Header.Set("traceparent", tp)
+	}
+
+	if err := waitPause(ctx, r.host); err != nil {
+		return nil, fmt.Errorf("can't send request: %w", err)
+	}
+
+	release, err := r.limiter.wait(ctx, isBlobDownload(method, u))
+	if err != nil {
+		return nil, fmt.Errorf("can't send request: %w", err)
+	}
+
+	start := time.Now()
+	resp, err := r.client.Do(req)
+	if err != nil {
+		release()
+		tracef("%v %v: %v", method, u, err)
+		return nil, fmt.Errorf("can't send request: %w", err)
+	}
+	tracef("%v %v: %v (%v)", method, u, resp.StatusCode, time.Since(start).Round(time.Millisecond))
+
+	if d := throttled(resp); d > 0 {
+		pauseHost(r.host, d)
+	}
+
+	// The request stays in flight until its body is consumed.
+	resp.Body = releasingBody{ReadCloser: resp.Body, release: release}
+
+	return resp, nil
+}
+
+// isBlobDownload reports whether the request reads a blob, whose body may
+// stay open while the blob is uploaded elsewhere.
+func isBlobDownload(method, u string) bool {
+	return method == http.MethodGet && strings.Contains(u, "/blobs/") && !strings.Contains(u, "/blobs/uploads/")
+}
+
+type releasingBody struct {
+	io.ReadCloser
+	release func()
+}
+
+func (b releasingBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.release()
+	return err
+}
+
+// repositoryFromURL extracts the repository name from a registry API URL.
+func repositoryFromURL(u string) string {
+	parsed, err := url.Parse(u)
+	if err != nil {
+		return ""
+	}
+
+	path := strings.TrimPrefix(parsed.Path, "/v2/")
+	for _, sep := range []string{"/manifests/", "/blobs/", "/tags/", "/referrers/"} {
+		if i := strings.Index(path, sep); i >= 0 {
+			return path[:i]
+		}
+	}
+
+	return path
+}
+
+// parseChallenge parses a WWW-Authenticate header value like
+// `Bearer realm="https://auth.docker.io/token",service="registry.docker.io"`.
+func parseChallenge(challenge string) (string, map[string]string) {
+	params := map[string]string{}
+
+	parts := strings.SplitN(strings.TrimSpace(challenge), " ", 2)
+	if len(parts) < 2 {
+		return parts[0], params
+	}
+
+	rest := parts[1]
+	for rest != "" {
+		eq := strings.Index(rest, "=")
+		if eq < 0 {
+			break
+		}
+
+		key := strings.ToLower(strings.TrimSpace(rest[:eq]))
+		rest = rest[eq+1:]
+
+		var value string
+		if strings.HasPrefix(rest, `"`) {
+			end := strings.Index(rest[1:], `"`)
+			if end < 0 {
+				value, rest = rest[1:], ""
+			} else {
+				value, rest = rest[1:end+1], rest[end+2:]
+			}
+		} else if comma := strings.Index(rest, ","); comma >= 0 {
+			value, rest = rest[:comma], rest[comma:]
+		} else {
+			value, rest = rest, ""
+		}
+
+		params[key] = value
+		rest = strings.TrimLeft(rest, ", ")
+	}
+
+	return parts[0], params
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"runtime"
+	"sync"
+
+	godigest "github.com/opencontainers/go-digest"
+)
+
+// registryEngine copies manifests and blobs from registry to registry without
+// a local image store. Manifests are pushed byte for byte, so indexes with all
+// their platforms and OCI artifacts like Helm charts, WASM modules or ORAS
+// artifacts keep their digests, artifactType and config media types.
+type registryEngine struct {
+	mu     sync.Mutex
+	images map[string]remoteImage
+
+	// nonDistributable copies foreign layers, which are otherwise left at
+	// their urls.
+	nonDistributable bool
+}
+
+// remoteImage is a pulled image: the source it is copied from. The digest is
+// resolved on pull, so a tag moving during the copy doesn't mix content.
+type remoteImage struct {
+	rc     *registryClient
+	repo   string
+	digest string
+}
+
+func newRegistryEngine(nonDistributable bool) *registryEngine {
+	return &registryEngine{images: map[string]remoteImage{}, nonDistributable: nonDistributable}
+}
+
+func (e *registryEngine) Close() error {
+	return nil
+}
+
+func (e *registryEngine) lookup(image string) (remoteImage, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	img, ok := e.images[image]
+	if !ok {
+		return remoteImage{}, fmt.Errorf("image '%v' wasn't pulled", image)
+	}
+	return img, nil
+}
+
+// Pull resolves the source manifest. Blobs are read during the push.
+func (e *registryEngine) Pull(ctx context.Context, image string, ac AuthConfig) error {
+	rc, repo, ref, err := registryForImage(image, ac)
+	if err != nil {
+		return err
+	}
+
+	digest, err := rc.ManifestDigest(ctx, repo, ref)
+	if err != nil {
+		return fmt.Errorf("can't resolve manifest: %w", err)
+	}
+
+	e.mu.Lock()
+	e.images[image] = remoteImage{rc: rc, repo: repo, digest: digest}
+	e.mu.Unlock()
+
+	infof("resolved %v (%v)", image, digest)
+
+	return nil
+}
+
+func (e *registryEngine) Tag(ctx context.Context, fromImg, toImg string) error {
+	img, err := e.lookup(fromImg)
+	if err != nil {
+		return err
+	}
+
+	e.mu.Lock()
+	e.images[toImg] = img
+	e.mu.Unlock()
+
+	return nil
+}
+
+// Push copies the manifest of image with everything it references.
+func (e *registryEngine) Push(ctx context.Context, image string, ac AuthConfig) error {
+	src, err := e.lookup(image)
+	if err != nil {
+		return err
+	}
+
+	rc, repo, tag, err := registryForImage(image, ac)
+	if err != nil {
+		return err
+	}
+
+	reuse := &layerReuse{}
+	pushed, err := e.copyManifest(ctx, src.rc, src.repo, rc, repo, src.digest, tag, reuse)
+	if err != nil {
+		return err
+	}
+
+	infof("pushed %v (%v), %v of %v layers reused", image, pushed.Digest, reuse.reused, reuse.total)
+
+	return nil
+}
+
+// layerReuse counts the layers of a push and those the destination had
+// already.
+type layerReuse struct {
+	total, reused int
+}
+
+// copyManifest copies the manifest ref of fromRepo to toRef of toRepo and
+// returns the descriptor of the pushed manifest. The manifests of an index
+// are copied by digest first, and blobs before the manifest referencing
+// them, as registries require. Only blobs missing at the destination are
+// transferred. Manifests only change when foreign layers are copied.
+func (e *registryEngine) copyManifest(ctx context.Context, src *registryClient, fromRepo string, dst *registryClient, toRepo, ref, toRef string, reuse *layerReuse) (descriptor, error) {
+	data, mediaType, _, err := src.GetManifest(ctx, fromRepo, ref)
+	if err != nil {
+		return descriptor{}, fmt.Errorf("can't get manifest '%v': %w", ref, err)
+	}
+
+	m := manifest{}
+	if err := json.Unmarshal(data, &m); err != nil {
+		return descriptor{}, fmt.Errorf("can't decode manifest '%v': %w", ref, err)
+	}
+	if mediaType == "" {
+		mediaType = m.MediaType
+	}
+
+	children := make([]descriptor, len(m.Manifests))
+	changed := false
+	for i, d := range m.Manifests {
+		pushed, err := e.copyManifest(ctx, src, fromRepo, dst, toRepo, d.Digest, d.Digest, reuse)
+		if err != nil {
+			return descriptor{}, err
+		}
+
+		children[i] = d
+		if pushed.Digest != d.Digest {
+			children[i].Digest, children[i].Size = pushed.Digest, pushed.Size
+			changed = true
+		}
+	}
+	if changed {
+		if data, err = rewriteDescriptors(data, "manifests", children); err != nil {
+			return descriptor{}, err
+		}
+	}
+
+	blobs := m.Layers
+	if m.Config.Digest != "" {
+		blobs = append([]descriptor{m.Config}, blobs...)
+	}
+	for _, d := range blobs {
+		if isForeign(d) && !e.nonDistributable {
+			continue
+		}
+
+		existed, err := copyBlob(ctx, src, fromRepo, dst, toRepo, d)
+		if err != nil {
+			return descriptor{}, fmt.Errorf("can't copy blob '%v': %w", d.Digest, err)
+		}
+		if d.Digest != m.Config.Digest {
+			reuse.total++
+			if existed {
+				reuse.reused++
+			}
+		}
+	}
+	if e.nonDistributable {
+		if data, _, err = distributableManifest(data, m); err != nil {
+			return descriptor{}, err
+		}
+	}
+
+	pushed := descriptor{MediaType: mediaType, Digest: godigest.FromBytes(data).String(), Size: int64(len(data))}
+	if toRef == ref && pushed.Digest != ref {
+		toRef = pushed.Digest
+	}
+	if err := dst.PutManifest(ctx, toRepo, toRef, mediaType, data); err != nil {
+		return descriptor{}, fmt.Errorf("can't push manifest '%v': %w", toRef, err)
+	}
+
+	return pushed, nil
+}
+
+// copyBlob transfers blob d unless the destination has it, which it
+// reports.
+func copyBlob(ctx context.Context, src *registryClient, fromRepo string, dst *registryClient, toRepo string, d descriptor) (bool, error) {
+	exists, err := dst.BlobExists(ctx, toRepo, d.Digest)
+	if err != nil {
+		return false, fmt.Errorf("can't check blob: %w", err)
+	}
+	if exists {
+		progressFrom(ctx).skip(d.Digest, d.Size)
+		return true, nil
+	}
+
+	// A resumed upload only downloads the rest of the layer.
+	return false, dst.uploadBlob(ctx, toRepo, d.Digest, d.Size, func(offset int64) (io.ReadCloser, error) {
+		body, err := openLayerAt(ctx, src, fromRepo, d, offset)
+		if err != nil {
+			return nil, err
+		}
+		return &progressReader{ReadCloser: body, p: progressFrom(ctx), id: d.Digest, total: d.Size, n: offset}, nil
+	})
+}
+
+func (e *registryEngine) Remove(ctx context.Context, image string) error {
+	e.mu.Lock()
+	delete(e.images, image)
+	e.mu.Unlock()
+
+	return nil
+}
+
+// HasDigest is always false, the registry engine resolves the source on
+// every pull.
+func (e *registryEngine) HasDigest(ctx context.Context, image, digest string) (bool, error) {
+	return false, nil
+}
+
+// InUse is always false, nothing runs from the registry engine.
+func (e *registryEngine) InUse(ctx context.Context, image string) (bool, error) {
+	return false, nil
+}
+
+// Layers is always empty, the registry engine keeps no layers.
+func (e *registryEngine) Layers(ctx context.Context, image string) ([]string, error) {
+	return nil, nil
+}
+
+// ImageID returns the config digest, of the current platform for an index.
+func (e *registryEngine) ImageID(ctx context.Context, image string) (string, error) {
+	img, err := e.lookup(image)
+	if err != nil {
+		return "", err
+	}
+
+	m, _, err := img.rc.FetchManifest(ctx, img.repo, img.digest)
+	if err != nil {
+		return "", fmt.Errorf("can't get manifest: %w", err)
+	}
+
+	if len(m.Manifests) > 0 {
+		d, err := selectPlatform(m.Manifests, runtime.GOOS, runtime.GOARCH)
+		if err != nil {
+			d = m.Manifests[0]
+		}
+
+		if m, _, err = img.rc.FetchManifest(ctx, img.repo, d.Digest); err != nil {
+			return "", fmt.Errorf("can't get platform manifest: %w", err)
+		}
+	}
+
+	return m.Config.Digest, nil
+}
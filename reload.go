@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// watchConfig reloads the daemon config on SIGHUP and whenever the config
+// or one of its includes changes. Sources are polled for their version: a
+// content hash for local files, which also catches the symlink swaps
+// Kubernetes does for mounted ConfigMaps, the ETag for HTTP and S3 and the
+// commit for git. Polling is off when every is 0.
+func (d *daemon) watchConfig(ctx context.Context, path string, every time.Duration) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	var tick <-chan time.Time
+	if every > 0 {
+		ticker := time.NewTicker(every)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	last := d.configVersion(ctx)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+			infof("SIGHUP received, reloading config")
+		case <-tick:
+			v := d.configVersion(ctx)
+			if v == "" || v == last {
+				continue
+			}
+			infof("config file changed, reloading config")
+		}
+
+		if err := d.reload(path); err != nil {
+			log.Print(fmt.Errorf("can't reload config, keeping the current one: %w", err))
+		}
+		last = d.configVersion(ctx)
+	}
+}
+
+// configVersion combines the versions of the sources the current config was
+// loaded from, or returns "" when one of them can't be checked. A new include
+// only shows up once a source already included references it.
+func (d *daemon) configVersion(ctx context.Context) string {
+	d.mu.Lock()
+	sources := d.config.sources
+	d.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(ctx, configTimeout)
+	defer cancel()
+
+	versions := make([]string, 0, len(sources))
+	for _, src := range sources {
+		v, err := src.Version(ctx)
+		if err != nil {
+			log.Print(fmt.Errorf("can't check config source '%v': %w", src, err))
+			return ""
+		}
+		versions = append(versions, v)
+	}
+
+	return strings.Join(versions, ",")
+}
+
+// reload validates the config file and applies it to the next sync run,
+// which is started right away. A run in progress keeps the old config.
+func (d *daemon) reload(path string) error {
+	c, err := d.loadConfig(path)
+	if err != nil {
+		return err
+	}
+
+	d.mu.Lock()
+	old := d.config
+	d.config = c
+	d.mu.Unlock()
+
+	added, removed, settings := configDiff(old, c)
+	for _, img := range added {
+		infof("config reloaded: added image %v", img)
+	}
+	for _, img := range removed {
+		infof("config reloaded: removed image %v", img)
+	}
+	if settings {
+		infof("config reloaded: settings changed")
+	}
+	if len(added) == 0 && len(removed) == 0 && !settings {
+		infof("config reloaded: no changes")
+		return nil
+	}
+
+	d.trigger()
+
+	return nil
+}
+
+// configDiff returns the images added and removed between two configs and
+// whether anything besides the image list changed.
+func configDiff(old, c Config) (added, removed []string, settings bool) {
+	oldKeys := map[string]bool{}
+	for _, img := range old.Images {
+		oldKeys[img.key()] = true
+	}
+
+	newKeys := map[string]bool{}
+	for _, img := range c.Images {
+		newKeys[img.key()] = true
+		if !oldKeys[img.key()] {
+			added = append(added, img.key())
+		}
+	}
+
+	for _, img := range old.Images {
+		if !newKeys[img.key()] {
+			removed = append(removed, img.key())
+		}
+	}
+
+	old.Images, c.Images = nil, nil
+	oldSettings, _ := json.Marshal(old)
+	newSettings, _ := json.Marshal(c)
+
+	return added, removed, !bytes.Equal(oldSettings, newSettings)
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Report formats for -report-format.
+const (
+	reportJSON  = "json"
+	reportJUnit = "junit"
+	reportCSV   = "csv"
+)
+
+// Image result statuses.
+const (
+	resultCopied     = "copied"
+	resultFailed     = "failed"
+	resultSkipped    = "skipped"
+	resultRolledBack = "rolled-back"
+)
+
+// imageResult is the outcome of copying one image.
+type imageResult struct {
+	Source      string  `json:"source"`
+	Destination string  `json:"destination"`
+	Status      string  `json:"status"`
+	Digest      string  `json:"digest,omitempty"`
+	Size        int64   `json:"size,omitempty"`
+	Duration    float64 `json:"duration_seconds"`
+	Error       string  `json:"error,omitempty"`
+	ErrorClass  string  `json:"error_class,omitempty"`
+
+	transferStats
+
+	// name and tag are those of the configured or discovered image, for
+	// alert groups.
+	name, tag string
+	// blocked marks images skipped because a dependency wasn't copied, their
+	// own dependents can't start either.
+	blocked bool
+}
+
+// runReport collects the results of a sync run for -report.
+type runReport struct {
+	Started  time.Time     `json:"started"`
+	Duration float64       `json:"duration_seconds"`
+	Images   []imageResult `json:"images"`
+	Stats    *runStats     `json:"stats,omitempty"`
+
+	mu sync.Mutex
+}
+
+func newRunReport() *runReport {
+	return &runReport{Started: time.Now(), Images: []imageResult{}}
+}
+
+func (r *runReport) add(res imageResult) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.Images = append(r.Images, res)
+}
+
+// markRolledBack records that the copied images were rolled back.
+func (r *runReport) markRolledBack() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for i := range r.Images {
+		if r.Images[i].Status == resultCopied {
+			r.Images[i].Status = resultRolledBack
+		}
+	}
+}
+
+func validReportFormat(format string) error {
+	switch format {
+	case reportJSON, reportJUnit, reportCSV:
+		return nil
+	default:
+		return fmt.Errorf("unknown report format '%v'", format)
+	}
+}
+
+// finish records the run duration and orders images by destination, so
+// reports of different runs can be compared.
+func (r *runReport) finish() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.Duration = time.Since(r.Started).Seconds()
+	sort.Slice(r.Images, func(i, j int) bool { return r.Images[i].Destination < r.Images[j].Destination })
+	r.Stats = newRunStats(r.Images)
+}
+
+// write stores the finished report at path.
+func (r *runReport) write(path, format string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	f, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("can't create report: %w", err)
+	}
+
+	switch format {
+	case reportJUnit:
+		err = r.writeJUnit(f)
+	case reportCSV:
+		err = r.writeCSV(f)
+	default:
+		enc := json.NewEncoder(f)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(r)
+	}
+
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return fmt.Errorf("can't write report: %w", err)
+	}
+
+	return nil
+}
+
+// failures counts the failed images. Skipped ones were left out on purpose.
+func (r *runReport) failures() int {
+	n := 0
+	for _, res := range r.Images {
+		if res.Status == resultFailed {
+			n++
+		}
+	}
+	return n
+}
+
+// The junit* types follow the JUnit XML format understood by CI systems.
+type junitSuite struct {
+	XMLName  xml.Name    `xml:"testsuite"`
+	Name     string      `xml:"name,attr"`
+	Tests    int         `xml:"tests,attr"`
+	Failures int         `xml:"failures,attr"`
+	Skipped  int         `xml:"skipped,attr"`
+	Time     string      `xml:"time,attr"`
+	Cases    []junitCase `xml:"testcase"`
+}
+
+type junitCase struct {
+	ClassName string        `xml:"classname,attr"`
+	Name      string        `xml:"name,attr"`
+	Time      string        `xml:"time,attr"`
+	Failure   *junitFailure `xml:"failure,omitempty"`
+	Skipped   *junitSkipped `xml:"skipped,omitempty"`
+}
+
+type junitSkipped struct {
+	Message string `xml:"message,attr"`
+}
+
+type junitFailure struct {
+	Message string `xml:"message,attr"`
+	Type    string `xml:"type,attr,omitempty"`
+	Text    string `xml:",chardata"`
+}
+
+func (r *runReport) writeJUnit(w io.Writer) error {
+	suite := junitSuite{
+		Name:     "dimco sync",
+		Tests:    len(r.Images),
+		Failures: r.failures(),
+		Time:     strconv.FormatFloat(r.Duration, 'f', 3, 64),
+	}
+
+	for _, res := range r.Images {
+		c := junitCase{
+			ClassName: "dimco",
+			Name:      res.Source + " -> " + res.Destination,
+			Time:      strconv.FormatFloat(res.Duration, 'f', 3, 64),
+		}
+		switch res.Status {
+		case resultCopied:
+		case resultSkipped:
+			c.Skipped = &junitSkipped{Message: res.Error}
+			suite.Skipped++
+		default:
+			c.Failure = &junitFailure{Message: res.Status, Type: res.ErrorClass, Text: res.Error}
+		}
+		suite.Cases = append(suite.Cases, c)
+	}
+
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	return enc.Encode(suite)
+}
+
+func (r *runReport) writeCSV(w io.Writer) error {
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"source", "destination", "status", "digest", "size", "duration_seconds", "error", "error_class"})
+
+	for _, res := range r.Images {
+		cw.Write([]string{
+			res.Source,
+			res.Destination,
+			res.Status,
+			res.Digest,
+			strconv.FormatInt(res.Size, 10),
+			strconv.FormatFloat(res.Duration, 'f', 3, 64),
+			res.Error,
+			res.ErrorClass,
+		})
+	}
+
+	cw.Flush()
+	return cw.Error()
+}
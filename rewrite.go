@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+)
+
+// RewriteRule maps source repository paths, relative to from_repo, to
+// destination paths, relative to to_repo, e.g. ^vendor/(.*) to
+// mirror/vendor/$1. Replace expands the submatches of Match like
+// regexp.Regexp.ReplaceAllString.
+type RewriteRule struct {
+	Match   string `json:"match"`
+	Replace string `json:"replace"`
+}
+
+func (c Config) validateRewrites() error {
+	for i, r := range c.Rewrite {
+		if r.Match == "" || r.Replace == "" {
+			return fmt.Errorf("rewrite[%v]: match and replace are required", i)
+		}
+		if _, err := regexp.Compile(r.Match); err != nil {
+			return fmt.Errorf("rewrite[%v]: invalid match: %w", i, err)
+		}
+	}
+	return nil
+}
+
+// withDestinations sets the destinations of images that don't set one: the
+// path of the first matching rewrite rule, or the to_prefix of the group. It
+// runs before destinations are compared for duplicates.
+func (c Config) withDestinations(images []ImageData) []ImageData {
+	for i := range images {
+		images[i] = c.rewritten(images[i])
+	}
+	return c.withGroupPrefixes(images)
+}
+
+// rewritten returns img with the destination of the first rewrite rule
+// matching its source path, unchanged when it has a to_prefix or to_name.
+func (c Config) rewritten(img ImageData) ImageData {
+	if img.ToPrefix != "" || img.ToName != "" {
+		return img
+	}
+
+	src := img.FromPrefix + img.normalized().Name
+	for _, r := range c.Rewrite {
+		re, err := regexp.Compile(r.Match)
+		if err != nil {
+			// validateRewrites reports it.
+			continue
+		}
+		if re.MatchString(src) {
+			img.ToName = re.ReplaceAllString(src, r.Replace)
+			debugf("rewrote %v to %v", src, img.ToName)
+			return img
+		}
+	}
+	return img
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sync"
+
+	godigest "github.com/opencontainers/go-digest"
+)
+
+// pushEntry is a destination tag pushed during the run together with the
+// manifest it pointed to before.
+type pushEntry struct {
+	Repo      string
+	Tag       string
+	Digest    string
+	Prior     []byte
+	PriorType string
+}
+
+// snapshotTag captures the current manifest of the destination tag, if any.
+func snapshotTag(ctx context.Context, dst *registryClient, repo, tag string) (pushEntry, error) {
+	e := pushEntry{Repo: repo, Tag: tag}
+
+	data, mediaType, _, err := dst.GetManifest(ctx, repo, tag)
+	if isNotFound(err) {
+		return e, nil
+	}
+	if err != nil {
+		return e, fmt.Errorf("can't snapshot destination tag: %w", err)
+	}
+
+	e.Prior, e.PriorType = data, mediaType
+	return e, nil
+}
+
+// pushJournal records the destination tags pushed during an atomic run.
+type pushJournal struct {
+	mu      sync.Mutex
+	entries []pushEntry
+}
+
+// add resolves the digest the tag points to after the push and records it.
+func (j *pushJournal) add(ctx context.Context, dst *registryClient, e pushEntry) error {
+	digest, err := dst.ManifestDigest(ctx, e.Repo, e.Tag)
+	if err != nil {
+		return err
+	}
+	e.Digest = digest
+	j.record(e)
+
+	return nil
+}
+
+// record adds e as is, e.g. for a tag deleted during the run, which is put
+// back to its prior manifest on rollback.
+func (j *pushJournal) record(e pushEntry) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.entries = append(j.entries, e)
+}
+
+func (j *pushJournal) len() int {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return len(j.entries)
+}
+
+// rollback restores every recorded tag to its prior manifest, or deletes
+// the pushed manifest when the tag didn't exist before the run. Deleting a
+// manifest removes every tag pointing to it, so manifests that tags outside
+// the journal still point to are kept, and each is deleted once. A manifest
+// that is gone already counts as rolled back.
+func (j *pushJournal) rollback(ctx context.Context, dst *registryClient) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	kept := map[string]map[string]string{}
+	deleted := map[string]bool{}
+	failed := 0
+	for i := len(j.entries) - 1; i >= 0; i-- {
+		e := j.entries[i]
+
+		var err error
+		switch {
+		case e.Prior != nil:
+			err = dst.PutManifest(ctx, e.Repo, e.Tag, e.PriorType, e.Prior)
+		case deleted[e.Repo+"@"+e.Digest]:
+			// The tag went with the manifest of an earlier entry.
+		default:
+			if kept[e.Repo] == nil {
+				if kept[e.Repo], err = j.keptDigests(ctx, dst, e.Repo); err != nil {
+					break
+				}
+			}
+			if tag, ok := kept[e.Repo][e.Digest]; ok {
+				log.Printf("%v:%v stays, %v:%v points to %v too", e.Repo, e.Tag, e.Repo, tag, e.Digest)
+				continue
+			}
+			err = dst.DeleteManifest(ctx, e.Repo, e.Digest)
+			if isNotFound(err) {
+				err = nil
+			}
+			deleted[e.Repo+"@"+e.Digest] = true
+		}
+
+		if err != nil {
+			log.Print(fmt.Errorf("can't roll back '%v:%v': %w", e.Repo, e.Tag, err))
+			failed++
+			continue
+		}
+
+		if e.Prior != nil {
+			recordAudit(auditRestore, qualifiedReference(dst.host, e.Repo, e.Tag), godigest.FromBytes(e.Prior).String())
+		} else {
+			recordAudit(auditDelete, qualifiedReference(dst.host, e.Repo, e.Tag), e.Digest)
+		}
+		infof("rolled back %v:%v", e.Repo, e.Tag)
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%v tags weren't rolled back", failed)
+	}
+
+	return nil
+}
+
+// keptDigests returns the manifests of repo that stay after the rollback,
+// each with a tag pointing to it: those of tags outside the journal and the
+// prior manifests of journaled tags, with the platforms of indexes among
+// them.
+func (j *pushJournal) keptDigests(ctx context.Context, dst *registryClient, repo string) (map[string]string, error) {
+	kept := map[string]string{}
+	keep := func(tag, digest string, m manifest) {
+		kept[digest] = tag
+		for _, d := range m.Manifests {
+			kept[d.Digest] = tag
+		}
+	}
+
+	// The earliest entry of a tag has the manifest from before the run.
+	journaled := map[string]bool{}
+	for _, e := range j.entries {
+		if e.Repo != repo || journaled[e.Tag] {
+			continue
+		}
+		journaled[e.Tag] = true
+		if e.Prior != nil {
+			m := manifest{}
+			json.Unmarshal(e.Prior, &m)
+			keep(e.Tag, godigest.FromBytes(e.Prior).String(), m)
+		}
+	}
+
+	tags, err := dst.ListTags(ctx, repo)
+	if err != nil {
+		return nil, fmt.Errorf("can't list tags: %w", err)
+	}
+	for _, tag := range tags {
+		if journaled[tag] || isReferrersTag(tag) {
+			continue
+		}
+		m, digest, err := dst.FetchManifest(ctx, repo, tag)
+		if err != nil {
+			return nil, fmt.Errorf("can't resolve '%v:%v': %w", repo, tag, err)
+		}
+		keep(tag, digest, m)
+	}
+
+	return kept, nil
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// runPlan orders the images of a run: an image starts after the images of
+// the next higher priority and the images it depends on have finished.
+// Images whose dependencies failed are skipped, those of images skipped on
+// purpose start.
+type runPlan struct {
+	images  []ImageData
+	after   [][]int
+	deps    [][]int
+	done    []chan struct{}
+	mu      sync.Mutex
+	passed  []bool
+	settled []bool
+}
+
+func newRunPlan(c Config) (*runPlan, error) {
+	deps, err := c.dependencies()
+	if err != nil {
+		return nil, err
+	}
+
+	p := &runPlan{
+		images:  c.Images,
+		deps:    deps,
+		after:   make([][]int, len(c.Images)),
+		done:    make([]chan struct{}, len(c.Images)),
+		passed:  make([]bool, len(c.Images)),
+		settled: make([]bool, len(c.Images)),
+	}
+
+	levels := map[int][]int{}
+	priorities := []int{}
+	for i, img := range c.Images {
+		if _, ok := levels[img.Priority]; !ok {
+			priorities = append(priorities, img.Priority)
+		}
+		levels[img.Priority] = append(levels[img.Priority], i)
+		p.done[i] = make(chan struct{})
+	}
+
+	// Waiting for the next higher level is enough, it waited for the rest.
+	sort.Sort(sort.Reverse(sort.IntSlice(priorities)))
+	for k := 1; k < len(priorities); k++ {
+		for _, i := range levels[priorities[k]] {
+			p.after[i] = levels[priorities[k-1]]
+		}
+	}
+
+	return p, nil
+}
+
+// wait blocks until image i may start. It returns an error when ctx is
+// done or a dependency failed.
+func (p *runPlan) wait(ctx context.Context, i int) error {
+	for _, j := range append(p.after[i], p.deps[i]...) {
+		select {
+		case <-p.done[j]:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, j := range p.deps[i] {
+		if !p.passed[j] {
+			img := p.images[j]
+			return fmt.Errorf("dependency %v%v:%v wasn't copied", img.ToPrefix, img.destinationName(), img.Tag)
+		}
+	}
+
+	return nil
+}
+
+// finish records the outcome of image i, passed when its dependents may
+// start. Retried images finish again.
+func (p *runPlan) finish(i int, passed bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.passed[i] = passed
+	if !p.settled[i] {
+		p.settled[i] = true
+		close(p.done[i])
+	}
+}
+
+// dependencies resolves depends_on of every image to the indexes of the
+// images it names. An entry matches name, name:tag or the destination
+// path with prefix, so one entry may cover several tags.
+func (c Config) dependencies() ([][]int, error) {
+	deps := make([][]int, len(c.Images))
+
+	for i, img := range c.Images {
+		for _, want := range img.DependsOn {
+			found := false
+			for j, other := range c.Images {
+				if j == i || !other.matches(want) {
+					continue
+				}
+				if other.Priority < img.Priority {
+					return nil, fmt.Errorf("images[%v] (%v): depends on %v, which has a lower priority", i, img.Name, want)
+				}
+				deps[i] = append(deps[i], j)
+				found = true
+			}
+
+			if !found {
+				return nil, fmt.Errorf("images[%v] (%v): depends on unknown image %v", i, img.Name, want)
+			}
+		}
+	}
+
+	// Depth-first search for cycles: 1 is on the current path, 2 is done.
+	state := make([]int, len(c.Images))
+	var visit func(i int) error
+	visit = func(i int) error {
+		switch state[i] {
+		case 1:
+			return fmt.Errorf("images[%v] (%v): dependency cycle", i, c.Images[i].Name)
+		case 2:
+			return nil
+		}
+
+		state[i] = 1
+		for _, j := range deps[i] {
+			if err := visit(j); err != nil {
+				return err
+			}
+		}
+		state[i] = 2
+
+		return nil
+	}
+	for i := range c.Images {
+		if err := visit(i); err != nil {
+			return nil, err
+		}
+	}
+
+	return deps, nil
+}
+
+func (img ImageData) matches(ref string) bool {
+	return ref == img.Name ||
+		ref == img.Name+":"+img.Tag ||
+		ref == img.ToPrefix+img.destinationName() ||
+		ref == img.destinationKey()
+}
@@ -0,0 +1,433 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Release channels of self-update.
+const (
+	channelStable = "stable"
+	channelEdge   = "edge"
+)
+
+const (
+	defaultReleaseRepo = "SealTV/dimco"
+	releaseChecksums   = "checksums.txt"
+	updateTimeout      = 10 * time.Minute
+)
+
+// releaseKey is the base64 encoded PEM of the public key release checksums
+// are signed with, set with -ldflags "-X main.releaseKey=...".
+var releaseKey = ""
+
+func newSelfUpdateCommand() *command {
+	fs := flag.NewFlagSet("self-update", flag.ExitOnError)
+	channel := fs.String("channel", channelStable, "release channel: stable, or edge for pre-releases")
+	repo := fs.String("repo", defaultReleaseRepo, "GitHub repository of the releases")
+	keyPath := fs.String("key", "", "public key of the release signature (default: the key built into dimco)")
+	skipSignature := fs.Bool("skip-signature", false, "only verify the checksum when no release key is known")
+	check := fs.Bool("check", false, "only report whether an update is available")
+	force := fs.Bool("force", false, "install the release even if it isn't newer")
+
+	return &command{
+		name:  "self-update",
+		usage: "replace dimco with the latest GitHub release of its channel",
+		flags: fs,
+		run: func(ctx context.Context) error {
+			if *channel != channelStable && *channel != channelEdge {
+				return fmt.Errorf("unknown channel '%v', use stable or edge", *channel)
+			}
+
+			ctx, cancel := context.WithTimeout(ctx, updateTimeout)
+			defer cancel()
+
+			rel, err := latestRelease(ctx, *repo, *channel)
+			if err != nil {
+				return err
+			}
+
+			current := currentBuild().Version
+			newer := newerVersion(rel.TagName, current)
+			if !newer && (*check || !*force) {
+				log.Printf("dimco %v is up to date, the latest %v release is %v", current, *channel, rel.TagName)
+				return nil
+			}
+			if *check {
+				log.Printf("dimco %v is available, running %v", rel.TagName, current)
+				return nil
+			}
+
+			// Only installing needs the key, -check reads nothing signed.
+			key, err := releasePublicKey(*keyPath)
+			if err != nil {
+				return err
+			}
+			if key == nil && !*skipSignature {
+				return fmt.Errorf("no release key is built in, pass -key or -skip-signature")
+			}
+
+			return installRelease(ctx, rel, key)
+		},
+	}
+}
+
+// githubRelease is the part of a GitHub release self-update needs.
+type githubRelease struct {
+	TagName    string `json:"tag_name"`
+	Draft      bool   `json:"draft"`
+	Prerelease bool   `json:"prerelease"`
+	Assets     []struct {
+		Name string `json:"name"`
+		URL  string `json:"browser_download_url"`
+	} `json:"assets"`
+}
+
+func (r githubRelease) asset(name string) (string, bool) {
+	for _, a := range r.Assets {
+		if a.Name == name {
+			return a.URL, true
+		}
+	}
+	return "", false
+}
+
+// latestRelease returns the newest release of repo, the stable channel
+// leaves out pre-releases. GITHUB_TOKEN raises the API rate limit.
+func latestRelease(ctx context.Context, repo, channel string) (githubRelease, error) {
+	api := os.Getenv("GITHUB_API_URL")
+	if api == "" {
+		api = "https://api.github.com"
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf("%v/repos/%v/releases?per_page=30", strings.TrimRight(api, "/"), repo), nil)
+	if err != nil {
+		return githubRelease{}, fmt.Errorf("can't create request: %w", err)
+	}
+	req.Header.Set("Accept", "application/vnd.github+json")
+	if token := os.Getenv("GITHUB_TOKEN"); token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	releases := []githubRelease{}
+	if err := doJSON(req, &releases); err != nil {
+		return githubRelease{}, fmt.Errorf("can't list releases of %v: %w", repo, err)
+	}
+
+	var latest *githubRelease
+	for i, r := range releases {
+		if r.Draft || (r.Prerelease && channel == channelStable) {
+			continue
+		}
+		if latest == nil || newerVersion(r.TagName, latest.TagName) {
+			latest = &releases[i]
+		}
+	}
+	if latest == nil {
+		return githubRelease{}, fmt.Errorf("%v has no %v release", repo, channel)
+	}
+
+	return *latest, nil
+}
+
+// releaseAssetName is the binary of this platform in a release.
+func releaseAssetName() string {
+	name := fmt.Sprintf("dimco_%v_%v", runtime.GOOS, runtime.GOARCH)
+	if runtime.GOOS == "windows" {
+		name += ".exe"
+	}
+	return name
+}
+
+// installRelease downloads the binary of rel, checks it against the signed
+// checksums and replaces the running executable.
+func installRelease(ctx context.Context, rel githubRelease, key *ecdsa.PublicKey) error {
+	name := releaseAssetName()
+	binURL, ok := rel.asset(name)
+	if !ok {
+		return fmt.Errorf("release %v has no binary for %v/%v", rel.TagName, runtime.GOOS, runtime.GOARCH)
+	}
+	sumsURL, ok := rel.asset(releaseChecksums)
+	if !ok {
+		return fmt.Errorf("release %v has no %v", rel.TagName, releaseChecksums)
+	}
+
+	sums, err := download(ctx, sumsURL)
+	if err != nil {
+		return err
+	}
+
+	if key != nil {
+		sigURL, ok := rel.asset(releaseChecksums + ".sig")
+		if !ok {
+			return fmt.Errorf("release %v has no %v.sig", rel.TagName, releaseChecksums)
+		}
+		sig, err := download(ctx, sigURL)
+		if err != nil {
+			return err
+		}
+		if err := verifyBlobSignature(key, sums, sig); err != nil {
+			return fmt.Errorf("can't verify %v of %v: %w", releaseChecksums, rel.TagName, err)
+		}
+		debugf("verified the signature of %v", releaseChecksums)
+	} else {
+		log.Printf("skipping the signature check of release %v", rel.TagName)
+	}
+
+	want, err := checksumOf(sums, name)
+	if err != nil {
+		return err
+	}
+
+	bin, err := download(ctx, binURL)
+	if err != nil {
+		return err
+	}
+	if sum := sha256.Sum256(bin); hex.EncodeToString(sum[:]) != want {
+		return fmt.Errorf("checksum of %v doesn't match %v", name, releaseChecksums)
+	}
+
+	exe, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("can't find the running executable: %w", err)
+	}
+	if exe, err = filepath.EvalSymlinks(exe); err != nil {
+		return fmt.Errorf("can't resolve the running executable: %w", err)
+	}
+
+	if err := replaceExecutable(exe, bin); err != nil {
+		return fmt.Errorf("can't replace %v: %w", exe, err)
+	}
+
+	log.Printf("updated %v to dimco %v", exe, rel.TagName)
+
+	return nil
+}
+
+// replaceExecutable writes the new binary next to exe and renames it over
+// exe. Windows can't replace a running executable, so it's moved aside.
+func replaceExecutable(exe string, bin []byte) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(exe), ".dimco-update-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(bin); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	mode := os.FileMode(0755)
+	if fi, err := os.Stat(exe); err == nil {
+		mode = fi.Mode().Perm()
+	}
+	if err := os.Chmod(tmp.Name(), mode); err != nil {
+		return err
+	}
+
+	if runtime.GOOS == "windows" {
+		old := exe + ".old"
+		os.Remove(old)
+		if err := os.Rename(exe, old); err != nil {
+			return err
+		}
+	}
+
+	return os.Rename(tmp.Name(), exe)
+}
+
+func download(ctx context.Context, u string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, fmt.Errorf("can't create request: %w", err)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("can't download %v: %w", u, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("GET %v: unexpected status %v", u, resp.StatusCode)
+	}
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("can't download %v: %w", u, err)
+	}
+	return data, nil
+}
+
+// checksumOf finds the SHA-256 of name in sha256sum output.
+func checksumOf(sums []byte, name string) (string, error) {
+	for _, line := range strings.Split(string(sums), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 2 && strings.TrimPrefix(fields[1], "*") == name {
+			return strings.ToLower(fields[0]), nil
+		}
+	}
+	return "", fmt.Errorf("%v has no checksum of %v", releaseChecksums, name)
+}
+
+// releasePublicKey reads the ECDSA key of path, or the built-in one.
+func releasePublicKey(path string) (*ecdsa.PublicKey, error) {
+	var data []byte
+	switch {
+	case path != "":
+		d, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("can't read release key: %w", err)
+		}
+		data = d
+	case releaseKey != "":
+		d, err := base64.StdEncoding.DecodeString(releaseKey)
+		if err != nil {
+			return nil, fmt.Errorf("invalid built-in release key: %w", err)
+		}
+		data = d
+	default:
+		return nil, nil
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("release key isn't PEM encoded")
+	}
+	pub, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("can't parse release key: %w", err)
+	}
+	key, ok := pub.(*ecdsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("release key isn't an ECDSA key")
+	}
+
+	return key, nil
+}
+
+// verifyBlobSignature checks a signature made by `cosign sign-blob --key`:
+// the base64 encoded ASN.1 ECDSA signature of the SHA-256 of data.
+func verifyBlobSignature(key *ecdsa.PublicKey, data, sig []byte) error {
+	raw, err := base64.StdEncoding.DecodeString(string(bytes.TrimSpace(sig)))
+	if err != nil {
+		return fmt.Errorf("invalid signature encoding: %w", err)
+	}
+
+	digest := sha256.Sum256(data)
+	if !ecdsa.VerifyASN1(key, digest[:], raw) {
+		return fmt.Errorf("invalid signature")
+	}
+	return nil
+}
+
+// newerVersion reports whether semantic version a is newer than b. Versions
+// that aren't semantic, like dev builds, are older than any release.
+func newerVersion(a, b string) bool {
+	va, okA := parseSemver(a)
+	vb, okB := parseSemver(b)
+	switch {
+	case !okA:
+		return false
+	case !okB:
+		return true
+	}
+
+	for i := 0; i < 3; i++ {
+		if va.core[i] != vb.core[i] {
+			return va.core[i] > vb.core[i]
+		}
+	}
+
+	// A release is newer than its pre-releases.
+	switch {
+	case va.pre == vb.pre:
+		return false
+	case va.pre == "":
+		return true
+	case vb.pre == "":
+		return false
+	}
+	return comparePrerelease(va.pre, vb.pre) > 0
+}
+
+type semver struct {
+	core [3]int
+	pre  string
+}
+
+func parseSemver(v string) (semver, bool) {
+	v = strings.TrimPrefix(v, "v")
+	if i := strings.IndexByte(v, '+'); i >= 0 {
+		v = v[:i]
+	}
+
+	s := semver{}
+	if i := strings.IndexByte(v, '-'); i >= 0 {
+		v, s.pre = v[:i], v[i+1:]
+	}
+
+	parts := strings.Split(v, ".")
+	if len(parts) != 3 {
+		return semver{}, false
+	}
+	for i, p := range parts {
+		n, err := strconv.Atoi(p)
+		if err != nil || n < 0 {
+			return semver{}, false
+		}
+		s.core[i] = n
+	}
+
+	return s, true
+}
+
+// comparePrerelease orders pre-release identifiers like rc.1 < rc.2 <
+// rc.10 as semantic versioning does.
+func comparePrerelease(a, b string) int {
+	pa, pb := strings.Split(a, "."), strings.Split(b, ".")
+	for i := 0; i < len(pa) && i < len(pb); i++ {
+		na, errA := strconv.Atoi(pa[i])
+		nb, errB := strconv.Atoi(pb[i])
+		switch {
+		case errA == nil && errB == nil:
+			if na != nb {
+				if na > nb {
+					return 1
+				}
+				return -1
+			}
+		case errA == nil:
+			return -1
+		case errB == nil:
+			return 1
+		default:
+			if c := strings.Compare(pa[i], pb[i]); c != 0 {
+				return c
+			}
+		}
+	}
+
+	return len(pa) - len(pb)
+}
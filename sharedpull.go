@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"sync"
+)
+
+// pullGroup shares the pull of a source image between the copies of a run
+// that push it to different destinations. The first copy pulls, the others
+// wait for it, and the image is removed when the last of them is done.
+type pullGroup struct {
+	mu    sync.Mutex
+	pulls map[string]*sharedPull
+}
+
+type sharedPull struct {
+	done chan struct{}
+	err  error
+
+	// users are the copies that still need the image, remove is set when
+	// any of them cleans the source up.
+	users  int
+	remove bool
+}
+
+// acquire pulls image with pull unless another copy does already, and
+// waits until it is in the engine. release must be called once the copy
+// doesn't need the image anymore; it reports whether the caller, as the
+// last user, should remove it.
+func (g *pullGroup) acquire(ctx context.Context, image string, pull func() error) (release func(remove bool) bool, err error) {
+	g.mu.Lock()
+	if g.pulls == nil {
+		g.pulls = map[string]*sharedPull{}
+	}
+	sp, shared := g.pulls[image]
+	if !shared {
+		sp = &sharedPull{done: make(chan struct{})}
+		g.pulls[image] = sp
+	}
+	sp.users++
+	g.mu.Unlock()
+
+	release = func(remove bool) bool {
+		g.mu.Lock()
+		defer g.mu.Unlock()
+
+		sp.users--
+		sp.remove = sp.remove || remove
+		if sp.users > 0 {
+			return false
+		}
+		if g.pulls[image] == sp {
+			delete(g.pulls, image)
+		}
+		return sp.remove
+	}
+
+	if shared {
+		select {
+		case <-sp.done:
+		case <-ctx.Done():
+			release(false)
+			return nil, ctx.Err()
+		}
+		if sp.err == nil {
+			debugf("%v was pulled for another destination, sharing it", image)
+		}
+	} else {
+		sp.err = pull()
+		if sp.err != nil {
+			// Copies starting later pull again.
+			g.mu.Lock()
+			if g.pulls[image] == sp {
+				delete(g.pulls, image)
+			}
+			g.mu.Unlock()
+		}
+		close(sp.done)
+	}
+
+	if sp.err != nil {
+		release(false)
+		return nil, sp.err
+	}
+	return release, nil
+}
@@ -0,0 +1,389 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// configSource is a place config documents are read from: a local file, an
+// HTTP(S) URL, an S3 object or a file in a git repository.
+type configSource interface {
+	// Read returns the document and a version identifying its content.
+	Read(ctx context.Context) ([]byte, string, error)
+	// Version returns the current version without necessarily fetching the document.
+	Version(ctx context.Context) (string, error)
+	// Include resolves an include pattern relative to the source.
+	Include(pattern string) ([]configSource, error)
+	String() string
+}
+
+// openSource parses a config location:
+//
+//	config.json
+//	https://config-server/internal/dimco.json
+//	s3://bucket/path/dimco.json
+//	git+https://git.example.com/infra/mirrors.git//dimco.json?ref=main
+//	configmap://dimco?key=config.json
+//
+// HTTP sources send DIMCO_CONFIG_TOKEN as a bearer token or the user info of
+// the URL as basic auth. S3 sources use the AWS_* environment variables and git
+// sources rely on the git client's own credential handling.
+func openSource(location string) (configSource, error) {
+	switch {
+	case strings.HasPrefix(location, "http://"), strings.HasPrefix(location, "https://"):
+		u, err := url.Parse(location)
+		if err != nil {
+			return nil, fmt.Errorf("invalid config url '%v': %w", location, err)
+		}
+		return &httpSource{url: u}, nil
+	case strings.HasPrefix(location, "s3://"):
+		u, err := url.Parse(location)
+		if err != nil {
+			return nil, fmt.Errorf("invalid config url '%v': %w", location, err)
+		}
+		return &s3Source{bucket: u.Host, key: strings.TrimPrefix(u.Path, "/")}, nil
+	case strings.HasPrefix(location, "git+"):
+		return parseGitSource(location)
+	case strings.HasPrefix(location, "configmap://"):
+		return parseKubeSource(location)
+	default:
+		return fileSource(location), nil
+	}
+}
+
+func contentVersion(data []byte) string {
+	h := sha256.Sum256(data)
+	return hex.EncodeToString(h[:])
+}
+
+// fileSource is a local config file.
+type fileSource string
+
+func (f fileSource) String() string { return string(f) }
+
+func (f fileSource) Read(ctx context.Context) ([]byte, string, error) {
+	data, err := ioutil.ReadFile(string(f))
+	if err != nil {
+		return nil, "", err
+	}
+
+	return data, contentVersion(data), nil
+}
+
+func (f fileSource) Version(ctx context.Context) (string, error) {
+	_, version, err := f.Read(ctx)
+	return version, err
+}
+
+func (f fileSource) Include(pattern string) ([]configSource, error) {
+	if !filepath.IsAbs(pattern) {
+		pattern = filepath.Join(filepath.Dir(string(f)), pattern)
+	}
+
+	matches, err := filepath.Glob(pattern)
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(matches)
+
+	out := make([]configSource, 0, len(matches))
+	for _, m := range matches {
+		out = append(out, fileSource(m))
+	}
+
+	return out, nil
+}
+
+// httpSource is a config served over HTTP(S). The ETag is used as version.
+type httpSource struct {
+	url *url.URL
+}
+
+func (s *httpSource) String() string {
+	u := *s.url
+	u.User = nil
+	return u.String()
+}
+
+func (s *httpSource) request(ctx context.Context, method string) (*http.Response, error) {
+	u := *s.url
+	u.User = nil
+
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), nil)
+	if err != nil {
+		return nil, fmt.Errorf("can't create request: %w", err)
+	}
+
+	if token := os.Getenv("DIMCO_CONFIG_TOKEN"); token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	} else if s.url.User != nil {
+		password, _ := s.url.User.Password()
+		req.SetBasicAuth(s.url.User.Username(), password)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("can't fetch '%v': %w", s, err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("can't fetch '%v': unexpected status %v", s, resp.StatusCode)
+	}
+
+	return resp, nil
+}
+
+func (s *httpSource) Read(ctx context.Context) ([]byte, string, error) {
+	resp, err := s.request(ctx, http.MethodGet)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, "", fmt.Errorf("can't read '%v': %w", s, err)
+	}
+
+	if etag := resp.Header.Get("ETag"); etag != "" {
+		return data, etag, nil
+	}
+
+	return data, contentVersion(data), nil
+}
+
+func (s *httpSource) Version(ctx context.Context) (string, error) {
+	resp, err := s.request(ctx, http.MethodHead)
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+
+	if etag := resp.Header.Get("ETag"); etag != "" {
+		return etag, nil
+	}
+
+	// Without an ETag the content itself is the only version there is.
+	_, version, err := s.Read(ctx)
+	return version, err
+}
+
+func (s *httpSource) Include(pattern string) ([]configSource, error) {
+	if strings.ContainsAny(pattern, "*?[") {
+		return nil, fmt.Errorf("glob patterns are only supported for local files")
+	}
+
+	ref, err := url.Parse(pattern)
+	if err != nil {
+		return nil, err
+	}
+
+	u := s.url.ResolveReference(ref)
+	u.User = s.url.User
+	return []configSource{&httpSource{url: u}}, nil
+}
+
+// s3Source is a config stored as an S3 object. AWS_ENDPOINT_URL_S3 selects an
+// S3 compatible store, which is then addressed path-style.
+type s3Source struct {
+	bucket string
+	key    string
+}
+
+func (s *s3Source) String() string { return "s3://" + s.bucket + "/" + s.key }
+
+func (s *s3Source) request(ctx context.Context, method string) (*http.Response, error) {
+	region := awsRegion()
+
+	// Object keys keep their slashes, every segment is escaped on its own.
+	segments := strings.Split(s.key, "/")
+	for i, seg := range segments {
+		segments[i] = url.PathEscape(seg)
+	}
+	escapedKey := strings.Join(segments, "/")
+
+	var u string
+	if endpoint := os.Getenv("AWS_ENDPOINT_URL_S3"); endpoint != "" {
+		u = strings.TrimRight(endpoint, "/") + "/" + s.bucket + "/" + escapedKey
+	} else {
+		u = fmt.Sprintf("https://%v.s3.%v.amazonaws.com/%v", s.bucket, region, escapedKey)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, u, nil)
+	if err != nil {
+		return nil, fmt.Errorf("can't create request: %w", err)
+	}
+
+	creds, err := awsCredentialsFromEnv()
+	if err != nil {
+		return nil, fmt.Errorf("can't sign request for '%v': %w", s, err)
+	}
+
+	if err := signAWS(req, creds, "s3", region, nil, time.Now().UTC()); err != nil {
+		return nil, err
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("can't fetch '%v': %w", s, err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+		return nil, fmt.Errorf("can't fetch '%v': unexpected status %v: %v", s, resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+
+	return resp, nil
+}
+
+func (s *s3Source) Read(ctx context.Context) ([]byte, string, error) {
+	resp, err := s.request(ctx, http.MethodGet)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, "", fmt.Errorf("can't read '%v': %w", s, err)
+	}
+
+	return data, resp.Header.Get("ETag"), nil
+}
+
+func (s *s3Source) Version(ctx context.Context) (string, error) {
+	resp, err := s.request(ctx, http.MethodHead)
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+
+	return resp.Header.Get("ETag"), nil
+}
+
+func (s *s3Source) Include(pattern string) ([]configSource, error) {
+	if strings.ContainsAny(pattern, "*?[") {
+		return nil, fmt.Errorf("glob patterns are only supported for local files")
+	}
+
+	if strings.HasPrefix(pattern, "s3://") {
+		src, err := openSource(pattern)
+		if err != nil {
+			return nil, err
+		}
+		return []configSource{src}, nil
+	}
+
+	return []configSource{&s3Source{bucket: s.bucket, key: path.Join(path.Dir(s.key), pattern)}}, nil
+}
+
+// gitSource is a file in a git repository, at the tip of a branch or tag.
+// The commit it was read from is used as version.
+type gitSource struct {
+	repo string
+	ref  string
+	file string
+}
+
+// parseGitSource parses git+<url>//<file>?ref=<ref>.
+func parseGitSource(location string) (*gitSource, error) {
+	rest := strings.TrimPrefix(location, "git+")
+
+	ref := ""
+	if i := strings.LastIndex(rest, "?ref="); i >= 0 {
+		rest, ref = rest[:i], rest[i+len("?ref="):]
+	}
+
+	schemeEnd := strings.Index(rest, "://")
+	sep := -1
+	if schemeEnd >= 0 {
+		if i := strings.Index(rest[schemeEnd+3:], "//"); i >= 0 {
+			sep = schemeEnd + 3 + i
+		}
+	}
+	if sep < 0 {
+		return nil, fmt.Errorf("git source '%v' must name a file after '//'", location)
+	}
+
+	return &gitSource{repo: rest[:sep], ref: ref, file: rest[sep+2:]}, nil
+}
+
+func (s *gitSource) String() string {
+	loc := "git+" + s.repo + "//" + s.file
+	if s.ref != "" {
+		loc += "?ref=" + s.ref
+	}
+	return loc
+}
+
+func (s *gitSource) Read(ctx context.Context) ([]byte, string, error) {
+	dir, err := ioutil.TempDir("", "dimco-config-")
+	if err != nil {
+		return nil, "", fmt.Errorf("can't create checkout dir: %w", err)
+	}
+	defer os.RemoveAll(dir)
+
+	args := []string{"clone", "--quiet", "--depth", "1"}
+	if s.ref != "" {
+		args = append(args, "--branch", s.ref)
+	}
+	args = append(args, s.repo, dir)
+
+	if out, err := exec.CommandContext(ctx, "git", args...).CombinedOutput(); err != nil {
+		return nil, "", fmt.Errorf("can't clone '%v': %w: %v", s.repo, err, strings.TrimSpace(string(out)))
+	}
+
+	commit, err := exec.CommandContext(ctx, "git", "-C", dir, "rev-parse", "HEAD").Output()
+	if err != nil {
+		return nil, "", fmt.Errorf("can't resolve commit of '%v': %w", s.repo, err)
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join(dir, filepath.FromSlash(s.file)))
+	if err != nil {
+		return nil, "", fmt.Errorf("can't read '%v': %w", s, err)
+	}
+
+	return data, strings.TrimSpace(string(commit)), nil
+}
+
+func (s *gitSource) Version(ctx context.Context) (string, error) {
+	ref := s.ref
+	if ref == "" {
+		ref = "HEAD"
+	}
+
+	out, err := exec.CommandContext(ctx, "git", "ls-remote", s.repo, ref).Output()
+	if err != nil {
+		return "", fmt.Errorf("can't query '%v': %w", s.repo, err)
+	}
+
+	fields := strings.Fields(string(out))
+	if len(fields) == 0 {
+		return "", fmt.Errorf("ref '%v' not found in '%v'", ref, s.repo)
+	}
+
+	return fields[0], nil
+}
+
+func (s *gitSource) Include(pattern string) ([]configSource, error) {
+	if strings.ContainsAny(pattern, "*?[") {
+		return nil, fmt.Errorf("glob patterns are only supported for local files")
+	}
+
+	return []configSource{&gitSource{repo: s.repo, ref: s.ref, file: path.Join(path.Dir(s.file), pattern)}}, nil
+}
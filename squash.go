@@ -0,0 +1,240 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+)
+
+const (
+	mediaTypeDockerLayer = "application/vnd.docker.image.rootfs.diff.tar.gzip"
+	mediaTypeOCILayer    = "application/vnd.oci.image.layer.v1.tar+gzip"
+
+	whiteoutPrefix = ".wh."
+	whiteoutOpaque = ".wh..wh..opq"
+)
+
+// squash merges the layers of the image into one. The config keeps
+// everything but rootfs and history, so entrypoint, env and labels survive.
+// The result only depends on the source, so squashing twice yields the same
+// digests.
+func (b *builtImage) squash() error {
+	files := make([]string, len(b.layers))
+	for i, l := range b.layers {
+		if strings.HasSuffix(l.MediaType, encryptedSuffix) {
+			return fmt.Errorf("layer '%v' is encrypted, configure encryption.decryption_keys", l.Digest)
+		}
+		if l.file == "" {
+			return fmt.Errorf("layer '%v' is a foreign layer, use -include-non-distributable", l.Digest)
+		}
+		files[i] = l.file
+	}
+
+	keep, err := survivingEntries(files)
+	if err != nil {
+		return err
+	}
+
+	layer, diffID, err := writeSquashedLayer(b.path("squashed"), files, keep)
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		os.Remove(f)
+	}
+
+	layer.MediaType = mediaTypeDockerLayer
+	if b.mediaType == mediaTypeOCIManifest {
+		layer.MediaType = mediaTypeOCILayer
+	}
+
+	config := map[string]json.RawMessage{}
+	if err := json.Unmarshal(b.configRaw, &config); err != nil {
+		return fmt.Errorf("can't decode config: %w", err)
+	}
+
+	rootfs, _ := json.Marshal(map[string]interface{}{"type": "layers", "diff_ids": []string{diffID}})
+	entry := map[string]interface{}{
+		"created_by": "dimco squash",
+		"comment":    fmt.Sprintf("squashed %v layers", len(b.layers)),
+	}
+	if created, ok := config["created"]; ok {
+		entry["created"] = created
+	}
+	history, _ := json.Marshal([]interface{}{entry})
+	config["rootfs"], config["history"] = rootfs, history
+
+	data, err := json.Marshal(config)
+	if err != nil {
+		return fmt.Errorf("can't encode config: %w", err)
+	}
+
+	infof("squashed %v layers into %v", len(b.layers), layer.Digest)
+
+	b.layers = []builtLayer{{descriptor: layer, file: b.path("squashed")}}
+	b.setConfig(data)
+
+	return nil
+}
+
+// survivingEntries returns, per layer, the paths that are still visible in
+// the final filesystem: not replaced by an upper layer and not removed by a
+// whiteout, an opaque directory or a file replacing a parent directory.
+func survivingEntries(layers []string) ([]map[string]bool, error) {
+	keep := make([]map[string]bool, len(layers))
+	upper := map[string]byte{}
+	whiteouts := map[string]bool{}
+	opaque := map[string]bool{}
+
+	for i := len(layers) - 1; i >= 0; i-- {
+		keep[i] = map[string]bool{}
+		entries := map[string]byte{}
+		layerWhiteouts := []string{}
+		layerOpaque := []string{}
+
+		err := readLayer(layers[i], func(h *tar.Header, _ io.Reader) error {
+			p := entryPath(h.Name)
+			dir, base := path.Split(p)
+			dir = strings.TrimSuffix(dir, "/")
+
+			switch {
+			case base == whiteoutOpaque:
+				layerOpaque = append(layerOpaque, dir)
+				return nil
+			case strings.HasPrefix(base, whiteoutPrefix):
+				layerWhiteouts = append(layerWhiteouts, path.Join(dir, strings.TrimPrefix(base, whiteoutPrefix)))
+				return nil
+			}
+
+			entries[p] = h.Typeflag
+			if _, ok := upper[p]; ok || whiteouts[p] {
+				return nil
+			}
+			for a := p; a != ""; {
+				a = parentPath(a)
+				if t, ok := upper[a]; whiteouts[a] || opaque[a] || ok && t != tar.TypeDir {
+					return nil
+				}
+			}
+
+			keep[i][p] = true
+			return nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("can't read layer %v: %w", i, err)
+		}
+
+		for p, t := range entries {
+			if _, ok := upper[p]; !ok {
+				upper[p] = t
+			}
+		}
+		for _, p := range layerWhiteouts {
+			whiteouts[p] = true
+		}
+		for _, p := range layerOpaque {
+			opaque[p] = true
+		}
+	}
+
+	return keep, nil
+}
+
+// writeSquashedLayer writes the surviving entries from the lowest layer up
+// into a gzipped tar and returns its descriptor and diff ID.
+func writeSquashedLayer(file string, layers []string, keep []map[string]bool) (descriptor, string, error) {
+	f, err := os.Create(file)
+	if err != nil {
+		return descriptor{}, "", fmt.Errorf("can't create layer: %w", err)
+	}
+	defer f.Close()
+
+	compressed := sha256.New()
+	counter := &countingWriter{}
+	zw := gzip.NewWriter(io.MultiWriter(f, compressed, counter))
+	uncompressed := sha256.New()
+	tw := tar.NewWriter(io.MultiWriter(zw, uncompressed))
+
+	for i, layer := range layers {
+		err := readLayer(layer, func(h *tar.Header, r io.Reader) error {
+			if !keep[i][entryPath(h.Name)] {
+				return nil
+			}
+
+			if err := tw.WriteHeader(h); err != nil {
+				return err
+			}
+			_, err := io.Copy(tw, r)
+			return err
+		})
+		if err != nil {
+			return descriptor{}, "", fmt.Errorf("can't squash layer %v: %w", i, err)
+		}
+	}
+
+	for _, c := range []io.Closer{tw, zw, f} {
+		if err := c.Close(); err != nil {
+			return descriptor{}, "", fmt.Errorf("can't write layer: %w", err)
+		}
+	}
+
+	d := descriptor{Digest: "sha256:" + hex.EncodeToString(compressed.Sum(nil)), Size: counter.n}
+	return d, "sha256:" + hex.EncodeToString(uncompressed.Sum(nil)), nil
+}
+
+// readLayer calls fn for every entry of a layer, gzipped or not.
+func readLayer(file string, fn func(h *tar.Header, r io.Reader) error) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	br := bufio.NewReader(f)
+	var r io.Reader = br
+	if magic, _ := br.Peek(2); bytes.Equal(magic, []byte{0x1f, 0x8b}) {
+		zr, err := gzip.NewReader(br)
+		if err != nil {
+			return err
+		}
+		defer zr.Close()
+		r = zr
+	}
+
+	tr := tar.NewReader(r)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		if err := fn(h, tr); err != nil {
+			return err
+		}
+	}
+}
+
+// entryPath is the tar entry name without "./" and trailing slashes; the
+// root directory is "".
+func entryPath(name string) string {
+	return strings.TrimPrefix(path.Clean("/"+name), "/")
+}
+
+func parentPath(p string) string {
+	if i := strings.LastIndexByte(p, '/'); i >= 0 {
+		return p[:i]
+	}
+	return ""
+}
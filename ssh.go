@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os/exec"
+	"sync"
+	"time"
+)
+
+// sshDialer returns a dialer that reaches the Docker daemon of a remote host
+// through `ssh host docker system dial-stdio`, like the docker CLI does.
+// Host keys and agent authentication are handled by the ssh client, which
+// reads ~/.ssh/known_hosts and SSH_AUTH_SOCK unless configured otherwise.
+func sshDialer(host string, cfg SSHConfig) (func(ctx context.Context, network, addr string) (net.Conn, error), error) {
+	u, err := url.Parse(host)
+	if err != nil {
+		return nil, fmt.Errorf("invalid ssh host '%v': %w", host, err)
+	}
+
+	if u.Scheme != "ssh" || u.Hostname() == "" {
+		return nil, fmt.Errorf("invalid ssh host '%v'", host)
+	}
+
+	if u.Path != "" && u.Path != "/" {
+		return nil, fmt.Errorf("ssh host '%v' can't have a path", host)
+	}
+
+	args := []string{"-o", "BatchMode=yes", "-o", "StrictHostKeyChecking=yes"}
+	if cfg.KnownHosts != "" {
+		args = append(args, "-o", "UserKnownHostsFile="+cfg.KnownHosts)
+	}
+	if cfg.IdentityFile != "" {
+		args = append(args, "-i", cfg.IdentityFile)
+	}
+	if u.User != nil {
+		args = append(args, "-l", u.User.Username())
+	}
+	if u.Port() != "" {
+		args = append(args, "-p", u.Port())
+	}
+	args = append(args, "--", u.Hostname(), "docker", "system", "dial-stdio")
+
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return newCommandConn("ssh", args...)
+	}, nil
+}
+
+// commandConn is a net.Conn over the stdin and stdout of a command.
+type commandConn struct {
+	cmd    *exec.Cmd
+	stdin  io.WriteCloser
+	stdout io.ReadCloser
+
+	closeOnce sync.Once
+}
+
+func newCommandConn(name string, args ...string) (*commandConn, error) {
+	// The command must outlive the dial context, it serves the whole connection.
+	cmd := exec.Command(name, args...)
+
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, fmt.Errorf("can't open stdin of %v: %w", name, err)
+	}
+
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, fmt.Errorf("can't open stdout of %v: %w", name, err)
+	}
+
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("can't start %v: %w", name, err)
+	}
+
+	return &commandConn{cmd: cmd, stdin: stdin, stdout: stdout}, nil
+}
+
+func (c *commandConn) Read(p []byte) (int, error) {
+	return c.stdout.Read(p)
+}
+
+func (c *commandConn) Write(p []byte) (int, error) {
+	return c.stdin.Write(p)
+}
+
+func (c *commandConn) Close() error {
+	c.closeOnce.Do(func() {
+		c.stdin.Close()
+		c.stdout.Close()
+		if c.cmd.Process != nil {
+			c.cmd.Process.Kill()
+		}
+		c.cmd.Wait()
+	})
+
+	return nil
+}
+
+func (c *commandConn) LocalAddr() net.Addr              { return dummyAddr{} }
+func (c *commandConn) RemoteAddr() net.Addr             { return dummyAddr{} }
+func (c *commandConn) SetDeadline(time.Time) error      { return nil }
+func (c *commandConn) SetReadDeadline(time.Time) error  { return nil }
+func (c *commandConn) SetWriteDeadline(time.Time) error { return nil }
+
+type dummyAddr struct{}
+
+func (dummyAddr) Network() string { return "command" }
+func (dummyAddr) String() string  { return "command" }
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"text/tabwriter"
+)
+
+// slowestImages is how many images the statistics list by duration.
+const slowestImages = 5
+
+// runStats sums the transfers of a run, per registry and in total.
+type runStats struct {
+	transferStats
+	Registries []registryStats `json:"registries"`
+	Slowest    []slowImage     `json:"slowest"`
+	// Errors counts the failed images by error class.
+	Errors map[string]int `json:"errors,omitempty"`
+}
+
+// registryStats are the bytes pulled from or pushed to one registry. The
+// speed is the average over the images, each measured on its own, so
+// parallel copies don't add up.
+type registryStats struct {
+	Registry       string  `json:"registry"`
+	Direction      string  `json:"direction"`
+	Bytes          int64   `json:"bytes"`
+	Seconds        float64 `json:"seconds"`
+	BytesPerSecond float64 `json:"bytes_per_second"`
+}
+
+type slowImage struct {
+	Destination string  `json:"destination"`
+	Duration    float64 `json:"duration_seconds"`
+	Bytes       int64   `json:"bytes"`
+}
+
+func newRunStats(results []imageResult) *runStats {
+	s := &runStats{Registries: []registryStats{}, Slowest: []slowImage{}}
+
+	registries := map[string]*registryStats{}
+	count := func(ref, direction string, bytes int64, seconds float64) {
+		if bytes == 0 {
+			return
+		}
+
+		host := strings.SplitN(ref, "/", 2)[0]
+		key := host + " " + direction
+		rs, ok := registries[key]
+		if !ok {
+			rs = &registryStats{Registry: host, Direction: direction}
+			registries[key] = rs
+		}
+		rs.Bytes += bytes
+		rs.Seconds += seconds
+	}
+
+	for _, res := range results {
+		s.add(res.transferStats)
+		count(res.Source, "pull", res.Pulled, res.PullSeconds)
+		count(res.Destination, "push", res.Pushed, res.PushSeconds)
+
+		if res.ErrorClass != "" {
+			if s.Errors == nil {
+				s.Errors = map[string]int{}
+			}
+			s.Errors[res.ErrorClass]++
+		}
+
+		if res.Status == resultCopied {
+			s.Slowest = append(s.Slowest, slowImage{Destination: res.Destination, Duration: res.Duration, Bytes: res.Pulled + res.Pushed})
+		}
+	}
+
+	for _, rs := range registries {
+		if rs.Seconds > 0 {
+			rs.BytesPerSecond = float64(rs.Bytes) / rs.Seconds
+		}
+		s.Registries = append(s.Registries, *rs)
+	}
+	sort.Slice(s.Registries, func(i, j int) bool {
+		a, b := s.Registries[i], s.Registries[j]
+		return a.Registry < b.Registry || a.Registry == b.Registry && a.Direction < b.Direction
+	})
+
+	sort.SliceStable(s.Slowest, func(i, j int) bool { return s.Slowest[i].Duration > s.Slowest[j].Duration })
+	if len(s.Slowest) > slowestImages {
+		s.Slowest = s.Slowest[:slowestImages]
+	}
+
+	return s
+}
+
+// write prints the statistics as tables.
+func (s *runStats) write(out io.Writer) error {
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "REGISTRY\tDIRECTION\tTRANSFERRED\tAVERAGE SPEED")
+	for _, rs := range s.Registries {
+		fmt.Fprintf(w, "%v\t%v\t%v\t%v/s\n", rs.Registry, rs.Direction, formatBytes(rs.Bytes), formatBytes(int64(rs.BytesPerSecond)))
+	}
+	fmt.Fprintln(w)
+
+	fmt.Fprintln(w, "SLOWEST\tDURATION\tTRANSFERRED")
+	for _, si := range s.Slowest {
+		fmt.Fprintf(w, "%v\t%.1fs\t%v\n", si.Destination, si.Duration, formatBytes(si.Bytes))
+	}
+
+	if len(s.Errors) > 0 {
+		classes := []string{}
+		for class := range s.Errors {
+			classes = append(classes, class)
+		}
+		sort.Strings(classes)
+
+		fmt.Fprintln(w)
+		fmt.Fprintln(w, "ERROR CLASS\tFAILED")
+		for _, class := range classes {
+			fmt.Fprintf(w, "%v\t%v\n", class, s.Errors[class])
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	_, err := fmt.Fprintf(out, "\nPulled %v, pushed %v; %v layers (%v) were at the destination already.\n",
+		formatBytes(s.Pulled), formatBytes(s.Pushed), s.SkippedLayers, formatBytes(s.SkippedBytes))
+	return err
+}
@@ -0,0 +1,17 @@
+//go:build windows || plan9
+// +build windows plan9
+
+package main
+
+import (
+	"fmt"
+	"io"
+)
+
+func openSyslog() (io.Writer, error) {
+	return nil, fmt.Errorf("syslog isn't supported on this platform, use audit.file")
+}
+
+func openSyslogSink() (levelWriter, error) {
+	return nil, fmt.Errorf("syslog isn't supported on this platform, use a file sink")
+}
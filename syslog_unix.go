@@ -0,0 +1,43 @@
+//go:build !windows && !plan9
+// +build !windows,!plan9
+
+package main
+
+import (
+	"io"
+	"log/syslog"
+)
+
+func openSyslog() (io.Writer, error) {
+	return syslog.New(syslog.LOG_INFO|syslog.LOG_AUTH, "dimco")
+}
+
+// syslogSink is a log sink with the daemon facility.
+type syslogSink struct {
+	w *syslog.Writer
+}
+
+func openSyslogSink() (levelWriter, error) {
+	w, err := syslog.New(syslog.LOG_INFO|syslog.LOG_DAEMON, "dimco")
+	if err != nil {
+		return nil, err
+	}
+	return syslogSink{w: w}, nil
+}
+
+func (s syslogSink) writeLevel(level int, stamp, msg string) error {
+	switch level {
+	case levelError:
+		return s.w.Err(msg)
+	case levelQuiet:
+		return s.w.Warning(msg)
+	case levelNormal:
+		return s.w.Info(msg)
+	default:
+		return s.w.Debug(msg)
+	}
+}
+
+func (s syslogSink) Close() error {
+	return s.w.Close()
+}
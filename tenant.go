@@ -0,0 +1,421 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TenantsConfig lists the tenants one daemon serves, each team with its own
+// config, credentials and API tokens.
+type TenantsConfig struct {
+	Tenants []TenantConfig `json:"tenants"`
+	// Metrics pushes the metrics of every tenant, with its name in the
+	// tenant label. Tenants without it push to the metrics of their config.
+	Metrics *MetricsConfig `json:"metrics,omitempty"`
+	// Logging is the logging of the daemon, that of the tenants' configs
+	// is ignored.
+	Logging *LoggingConfig `json:"logging,omitempty"`
+}
+
+// TenantConfig is one tenant of the daemon. Its endpoints are served under
+// /tenants/<name>/.
+type TenantConfig struct {
+	Name string `json:"name"`
+	// Config is the config of the tenant, a path or any source -f accepts.
+	// It names the registries, credentials and images of the tenant.
+	Config string `json:"config"`
+	// Tokens authorize requests to the endpoints of the tenant. TokenFile
+	// is read as well, one token per line, e.g. a mounted secret.
+	Tokens    []string `json:"tokens,omitempty"`
+	TokenFile string   `json:"token_file,omitempty"`
+	// Quota replaces the quota of the tenant's config, so the operator
+	// rather than the team sets it.
+	Quota *QuotaConfig `json:"quota,omitempty"`
+	// Credentials replace the credentials of the tenant's config. Providers
+	// other than static act as the service, only the operator sets them.
+	Credentials map[string]CredentialConfig `json:"credentials,omitempty"`
+	// MetricsLabels are added to the labels of the tenant's metrics.
+	MetricsLabels map[string]string `json:"metrics_labels,omitempty"`
+}
+
+var tenantName = regexp.MustCompile(`^[a-z0-9][a-z0-9._-]*$`)
+
+func (tc TenantsConfig) validate() error {
+	if len(tc.Tenants) == 0 {
+		return fmt.Errorf("tenants is empty")
+	}
+
+	if tc.Metrics != nil {
+		if err := tc.Metrics.validate(); err != nil {
+			return err
+		}
+	}
+	if tc.Logging != nil {
+		if err := tc.Logging.validate(); err != nil {
+			return err
+		}
+	}
+
+	seen := map[string]bool{}
+	for i, t := range tc.Tenants {
+		if !tenantName.MatchString(t.Name) {
+			return fmt.Errorf("tenants[%v]: invalid name '%v', use lower case letters, digits, '.', '_' and '-'", i, t.Name)
+		}
+		if seen[t.Name] {
+			return fmt.Errorf("tenants[%v]: duplicate name '%v'", i, t.Name)
+		}
+		seen[t.Name] = true
+
+		if t.Config == "" {
+			return fmt.Errorf("tenant %v: config is required", t.Name)
+		}
+		if len(t.Tokens) == 0 && t.TokenFile == "" {
+			return fmt.Errorf("tenant %v: tokens or token_file is required", t.Name)
+		}
+		if t.Quota != nil {
+			if err := t.Quota.validate(); err != nil {
+				return fmt.Errorf("tenant %v: %w", t.Name, err)
+			}
+		}
+		for host, cc := range t.Credentials {
+			if _, err := cc.provider(); err != nil {
+				return fmt.Errorf("tenant %v: credentials[%v]: %w", t.Name, host, err)
+			}
+		}
+		for name := range t.MetricsLabels {
+			if !validMetricName(name) || name == "job" || name == "instance" || name == "tenant" || strings.HasPrefix(name, "__") {
+				return fmt.Errorf("tenant %v: invalid metrics label '%v'", t.Name, name)
+			}
+		}
+	}
+
+	return nil
+}
+
+// loadTenants reads the tenants file from a local file or one of the remote
+// sources understood by openSource.
+func loadTenants(path string) (TenantsConfig, error) {
+	src, err := openSource(path)
+	if err != nil {
+		return TenantsConfig{}, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), configTimeout)
+	defer cancel()
+
+	data, _, err := src.Read(ctx)
+	if err != nil {
+		return TenantsConfig{}, fmt.Errorf("can't read tenants file: %w", err)
+	}
+
+	tc := TenantsConfig{}
+	if err := json.Unmarshal(data, &tc); err != nil {
+		return TenantsConfig{}, fmt.Errorf("can't unmarshal tenants file: %w", err)
+	}
+	if err := tc.validate(); err != nil {
+		return TenantsConfig{}, fmt.Errorf("invalid tenants file: %w", err)
+	}
+
+	return tc, nil
+}
+
+// tenantScope is what the daemon of a tenant needs of the tenants file.
+type tenantScope struct {
+	config  TenantConfig
+	metrics *MetricsConfig
+	logging *LoggingConfig
+	tokens  []string
+	turns   *engineTurns
+}
+
+// engineTurns lets the tenants sharing an engine take turns, they share its
+// image store and disk. Tenants of different backends, and those copying
+// from registry to registry, run side by side. Tenants can't choose the
+// address of the engine, so the backend names it.
+type engineTurns struct {
+	mu    sync.Mutex
+	turns map[string]*sync.Mutex
+}
+
+// take waits for the turn on the engine of backend and returns its release.
+func (et *engineTurns) take(backend string) func() {
+	if backend == backendRegistry {
+		return func() {}
+	}
+	if backend == "" {
+		backend = backendDocker
+	}
+
+	et.mu.Lock()
+	turn, ok := et.turns[backend]
+	if !ok {
+		turn = &sync.Mutex{}
+		et.turns[backend] = turn
+	}
+	et.mu.Unlock()
+
+	turn.Lock()
+	return turn.Unlock
+}
+
+// tokens returns the API tokens of t, with those of its token file.
+func (t TenantConfig) tokens() ([]string, error) {
+	tokens := append([]string{}, t.Tokens...)
+	if t.TokenFile != "" {
+		data, err := ioutil.ReadFile(t.TokenFile)
+		if err != nil {
+			return nil, fmt.Errorf("can't read token file of tenant %v: %w", t.Name, err)
+		}
+		for _, line := range strings.Split(string(data), "\n") {
+			if line = strings.TrimSpace(line); line != "" {
+				tokens = append(tokens, line)
+			}
+		}
+	}
+	if len(tokens) == 0 {
+		return nil, fmt.Errorf("tenant %v has no tokens", t.Name)
+	}
+
+	for _, token := range tokens {
+		registerSecret(token)
+	}
+	return tokens, nil
+}
+
+// hostSettings names the settings of c that act as the service on its host:
+// they run commands, read or write local files, reach the engine directly or
+// use the identity and environment of the service, e.g. cloud credentials and
+// the tokens of email, events and alerts.
+func (c Config) hostSettings() []string {
+	set := []string{}
+	seen := map[string]bool{}
+	add := func(name string, ok bool) {
+		if ok && !seen[name] {
+			seen[name] = true
+			set = append(set, name)
+		}
+	}
+
+	add("hooks", len(c.Hooks) > 0)
+	add("policy.command", c.Policy != nil && len(c.Policy.Command) > 0)
+	add("policy.scan", c.Policy != nil && len(c.Policy.Scan) > 0)
+	add("pins", len(c.Pins) > 0)
+	add("lock", c.Lock != nil)
+	add("audit", c.Audit != nil)
+	add("work_dir", c.WorkDir != "")
+	add("disk_guard", c.DiskGuard != nil)
+	add("encryption", c.Encryption != nil)
+	add("engine_host", c.EngineHost != "")
+	add("ssh", c.SSH != SSHConfig{})
+	add("containerd", c.Containerd != ContainerdConfig{})
+	add("email", c.Email != nil)
+	add("events", c.Events != nil)
+	add("alerts", len(c.Alerts) > 0)
+	add("artifactory", c.Artifactory != nil)
+
+	for _, ac := range c.registries() {
+		add(ac.BaseAddress+" password_file", ac.PasswordFile != "")
+		add(ac.BaseAddress+" secret", ac.Secret != nil)
+	}
+
+	hosts := []string{}
+	for host := range c.Credentials {
+		hosts = append(hosts, host)
+	}
+	sort.Strings(hosts)
+	for _, host := range hosts {
+		add("credentials["+host+"] provider "+c.Credentials[host].Provider, c.Credentials[host].Provider != providerStatic)
+	}
+
+	for _, dc := range c.Discover {
+		add("discover api quay", dc.API == discoverQuay)
+	}
+	for _, img := range c.Images {
+		add("images expires_after", img.ExpiresAfter > 0)
+	}
+
+	return set
+}
+
+// apply checks that the config c of the tenant stays in its scope and puts
+// the settings the operator makes for the tenant over it.
+func (ts *tenantScope) apply(c *Config) error {
+	if set := c.hostSettings(); len(set) > 0 {
+		return fmt.Errorf("invalid config: tenants can't set %v", strings.Join(set, ", "))
+	}
+
+	if ts.config.Quota != nil {
+		c.Quota = ts.config.Quota
+	}
+	if ts.config.Credentials != nil {
+		c.Credentials = ts.config.Credentials
+	}
+	// The log is shared, a tenant can't redirect it.
+	c.Logging = ts.logging
+
+	m := c.Metrics
+	if ts.metrics != nil {
+		m = ts.metrics
+	}
+	if m != nil {
+		mc := *m
+		mc.Labels = map[string]string{}
+		for k, v := range m.Labels {
+			mc.Labels[k] = v
+		}
+		for k, v := range ts.config.MetricsLabels {
+			mc.Labels[k] = v
+		}
+		mc.Labels["tenant"] = ts.config.Name
+		c.Metrics = &mc
+	}
+
+	return nil
+}
+
+// loadConfig loads the config at path with the settings of the tenant of d.
+func (d *daemon) loadConfig(path string) (Config, error) {
+	if d.tenant == nil {
+		return loadConfig(path)
+	}
+	return loadScopedConfig(path, d.tenant.apply)
+}
+
+// logPrefix names the tenant of d in its log lines.
+func (d *daemon) logPrefix() string {
+	if d.tenant == nil {
+		return ""
+	}
+	return "tenant " + d.tenant.config.Name + ": "
+}
+
+// authorized reports whether r carries a token of the tenant, as bearer
+// token or as password of basic auth, which browsers ask for.
+func (ts *tenantScope) authorized(r *http.Request) bool {
+	token := ""
+	if _, password, ok := r.BasicAuth(); ok {
+		token = password
+	} else if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		token = strings.TrimPrefix(auth, "Bearer ")
+	}
+	if token == "" {
+		return false
+	}
+
+	ok := false
+	for _, t := range ts.tokens {
+		if subtle.ConstantTimeCompare([]byte(t), []byte(token)) == 1 {
+			ok = true
+		}
+	}
+	return ok
+}
+
+// withAuth serves the requests to h that carry a token of the tenant.
+func (ts *tenantScope) withAuth(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !ts.authorized(r) {
+			w.Header().Set("WWW-Authenticate", fmt.Sprintf("Basic realm=%q", "dimco "+ts.config.Name))
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// runTenants runs a daemon per tenant of the tenants file at path, made by
+// newDaemon, and serves their endpoints under /tenants/<name>/. /healthz
+// fails when the run of any tenant hangs; /readyz only reports the service
+// up, the readiness of a tenant is at /tenants/<name>/readyz so one tenant's
+// registries don't take the others out of service.
+func runTenants(ctx context.Context, path, listen string, watch time.Duration, newDaemon func(Config) *daemon) error {
+	tc, err := loadTenants(path)
+	if err != nil {
+		return err
+	}
+
+	if err := (Config{Logging: tc.Logging}).startLogging(); err != nil {
+		return err
+	}
+
+	turns := &engineTurns{turns: map[string]*sync.Mutex{}}
+	daemons := []*daemon{}
+	configs := []string{}
+	for _, t := range tc.Tenants {
+		tokens, err := t.tokens()
+		if err != nil {
+			return err
+		}
+
+		ts := &tenantScope{config: t, metrics: tc.Metrics, logging: tc.Logging, tokens: tokens, turns: turns}
+		d := newDaemon(Config{})
+		d.tenant, d.base = ts, "/tenants/"+t.Name
+
+		c, err := d.loadConfig(t.Config)
+		if err != nil {
+			return fmt.Errorf("tenant %v: %w", t.Name, err)
+		}
+		d.config = c
+
+		daemons = append(daemons, d)
+		configs = append(configs, t.Config)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		for _, d := range daemons {
+			d.mu.Lock()
+			running, runStarted := d.running, d.runStarted
+			d.mu.Unlock()
+
+			if running && time.Since(runStarted) > d.maxRun {
+				http.Error(w, fmt.Sprintf("sync of tenant %v running since %v", d.tenant.config.Name, runStarted.Format(time.RFC3339)), http.StatusServiceUnavailable)
+				return
+			}
+		}
+		fmt.Fprintln(w, "ok")
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "ok")
+	})
+	for _, d := range daemons {
+		mux.Handle(d.base+"/", http.StripPrefix(d.base, d.tenant.withAuth(d.handler())))
+	}
+	served, err := serve(ctx, listen, mux)
+	if err != nil {
+		return err
+	}
+
+	infof("serving %v tenants", len(daemons))
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	wg := sync.WaitGroup{}
+	for i, d := range daemons {
+		go d.watchConfig(ctx, configs[i], watch)
+
+		wg.Add(1)
+		go func(d *daemon) {
+			defer wg.Done()
+			d.loop(ctx)
+		}(d)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	return untilServeFails(served, done, cancel)
+}
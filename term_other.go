@@ -0,0 +1,21 @@
+//go:build !linux && !darwin && !freebsd && !netbsd && !openbsd
+// +build !linux,!darwin,!freebsd,!netbsd,!openbsd
+
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+func disableEcho(tty *os.File) (func(), error) {
+	return nil, fmt.Errorf("hidden input isn't supported on this platform")
+}
+
+func makeRaw(tty *os.File) (func(), error) {
+	return nil, fmt.Errorf("the dashboard isn't supported on this platform")
+}
+
+func terminalSize(tty *os.File) (int, int, error) {
+	return 0, 0, fmt.Errorf("terminal size isn't supported on this platform")
+}
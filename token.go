@@ -0,0 +1,288 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// defaultTokenExpiry is the lifetime of tokens without expires_in, the
+	// minimum of the token spec.
+	defaultTokenExpiry = 60 * time.Second
+	// tokenExpiryMargin renews tokens before they expire in flight.
+	tokenExpiryMargin = 10 * time.Second
+)
+
+// Kinds of access to a repository, each authorized on its own: registries
+// grant tokens for pulls that don't allow pushes or deletes.
+const (
+	accessPull   = "pull"
+	accessPush   = "push"
+	accessDelete = "delete"
+)
+
+// accessOf is the kind of access a request with method needs.
+func accessOf(method string) string {
+	switch method {
+	case http.MethodGet, http.MethodHead:
+		return accessPull
+	case http.MethodDelete:
+		return accessDelete
+	default:
+		return accessPush
+	}
+}
+
+// challengeActions are the actions of the scope asked for when a bearer
+// challenge doesn't name one.
+var challengeActions = map[string]string{
+	accessPull:   "pull",
+	accessPush:   "pull,push",
+	accessDelete: "delete",
+}
+
+// authChallenge is a WWW-Authenticate challenge of the registry.
+type authChallenge struct {
+	scheme  string
+	realm   string
+	service string
+	// scopes are the resource scopes of a bearer challenge, like
+	// repository:team/app:pull,push.
+	scopes []string
+}
+
+// newAuthChallenge parses the challenge returned for a request with access
+// to repo, adding the scope the registry left out.
+func newAuthChallenge(header, repo, access string) authChallenge {
+	scheme, params := parseChallenge(header)
+	ch := authChallenge{scheme: strings.ToLower(scheme), realm: params["realm"], service: params["service"]}
+	if scope := params["scope"]; scope != "" {
+		ch.scopes = strings.Fields(scope)
+	} else if ch.scheme == "bearer" && repo == "_catalog" {
+		ch.scopes = []string{"registry:catalog:*"}
+	} else if ch.scheme == "bearer" && repo != "" {
+		ch.scopes = []string{"repository:" + repo + ":" + challengeActions[access]}
+	}
+	return ch
+}
+
+// key identifies the token answering the challenge.
+func (ch authChallenge) key() string {
+	return ch.scheme + " " + ch.realm + " " + ch.service + " " + strings.Join(ch.scopes, " ")
+}
+
+// cachedToken is an Authorization header and when it stops being accepted,
+// zero for credentials that don't expire.
+type cachedToken struct {
+	authorization string
+	expires       time.Time
+}
+
+func (t cachedToken) valid(now time.Time) bool {
+	return t.authorization != "" && (t.expires.IsZero() || now.Before(t.expires.Add(-tokenExpiryMargin)))
+}
+
+// authCache remembers the challenges of a registry and the tokens answering
+// them. It is shared by every client of the registry with the same
+// credentials, so the tokens of a scope are fetched once per run rather than
+// once per request.
+type authCache struct {
+	mu sync.Mutex
+	// challenges holds the challenge of the last request per repository and
+	// kind of access.
+	challenges map[string]authChallenge
+	// tokens holds the tokens by challenge key.
+	tokens map[string]cachedToken
+}
+
+var authCaches = struct {
+	mu sync.Mutex
+	m  map[string]*authCache
+}{m: map[string]*authCache{}}
+
+// authCacheFor returns the cache of the clients of host with the credentials
+// of ac. Changed credentials, e.g. after a config reload, get a new cache.
+// Headers count as credentials, a gateway may hand out tokens by API key.
+func authCacheFor(host string, ac AuthConfig) *authCache {
+	headers, _ := json.Marshal(ac.Headers)
+	sum := sha256.Sum256([]byte(ac.Username + "\x00" + ac.Password + "\x00" + string(headers)))
+	key := host + " " + hex.EncodeToString(sum[:])
+
+	authCaches.mu.Lock()
+	defer authCaches.mu.Unlock()
+
+	c, ok := authCaches.m[key]
+	if !ok {
+		c = &authCache{challenges: map[string]authChallenge{}, tokens: map[string]cachedToken{}}
+		authCaches.m[key] = c
+	}
+	return c
+}
+
+func (c *authCache) challenge(repo, access string) (authChallenge, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ch, ok := c.challenges[repo+" "+access]
+	return ch, ok
+}
+
+func (c *authCache) setChallenge(repo, access string, ch authChallenge) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.challenges[repo+" "+access] = ch
+}
+
+func (c *authCache) token(key string, now time.Time) (cachedToken, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	t, ok := c.tokens[key]
+	return t, ok && t.valid(now)
+}
+
+func (c *authCache) setToken(key string, t cachedToken) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.tokens[key] = t
+}
+
+// forget drops the token of key after the registry rejected it.
+func (c *authCache) forget(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.tokens, key)
+}
+
+// authorization returns the Authorization header for a request with access
+// to repo: the cached token of the challenge the registry returned for such
+// requests before, renewed once it expired. It is empty for requests that
+// haven't been challenged yet.
+func (r *registryClient) authorization(ctx context.Context, repo, access string) (string, error) {
+	ch, ok := r.tokens.challenge(repo, access)
+	if !ok && access == accessPull {
+		// A client that pushed may also pull.
+		ch, ok = r.tokens.challenge(repo, accessPush)
+	}
+	if !ok {
+		return "", nil
+	}
+	return r.authorize(ctx, ch)
+}
+
+// authorize returns the Authorization header value answering the challenge,
+// from the cache while the token is valid.
+func (r *registryClient) authorize(ctx context.Context, ch authChallenge) (string, error) {
+	key := ch.key()
+	if t, ok := r.tokens.token(key, time.Now()); ok {
+		return t.authorization, nil
+	}
+
+	var t cachedToken
+	switch ch.scheme {
+	case "basic":
+		req, _ := http.NewRequest(http.MethodGet, "/", nil)
+		req.SetBasicAuth(r.auth.Username, r.auth.Password)
+		t.authorization = req.Header.Get("Authorization")
+	case "bearer":
+		token, expires, err := r.fetchToken(ctx, ch)
+		if err != nil {
+			return "", err
+		}
+		t = cachedToken{authorization: "Bearer " + token, expires: expires}
+	default:
+		return "", fmt.Errorf("unsupported auth challenge '%v'", ch.scheme)
+	}
+
+	registerAuthorization(t.authorization)
+	r.tokens.setToken(key, t)
+	return t.authorization, nil
+}
+
+// fetchToken requests a token for the scopes of the challenge from its
+// realm, with the credentials of the client if it has any.
+func (r *registryClient) fetchToken(ctx context.Context, ch authChallenge) (string, time.Time, error) {
+	if ch.realm == "" {
+		return "", time.Time{}, fmt.Errorf("bearer challenge without realm")
+	}
+
+	q := url.Values{}
+	if ch.service != "" {
+		q.Set("service", ch.service)
+	}
+	for _, scope := range ch.scopes {
+		q.Add("scope", scope)
+	}
+
+	u := ch.realm
+	if len(q) > 0 {
+		sep := "?"
+		if strings.Contains(u, "?") {
+			sep = "&"
+		}
+		u += sep + q.Encode()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("can't create token request: %w", err)
+	}
+	r.auth.setHeaders(req)
+
+	if r.auth.Username != "" {
+		req.SetBasicAuth(r.auth.Username, r.auth.Password)
+	}
+
+	requested := time.Now()
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("can't request token: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		data, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+		return "", time.Time{}, &statusError{Method: http.MethodGet, URL: ch.realm, StatusCode: resp.StatusCode, Body: string(data),
+			RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After"))}
+	}
+
+	var out struct {
+		Token       string    `json:"token"`
+		AccessToken string    `json:"access_token"`
+		ExpiresIn   int       `json:"expires_in"`
+		IssuedAt    time.Time `json:"issued_at"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		return "", time.Time{}, fmt.Errorf("can't decode token: %w", err)
+	}
+
+	token := out.Token
+	if token == "" {
+		token = out.AccessToken
+	}
+	if token == "" {
+		return "", time.Time{}, fmt.Errorf("token response of %v has no token", ch.realm)
+	}
+
+	lifetime := defaultTokenExpiry
+	if out.ExpiresIn > 0 {
+		lifetime = time.Duration(out.ExpiresIn) * time.Second
+	}
+	// The clock of the token server may be off, the expiry counts from the
+	// request unless the token was issued later.
+	issued := requested
+	if out.IssuedAt.After(issued) && out.IssuedAt.Before(time.Now()) {
+		issued = out.IssuedAt
+	}
+	debugf("got token for %v from %v, valid for %v", strings.Join(ch.scopes, " "), ch.realm, lifetime)
+
+	return token, issued.Add(lifetime), nil
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Tracing is configured with the standard OpenTelemetry environment
+// variables and is disabled when no OTLP endpoint is set. Finished spans are
+// buffered and exported as OTLP/HTTP JSON when the tracer is flushed.
+var tracer = newTracerFromEnv()
+
+type otlpTracer struct {
+	endpoint    string
+	headers     http.Header
+	serviceName string
+	client      *http.Client
+
+	mu    sync.Mutex
+	spans []*span
+}
+
+func newTracerFromEnv() *otlpTracer {
+	endpoint := os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT")
+	if endpoint == "" {
+		base := os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT")
+		if base == "" {
+			return nil
+		}
+		endpoint = strings.TrimRight(base, "/") + "/v1/traces"
+	}
+
+	headers := http.Header{"Content-Type": []string{"application/json"}}
+	for _, kv := range strings.Split(os.Getenv("OTEL_EXPORTER_OTLP_HEADERS"), ",") {
+		if parts := strings.SplitN(kv, "=", 2); len(parts) == 2 {
+			headers.Set(strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1]))
+		}
+	}
+
+	serviceName := os.Getenv("OTEL_SERVICE_NAME")
+	if serviceName == "" {
+		serviceName = "dimco"
+	}
+
+	return &otlpTracer{
+		endpoint:    endpoint,
+		headers:     headers,
+		serviceName: serviceName,
+		client:      &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+type spanContextKey struct{}
+
+// span is a timed operation of a trace. A nil span is a no-op, which is what
+// startSpan returns when tracing is disabled.
+type span struct {
+	traceID  [16]byte
+	spanID   [8]byte
+	parentID [8]byte
+	name     string
+	start    time.Time
+	end      time.Time
+	attrs    map[string]string
+	err      error
+}
+
+// startSpan starts a span as a child of the span in ctx, if any.
+func startSpan(ctx context.Context, name string, attrs ...string) (context.Context, *span) {
+	if tracer == nil {
+		return ctx, nil
+	}
+
+	s := &span{name: name, start: time.Now(), attrs: map[string]string{}}
+	if parent, ok := ctx.Value(spanContextKey{}).(*span); ok && parent != nil {
+		s.traceID = parent.traceID
+		s.parentID = parent.spanID
+	} else {
+		rand.Read(s.traceID[:])
+	}
+	rand.Read(s.spanID[:])
+
+	for i := 0; i+1 < len(attrs); i += 2 {
+		s.attrs[attrs[i]] = attrs[i+1]
+	}
+
+	return context.WithValue(ctx, spanContextKey{}, s), s
+}
+
+// SetAttribute records a key/value pair on the span.
+func (s *span) SetAttribute(key, value string) {
+	if s == nil {
+		return
+	}
+	s.attrs[key] = value
+}
+
+// End finishes the span, marking it failed when err isn't nil.
+func (s *span) End(err error) {
+	if s == nil {
+		return
+	}
+
+	s.end = time.Now()
+	s.err = err
+
+	tracer.mu.Lock()
+	tracer.spans = append(tracer.spans, s)
+	tracer.mu.Unlock()
+}
+
+// withoutSpan returns a context whose spans start a new trace.
+func withoutSpan(ctx context.Context) context.Context {
+	return context.WithValue(ctx, spanContextKey{}, (*span)(nil))
+}
+
+// traceparent returns the W3C trace context header value for the span in ctx.
+func traceparent(ctx context.Context) string {
+	s, ok := ctx.Value(spanContextKey{}).(*span)
+	if !ok || s == nil {
+		return ""
+	}
+
+	return fmt.Sprintf("00-%x-%x-01", s.traceID, s.spanID)
+}
+
+// flushTracing exports the buffered spans.
+func flushTracing(ctx context.Context) error {
+	if tracer == nil {
+		return nil
+	}
+
+	tracer.mu.Lock()
+	spans := tracer.spans
+	tracer.spans = nil
+	tracer.mu.Unlock()
+
+	if len(spans) == 0 {
+		return nil
+	}
+
+	body, err := json.Marshal(tracer.payload(spans))
+	if err != nil {
+		return fmt.Errorf("can't encode spans: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, tracer.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("can't create export request: %w", err)
+	}
+	req.Header = tracer.headers.Clone()
+
+	resp, err := tracer.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("can't export spans: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("can't export spans: unexpected status %v", resp.StatusCode)
+	}
+
+	return nil
+}
+
+// The otlp* types follow the JSON encoding of the OTLP trace protocol.
+type otlpAttribute struct {
+	Key   string `json:"key"`
+	Value struct {
+		StringValue string `json:"stringValue"`
+	} `json:"value"`
+}
+
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	Status            struct {
+		Code    int    `json:"code,omitempty"`
+		Message string `json:"message,omitempty"`
+	} `json:"status"`
+}
+
+func otlpAttributes(attrs map[string]string) []otlpAttribute {
+	out := make([]otlpAttribute, 0, len(attrs))
+	for k, v := range attrs {
+		a := otlpAttribute{Key: k}
+		a.Value.StringValue = v
+		out = append(out, a)
+	}
+
+	return out
+}
+
+func (t *otlpTracer) payload(spans []*span) interface{} {
+	out := make([]otlpSpan, 0, len(spans))
+	for _, s := range spans {
+		o := otlpSpan{
+			TraceID:           hex.EncodeToString(s.traceID[:]),
+			SpanID:            hex.EncodeToString(s.spanID[:]),
+			Name:              s.name,
+			Kind:              1,
+			StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(s.end.UnixNano(), 10),
+			Attributes:        otlpAttributes(s.attrs),
+		}
+
+		if s.parentID != [8]byte{} {
+			o.ParentSpanID = hex.EncodeToString(s.parentID[:])
+		}
+
+		if s.err != nil {
+			o.Status.Code = 2
+			o.Status.Message = redact(s.err.Error())
+		} else {
+			o.Status.Code = 1
+		}
+
+		out = append(out, o)
+	}
+
+	return map[string]interface{}{
+		"resourceSpans": []interface{}{
+			map[string]interface{}{
+				"resource": map[string]interface{}{
+					"attributes": otlpAttributes(map[string]string{"service.name": t.serviceName}),
+				},
+				"scopeSpans": []interface{}{
+					map[string]interface{}{
+						"scope": map[string]string{"name": "github.com/SealTV/dimco"},
+						"spans": out,
+					},
+				},
+			},
+		},
+	}
+}
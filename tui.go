@@ -0,0 +1,384 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	dashboardRefresh  = 250 * time.Millisecond
+	dashboardLogLines = 5
+)
+
+// dashboardActive is set while -tui owns the terminal, which keeps engine
+// progress off stdout.
+var dashboardActive bool
+
+// dashboard is the live table of `sync -tui`. It owns the terminal while the
+// images are copied: log output is captured and shown below the table, and
+// keys retry or cancel single images.
+type dashboard struct {
+	tty      *os.File
+	restore  func()
+	done     chan struct{}
+	names    []string
+	progress []*imageProgress
+	rates    []transferRate
+	logs     *logBuffer
+	selected int
+}
+
+// transferRate tracks the speed of one image between two redraws.
+type transferRate struct {
+	bytes int64
+	at    time.Time
+	speed float64
+}
+
+func newDashboard(s *syncer, images []ImageData) (*dashboard, error) {
+	tty, err := os.OpenFile("/dev/tty", os.O_RDWR, 0)
+	if err != nil {
+		return nil, fmt.Errorf("-tui needs a terminal: %w", err)
+	}
+
+	restore, err := makeRaw(tty)
+	if err != nil {
+		tty.Close()
+		return nil, fmt.Errorf("can't set up terminal: %w", err)
+	}
+
+	d := &dashboard{
+		tty:     tty,
+		restore: restore,
+		done:    make(chan struct{}),
+		rates:   make([]transferRate, len(images)),
+		logs:    &logBuffer{},
+	}
+	for _, img := range images {
+		_, toImg := s.references(img)
+		d.names = append(d.names, toImg)
+		d.progress = append(d.progress, newImageProgress())
+	}
+
+	logs.setConsole(d.logs)
+	dashboardActive = true
+
+	// Alternate screen, hidden cursor.
+	fmt.Fprint(tty, "\x1b[?1049h\x1b[?25l")
+
+	return d, nil
+}
+
+// close gives the terminal back and prints the captured log output.
+func (d *dashboard) close() {
+	close(d.done)
+
+	fmt.Fprint(d.tty, "\x1b[?25h\x1b[?1049l")
+	d.restore()
+	d.tty.Close()
+
+	dashboardActive = false
+	logs.setConsole(os.Stderr)
+	os.Stderr.Write(d.logs.bytes())
+}
+
+// run copies every image with copyImage and serves the dashboard until the
+// user quits or ctx is cancelled. Retried images replace their earlier
+// result.
+func (d *dashboard) run(ctx context.Context, copyImage func(ctx context.Context, i int) imageResult) []imageResult {
+	results := make([]imageResult, len(d.names))
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+
+	launch := func(i int) {
+		p := d.progress[i]
+		if p.snapshot().Running {
+			return
+		}
+
+		imgCtx, cancel := context.WithCancel(ctx)
+		p.start(cancel)
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer cancel()
+
+			res := copyImage(withProgress(imgCtx, p), i)
+			mu.Lock()
+			results[i] = res
+			mu.Unlock()
+			p.finish(res)
+		}()
+	}
+
+	for i := range d.names {
+		launch(i)
+	}
+
+	keys := d.readKeys()
+	ticker := time.NewTicker(dashboardRefresh)
+	defer ticker.Stop()
+
+	for {
+		d.render()
+
+		select {
+		case <-ctx.Done():
+			wg.Wait()
+			return results
+		case <-ticker.C:
+		case k, ok := <-keys:
+			if !ok {
+				wg.Wait()
+				return results
+			}
+
+			switch k {
+			case 'k':
+				if d.selected > 0 {
+					d.selected--
+				}
+			case 'j':
+				if d.selected < len(d.names)-1 {
+					d.selected++
+				}
+			case 'r':
+				if s := d.progress[d.selected].snapshot(); s.Status == resultFailed || s.Status == resultSkipped || s.Status == phaseCancelled {
+					launch(d.selected)
+				}
+			case 'c':
+				d.progress[d.selected].abort()
+			case 'q':
+				for _, p := range d.progress {
+					p.abort()
+				}
+				wg.Wait()
+				return results
+			}
+		}
+	}
+}
+
+// readKeys delivers key presses, with the arrow keys mapped to k and j.
+func (d *dashboard) readKeys() <-chan byte {
+	keys := make(chan byte)
+
+	go func() {
+		defer close(keys)
+
+		r := bufio.NewReader(d.tty)
+		for {
+			b, err := r.ReadByte()
+			if err != nil {
+				return
+			}
+
+			// Arrow keys arrive as ESC [ A and ESC [ B.
+			if b == 0x1b {
+				if next, _ := r.ReadByte(); next != '[' {
+					continue
+				}
+				switch c, _ := r.ReadByte(); c {
+				case 'A':
+					b = 'k'
+				case 'B':
+					b = 'j'
+				default:
+					continue
+				}
+			}
+
+			select {
+			case keys <- b:
+			case <-d.done:
+				return
+			}
+		}
+	}()
+
+	return keys
+}
+
+func (d *dashboard) render() {
+	width, height, err := terminalSize(d.tty)
+	if err != nil || width <= 0 || height <= 0 {
+		width, height = 120, 40
+	}
+
+	snaps := make([]progressSnapshot, len(d.progress))
+	copied, failed, running := 0, 0, 0
+	for i, p := range d.progress {
+		snaps[i] = p.snapshot()
+		switch {
+		case snaps[i].Running:
+			running++
+		case snaps[i].Status == resultCopied:
+			copied++
+		default:
+			failed++
+		}
+	}
+
+	var lines []string
+	header := fmt.Sprintf("dimco sync: %v/%v copied, %v failed, %v running", copied, len(d.names), failed, running)
+	if running == 0 {
+		header += ", done"
+	}
+	lines = append(lines, header)
+
+	nameWidth := 11
+	for _, n := range d.names {
+		if len(n) > nameWidth {
+			nameWidth = len(n)
+		}
+	}
+	if nameWidth > width/2 {
+		nameWidth = width / 2
+	}
+	row := func(marker, name, status, progress, speed, errMsg string) string {
+		return fmt.Sprintf("%v %-*v  %-10v %-24v %-10v %v", marker, nameWidth, truncate(name, nameWidth), status, progress, speed, errMsg)
+	}
+	lines = append(lines, row(" ", "DESTINATION", "STATUS", "PROGRESS", "SPEED", "ERROR"))
+
+	// Scroll the table so the selected image stays visible.
+	visible := height - len(lines) - dashboardLogLines - 4
+	if visible < 1 {
+		visible = 1
+	}
+	first := 0
+	if d.selected >= visible {
+		first = d.selected - visible + 1
+	}
+
+	now := time.Now()
+	for i, s := range snaps {
+		speed := d.rates[i].update(s, now)
+		if i < first || i >= first+visible {
+			continue
+		}
+
+		marker := " "
+		if i == d.selected {
+			marker = ">"
+		}
+
+		progress := ""
+		if s.Total > 0 && s.Running {
+			progress = fmt.Sprintf("%v/%v %v%%", formatBytes(s.Current), formatBytes(s.Total), s.Current*100/s.Total)
+		}
+
+		rate := ""
+		if s.Running && speed > 0 {
+			rate = formatBytes(int64(speed)) + "/s"
+		}
+
+		lines = append(lines, row(marker, d.names[i], s.Status, progress, rate, firstLine(s.Error)))
+	}
+
+	lines = append(lines, "")
+	if s := snaps[d.selected]; s.Error != "" {
+		lines = append(lines, "error: "+firstLine(s.Error))
+	} else {
+		lines = append(lines, "")
+	}
+	lines = append(lines, d.logs.tail(dashboardLogLines)...)
+	lines = append(lines, "", "j/k move  r retry  c cancel  q quit")
+
+	var b strings.Builder
+	b.WriteString("\x1b[H\x1b[2J")
+	for i, l := range lines {
+		if i > 0 {
+			b.WriteString("\n")
+		}
+		b.WriteString(truncate(l, width))
+	}
+	d.tty.WriteString(b.String())
+}
+
+// update returns the smoothed speed in bytes per second. A new phase starts
+// counting from zero again.
+func (r *transferRate) update(s progressSnapshot, now time.Time) float64 {
+	if !s.Running || s.Current < r.bytes || r.at.IsZero() {
+		r.bytes, r.at, r.speed = s.Current, now, 0
+		return 0
+	}
+
+	if elapsed := now.Sub(r.at).Seconds(); elapsed > 0 {
+		r.speed = 0.7*r.speed + 0.3*float64(s.Current-r.bytes)/elapsed
+	}
+	r.bytes, r.at = s.Current, now
+
+	return r.speed
+}
+
+// logBuffer keeps the log output written while the dashboard is shown.
+type logBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (l *logBuffer) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.buf.Write(p)
+}
+
+func (l *logBuffer) bytes() []byte {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]byte(nil), l.buf.Bytes()...)
+}
+
+// tail returns the last n lines.
+func (l *logBuffer) tail(n int) []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	lines := strings.Split(strings.TrimRight(l.buf.String(), "\n"), "\n")
+	if len(lines) == 1 && lines[0] == "" {
+		return nil
+	}
+	if len(lines) > n {
+		lines = lines[len(lines)-n:]
+	}
+	return lines
+}
+
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%vB", n)
+	}
+
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f%ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+func truncate(s string, n int) string {
+	r := []rune(s)
+	if len(r) <= n {
+		return s
+	}
+	if n <= 1 {
+		return string(r[:n])
+	}
+	return string(r[:n-1]) + "…"
+}
+
+func firstLine(s string) string {
+	if i := strings.IndexByte(s, '\n'); i >= 0 {
+		return s[:i]
+	}
+	return s
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultChunkSize = 64 << 20
+	// maxChunkRetries is how often a chunk is resumed before the upload
+	// fails.
+	maxChunkRetries = 5
+)
+
+// chunkSize is the upload chunk size for the registry, 0 for monolithic
+// uploads.
+func (ac AuthConfig) chunkSize() int64 {
+	if ac.ChunkSize == "" {
+		return defaultChunkSize
+	}
+	// Validated when the config was loaded.
+	n, _ := parseBytes(ac.ChunkSize)
+	return n
+}
+
+// uploadChunked uploads content, the blob from offset on, with PATCH
+// requests of chunk bytes to the upload session at location. A chunk that
+// fails with a transient error continues from what the registry committed of
+// it, so a dropped connection costs at most one chunk instead of the whole
+// blob. With checkpoints, the session is recorded after every chunk for the
+// next run to continue.
+func (r *registryClient) uploadChunked(ctx context.Context, repo string, location *url.URL, digest string, content io.Reader, chunk, offset int64) error {
+	cps := checkpointsFrom(ctx)
+	buf := make([]byte, chunk)
+	for {
+		n, err := io.ReadFull(content, buf)
+		if err == io.EOF {
+			break
+		}
+		if err != nil && err != io.ErrUnexpectedEOF {
+			return fmt.Errorf("can't read blob: %w", err)
+		}
+
+		location, err = r.uploadChunk(ctx, location, digest, buf[:n], offset)
+		if err != nil {
+			return err
+		}
+		offset += int64(n)
+		cps.save(uploadCheckpoint{Registry: r.host, Repository: repo, Digest: digest, Location: location.String(), Offset: offset})
+
+		if n < len(buf) {
+			break
+		}
+	}
+
+	q := location.Query()
+	q.Set("digest", digest)
+	location.RawQuery = q.Encode()
+
+	resp, err := r.do(ctx, http.MethodPut, location.String(), nil, nil)
+	if err != nil {
+		return fmt.Errorf("can't complete upload: %w", err)
+	}
+	resp.Body.Close()
+	cps.remove(r.host, repo, digest)
+
+	return nil
+}
+
+// uploadChunk sends the bytes of data starting at offset of the blob and
+// returns the location of the next chunk.
+func (r *registryClient) uploadChunk(ctx context.Context, location *url.URL, digest string, data []byte, offset int64) (*url.URL, error) {
+	backoff := RetryConfig{Backoff: Duration(time.Second)}
+
+	for attempt := 1; ; attempt++ {
+		header := http.Header{
+			"Content-Type":  []string{"application/octet-stream"},
+			"Content-Range": []string{fmt.Sprintf("%d-%d", offset, offset+int64(len(data))-1)},
+		}
+		resp, err := r.do(ctx, http.MethodPatch, location.String(), header, data)
+		if err == nil {
+			resp.Body.Close()
+			return r.location(resp)
+		}
+
+		var se *statusError
+		outOfRange := errors.As(err, &se) && se.StatusCode == http.StatusRequestedRangeNotSatisfiable
+		if attempt > maxChunkRetries || ctx.Err() != nil || !outOfRange && !retryable(errorClass(err)) {
+			return nil, fmt.Errorf("can't upload chunk at %v: %w", offset, err)
+		}
+
+		select {
+		case <-time.After(backoff.retryDelay(attempt, err)):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+
+		committed, next, err := r.uploadStatus(ctx, location)
+		if err != nil {
+			debugf("can't read the upload status of %v: %v", digest, err)
+			continue
+		}
+		if committed < offset || committed > offset+int64(len(data)) {
+			return nil, fmt.Errorf("can't resume upload at %v: the registry has %v bytes", offset, committed)
+		}
+
+		infof("resuming upload of %v at %v", digest, formatBytes(committed))
+		location = next
+		data = data[committed-offset:]
+		offset = committed
+		if len(data) == 0 {
+			return location, nil
+		}
+	}
+}
+
+// uploadStatus asks the registry how many bytes of the upload at location it
+// has, and where to continue.
+func (r *registryClient) uploadStatus(ctx context.Context, location *url.URL) (int64, *url.URL, error) {
+	resp, err := r.do(ctx, http.MethodGet, location.String(), nil, nil)
+	if err != nil {
+		return 0, nil, err
+	}
+	resp.Body.Close()
+
+	next, err := r.location(resp)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	// Range is the inclusive range received, 0-0 for nothing.
+	rng := strings.TrimPrefix(resp.Header.Get("Range"), "bytes=")
+	if rng == "" || rng == "0-0" {
+		return 0, next, nil
+	}
+	end, err := strconv.ParseInt(rng[strings.IndexByte(rng, '-')+1:], 10, 64)
+	if err != nil || !strings.HasPrefix(rng, "0-") {
+		return 0, nil, fmt.Errorf("invalid upload range '%v'", rng)
+	}
+	return end + 1, next, nil
+}
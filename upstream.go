@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"fmt"
+)
+
+// UpstreamConfig verifies images pulled from a mirror against the canonical
+// registry they mirror, so a tampered or stale third-party mirror can't get
+// images pushed that upstream doesn't serve.
+type UpstreamConfig struct {
+	// Registry is the canonical registry, e.g. docker.io. Images have the
+	// same repository path there as in from_repo.
+	Registry AuthConfig `json:"registry"`
+	// Images limits the verification to these patterns of image names, or
+	// name:tag, as understood by path.Match.
+	Images []string `json:"images,omitempty"`
+}
+
+func (uc UpstreamConfig) validate() error {
+	if uc.Registry.BaseAddress == "" {
+		return fmt.Errorf("verify_against.registry.base_address is required")
+	}
+	if err := validPatterns(uc.Images); err != nil {
+		return fmt.Errorf("verify_against: %w", err)
+	}
+	return nil
+}
+
+// verifyUpstream compares the manifest digest the source serves for img
+// with that of the upstream registry and returns img pinned to it, so the
+// mirror can't serve another image for the pull. Mismatches fail the copy.
+func (s *syncer) verifyUpstream(ctx context.Context, img ImageData) (ImageData, error) {
+	uc := s.config.VerifyAgainst
+	if uc == nil || !img.selectedBy(uc.Images) {
+		return img, nil
+	}
+
+	fromImg, _ := s.references(img)
+	src := newRegistryClient(s.config.FromRepo)
+	digest, err := src.ManifestDigest(ctx, repositoryPath(s.config.FromRepo, img.FromPrefix, img.Name), img.sourceRef())
+	if err != nil {
+		return img, fmt.Errorf("can't resolve '%v': %w", fromImg, err)
+	}
+
+	upstream := newRegistryClient(uc.Registry)
+	upstreamRepo := repositoryPath(uc.Registry, img.FromPrefix, img.Name)
+	upstreamImg := qualifiedReference(upstream.host, upstreamRepo, img.sourceRef())
+	want, err := upstream.ManifestDigest(ctx, upstreamRepo, img.sourceRef())
+	if err != nil {
+		return img, fmt.Errorf("can't verify '%v' against '%v': %w", fromImg, upstreamImg, err)
+	}
+
+	if digest != want {
+		return img, &classifiedError{class: classUpstreamMismatch,
+			err: fmt.Errorf("'%v' is %v but upstream '%v' is %v, the mirror is stale or tampered with", fromImg, digest, upstreamImg, want)}
+	}
+
+	debugf("%v matches upstream %v (%v)", fromImg, upstreamImg, digest)
+	img.Digest = digest
+	return img, nil
+}
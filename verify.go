@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"text/tabwriter"
+)
+
+// verifyResult is a single line of the `dimco verify` report.
+type verifyResult struct {
+	Source            string `json:"source"`
+	Destination       string `json:"destination"`
+	SourceDigest      string `json:"source_digest,omitempty"`
+	DestinationDigest string `json:"destination_digest,omitempty"`
+	Passed            bool   `json:"passed"`
+	Reason            string `json:"reason"`
+}
+
+func newVerifyCommand() *command {
+	fs := flag.NewFlagSet("verify", flag.ExitOnError)
+	configPath := fs.String("f", "config.json", "config file path")
+	output := fs.String("o", "text", "output format: text or json")
+	layers := fs.Bool("layers", false, "compare layer digests when manifest digests differ")
+
+	return &command{
+		name:  "verify",
+		usage: "check that destination images match their source",
+		flags: fs,
+		run: func(ctx context.Context) error {
+			c, err := loadConfig(*configPath)
+			if err != nil {
+				return err
+			}
+
+			results := runVerify(ctx, c, *layers)
+			if err := writeVerify(results, *output); err != nil {
+				return err
+			}
+
+			failed := 0
+			for _, r := range results {
+				if !r.Passed {
+					failed++
+				}
+			}
+
+			if failed > 0 {
+				return fmt.Errorf("%v of %v images failed verification", failed, len(results))
+			}
+
+			return nil
+		},
+	}
+}
+
+func runVerify(ctx context.Context, c Config, layers bool) []verifyResult {
+	src := newRegistryClient(c.FromRepo)
+	dst := newRegistryClient(c.ToRepo)
+
+	results := make([]verifyResult, 0, len(c.Images))
+	for _, img := range c.Images {
+		fromRepo := repositoryPath(c.FromRepo, img.FromPrefix, img.Name)
+		toRepo := repositoryPath(c.ToRepo, img.ToPrefix, img.destinationName())
+
+		r := verifyResult{
+			Source:      fromRepo + ":" + img.Tag,
+			Destination: toRepo + ":" + img.Tag,
+		}
+		if img.Digest != "" {
+			r.Source = fromRepo + "@" + img.Digest
+		}
+		verify := verifyImage
+		if img.ArchTags == archTagsOnly {
+			verify = verifyArchTags
+		}
+		r.SourceDigest, r.DestinationDigest, r.Passed, r.Reason = verify(ctx, src, dst, fromRepo, toRepo, img.sourceRef(), img.Tag, layers)
+
+		results = append(results, r)
+	}
+
+	return results
+}
+
+func verifyImage(ctx context.Context, src, dst *registryClient, fromRepo, toRepo, fromRef, tag string, layers bool) (string, string, bool, string) {
+	srcManifest, srcDigest, err := src.FetchManifest(ctx, fromRepo, fromRef)
+	if err != nil {
+		return "", "", false, fmt.Sprintf("can't fetch source manifest: %v", err)
+	}
+
+	dstManifest, dstDigest, err := dst.FetchManifest(ctx, toRepo, tag)
+	if err != nil {
+		return srcDigest, "", false, fmt.Sprintf("can't fetch destination manifest: %v", err)
+	}
+
+	if srcDigest == dstDigest {
+		return srcDigest, dstDigest, true, "manifest digests match"
+	}
+
+	if !layers {
+		return srcDigest, dstDigest, false, "manifest digests differ"
+	}
+
+	if len(dstManifest.Manifests) > 0 {
+		return srcDigest, dstDigest, false, "manifest digests differ and destination is a multi-platform index"
+	}
+
+	// A single-platform destination may be one platform of a source index,
+	// which is what a push from the local daemon produces.
+	candidates := []manifest{srcManifest}
+	if len(srcManifest.Manifests) > 0 {
+		candidates = candidates[:0]
+		for _, d := range srcManifest.Manifests {
+			m, _, err := src.FetchManifest(ctx, fromRepo, d.Digest)
+			if err != nil {
+				return srcDigest, dstDigest, false, fmt.Sprintf("can't fetch source platform manifest: %v", err)
+			}
+			candidates = append(candidates, m)
+		}
+	}
+
+	for _, m := range candidates {
+		if m.Config.Digest == dstManifest.Config.Digest && sameLayers(m.Layers, dstManifest.Layers) {
+			return srcDigest, dstDigest, true, "config and layer digests match"
+		}
+	}
+
+	return srcDigest, dstDigest, false, "config or layer digests differ"
+}
+
+func sameLayers(a, b []descriptor) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for i := range a {
+		if a[i].Digest != b[i].Digest {
+			return false
+		}
+	}
+
+	return true
+}
+
+func writeVerify(results []verifyResult, format string) error {
+	switch format {
+	case "json":
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(results)
+	case "text":
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "RESULT\tSOURCE\tDESTINATION\tREASON")
+		for _, r := range results {
+			status := "PASS"
+			if !r.Passed {
+				status = "FAIL"
+			}
+			fmt.Fprintf(w, "%v\t%v\t%v\t%v\n", status, r.Source, r.Destination, r.Reason)
+		}
+		return w.Flush()
+	default:
+		return fmt.Errorf("unknown output format '%v'", format)
+	}
+}
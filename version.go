@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"runtime"
+	"runtime/debug"
+)
+
+// Build metadata, set with
+//
+//	go build -ldflags "-X main.version=1.4.0 -X main.commit=$(git rev-parse HEAD) -X main.buildDate=$(date -u +%FT%TZ)"
+var (
+	version   = ""
+	commit    = ""
+	buildDate = ""
+)
+
+// buildInfo is what `dimco version` prints.
+type buildInfo struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit,omitempty"`
+	BuildDate string `json:"build_date,omitempty"`
+	GoVersion string `json:"go_version"`
+	Platform  string `json:"platform"`
+}
+
+// currentBuild returns the build metadata. Without ldflags the version is
+// that of the module when built with go install, or dev.
+func currentBuild() buildInfo {
+	v := version
+	if v == "" {
+		if bi, ok := debug.ReadBuildInfo(); ok && bi.Main.Version != "" && bi.Main.Version != "(devel)" {
+			v = bi.Main.Version
+		} else {
+			v = "dev"
+		}
+	}
+
+	return buildInfo{
+		Version:   v,
+		Commit:    commit,
+		BuildDate: buildDate,
+		GoVersion: runtime.Version(),
+		Platform:  runtime.GOOS + "/" + runtime.GOARCH,
+	}
+}
+
+func newVersionCommand() *command {
+	fs := flag.NewFlagSet("version", flag.ExitOnError)
+	output := fs.String("o", "text", "output format: text or json")
+	fs.StringVar(output, "output", "text", "same as -o")
+
+	return &command{
+		name:  "version",
+		usage: "print the version, commit, build date and Go version",
+		flags: fs,
+		run: func(ctx context.Context) error {
+			bi := currentBuild()
+
+			switch *output {
+			case "json":
+				enc := json.NewEncoder(os.Stdout)
+				enc.SetIndent("", "  ")
+				return enc.Encode(bi)
+			case "text":
+				fmt.Printf("dimco %v\n", bi.Version)
+				if bi.Commit != "" {
+					fmt.Printf("commit:     %v\n", bi.Commit)
+				}
+				if bi.BuildDate != "" {
+					fmt.Printf("built:      %v\n", bi.BuildDate)
+				}
+				fmt.Printf("go version: %v %v\n", bi.GoVersion, bi.Platform)
+				return nil
+			default:
+				return fmt.Errorf("unknown output format '%v'", *output)
+			}
+		},
+	}
+}
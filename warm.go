@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"strings"
+	"sync"
+)
+
+// warmWorkers is how many images `dimco warm` pulls at a time.
+const warmWorkers = 4
+
+func newWarmCommand() *command {
+	fs := flag.NewFlagSet("warm", flag.ExitOnError)
+	configPath := fs.String("f", "config.json", "config file path")
+	platform := fs.String("platform", "", "only pull this os/arch of multi-platform images, e.g. linux/amd64")
+
+	return &command{
+		name:  "warm",
+		usage: "pull the configured images through the warm_cache registry to prime it, pushing nothing",
+		flags: fs,
+		run: func(ctx context.Context) error {
+			c, err := loadConfig(*configPath)
+			if err != nil {
+				return err
+			}
+
+			if c.WarmCache == nil {
+				return fmt.Errorf("warm needs warm_cache in the config")
+			}
+
+			if *platform != "" && !strings.Contains(*platform, "/") {
+				return fmt.Errorf("invalid platform '%v', use os/arch", *platform)
+			}
+
+			c, err = c.withDiscovered(ctx)
+			if err != nil {
+				return err
+			}
+
+			return runWarm(ctx, c, *platform)
+		},
+	}
+}
+
+// warmer pulls images through a pull-through cache, reading every blob once
+// so the cache stores it.
+type warmer struct {
+	cache    *registryClient
+	platform string
+
+	mu   sync.Mutex
+	seen map[string]bool
+}
+
+func runWarm(ctx context.Context, c Config, platform string) error {
+	w := &warmer{cache: newRegistryClient(*c.WarmCache), platform: platform, seen: map[string]bool{}}
+
+	errs := make([]error, len(c.Images))
+	next := make(chan int)
+	wg := sync.WaitGroup{}
+	for i := 0; i < warmWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				errs[i] = w.warmImage(ctx, c, c.Images[i])
+			}
+		}()
+	}
+
+	for i := range c.Images {
+		next <- i
+	}
+	close(next)
+	wg.Wait()
+
+	failed := 0
+	for _, err := range errs {
+		if err != nil {
+			failed++
+			errorf("%v [%v]", err, errorClass(err))
+		}
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%v of %v images weren't warmed", failed, len(c.Images))
+	}
+
+	log.Printf("warmed %v images", len(c.Images))
+	return nil
+}
+
+func (w *warmer) warmImage(ctx context.Context, c Config, img ImageData) error {
+	repo := repositoryPath(*c.WarmCache, img.FromPrefix, img.Name)
+	ref := referenceString(*c.WarmCache, img.FromPrefix, img.Name, img.sourceRef())
+
+	m, _, err := w.cache.FetchManifest(ctx, repo, img.sourceRef())
+	if err != nil {
+		return fmt.Errorf("can't warm '%v': %w", ref, err)
+	}
+
+	manifests := []manifest{m}
+	if len(m.Manifests) > 0 {
+		manifests = manifests[:0]
+		for _, d := range m.Manifests {
+			if w.platform != "" && (d.Platform == nil || d.Platform.OS+"/"+d.Platform.Architecture != w.platform) {
+				continue
+			}
+
+			pm, _, err := w.cache.FetchManifest(ctx, repo, d.Digest)
+			if err != nil {
+				return fmt.Errorf("can't warm '%v': %w", ref, err)
+			}
+			manifests = append(manifests, pm)
+		}
+
+		if len(manifests) == 0 {
+			return fmt.Errorf("can't warm '%v': no manifest for %v", ref, w.platform)
+		}
+	}
+
+	var pulled int64
+	blobs := 0
+	for _, pm := range manifests {
+		for _, d := range append([]descriptor{pm.Config}, pm.Layers...) {
+			// Foreign layers aren't served by registries.
+			if d.Digest == "" || len(d.URLs) > 0 || !w.claim(repo, d.Digest) {
+				continue
+			}
+
+			n, err := w.pullBlob(ctx, repo, d.Digest)
+			if err != nil {
+				w.release(repo, d.Digest)
+				return fmt.Errorf("can't warm '%v': %w", ref, err)
+			}
+			pulled += n
+			blobs++
+		}
+	}
+
+	infof("warmed %v: %v blobs, %v", ref, blobs, formatBytes(pulled))
+	return nil
+}
+
+// claim reports whether the blob still needs to be pulled by the caller.
+// Tags of a repository sharing layers pull them once; caches link blobs per
+// repository, so other repositories pull them again.
+func (w *warmer) claim(repo, digest string) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.seen[repo+"@"+digest] {
+		return false
+	}
+	w.seen[repo+"@"+digest] = true
+	return true
+}
+
+func (w *warmer) release(repo, digest string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	delete(w.seen, repo+"@"+digest)
+}
+
+// pullBlob reads the whole blob, a cache only keeps blobs downloaded to the
+// end.
+func (w *warmer) pullBlob(ctx context.Context, repo, digest string) (int64, error) {
+	body, _, err := w.cache.OpenBlob(ctx, repo, digest)
+	if err != nil {
+		return 0, err
+	}
+	defer body.Close()
+
+	n, err := io.Copy(ioutil.Discard, body)
+	if err != nil {
+		return n, fmt.Errorf("can't read blob %v: %w", digest, err)
+	}
+	return n, nil
+}
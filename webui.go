@@ -0,0 +1,218 @@
+package main
+
+import (
+	"html/template"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// maxFailures is the number of failed copies the status page lists.
+const maxFailures = 20
+
+// imageStatus is the last known state of a destination image.
+type imageStatus struct {
+	result     imageResult
+	lastCopied time.Time
+}
+
+type failure struct {
+	result imageResult
+	at     time.Time
+}
+
+// record keeps the results of a finished run for the status page. The
+// caller holds d.mu.
+func (d *daemon) record(report *runReport) {
+	for _, res := range report.Images {
+		st := d.images[res.Destination]
+		st.result = res
+		if res.Status == resultCopied {
+			st.lastCopied = d.lastRun
+		} else if res.Status == resultFailed {
+			d.failures = append([]failure{{result: res, at: d.lastRun}}, d.failures...)
+		}
+		d.images[res.Destination] = st
+	}
+
+	if len(d.failures) > maxFailures {
+		d.failures = d.failures[:maxFailures]
+	}
+}
+
+type statusImage struct {
+	Source      string
+	Destination string
+	Status      string
+	Digest      string
+	Duration    string
+	LastCopied  string
+	Error       string
+	// NextTry is when a quarantined image is copied again.
+	NextTry string
+}
+
+type statusFailure struct {
+	At          string
+	Destination string
+	Error       string
+}
+
+type statusView struct {
+	Running     bool
+	RunStarted  string
+	LastRun     string
+	LastSuccess string
+	LastError   string
+	Images      []statusImage
+	Failures    []statusFailure
+	// Tenant and Base are the tenant of the page and the path it is
+	// served under.
+	Tenant string
+	Base   string
+}
+
+// handleStatus renders the status page: configured mirrors, the result of
+// the last run per image and recent failures.
+func (d *daemon) handleStatus(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+
+	d.mu.Lock()
+	s := &syncer{config: d.config, opts: d.opts}
+	v := statusView{
+		Running:     d.running,
+		RunStarted:  formatTime(d.runStarted),
+		LastRun:     formatTime(d.lastRun),
+		LastSuccess: formatTime(d.lastSuccess),
+		Base:        d.base,
+	}
+	if d.tenant != nil {
+		v.Tenant = d.tenant.config.Name
+	}
+	if d.lastErr != nil {
+		v.LastError = redact(d.lastErr.Error())
+	}
+
+	for _, img := range d.config.Images {
+		fromImg, toImg := s.references(img)
+		si := statusImage{Source: fromImg, Destination: toImg, Status: "pending"}
+		if st, ok := d.images[toImg]; ok {
+			si.Status = st.result.Status
+			si.Digest = st.result.Digest
+			si.Duration = time.Duration(st.result.Duration * float64(time.Second)).Round(time.Millisecond).String()
+			si.LastCopied = formatTime(st.lastCopied)
+			si.Error = st.result.Error
+		}
+		if d.backoff[toImg].quarantined(d.quarantineAfter) {
+			si.Status = "quarantined"
+			si.NextTry = formatTime(d.retryAt(d.config, img))
+		}
+		v.Images = append(v.Images, si)
+	}
+
+	for _, f := range d.failures {
+		v.Failures = append(v.Failures, statusFailure{At: formatTime(f.at), Destination: f.result.Destination, Error: f.result.Error})
+	}
+	d.mu.Unlock()
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := statusPage.Execute(w, v); err != nil {
+		log.Print(err)
+	}
+}
+
+// handleSyncNow starts a sync run right away. Requests of other sites are
+// refused, so a page opened in the browser of an engineer can't start runs.
+func (d *daemon) handleSyncNow(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !sameOrigin(r) {
+		http.Error(w, "cross-origin request", http.StatusForbidden)
+		return
+	}
+
+	infof("sync requested from %v", r.RemoteAddr)
+	d.trigger()
+
+	http.Redirect(w, r, d.base+"/", http.StatusSeeOther)
+}
+
+// sameOrigin reports whether r was sent by a page of the daemon, or by a
+// client that isn't a browser and sends neither Sec-Fetch-Site nor Origin.
+func sameOrigin(r *http.Request) bool {
+	if site := r.Header.Get("Sec-Fetch-Site"); site != "" {
+		return site == "same-origin" || site == "none"
+	}
+
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		origin = r.Header.Get("Referer")
+	}
+	if origin == "" {
+		return true
+	}
+
+	// Sandboxed pages send the origin null.
+	u, err := url.Parse(origin)
+	if err != nil || u.Host == "" {
+		return false
+	}
+	return u.Host == r.Host || u.Host == r.Header.Get("X-Forwarded-Host")
+}
+
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.Format(time.RFC3339)
+}
+
+var statusPage = template.Must(template.New("status").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta http-equiv="refresh" content="30">
+<title>dimco</title>
+<style>
+body { font-family: sans-serif; margin: 2em; color: #222; }
+table { border-collapse: collapse; width: 100%; margin-bottom: 2em; }
+th, td { text-align: left; padding: 4px 8px; border-bottom: 1px solid #ddd; font-size: 14px; }
+td.digest { font-family: monospace; }
+.copied { color: #1a7f37; }
+.failed, .rolled-back, .quarantined { color: #cf222e; }
+.pending, .skipped { color: #888; }
+</style>
+</head>
+<body>
+<h1>dimco{{if .Tenant}} {{.Tenant}}{{end}}</h1>
+<p>
+{{if .Running}}Sync running since {{.RunStarted}}.{{else if .LastRun}}Last sync {{.LastRun}}.{{else}}No sync yet.{{end}}
+{{if .LastSuccess}}Last successful sync {{.LastSuccess}}.{{end}}
+</p>
+{{if .LastError}}<p class="failed">{{.LastError}}</p>{{end}}
+<form method="post" action="{{.Base}}/sync"><button type="submit"{{if .Running}} disabled{{end}}>Sync now</button></form>
+
+<h2>Images</h2>
+<table>
+<tr><th>Source</th><th>Destination</th><th>Status</th><th>Digest</th><th>Duration</th><th>Last copied</th><th>Next try</th><th>Error</th></tr>
+{{range .Images}}<tr>
+<td>{{.Source}}</td><td>{{.Destination}}</td><td class="{{.Status}}">{{.Status}}</td>
+<td class="digest">{{.Digest}}</td><td>{{.Duration}}</td><td>{{.LastCopied}}</td><td>{{.NextTry}}</td><td>{{.Error}}</td>
+</tr>
+{{end}}</table>
+
+<h2>Recent failures</h2>
+{{if .Failures}}<table>
+<tr><th>Time</th><th>Destination</th><th>Error</th></tr>
+{{range .Failures}}<tr><td>{{.At}}</td><td>{{.Destination}}</td><td>{{.Error}}</td></tr>
+{{end}}</table>{{else}}<p>None.</p>{{end}}
+</body>
+</html>
+`))
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// WindowConfig is the time of day the daemon copies images in, e.g. at
+// night for large images that would compete with build traffic. A window
+// whose end is before its start spans midnight.
+type WindowConfig struct {
+	// Start and End are times of day as 15:04.
+	Start string `json:"start"`
+	End   string `json:"end"`
+	// Timezone is an IANA location like Europe/Berlin, the local time of
+	// the daemon by default.
+	Timezone string `json:"timezone,omitempty"`
+}
+
+func (wc WindowConfig) validate() error {
+	if _, _, err := wc.bounds(); err != nil {
+		return err
+	}
+
+	if _, err := wc.location(); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// bounds returns start and end as times of day.
+func (wc WindowConfig) bounds() (time.Time, time.Time, error) {
+	start, err := time.Parse("15:04", wc.Start)
+	if err != nil {
+		return time.Time{}, time.Time{}, fmt.Errorf("invalid window start '%v', use HH:MM", wc.Start)
+	}
+	end, err := time.Parse("15:04", wc.End)
+	if err != nil {
+		return time.Time{}, time.Time{}, fmt.Errorf("invalid window end '%v', use HH:MM", wc.End)
+	}
+	if start.Equal(end) {
+		return time.Time{}, time.Time{}, fmt.Errorf("window start and end are both %v", wc.Start)
+	}
+
+	return start, end, nil
+}
+
+func (wc WindowConfig) location() (*time.Location, error) {
+	if wc.Timezone == "" {
+		return time.Local, nil
+	}
+
+	loc, err := time.LoadLocation(wc.Timezone)
+	if err != nil {
+		return nil, fmt.Errorf("invalid window timezone '%v': %w", wc.Timezone, err)
+	}
+	return loc, nil
+}
+
+// untilOpen is the time from t until the window opens, 0 while it is open.
+// A nil window is always open.
+func (wc *WindowConfig) untilOpen(t time.Time) time.Duration {
+	if wc == nil {
+		return 0
+	}
+
+	// Validated when the config was loaded.
+	start, end, _ := wc.bounds()
+	loc, _ := wc.location()
+
+	t = t.In(loc)
+	// Built as wall clock times, an offset from midnight is an hour off
+	// on the days the clocks change.
+	at := func(day int, hm time.Time) time.Time {
+		return time.Date(t.Year(), t.Month(), day, hm.Hour(), hm.Minute(), 0, 0, loc)
+	}
+	opens, closes := at(t.Day(), start), at(t.Day(), end)
+
+	open := !t.Before(opens) && t.Before(closes)
+	if end.Before(start) {
+		open = !t.Before(opens) || t.Before(closes)
+	}
+	if open {
+		return 0
+	}
+
+	next := opens
+	if !t.Before(opens) {
+		next = at(t.Day()+1, start)
+	}
+	return next.Sub(t)
+}
+
+// window is the transfer window of img, that of its group or the config.
+func (c Config) window(img ImageData) *WindowConfig {
+	if gc := c.group(img); gc != nil && gc.Window != nil {
+		return gc.Window
+	}
+	return c.Window
+}